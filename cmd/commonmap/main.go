@@ -3,36 +3,92 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"cm/pkg/commonmap"
 )
 
 func main() {
-	var useVector, doServe, genMap bool
-	var IndexPath string
+	var useVector, doServe, genMap, watch, useRoots bool
+	var IndexPath, reindexRoot string
+	var addRoots rootList
+	var options commonmap.IndexOptions
+	var cacheMB int64
 
-	flag.StringVar(&IndexPath, "index", "", "drive letter to index")
+	flag.StringVar(&IndexPath, "index", "", "drive letter or directory to index, several separated by "+string(os.PathListSeparator))
+	flag.Var(&addRoots, "root", "register a holdings root as `name[:priority]=path` and index every root; repeat for several, the highest priority winning duplicates")
+	flag.BoolVar(&useRoots, "roots", false, "index every registered root")
+	flag.StringVar(&reindexRoot, "reindex", "", "update the index for the registered root of this `name` alone")
 	flag.BoolVar(&useVector, "vector", true, "include vector base map")
 	flag.BoolVar(&doServe, "serve", true, "start web server")
 	flag.BoolVar(&genMap, "map", false, "regenerate map without reindexing")
+	flag.BoolVar(&options.UseTOC, "toc", false, "index from RPF A.TOC files instead of scanning every file")
+	flag.BoolVar(&options.VerifyHeaders, "verify", false, "check file name bounds against each frame's RPF header")
+	flag.BoolVar(&options.Incremental, "incremental", false, "update the index for frames added, removed or changed since the last scan")
+	flag.BoolVar(&watch, "watch", false, "keep the index of the -index holdings or the registered roots current while serving")
+	flag.BoolVar(&options.History, "history", false, "keep every edition of the frames in a history index, the index serving the newest")
+	flag.BoolVar(&options.HashDuplicates, "hash", false, "compare the content of frames with the same name and size before leaving copies out")
+	flag.StringVar(&options.DuplicatesReport, "duplicates", "", "write the duplicate frames left out of the index to this `file`, CSV or .json")
+	flag.IntVar(&options.QixDepth, "qixdepth", 0, "depth of the .qix quadtrees, 0 to pick it from the frame count")
+	flag.IntVar(&options.Walkers, "walkers", 0, "parallel directory readers when scanning holdings (default 16)")
+	flag.Var((*outputList)(&options.Outputs), "output", "index `format[=path]` to write besides the shapefiles, one of "+
+		strings.Join(commonmap.IndexFormats(), ", ")+"; repeat or separate with commas for several")
+	flag.Int64Var(&cacheMB, "cache", 512, "megabytes of rendered tiles to keep on disk, 0 to disable")
 	flag.Parse()
 
-	if IndexPath == "" && !doServe {
+	if err := commonmap.CheckInstall(); err != nil {
+		log.Fatal(err)
+	}
+	ix := commonmap.NewIndexer(commonmap.IndexPath)
+	ix.CacheDir = commonmap.TileCacheDir
+	ix.Mapfile = commonmap.MapfilePath
+
+	if IndexPath == "" && !doServe && !useRoots && reindexRoot == "" && len(addRoots) == 0 {
 		flag.PrintDefaults()
 		return
 	}
 
-	if IndexPath != "" {
+	var roots []commonmap.HoldingRoot
+	if len(addRoots) > 0 || useRoots || reindexRoot != "" {
+		var err error
+		if roots, err = commonmap.RegisterRoots(addRoots); err != nil {
+			fmt.Printf("CANNOT READ HOLDINGS ROOTS\n%s\n", err.Error())
+			return
+		}
+		useRoots = useRoots || len(addRoots) > 0
+	}
+
+	if reindexRoot != "" {
+		if _, ok := commonmap.FindRoot(roots, reindexRoot); !ok {
+			fmt.Printf("No root named %s is registered\n", reindexRoot)
+			return
+		}
+		fmt.Println("Indexing root " + reindexRoot)
+		ix.ReindexRoot(roots, reindexRoot, options)
+		genMap = true
+	} else if useRoots {
+		for _, root := range roots {
+			fmt.Printf("Indexing %s (%s, priority %d)\n", root.Path, root.Name, root.Priority)
+		}
+		if !options.Incremental {
+			cleanIndexPath(ix.OutputDir(options))
+		}
+		ix.IndexRoots(roots, options)
+		genMap = true
+	} else if IndexPath != "" {
 		fmt.Println("Indexing " + IndexPath)
-		cleanIndexPath()
-		commonmap.Index(IndexPath)
+		if !options.Incremental {
+			cleanIndexPath(ix.OutputDir(options))
+		}
+		ix.Index(IndexPath, options)
 		genMap = true
 	}
 
 	if genMap {
-		// shapeFiles fully populated... build map file
+		// shapefiles fully populated... build map file
 		mapfile, err := os.Create(commonmap.MapfilePath)
 		if err != nil {
 			fmt.Printf("CANNOT CREATE MAP FILE\n%s\n", err.Error())
@@ -43,18 +99,33 @@ func main() {
 					fmt.Printf("CANNOT CLOSE MAP FILE\n%s\n", err.Error())
 				}
 			}()
-			commonmap.WriteMap(mapfile)
+			ix.WriteMap(mapfile)
 		}
 	}
 
 	if doServe {
-		commonmap.Serve()
+		if watch && len(roots) > 0 {
+			watcher, err := ix.WatchRoots(roots, options)
+			if err != nil {
+				fmt.Printf("CANNOT WATCH HOLDINGS ROOTS\n%s\n", err.Error())
+			} else {
+				defer func() { _ = watcher.Close() }()
+			}
+		} else if watch && IndexPath != "" {
+			watcher, err := ix.WatchHoldings(IndexPath, options)
+			if err != nil {
+				fmt.Printf("CANNOT WATCH %s\n%s\n", IndexPath, err.Error())
+			} else {
+				defer func() { _ = watcher.Close() }()
+			}
+		}
+		ix.Serve(commonmap.ServeOptions{CacheSize: cacheMB << 20})
 	}
 }
 
-func cleanIndexPath() {
+func cleanIndexPath(dir string) {
 	// todo: error checking
-	if err := filepath.Walk(commonmap.IndexPath, func(path string, f os.FileInfo, err error) error {
+	if err := filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -68,3 +139,35 @@ func cleanIndexPath() {
 		fmt.Printf("error cleaning index path: %v\n", err)
 	}
 }
+
+// outputList collects the -output formats
+type outputList []string
+
+func (l *outputList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *outputList) Set(value string) error {
+	*l = append(*l, strings.Split(value, ",")...)
+	return nil
+}
+
+// rootList collects the -root holdings roots
+type rootList []commonmap.HoldingRoot
+
+func (l *rootList) String() string {
+	specs := make([]string, len(*l))
+	for i, root := range *l {
+		specs[i] = fmt.Sprintf("%s:%d=%s", root.Name, root.Priority, root.Path)
+	}
+	return strings.Join(specs, " ")
+}
+
+func (l *rootList) Set(value string) error {
+	root, err := commonmap.ParseHoldingRoot(value)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, root)
+	return nil
+}
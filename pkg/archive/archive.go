@@ -0,0 +1,289 @@
+// Package archive reads the files held in ZIP archives and ISO 9660 or UDF disc
+// images in place, so frames delivered that way are indexed and drawn without
+// extracting them.
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotArchive = errors.New("archive: not a ZIP archive or disc image")
+	ErrNoMember   = errors.New("archive: no such member")
+	ErrCorrupt    = errors.New("archive: corrupt")
+	ErrFormat     = errors.New("archive: unsupported format")
+)
+
+// Separator ends the path of an archive in the location of one of its members, as in
+// D:\deliveries\cadrg.iso!/RPF/CJGA/00610011.JG1
+const Separator = "!/"
+
+// maxDirectorySize bounds the directories of disc images, read whole, whatever length
+// a damaged image records
+const maxDirectorySize = 64 << 20
+
+// Member is a file held in an archive
+type Member struct {
+	Name    string // slash separated, from the root of the archive
+	Size    int64
+	ModTime time.Time
+}
+
+// File is an open file or archive member
+type File interface {
+	io.ReaderAt
+	io.Closer
+	Size() int64
+}
+
+// Archive is an open ZIP archive or disc image
+type Archive struct {
+	Path    string
+	file    *os.File
+	members []Member
+	opens   []func() (io.ReaderAt, error) // of each member
+	byName  map[string]int
+}
+
+// add lists a member and how to read it
+func (a *Archive) add(m Member, open func() (io.ReaderAt, error)) {
+	a.members = append(a.members, m)
+	a.opens = append(a.opens, open)
+}
+
+// IsArchive tells whether a file name is that of an archive the package reads
+func IsArchive(fileName string) bool {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".zip", ".iso", ".udf":
+		return true
+	}
+	return false
+}
+
+// Location names a member of the archive at archivePath
+func Location(archivePath, name string) string {
+	return archivePath + Separator + name
+}
+
+// Split tells the archive and the member a location names. A location without an
+// archive path ending in the extension of an archive is a plain file.
+func Split(location string) (archivePath, name string, ok bool) {
+	for from := 0; ; {
+		i := strings.Index(location[from:], Separator)
+		if i < 0 {
+			return "", "", false
+		}
+		i += from
+		if IsArchive(location[:i]) {
+			return location[:i], location[i+len(Separator):], true
+		}
+		from = i + 1
+	}
+}
+
+// OpenArchive opens a ZIP archive, told by its extension, or a disc image, whose UDF
+// file system is read in preference to its ISO 9660 one
+func OpenArchive(archivePath string) (*Archive, error) {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	a := &Archive{Path: archivePath, file: file}
+	if strings.EqualFold(filepath.Ext(archivePath), ".zip") {
+		err = a.readZip(info.Size())
+	} else if err = a.readUDF(); errors.Is(err, ErrNotArchive) {
+		err = a.readISO9660()
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("%s: %w", archivePath, err)
+	}
+	sort.Stable(byMemberName{a})
+	a.byName = make(map[string]int, len(a.members))
+	for i, m := range a.members {
+		a.byName[m.Name] = i
+	}
+	return a, nil
+}
+
+// byMemberName sorts the members of an archive with their openers
+type byMemberName struct{ a *Archive }
+
+func (s byMemberName) Len() int           { return len(s.a.members) }
+func (s byMemberName) Less(i, j int) bool { return s.a.members[i].Name < s.a.members[j].Name }
+func (s byMemberName) Swap(i, j int) {
+	s.a.members[i], s.a.members[j] = s.a.members[j], s.a.members[i]
+	s.a.opens[i], s.a.opens[j] = s.a.opens[j], s.a.opens[i]
+}
+
+// Members lists the files of the archive in name order
+func (a *Archive) Members() []Member {
+	return a.members
+}
+
+// Open opens a member of the archive for reading. Members stored contiguously are
+// read in place, compressed ones are decompressed whole.
+func (a *Archive) Open(name string) (File, error) {
+	i, ok := a.byName[strings.TrimPrefix(path.Clean("/"+name), "/")]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s in %s", ErrNoMember, name, a.Path)
+	}
+	r, err := a.opens[i]()
+	if err != nil {
+		return nil, fmt.Errorf("%s in %s: %w", name, a.Path, err)
+	}
+	return &member{r, a.members[i].Size, nil}, nil
+}
+
+// Close closes the file of the archive
+func (a *Archive) Close() error {
+	return a.file.Close()
+}
+
+// member is an open member of an archive
+type member struct {
+	io.ReaderAt
+	size  int64
+	close func()
+}
+
+func (m *member) Size() int64 {
+	return m.size
+}
+
+func (m *member) Close() error {
+	if m.close != nil {
+		m.close()
+		m.close = nil
+	}
+	return nil
+}
+
+// osFile is an open plain file
+type osFile struct {
+	*os.File
+	size int64
+}
+
+func (f *osFile) Size() int64 {
+	return f.size
+}
+
+// Open opens a plain file, or the member of an archive its location names. Archives
+// stay open for the next members read from them until others take their place.
+func Open(location string) (File, error) {
+	archivePath, name, ok := Split(location)
+	if !ok {
+		file, err := os.Open(location)
+		if err != nil {
+			return nil, err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+		return &osFile{file, info.Size()}, nil
+	}
+	a, release, err := archives.get(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	f, err := a.Open(name)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	f.(*member).close = release
+	return f, nil
+}
+
+// openArchives keeps the archives read from last, as frames are drawn from the same
+// few at a time
+type openArchives struct {
+	mu      sync.Mutex
+	entries []*openArchive // most recently used last
+}
+
+type openArchive struct {
+	archive *Archive
+	modTime time.Time
+	size    int64
+	users   int
+	evicted bool
+}
+
+// keptArchives is how many archives stay open
+const keptArchives = 16
+
+var archives = &openArchives{}
+
+// get opens an archive or finds it open, unless it changed since. release must be
+// called once done with it.
+func (c *openArchives) get(archivePath string) (*Archive, func(), error) {
+	info, err := os.Stat(archivePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var entry *openArchive
+	for i, e := range c.entries {
+		if e.archive.Path != archivePath {
+			continue
+		}
+		c.entries = append(c.entries[:i], c.entries[i+1:]...)
+		if e.modTime.Equal(info.ModTime()) && e.size == info.Size() {
+			entry = e
+		} else {
+			c.evict(e)
+		}
+		break
+	}
+	if entry == nil {
+		a, err := OpenArchive(archivePath)
+		if err != nil {
+			return nil, nil, err
+		}
+		entry = &openArchive{archive: a, modTime: info.ModTime(), size: info.Size()}
+	}
+	c.entries = append(c.entries, entry)
+	for len(c.entries) > keptArchives {
+		c.evict(c.entries[0])
+		c.entries = c.entries[1:]
+	}
+	entry.users++
+	var once sync.Once
+	return entry.archive, func() { once.Do(func() { c.release(entry) }) }, nil
+}
+
+// evict closes an archive now or, when members are still open, once they are closed
+func (c *openArchives) evict(e *openArchive) {
+	e.evicted = true
+	if e.users == 0 {
+		_ = e.archive.Close()
+	}
+}
+
+func (c *openArchives) release(e *openArchive) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e.users--
+	if e.evicted && e.users == 0 {
+		_ = e.archive.Close()
+	}
+}
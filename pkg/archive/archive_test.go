@@ -0,0 +1,169 @@
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeZip(t *testing.T, zipPath string, files map[string][]byte, method uint16) {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, name := range []string{"RPF/CJGA/00610011.JG1", "RPF/A.TOC", "README.TXT"} {
+		data, ok := files[name]
+		if !ok {
+			continue
+		}
+		f, err := w.CreateHeader(&zip.FileHeader{Name: name, Method: method, Modified: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := w.CreateHeader(&zip.FileHeader{Name: "RPF/EMPTY/"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(zipPath, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readAll(t *testing.T, f File) []byte {
+	t.Helper()
+	data := make([]byte, f.Size())
+	if _, err := f.ReadAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestZipMembers(t *testing.T) {
+	frame := bytes.Repeat([]byte("NITF02.10"), 1000)
+	files := map[string][]byte{"RPF/CJGA/00610011.JG1": frame, "RPF/A.TOC": []byte("toc"), "README.TXT": nil}
+	for _, method := range []uint16{zip.Store, zip.Deflate} {
+		zipPath := filepath.Join(t.TempDir(), "delivery.zip")
+		writeZip(t, zipPath, files, method)
+		a, err := OpenArchive(zipPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, m := range a.Members() {
+			names = append(names, m.Name)
+			if want := int64(len(files[m.Name])); m.Size != want {
+				t.Fatalf("size of %s = %d, want %d", m.Name, m.Size, want)
+			}
+		}
+		if got, want := names, []string{"README.TXT", "RPF/A.TOC", "RPF/CJGA/00610011.JG1"}; len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+			t.Fatalf("members = %v, want %v", got, want)
+		}
+		f, err := a.Open("RPF/CJGA/00610011.JG1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(readAll(t, f), frame) {
+			t.Fatalf("method %d: member content differs", method)
+		}
+		if _, err := a.Open("RPF/CJGA/00620011.JG1"); err == nil {
+			t.Fatal("opened a missing member")
+		}
+		_ = a.Close()
+	}
+}
+
+func TestSplitLocation(t *testing.T) {
+	tests := []struct {
+		location, archive, name string
+		ok                      bool
+	}{
+		{"/data/cadrg.zip!/RPF/CJGA/00610011.JG1", "/data/cadrg.zip", "RPF/CJGA/00610011.JG1", true},
+		{`D:\deliveries\CADRG.ISO!/RPF/A.TOC`, `D:\deliveries\CADRG.ISO`, "RPF/A.TOC", true},
+		{"/data/wow!/cadrg.udf!/A.TOC", "/data/wow!/cadrg.udf", "A.TOC", true},
+		{"/data/wow!/00610011.JG1", "", "", false},
+		{"/data/RPF/CJGA/00610011.JG1", "", "", false},
+	}
+	for _, tt := range tests {
+		archive, name, ok := Split(tt.location)
+		if archive != tt.archive || name != tt.name || ok != tt.ok {
+			t.Fatalf("Split(%q) = %q, %q, %v, want %q, %q, %v", tt.location, archive, name, ok, tt.archive, tt.name, tt.ok)
+		}
+		if ok && Location(archive, name) != tt.location {
+			t.Fatalf("Location(%q, %q) = %q, want %q", archive, name, Location(archive, name), tt.location)
+		}
+	}
+}
+
+func TestOpenLocation(t *testing.T) {
+	dir := t.TempDir()
+	zipPath := filepath.Join(dir, "delivery.zip")
+	writeZip(t, zipPath, map[string][]byte{"RPF/A.TOC": []byte("first")}, zip.Store)
+
+	plain := filepath.Join(dir, "A.TOC")
+	if err := os.WriteFile(plain, []byte("plain"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := Open(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(readAll(t, f)); got != "plain" {
+		t.Fatalf("plain file = %q, want %q", got, "plain")
+	}
+	_ = f.Close()
+
+	f, err = Open(Location(zipPath, "RPF/A.TOC"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(readAll(t, f)); got != "first" {
+		t.Fatalf("member = %q, want %q", got, "first")
+	}
+	_ = f.Close()
+
+	// a rewritten archive is read again
+	writeZip(t, zipPath, map[string][]byte{"RPF/A.TOC": []byte("second!")}, zip.Store)
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(zipPath, later, later); err != nil {
+		t.Fatal(err)
+	}
+	f, err = Open(Location(zipPath, "RPF/A.TOC"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(readAll(t, f)); got != "second!" {
+		t.Fatalf("rewritten member = %q, want %q", got, "second!")
+	}
+	_ = f.Close()
+
+	if _, err := Open(Location(zipPath, "RPF/MISSING")); err == nil {
+		t.Fatal("opened a missing member")
+	}
+}
+
+func TestExtentReader(t *testing.T) {
+	image := []byte("0123456789abcdefghij")
+	r := newExtentReader(bytes.NewReader(image), []extent{{10, 4}, {-1, 3}, {2, 5}}, 10)
+	got := make([]byte, 10)
+	if n, err := r.ReadAt(got, 0); n != 10 || err != nil {
+		t.Fatalf("ReadAt = %d, %v", n, err)
+	}
+	if want := "abcd\x00\x00\x00234"; string(got) != want {
+		t.Fatalf("extents read %q, want %q", got, want)
+	}
+	part := make([]byte, 4)
+	if n, _ := r.ReadAt(part, 3); n != 4 || string(part) != "d\x00\x00\x00" {
+		t.Fatalf("ReadAt(3) = %q", part[:n])
+	}
+	if n, err := r.ReadAt(part, 8); n != 2 || err == nil {
+		t.Fatalf("ReadAt past the end = %d, %v", n, err)
+	}
+}
@@ -0,0 +1,67 @@
+package archive
+
+import (
+	"io"
+)
+
+// extent is a run of bytes of a disc image, zeros when its offset is negative
+type extent struct {
+	offset, length int64
+}
+
+// extentReader reads a file recorded in one or more extents of a disc image
+type extentReader struct {
+	r       io.ReaderAt
+	extents []extent
+	size    int64
+}
+
+// newExtentReader reads size bytes from the extents, a single extent being read as a section
+func newExtentReader(r io.ReaderAt, extents []extent, size int64) io.ReaderAt {
+	if len(extents) == 1 && extents[0].length >= size && extents[0].offset >= 0 {
+		return io.NewSectionReader(r, extents[0].offset, size)
+	}
+	return &extentReader{r, extents, size}
+}
+
+func (e *extentReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= e.size {
+		return 0, io.EOF
+	}
+	n := 0
+	start := int64(0)
+	for _, x := range e.extents {
+		if len(p) == 0 {
+			break
+		}
+		if off >= start+x.length {
+			start += x.length
+			continue
+		}
+		within := off - start
+		chunk := p
+		if int64(len(chunk)) > x.length-within {
+			chunk = chunk[:x.length-within]
+		}
+		if int64(len(chunk)) > e.size-off {
+			chunk = chunk[:e.size-off]
+		}
+		read := len(chunk)
+		if x.offset < 0 {
+			clear(chunk)
+		} else if r, err := e.r.ReadAt(chunk, x.offset+within); err != nil {
+			return n + r, err
+		}
+		n += read
+		p = p[read:]
+		off += int64(read)
+		start += x.length
+		if off >= e.size {
+			break
+		}
+	}
+	if len(p) > 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
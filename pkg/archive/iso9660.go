@@ -0,0 +1,162 @@
+package archive
+
+import (
+	"encoding/binary"
+	"io"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// This file reads ISO 9660 images, with Joliet names when the image has them.
+// See ECMA-119.
+
+const isoSector = 2048
+
+// isoDirectory is a directory record
+type isoDirectory struct {
+	extent  uint32
+	length  uint32
+	modTime time.Time
+	dir     bool
+	more    bool // the file goes on in the next record
+	name    []byte
+}
+
+func parseIsoDirectory(b []byte) (isoDirectory, bool) {
+	if len(b) < 34 || int(b[0]) > len(b) || 33+int(b[32]) > int(b[0]) {
+		return isoDirectory{}, false
+	}
+	return isoDirectory{
+		extent:  binary.LittleEndian.Uint32(b[2:]),
+		length:  binary.LittleEndian.Uint32(b[10:]),
+		modTime: isoTime(b[18:25]),
+		dir:     b[25]&0x02 != 0,
+		more:    b[25]&0x80 != 0,
+		name:    b[33 : 33+int(b[32])],
+	}, true
+}
+
+// isoTime reads a recording date, seven bytes from 1900 with the zone in quarter hours
+func isoTime(b []byte) time.Time {
+	if b[1] == 0 {
+		return time.Time{}
+	}
+	zone := time.FixedZone("", int(int8(b[6]))*15*60)
+	return time.Date(1900+int(b[0]), time.Month(b[1]), int(b[2]), int(b[3]), int(b[4]), int(b[5]), 0, zone)
+}
+
+// readISO9660 lists the files of an ISO 9660 image
+func (a *Archive) readISO9660() error {
+	var root isoDirectory
+	found, joliet := false, false
+	descriptor := make([]byte, isoSector)
+	for sector := int64(16); ; sector++ {
+		if _, err := a.file.ReadAt(descriptor, sector*isoSector); err != nil {
+			if found {
+				break
+			}
+			return ErrNotArchive
+		}
+		if string(descriptor[1:6]) != "CD001" {
+			if found {
+				break
+			}
+			return ErrNotArchive
+		}
+		kind := descriptor[0]
+		if kind == 255 {
+			break
+		}
+		escapes := string(descriptor[88:91])
+		isJoliet := kind == 2 && (escapes == "%/@" || escapes == "%/C" || escapes == "%/E")
+		if (kind == 1 && !found) || (isJoliet && !joliet) {
+			if r, ok := parseIsoDirectory(descriptor[156:190]); ok {
+				root, found, joliet = r, true, isJoliet
+			}
+		}
+	}
+	if !found {
+		return ErrNotArchive
+	}
+
+	var extents = make(map[string][]extent) // of the files recorded in several
+	visited := make(map[uint32]bool)
+	var walk func(dir isoDirectory, dirPath string, depth int) error
+	walk = func(dir isoDirectory, dirPath string, depth int) error {
+		if depth > 64 || visited[dir.extent] {
+			return nil // loops back on itself
+		}
+		visited[dir.extent] = true
+		if dir.length > maxDirectorySize {
+			return ErrCorrupt
+		}
+		data := make([]byte, dir.length)
+		if _, err := a.file.ReadAt(data, int64(dir.extent)*isoSector); err != nil {
+			return ErrCorrupt
+		}
+		for offset := 0; offset < len(data); {
+			if data[offset] == 0 { // records do not cross sectors
+				offset = (offset/isoSector + 1) * isoSector
+				continue
+			}
+			r, ok := parseIsoDirectory(data[offset:])
+			if !ok {
+				return ErrCorrupt
+			}
+			offset += int(data[offset])
+			if len(r.name) == 1 && r.name[0] <= 1 {
+				continue // itself or its parent
+			}
+			name := path.Join(dirPath, isoName(r.name, joliet, r.dir))
+			if r.dir {
+				if err := walk(r, name, depth+1); err != nil {
+					return err
+				}
+				continue
+			}
+			parts := append(extents[name], extent{int64(r.extent) * isoSector, int64(r.length)})
+			if r.more {
+				extents[name] = parts
+				continue
+			}
+			delete(extents, name)
+			size := int64(0)
+			for _, p := range parts {
+				size += p.length
+			}
+			a.add(Member{name, size, r.modTime}, a.extentOpener(parts, size))
+		}
+		return nil
+	}
+	return walk(root, "", 0)
+}
+
+// isoName decodes a file identifier, dropping the version of files
+func isoName(b []byte, joliet, dir bool) string {
+	var name string
+	if joliet {
+		chars := make([]uint16, len(b)/2)
+		for i := range chars {
+			chars[i] = binary.BigEndian.Uint16(b[2*i:])
+		}
+		name = string(utf16.Decode(chars))
+	} else {
+		name = string(b)
+	}
+	if !dir {
+		if i := strings.LastIndexByte(name, ';'); i >= 0 {
+			name = name[:i]
+		}
+		name = strings.TrimSuffix(name, ".")
+	}
+	return name
+}
+
+// extentOpener reads a member of a disc image from its extents
+func (a *Archive) extentOpener(extents []extent, size int64) func() (io.ReaderAt, error) {
+	return func() (io.ReaderAt, error) {
+		return newExtentReader(a.file, extents, size), nil
+	}
+}
@@ -0,0 +1,157 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// discImage lays out the sectors of a disc image
+type discImage struct {
+	sectorSize int
+	data       []byte
+}
+
+func (d *discImage) put(sector int, b []byte) {
+	end := sector*d.sectorSize + len(b)
+	if end > len(d.data) {
+		d.data = append(d.data, make([]byte, end-len(d.data))...)
+	}
+	copy(d.data[sector*d.sectorSize:], b)
+}
+
+func (d *discImage) write(t *testing.T, name string) string {
+	t.Helper()
+	imagePath := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(imagePath, d.data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return imagePath
+}
+
+// isoRecord makes a directory record
+func isoRecord(extent, length uint32, dir bool, name string) []byte {
+	size := 33 + len(name)
+	size += size & 1
+	b := make([]byte, size)
+	b[0] = byte(size)
+	binary.LittleEndian.PutUint32(b[2:], extent)
+	binary.BigEndian.PutUint32(b[6:], extent)
+	binary.LittleEndian.PutUint32(b[10:], length)
+	binary.BigEndian.PutUint32(b[14:], length)
+	copy(b[18:], []byte{99, 12, 31, 23, 59, 58, 4}) // 1999-12-31 23:59:58 +01:00
+	if dir {
+		b[25] = 0x02
+	}
+	b[32] = byte(len(name))
+	copy(b[33:], name)
+	return b
+}
+
+func TestISO9660Members(t *testing.T) {
+	frame := bytes.Repeat([]byte{7, 1, 2}, 1500) // 4500 bytes, three sectors
+	d := &discImage{sectorSize: isoSector}
+
+	pvd := make([]byte, isoSector)
+	pvd[0], pvd[6] = 1, 1
+	copy(pvd[1:], "CD001")
+	copy(pvd[156:], isoRecord(18, isoSector, true, "\x00"))
+	d.put(16, pvd)
+	terminator := make([]byte, isoSector)
+	terminator[0], terminator[6] = 255, 1
+	copy(terminator[1:], "CD001")
+	d.put(17, terminator)
+
+	var root bytes.Buffer
+	root.Write(isoRecord(18, isoSector, true, "\x00"))
+	root.Write(isoRecord(18, isoSector, true, "\x01"))
+	root.Write(isoRecord(19, isoSector, true, "RPF"))
+	root.Write(isoRecord(20, 6, false, "README.;1"))
+	d.put(18, root.Bytes())
+	var rpfDir bytes.Buffer
+	rpfDir.Write(isoRecord(19, isoSector, true, "\x00"))
+	rpfDir.Write(isoRecord(18, isoSector, true, "\x01"))
+	rpfDir.Write(isoRecord(21, uint32(len(frame)), false, "00610011.JG1;1"))
+	d.put(19, rpfDir.Bytes())
+	d.put(20, []byte("readme"))
+	d.put(21, frame)
+	d.put(24, make([]byte, isoSector))
+
+	a, err := OpenArchive(d.write(t, "cadrg.iso"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = a.Close() }()
+	members := a.Members()
+	if len(members) != 2 || members[0].Name != "README" || members[1].Name != "RPF/00610011.JG1" {
+		t.Fatalf("members = %v", members)
+	}
+	if members[1].Size != int64(len(frame)) {
+		t.Fatalf("size = %d, want %d", members[1].Size, len(frame))
+	}
+	if _, offset := members[1].ModTime.Zone(); members[1].ModTime.Year() != 1999 || offset != 3600 {
+		t.Fatalf("modified %v, want 1999-12-31 23:59:58 +01:00", members[1].ModTime)
+	}
+	f, err := a.Open("RPF/00610011.JG1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readAll(t, f), frame) {
+		t.Fatal("member content differs")
+	}
+}
+
+func TestNotADiscImage(t *testing.T) {
+	d := &discImage{sectorSize: isoSector}
+	d.put(20, []byte("not a file system"))
+	if _, err := OpenArchive(d.write(t, "blank.iso")); err == nil {
+		t.Fatal("opened a blank image")
+	}
+}
+
+func TestISO9660CorruptDirectoryLength(t *testing.T) {
+	tests := []struct {
+		name                  string
+		rootLength, rpfLength uint32
+	}{
+		{"root", 0xfffff800, isoSector},
+		{"subdirectory", isoSector, 0x7ffff800},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &discImage{sectorSize: isoSector}
+			pvd := make([]byte, isoSector)
+			pvd[0], pvd[6] = 1, 1
+			copy(pvd[1:], "CD001")
+			copy(pvd[156:], isoRecord(18, tt.rootLength, true, "\x00"))
+			d.put(16, pvd)
+			terminator := make([]byte, isoSector)
+			terminator[0], terminator[6] = 255, 1
+			copy(terminator[1:], "CD001")
+			d.put(17, terminator)
+			var root bytes.Buffer
+			root.Write(isoRecord(18, isoSector, true, "\x00"))
+			root.Write(isoRecord(18, isoSector, true, "\x01"))
+			root.Write(isoRecord(19, tt.rpfLength, true, "RPF"))
+			d.put(18, root.Bytes())
+			d.put(19, make([]byte, isoSector))
+
+			imagePath := d.write(t, "damaged.iso")
+
+			// the read fails either way, what matters is not asking for the length first
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			if _, err := OpenArchive(imagePath); !errors.Is(err, ErrCorrupt) {
+				t.Fatalf("OpenArchive error = %v, want ErrCorrupt", err)
+			}
+			runtime.ReadMemStats(&after)
+			if allocated := after.TotalAlloc - before.TotalAlloc; allocated > maxDirectorySize {
+				t.Fatalf("opening the image allocated %d bytes", allocated)
+			}
+		})
+	}
+}
@@ -0,0 +1,393 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+	"time"
+	"unicode/utf16"
+)
+
+// This file reads UDF images, as found on DVDs and on CDs bridging UDF and ISO 9660.
+// Physical and sparable partitions are read, not the virtual partitions of discs
+// written incrementally or the metadata partitions of UDF 2.50. See ECMA-167 and
+// OSTA UDF 2.60.
+
+// descriptor tag identifiers
+const (
+	udfAnchor            = 2
+	udfPartition         = 5
+	udfLogicalVolume     = 6
+	udfTerminating       = 8
+	udfFileSet           = 256
+	udfFileIdentifier    = 257
+	udfAllocationExtent  = 258
+	udfFileEntry         = 261
+	udfExtendedFileEntry = 266
+)
+
+// ICB file types
+const (
+	udfDirectoryType = 4
+	udfFileType      = 5
+)
+
+// udfVolume reads the blocks of a logical volume
+type udfVolume struct {
+	a          *Archive
+	blockSize  int64
+	partitions []int64 // first block of the partition of each reference
+}
+
+// udfAddress is the place of a block in a logical volume
+type udfAddress struct {
+	partition uint16
+	block     uint32
+}
+
+// udfEntry is what a file entry tells of a file
+type udfEntry struct {
+	fileType byte
+	size     int64
+	modTime  time.Time
+	extents  []extent
+	inline   []byte // the data itself, when held in the entry
+}
+
+// readUDF lists the files of a UDF image
+func (a *Archive) readUDF() error {
+	if !hasUDFRecognition(a.file) {
+		return ErrNotArchive
+	}
+	v := &udfVolume{a: a}
+	var anchor []byte
+	for _, blockSize := range []int64{2048, 512, 4096} {
+		b := make([]byte, blockSize)
+		if _, err := a.file.ReadAt(b, 256*blockSize); err == nil && udfTag(b) == udfAnchor &&
+			binary.LittleEndian.Uint32(b[12:]) == 256 {
+			v.blockSize, anchor = blockSize, b
+			break
+		}
+	}
+	if anchor == nil {
+		return ErrNotArchive
+	}
+
+	// the main volume descriptor sequence
+	length := int64(binary.LittleEndian.Uint32(anchor[16:]))
+	location := int64(binary.LittleEndian.Uint32(anchor[20:]))
+	starts := make(map[uint16]int64) // partition number -> first block
+	var volume []byte
+	for i := int64(0); i < length/v.blockSize; i++ {
+		b := make([]byte, v.blockSize)
+		if _, err := a.file.ReadAt(b, (location+i)*v.blockSize); err != nil {
+			return ErrCorrupt
+		}
+		switch udfTag(b) {
+		case udfPartition:
+			starts[binary.LittleEndian.Uint16(b[22:])] = int64(binary.LittleEndian.Uint32(b[188:]))
+		case udfLogicalVolume:
+			if volume == nil {
+				volume = b
+			}
+		}
+		if udfTag(b) == udfTerminating {
+			break
+		}
+	}
+	if volume == nil {
+		return ErrCorrupt
+	}
+	if int64(binary.LittleEndian.Uint32(volume[212:])) != v.blockSize {
+		return fmt.Errorf("%w: UDF logical blocks differ from the sectors", ErrFormat)
+	}
+
+	// partition maps, from partition references to partitions
+	maps := volume[440:]
+	count := int(binary.LittleEndian.Uint32(volume[268:]))
+	for i, offset := 0, 0; i < count; i++ {
+		if offset+2 > len(maps) || offset+int(maps[offset+1]) > len(maps) || maps[offset+1] == 0 {
+			return ErrCorrupt
+		}
+		m := maps[offset : offset+int(maps[offset+1])]
+		var number uint16
+		switch {
+		case m[0] == 1 && len(m) >= 6:
+			number = binary.LittleEndian.Uint16(m[4:])
+		case m[0] == 2 && len(m) >= 40 && string(bytes.TrimRight(m[5:28], "\x00")) == "*UDF Sparable Partition":
+			number = binary.LittleEndian.Uint16(m[38:]) // defects remapped on the medium, not in images
+		default:
+			return fmt.Errorf("%w: UDF partition map %q", ErrFormat, bytes.TrimRight(m[5:min(len(m), 28)], "\x00"))
+		}
+		start, ok := starts[number]
+		if !ok {
+			return ErrCorrupt
+		}
+		v.partitions = append(v.partitions, start)
+		offset += len(m)
+	}
+
+	// the file set, then its root directory
+	fileSet, err := v.block(udfLongAddress(volume[248:]))
+	if err != nil || udfTag(fileSet) != udfFileSet {
+		return ErrCorrupt
+	}
+	visited := make(map[udfAddress]bool)
+	var walk func(at udfAddress, dirPath string, depth int) error
+	walk = func(at udfAddress, dirPath string, depth int) error {
+		if depth > 64 || visited[at] {
+			return nil // loops back on itself
+		}
+		visited[at] = true
+		dir, err := v.entry(at)
+		if err != nil {
+			return err
+		}
+		data, err := v.read(dir)
+		if err != nil {
+			return err
+		}
+		for offset := 0; offset+38 <= len(data); {
+			fid := data[offset:]
+			if udfTag(fid) != udfFileIdentifier {
+				return ErrCorrupt
+			}
+			characteristics := fid[18]
+			nameLength := int(fid[19])
+			implementationLength := int(binary.LittleEndian.Uint16(fid[36:]))
+			end := 38 + implementationLength + nameLength
+			if end > len(fid) {
+				return ErrCorrupt
+			}
+			name := udfName(fid[38+implementationLength : end])
+			child := udfLongAddress(fid[20:])
+			offset += (end + 3) &^ 3
+			if characteristics&0x0C != 0 || name == "" {
+				continue // deleted, or the parent
+			}
+			name = path.Join(dirPath, name)
+			if characteristics&0x02 != 0 {
+				if err := walk(child, name, depth+1); err != nil {
+					return err
+				}
+				continue
+			}
+			e, err := v.entry(child)
+			if err != nil {
+				return err
+			}
+			if e.fileType == udfFileType {
+				a.add(Member{name, e.size, e.modTime}, v.opener(e))
+			}
+		}
+		return nil
+	}
+	return walk(udfLongAddress(fileSet[400:]), "", 0)
+}
+
+// hasUDFRecognition looks for the NSR descriptor of a UDF volume recognition sequence
+func hasUDFRecognition(r io.ReaderAt) bool {
+	b := make([]byte, 6)
+	for sector := int64(16); sector < 64; sector++ {
+		if _, err := r.ReadAt(b, sector*2048); err != nil {
+			return false
+		}
+		switch string(b[1:6]) {
+		case "NSR02", "NSR03":
+			return true
+		case "BEA01", "TEA01", "CD001", "CDW02", "BOOT2":
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+func udfTag(b []byte) uint16 {
+	if len(b) < 16 {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(b)
+}
+
+// udfLongAddress reads the place of a long allocation descriptor
+func udfLongAddress(b []byte) udfAddress {
+	return udfAddress{binary.LittleEndian.Uint16(b[8:]), binary.LittleEndian.Uint32(b[4:])}
+}
+
+// offset is where a block of the volume lies in the image
+func (v *udfVolume) offset(at udfAddress) (int64, error) {
+	if int(at.partition) >= len(v.partitions) {
+		return 0, ErrCorrupt
+	}
+	return (v.partitions[at.partition] + int64(at.block)) * v.blockSize, nil
+}
+
+func (v *udfVolume) block(at udfAddress) ([]byte, error) {
+	offset, err := v.offset(at)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, v.blockSize)
+	if _, err := v.a.file.ReadAt(b, offset); err != nil {
+		return nil, ErrCorrupt
+	}
+	return b, nil
+}
+
+// entry reads the file entry at an address
+func (v *udfVolume) entry(at udfAddress) (*udfEntry, error) {
+	b, err := v.block(at)
+	if err != nil {
+		return nil, err
+	}
+	var modTime, attributesLength, descriptorsLength, descriptors int
+	switch udfTag(b) {
+	case udfFileEntry:
+		modTime, attributesLength, descriptorsLength, descriptors = 84, 168, 172, 176
+	case udfExtendedFileEntry:
+		modTime, attributesLength, descriptorsLength, descriptors = 92, 208, 212, 216
+	default:
+		return nil, ErrCorrupt
+	}
+	e := &udfEntry{
+		fileType: b[27],
+		size:     int64(binary.LittleEndian.Uint64(b[56:])),
+		modTime:  udfTime(b[modTime:]),
+	}
+	descriptors += int(binary.LittleEndian.Uint32(b[attributesLength:]))
+	end := descriptors + int(binary.LittleEndian.Uint32(b[descriptorsLength:]))
+	if e.size < 0 || end > len(b) {
+		return nil, ErrCorrupt
+	}
+	kind := binary.LittleEndian.Uint16(b[34:]) & 7
+	if kind == 3 { // the data follows
+		if e.size > int64(end-descriptors) {
+			return nil, ErrCorrupt
+		}
+		e.inline = b[descriptors : descriptors+int(e.size)]
+		return e, nil
+	}
+	if err := v.extents(e, b[descriptors:end], kind, at.partition); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// extents reads the allocation descriptors of a file, short or long ones, following
+// them into allocation extent descriptors
+func (v *udfVolume) extents(e *udfEntry, b []byte, kind uint16, partition uint16) error {
+	var size int
+	switch kind {
+	case 0:
+		size = 8
+	case 1:
+		size = 16
+	default:
+		return fmt.Errorf("%w: UDF allocation descriptors of type %d", ErrFormat, kind)
+	}
+	recorded := int64(0)
+	for more := 0; len(b) >= size && recorded < e.size; {
+		length := binary.LittleEndian.Uint32(b)
+		at := udfAddress{partition, binary.LittleEndian.Uint32(b[4:])}
+		if kind == 1 {
+			at.partition = binary.LittleEndian.Uint16(b[8:])
+		}
+		b = b[size:]
+		extentLength, extentType := int64(length&0x3FFFFFFF), length>>30
+		if extentLength == 0 {
+			break
+		}
+		if extentType == 3 { // the descriptors go on elsewhere
+			if more++; more > 1024 {
+				return ErrCorrupt
+			}
+			next, err := v.block(at)
+			if err != nil || udfTag(next) != udfAllocationExtent {
+				return ErrCorrupt
+			}
+			n := int(binary.LittleEndian.Uint32(next[20:]))
+			if 24+n > len(next) {
+				return ErrCorrupt
+			}
+			b = next[24 : 24+n]
+			continue
+		}
+		x := extent{-1, extentLength} // not recorded, read as zeros
+		if extentType == 0 {
+			offset, err := v.offset(at)
+			if err != nil {
+				return err
+			}
+			x.offset = offset
+		}
+		e.extents = append(e.extents, x)
+		recorded += extentLength
+	}
+	if recorded < e.size {
+		return ErrCorrupt
+	}
+	return nil
+}
+
+// read reads the whole of a small file, as directories are
+func (v *udfVolume) read(e *udfEntry) ([]byte, error) {
+	if e.inline != nil {
+		return e.inline, nil
+	}
+	if e.size > maxDirectorySize {
+		return nil, ErrCorrupt
+	}
+	data := make([]byte, e.size)
+	if _, err := newExtentReader(v.a.file, e.extents, e.size).ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil, ErrCorrupt
+	}
+	return data, nil
+}
+
+func (v *udfVolume) opener(e *udfEntry) func() (io.ReaderAt, error) {
+	return func() (io.ReaderAt, error) {
+		if e.inline != nil {
+			return bytes.NewReader(e.inline), nil
+		}
+		return newExtentReader(v.a.file, e.extents, e.size), nil
+	}
+}
+
+// udfName decodes an OSTA compressed unicode file identifier
+func udfName(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	switch b[0] {
+	case 8:
+		chars := make([]rune, len(b)-1)
+		for i, c := range b[1:] {
+			chars[i] = rune(c)
+		}
+		return string(chars)
+	case 16:
+		chars := make([]uint16, (len(b)-1)/2)
+		for i := range chars {
+			chars[i] = binary.BigEndian.Uint16(b[1+2*i:])
+		}
+		return string(utf16.Decode(chars))
+	}
+	return ""
+}
+
+// udfTime reads a timestamp, local time with its offset from UTC in minutes
+func udfTime(b []byte) time.Time {
+	typeAndZone := binary.LittleEndian.Uint16(b)
+	year := int(int16(binary.LittleEndian.Uint16(b[2:])))
+	if year == 0 || b[4] == 0 {
+		return time.Time{}
+	}
+	zone := time.UTC
+	if minutes := int(int16(typeAndZone<<4) >> 4); typeAndZone>>12 == 1 && minutes != -2047 {
+		zone = time.FixedZone("", minutes*60)
+	}
+	return time.Date(year, time.Month(b[4]), int(b[5]), int(b[6]), int(b[7]), int(b[8]), int(b[9])*10*int(time.Millisecond), zone)
+}
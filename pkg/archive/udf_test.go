@@ -0,0 +1,147 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// the test volume's partition starts at sector 64
+const udfTestPartition = 64
+
+func udfDescriptor(tag uint16, location uint32) []byte {
+	b := make([]byte, 2048)
+	binary.LittleEndian.PutUint16(b, tag)
+	binary.LittleEndian.PutUint32(b[12:], location)
+	return b
+}
+
+func udfLong(b []byte, length, block uint32) {
+	binary.LittleEndian.PutUint32(b, length)
+	binary.LittleEndian.PutUint32(b[4:], block)
+}
+
+// udfFID makes a file identifier descriptor naming the entry at block
+func udfFID(characteristics byte, name string, block uint32) []byte {
+	id := []byte{}
+	if name != "" {
+		id = append([]byte{8}, name...)
+	}
+	size := (38 + len(id) + 3) &^ 3
+	b := make([]byte, size)
+	binary.LittleEndian.PutUint16(b, udfFileIdentifier)
+	b[18] = characteristics
+	b[19] = byte(len(id))
+	udfLong(b[20:], 2048, block)
+	copy(b[38:], id)
+	return b
+}
+
+// udfEntryAt makes a file entry, extended when asked, with short allocation
+// descriptors or, when extents is nil, the data itself
+func udfEntryAt(block uint32, fileType byte, extended bool, data []byte, size int, extents [][2]uint32) []byte {
+	tag, descriptors, lengths := uint16(udfFileEntry), 176, 168
+	if extended {
+		tag, descriptors, lengths = udfExtendedFileEntry, 216, 208
+	}
+	b := udfDescriptor(tag, block)
+	b[27] = fileType
+	binary.LittleEndian.PutUint64(b[56:], uint64(size))
+	modTime := 84
+	if extended {
+		modTime = 92
+	}
+	binary.LittleEndian.PutUint16(b[modTime:], 1<<12|uint16(120)) // local time, UTC+2
+	binary.LittleEndian.PutUint16(b[modTime+2:], 2004)
+	copy(b[modTime+4:], []byte{2, 29, 12, 30, 15})
+	if extents == nil {
+		binary.LittleEndian.PutUint16(b[34:], 3)
+		binary.LittleEndian.PutUint32(b[lengths+4:], uint32(len(data)))
+		copy(b[descriptors:], data)
+		return b
+	}
+	binary.LittleEndian.PutUint32(b[lengths+4:], uint32(8*len(extents)))
+	for i, x := range extents {
+		binary.LittleEndian.PutUint32(b[descriptors+8*i:], x[1])
+		binary.LittleEndian.PutUint32(b[descriptors+8*i+4:], x[0])
+	}
+	return b
+}
+
+func TestUDFMembers(t *testing.T) {
+	frame := bytes.Repeat([]byte{1, 2, 3, 4, 5}, 600) // 3000 bytes, two extents
+	d := &discImage{sectorSize: 2048}
+	for i, id := range []string{"BEA01", "NSR02", "TEA01"} {
+		b := make([]byte, 2048)
+		copy(b[1:], id)
+		b[6] = 1
+		d.put(16+i, b)
+	}
+	anchor := udfDescriptor(udfAnchor, 256)
+	udfLong(anchor[16:], 3*2048, 32)
+	d.put(256, anchor)
+
+	partition := udfDescriptor(udfPartition, 32)
+	binary.LittleEndian.PutUint32(partition[188:], udfTestPartition)
+	binary.LittleEndian.PutUint32(partition[192:], 32)
+	d.put(32, partition)
+	volume := udfDescriptor(udfLogicalVolume, 33)
+	binary.LittleEndian.PutUint32(volume[212:], 2048)
+	udfLong(volume[248:], 2048, 0)
+	binary.LittleEndian.PutUint32(volume[264:], 6)
+	binary.LittleEndian.PutUint32(volume[268:], 1)
+	copy(volume[440:], []byte{1, 6, 1, 0, 0, 0})
+	d.put(33, volume)
+	d.put(34, udfDescriptor(udfTerminating, 34))
+
+	fileSet := udfDescriptor(udfFileSet, 0)
+	udfLong(fileSet[400:], 2048, 1)
+	d.put(udfTestPartition, fileSet)
+
+	// the root directory recorded in block 2, RPF's held in its entry
+	var root bytes.Buffer
+	root.Write(udfFID(0x0A, "", 1))
+	root.Write(udfFID(0x02, "RPF", 3))
+	root.Write(udfFID(0x04, "GONE.TXT", 9))
+	d.put(udfTestPartition+1, udfEntryAt(1, udfDirectoryType, false, nil, root.Len(), [][2]uint32{{2, uint32(root.Len())}}))
+	d.put(udfTestPartition+2, root.Bytes())
+	var rpfDir bytes.Buffer
+	rpfDir.Write(udfFID(0x0A, "", 1))
+	rpfDir.Write(udfFID(0, "00610011.JG1", 4))
+	rpfDir.Write(udfFID(0, "a.toc", 5))
+	d.put(udfTestPartition+3, udfEntryAt(3, udfDirectoryType, true, rpfDir.Bytes(), rpfDir.Len(), nil))
+	d.put(udfTestPartition+4, udfEntryAt(4, udfFileType, false, nil, len(frame), [][2]uint32{{6, 2048}, {10, 952}}))
+	d.put(udfTestPartition+5, udfEntryAt(5, udfFileType, true, []byte("toc"), 3, nil))
+	d.put(udfTestPartition+6, frame[:2048])
+	d.put(udfTestPartition+10, frame[2048:])
+
+	a, err := OpenArchive(d.write(t, "cadrg.iso"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = a.Close() }()
+	members := a.Members()
+	if len(members) != 2 || members[0].Name != "RPF/00610011.JG1" || members[1].Name != "RPF/a.toc" {
+		t.Fatalf("members = %v", members)
+	}
+	if m := members[0]; m.Size != int64(len(frame)) || m.ModTime.Year() != 2004 || m.ModTime.Day() != 29 {
+		t.Fatalf("frame member = %+v", m)
+	}
+	if _, offset := members[0].ModTime.Zone(); offset != 7200 {
+		t.Fatalf("zone offset = %d, want 7200", offset)
+	}
+	f, err := a.Open("RPF/00610011.JG1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readAll(t, f), frame) {
+		t.Fatal("frame content differs")
+	}
+	f, err = a.Open("RPF/a.toc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(readAll(t, f)); got != "toc" {
+		t.Fatalf("inline member = %q, want %q", got, "toc")
+	}
+}
@@ -0,0 +1,49 @@
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"path"
+	"strings"
+)
+
+// readZip lists the files of a ZIP archive
+func (a *Archive) readZip(size int64) error {
+	z, err := zip.NewReader(a.file, size)
+	if err != nil {
+		return ErrNotArchive
+	}
+	for _, f := range z.File {
+		if strings.HasSuffix(f.Name, "/") || f.Mode().IsDir() {
+			continue
+		}
+		f := f
+		name := strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(f.Name, "\\", "/")), "/")
+		a.add(Member{name, int64(f.UncompressedSize64), f.Modified}, func() (io.ReaderAt, error) {
+			return openZipFile(a, f)
+		})
+	}
+	return nil
+}
+
+// openZipFile reads a stored file in place and decompresses any other
+func openZipFile(a *Archive, f *zip.File) (io.ReaderAt, error) {
+	if f.Method == zip.Store && f.Flags&0x1 == 0 { // not encrypted
+		offset, err := f.DataOffset()
+		if err != nil {
+			return nil, err
+		}
+		return io.NewSectionReader(a.file, offset, int64(f.UncompressedSize64)), nil
+	}
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = r.Close() }()
+	data, err := io.ReadAll(r) // also checks the CRC
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
@@ -0,0 +1,289 @@
+package commonmap
+
+import (
+	"encoding/xml"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+
+	"cm/pkg/rpf"
+)
+
+// This file writes the WMS GetCapabilities document for the series in the index.
+
+// supported CRSs, as understood by parseMapView
+var wmsCRS = []string{"EPSG:4326", "CRS:84", "EPSG:3857"}
+
+// latitude where web mercator is cut off
+const mercatorMaxLat = 85.0511287798
+
+type wmsCapabilities struct {
+	XMLName        xml.Name
+	Version        string         `xml:"version,attr"`
+	Xmlns          string         `xml:"xmlns,attr,omitempty"`
+	XmlnsXlink     string         `xml:"xmlns:xlink,attr"`
+	XmlnsXsi       string         `xml:"xmlns:xsi,attr,omitempty"`
+	SchemaLocation string         `xml:"xsi:schemaLocation,attr,omitempty"`
+	Service        capsService    `xml:"Service"`
+	Capability     capsCapability `xml:"Capability"`
+}
+
+type capsService struct {
+	Name           string             `xml:"Name"`
+	Title          string             `xml:"Title"`
+	Abstract       string             `xml:"Abstract"`
+	OnlineResource capsOnlineResource `xml:"OnlineResource"`
+	MaxWidth       int                `xml:"MaxWidth,omitempty"`
+	MaxHeight      int                `xml:"MaxHeight,omitempty"`
+}
+
+type capsOnlineResource struct {
+	Type string `xml:"xlink:type,attr"`
+	Href string `xml:"xlink:href,attr"`
+}
+
+type capsCapability struct {
+	GetCapabilities capsOperation `xml:"Request>GetCapabilities"`
+	GetMap          capsOperation `xml:"Request>GetMap"`
+	Exception       []string      `xml:"Exception>Format"`
+	Layer           capsLayer     `xml:"Layer"`
+}
+
+type capsOperation struct {
+	Formats []string           `xml:"Format"`
+	Get     capsOnlineResource `xml:"DCPType>HTTP>Get>OnlineResource"`
+}
+
+// capsLayer carries the elements of both versions, only one set is filled in
+type capsLayer struct {
+	Queryable   int            `xml:"queryable,attr"`
+	Name        string         `xml:"Name,omitempty"`
+	Title       string         `xml:"Title"`
+	Abstract    string         `xml:"Abstract,omitempty"`
+	SRS         []string       `xml:"SRS"`
+	CRS         []string       `xml:"CRS"`
+	LatLonBox   *capsBox       `xml:"LatLonBoundingBox"`
+	GeoBox      *capsGeoBox    `xml:"EX_GeographicBoundingBox"`
+	BoundingBox []capsBox      `xml:"BoundingBox"`
+	Style       []capsStyle    `xml:"Style"`
+	ScaleHint   *capsScaleHint `xml:"ScaleHint"`
+	MinScale    string         `xml:"MinScaleDenominator,omitempty"`
+	MaxScale    string         `xml:"MaxScaleDenominator,omitempty"`
+	Layers      []capsLayer    `xml:"Layer"`
+	scale       [2]float64     // drawn from scale[0] up to scale[1]
+	extent      Box            // in degrees
+}
+
+type capsBox struct {
+	CRS  string `xml:"CRS,attr,omitempty"`
+	SRS  string `xml:"SRS,attr,omitempty"`
+	MinX string `xml:"minx,attr"`
+	MinY string `xml:"miny,attr"`
+	MaxX string `xml:"maxx,attr"`
+	MaxY string `xml:"maxy,attr"`
+}
+
+type capsGeoBox struct {
+	West  string `xml:"westBoundLongitude"`
+	East  string `xml:"eastBoundLongitude"`
+	South string `xml:"southBoundLatitude"`
+	North string `xml:"northBoundLatitude"`
+}
+
+type capsStyle struct {
+	Name  string `xml:"Name"`
+	Title string `xml:"Title"`
+}
+
+type capsScaleHint struct {
+	Min string `xml:"min,attr"`
+	Max string `xml:"max,attr"`
+}
+
+func formatNumber(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// serviceURL is the WMS endpoint as the client reached it
+func serviceURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host + r.URL.Path + "?"
+}
+
+// getCapabilities answers a WMS GetCapabilities request
+func (ix *Indexer) getCapabilities(w http.ResponseWriter, r *http.Request, params wmsParams) {
+	version := params.version()
+	href := capsOnlineResource{"simple", serviceURL(r)}
+	caps := wmsCapabilities{
+		Version:    version,
+		XmlnsXlink: "http://www.w3.org/1999/xlink",
+		Service: capsService{
+			Name:           "WMS",
+			Title:          "CommonMap",
+			Abstract:       "RPF map data served from the original frames",
+			OnlineResource: href,
+		},
+		Capability: capsCapability{
+			GetCapabilities: capsOperation{[]string{"text/xml"}, href},
+			GetMap:          capsOperation{[]string{"image/png", "image/jpeg"}, href},
+			Exception:       []string{"XML"},
+		},
+	}
+	contentType := "text/xml"
+	if version == "1.3.0" {
+		caps.XMLName.Local = "WMS_Capabilities"
+		caps.Xmlns = "http://www.opengis.net/wms"
+		caps.XmlnsXsi = "http://www.w3.org/2001/XMLSchema-instance"
+		caps.SchemaLocation = "http://www.opengis.net/wms http://schemas.opengis.net/wms/1.3.0/capabilities_1_3_0.xsd"
+		caps.Service.MaxWidth, caps.Service.MaxHeight = maxMapSize, maxMapSize
+	} else {
+		caps.XMLName.Local = "WMT_MS_Capabilities"
+		caps.Service.Name = "OGC:WMS"
+		caps.Capability.GetCapabilities.Formats = []string{"application/vnd.ogc.wms_xml"}
+		caps.Capability.Exception = []string{"application/vnd.ogc.se_xml"}
+		contentType = "application/vnd.ogc.wms_xml"
+	}
+	caps.Capability.Layer = ix.capabilityLayers(version)
+
+	body, err := xml.MarshalIndent(caps, "", "  ")
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-type", contentType)
+	doc := xml.Header
+	if version == "1.1.1" {
+		doc += `<!DOCTYPE WMT_MS_Capabilities SYSTEM "http://schemas.opengis.net/wms/1.1.1/WMS_MS_Capabilities.dtd">` + "\n"
+	}
+	if _, err := w.Write(append([]byte(doc), body...)); err != nil {
+		log.Print(err)
+	}
+}
+
+// rasterLayer is a native layer as advertised by the capabilities documents
+type rasterLayer struct {
+	name, title, abstract string
+	extent                Box        // in degrees
+	scale                 [2]float64 // drawn from scale[0] up to scale[1]
+}
+
+// rasterLayers lists the RPF group, then a layer per indexed imagery series, finest first
+func (ix *Indexer) rasterLayers() []rasterLayer {
+	group := rasterLayer{
+		name:     "RPF",
+		title:    "RPF",
+		abstract: "The finest RPF series for the scale, falling back to coarser series",
+		extent:   Box{-180, -90, 180, 90},
+	}
+	var layers []rasterLayer
+	for _, series := range ix.indexedSeries() {
+		info := rpf.DataSeries[series.seriesCode]
+		if info.Type == rpf.CDTED {
+			continue
+		}
+		extent, err := ix.indexExtent(series.seriesCode)
+		if err != nil {
+			log.Printf("cannot read the extent of %s: %v", series.seriesCode, err)
+			continue
+		}
+		if len(layers) == 0 {
+			group.extent = extent
+		} else {
+			extendBbox(&group.extent, &extent)
+		}
+		group.scale[1] = math.Max(group.scale[1], series.scale*2)
+		layers = append(layers, rasterLayer{
+			name:     "RPF-" + series.seriesCode,
+			title:    info.Name,
+			abstract: info.SeriesCode + " " + info.GroupCode + " " + info.ScaleText,
+			extent:   extent,
+			scale:    [2]float64{series.scale / 3, series.scale * 2},
+		})
+	}
+	return append([]rasterLayer{group}, layers...)
+}
+
+// capabilityLayers builds the WMS layer tree: the untitled root, the RPF group, then
+// the series layers
+func (ix *Indexer) capabilityLayers(version string) capsLayer {
+	layers := ix.rasterLayers()
+	group := capsLayer{
+		Name:     layers[0].name,
+		Title:    layers[0].title,
+		Abstract: layers[0].abstract,
+		Style:    []capsStyle{{"default", "default"}}, // inherited by every series
+		scale:    layers[0].scale,
+		extent:   layers[0].extent,
+	}
+	for _, layer := range layers[1:] {
+		group.Layers = append(group.Layers, capsLayer{
+			Name:     layer.name,
+			Title:    layer.title,
+			Abstract: layer.abstract,
+			scale:    layer.scale,
+			extent:   layer.extent,
+		})
+	}
+
+	root := capsLayer{Title: "CommonMap", extent: group.extent, Layers: []capsLayer{group}}
+	describeLayer(&root, version, true)
+	return root
+}
+
+// describeLayer fills in the version specific elements of a layer and its children
+func describeLayer(layer *capsLayer, version string, isRoot bool) {
+	x1, y1, x2, y2 := layer.extent[MinX], layer.extent[MinY], layer.extent[MaxX], layer.extent[MaxY]
+	mercator := func(lon, lat float64) (string, string) {
+		lat = math.Max(-mercatorMaxLat, math.Min(mercatorMaxLat, lat))
+		x := lon * math.Pi / 180 * mercatorRadius
+		y := math.Log(math.Tan(math.Pi/4+lat*math.Pi/360)) * mercatorRadius
+		return formatNumber(x), formatNumber(y)
+	}
+	mx1, my1 := mercator(x1, y1)
+	mx2, my2 := mercator(x2, y2)
+	lon1, lat1, lon2, lat2 := formatNumber(x1), formatNumber(y1), formatNumber(x2), formatNumber(y2)
+
+	if version == "1.3.0" {
+		if isRoot {
+			layer.CRS = wmsCRS
+		}
+		layer.GeoBox = &capsGeoBox{lon1, lon2, lat1, lat2}
+		layer.BoundingBox = []capsBox{
+			{CRS: "EPSG:4326", MinX: lat1, MinY: lon1, MaxX: lat2, MaxY: lon2},
+			{CRS: "CRS:84", MinX: lon1, MinY: lat1, MaxX: lon2, MaxY: lat2},
+			{CRS: "EPSG:3857", MinX: mx1, MinY: my1, MaxX: mx2, MaxY: my2},
+		}
+		if layer.scale[1] > 0 {
+			if layer.scale[0] > 0 {
+				layer.MinScale = formatNumber(math.Round(layer.scale[0]))
+			}
+			layer.MaxScale = formatNumber(math.Round(layer.scale[1]))
+		}
+	} else {
+		if isRoot {
+			layer.SRS = []string{"EPSG:4326", "EPSG:3857"}
+		}
+		layer.LatLonBox = &capsBox{MinX: lon1, MinY: lat1, MaxX: lon2, MaxY: lat2}
+		layer.BoundingBox = []capsBox{
+			{SRS: "EPSG:4326", MinX: lon1, MinY: lat1, MaxX: lon2, MaxY: lat2},
+			{SRS: "EPSG:3857", MinX: mx1, MinY: my1, MaxX: mx2, MaxY: my2},
+		}
+		if layer.scale[1] > 0 {
+			// ground distance of a pixel's diagonal, as MapServer reports it
+			hint := func(scale float64) string {
+				return strconv.FormatFloat(scale/(inchesPerMeter*mapResolution)*math.Sqrt2, 'f', 4, 64)
+			}
+			layer.ScaleHint = &capsScaleHint{hint(layer.scale[0]), hint(layer.scale[1])}
+		}
+	}
+	for i := range layer.Layers {
+		describeLayer(&layer.Layers[i], version, false)
+	}
+}
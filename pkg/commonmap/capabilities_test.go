@@ -0,0 +1,150 @@
+package commonmap
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strconv"
+	"testing"
+
+	"cm/pkg/rpf"
+)
+
+// capsDocLayer reads back the layers of either version of the capabilities
+type capsDocLayer struct {
+	Name        string         `xml:"Name"`
+	Title       string         `xml:"Title"`
+	GeoBox      *capsGeoBox    `xml:"EX_GeographicBoundingBox"`
+	LatLonBox   *capsBox       `xml:"LatLonBoundingBox"`
+	BoundingBox []capsBox      `xml:"BoundingBox"`
+	Layers      []capsDocLayer `xml:"Layer"`
+}
+
+type capsDoc struct {
+	XMLName xml.Name
+	Version string       `xml:"version,attr"`
+	Layer   capsDocLayer `xml:"Capability>Layer"`
+}
+
+func parseNumbers(t *testing.T, values ...string) Box {
+	t.Helper()
+	var box Box
+	for i, value := range values {
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		box[i] = v
+	}
+	return box
+}
+
+// checkExtent checks every box of a layer against its extent in degrees
+func checkExtent(t *testing.T, version string, layer capsDocLayer, want Box) {
+	t.Helper()
+	boxes := map[string]Box{}
+	if version == "1.3.0" {
+		if layer.GeoBox == nil {
+			t.Fatalf("%s has no EX_GeographicBoundingBox", layer.Title)
+		}
+		g := layer.GeoBox
+		boxes["EX_GeographicBoundingBox"] = parseNumbers(t, g.West, g.South, g.East, g.North)
+	} else {
+		if layer.LatLonBox == nil {
+			t.Fatalf("%s has no LatLonBoundingBox", layer.Title)
+		}
+		b := layer.LatLonBox
+		boxes["LatLonBoundingBox"] = parseNumbers(t, b.MinX, b.MinY, b.MaxX, b.MaxY)
+	}
+	for _, b := range layer.BoundingBox {
+		crs := b.CRS + b.SRS
+		switch {
+		case crs == "EPSG:4326" && version == "1.3.0":
+			// latitude first
+			boxes[crs] = parseNumbers(t, b.MinY, b.MinX, b.MaxY, b.MaxX)
+		case crs == "EPSG:4326" || crs == "CRS:84":
+			boxes[crs] = parseNumbers(t, b.MinX, b.MinY, b.MaxX, b.MaxY)
+		}
+	}
+	wantBoxes := 3
+	if version == "1.1.1" {
+		wantBoxes = 2
+	}
+	if len(boxes) != wantBoxes {
+		t.Fatalf("%s has the boxes %v", layer.Title, boxes)
+	}
+	for name, box := range boxes {
+		if box != want {
+			t.Errorf("%s %s is %v, want %v", layer.Title, name, box, want)
+		}
+	}
+}
+
+func TestGetCapabilities(t *testing.T) {
+	jg1, jg2, on := "RPF/JG/000A0010.JG1", "RPF/JG/000B0010.JG1", "RPF/ON/00010010.ON1"
+	_, server := serveFrames(t, jg1, jg2, on)
+	jgExtent, jg2Extent, onExtent := frameBounds(t, jg1), frameBounds(t, jg2), frameBounds(t, on)
+	extendBbox(&jgExtent, &jg2Extent)
+	all := jgExtent
+	extendBbox(&all, &onExtent)
+
+	tests := []struct {
+		version, root, contentType string
+	}{
+		{"1.1.1", "WMT_MS_Capabilities", "application/vnd.ogc.wms_xml"},
+		{"1.3.0", "WMS_Capabilities", "text/xml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			resp, body := httpGet(t, server.URL+"/wms?SERVICE=WMS&REQUEST=GetCapabilities&VERSION="+tt.version)
+			if ct := resp.Header.Get("Content-type"); ct != tt.contentType {
+				t.Fatalf("GetCapabilities answered %s, want %s", ct, tt.contentType)
+			}
+
+			// well-formed down to the last token
+			decoder := xml.NewDecoder(bytes.NewReader(body))
+			for {
+				if _, err := decoder.Token(); errors.Is(err, io.EOF) {
+					break
+				} else if err != nil {
+					t.Fatalf("%v in %s", err, body)
+				}
+			}
+
+			var doc capsDoc
+			if err := xml.Unmarshal(body, &doc); err != nil {
+				t.Fatal(err)
+			}
+			if doc.XMLName.Local != tt.root || doc.Version != tt.version {
+				t.Fatalf("document is %s version %s, want %s version %s", doc.XMLName.Local, doc.Version, tt.root, tt.version)
+			}
+			if tt.version == "1.3.0" && doc.XMLName.Space != "http://www.opengis.net/wms" {
+				t.Fatalf("document in namespace %q", doc.XMLName.Space)
+			}
+
+			root := doc.Layer
+			if root.Title != "CommonMap" || len(root.Layers) != 1 || root.Layers[0].Name != "RPF" {
+				t.Fatalf("root layer %q holds %v, want the RPF group", root.Title, root.Layers)
+			}
+			checkExtent(t, tt.version, root, all)
+			group := root.Layers[0]
+			checkExtent(t, tt.version, group, all)
+
+			want := []struct {
+				seriesCode string
+				extent     Box
+			}{{"JG", jgExtent}, {"ON", onExtent}}
+			if len(group.Layers) != len(want) {
+				t.Fatalf("RPF group holds %d layers, want %d", len(group.Layers), len(want))
+			}
+			for i, series := range want {
+				layer := group.Layers[i]
+				if layer.Name != "RPF-"+series.seriesCode || layer.Title != rpf.DataSeries[series.seriesCode].Name {
+					t.Fatalf("layer %d is %s %q, want RPF-%s %q", i, layer.Name, layer.Title, series.seriesCode, rpf.DataSeries[series.seriesCode].Name)
+				}
+				checkExtent(t, tt.version, layer, series.extent)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package commonmap
+
+import (
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"cm/pkg/rpf"
+)
+
+// This file lays out the attributes of the series index DBF, one record per frame,
+// so GIS users can query and style the index layers.
+
+// FrameAttributes describe an indexed frame
+type FrameAttributes struct {
+	Location    string
+	SeriesCode  string
+	FrameNumber int // -1 when the file name doesn't follow RPF conventions
+	Edition     int
+	Producer    int
+	Zone        string
+	Scale       string
+	Size        int64 // bytes, -1 when unknown
+	ModTime     time.Time
+	Type        string // CADRG, CIB or CDTED
+}
+
+var typeNames = map[rpf.Type]string{rpf.CADRG: "CADRG", rpf.CIB: "CIB", rpf.CDTED: "CDTED"}
+
+// NewFrameAttributes describes a frame from its file name, and from info or the file
+// itself when info is nil
+func NewFrameAttributes(location string, info fs.FileInfo) FrameAttributes {
+	a := FrameAttributes{Location: location, FrameNumber: -1, Edition: -1, Producer: -1, Size: -1}
+	fileName := filepath.Base(location)
+	if len(fileName) > 3 {
+		a.SeriesCode = seriesOf(fileName)
+		if series, ok := rpf.DataSeries[a.SeriesCode]; ok {
+			a.Scale, a.Type = series.ScaleText, typeNames[series.Type]
+		}
+	}
+	if frame := rpf.NewFrameInfo(strings.ToUpper(fileName)); frame != nil {
+		a.FrameNumber, a.Edition, a.Producer = frame.FrameNumber, frame.Edition, frame.Producer
+		a.Zone = string(frame.ArcZone)
+	}
+	if info == nil {
+		info, _ = os.Stat(location)
+	}
+	if info != nil {
+		a.Size, a.ModTime = info.Size(), info.ModTime()
+	}
+	return a
+}
+
+// dbfField is a column of the index DBF
+type dbfField struct {
+	name     string
+	kind     byte // C character, N numeric, D date
+	size     int
+	decimals int
+	value    func(a *FrameAttributes) string
+}
+
+// dbfFields are the columns of the index DBF, location first as mapserv's TILEITEM.
+// The location is sized by dbfLayout.
+var dbfFields = []dbfField{
+	{"location", 'C', 0, 0, func(a *FrameAttributes) string { return a.Location }},
+	{"series", 'C', 2, 0, func(a *FrameAttributes) string { return a.SeriesCode }},
+	{"frame", 'N', 10, 0, func(a *FrameAttributes) string { return dbfNumber(int64(a.FrameNumber)) }},
+	{"edition", 'N', 4, 0, func(a *FrameAttributes) string { return dbfNumber(int64(a.Edition)) }},
+	{"producer", 'N', 2, 0, func(a *FrameAttributes) string { return dbfNumber(int64(a.Producer)) }},
+	{"zone", 'C', 1, 0, func(a *FrameAttributes) string { return a.Zone }},
+	{"scale", 'C', 16, 0, func(a *FrameAttributes) string { return a.Scale }},
+	{"size", 'N', 12, 0, func(a *FrameAttributes) string { return dbfNumber(a.Size) }},
+	{"modified", 'D', 8, 0, func(a *FrameAttributes) string {
+		if a.ModTime.IsZero() {
+			return ""
+		}
+		return a.ModTime.Format("20060102")
+	}},
+	{"type", 'C', 5, 0, func(a *FrameAttributes) string { return a.Type }},
+}
+
+// dbfHeaderLength is the size of the DBF header, records follow it
+var dbfHeaderLength = 32 + 32*len(dbfFields) + 1
+
+// dbfMaxRecord is the longest record the header can describe
+const dbfMaxRecord = math.MaxUint16
+
+// dbfLayout sizes the location field to the longest location, as far as a record allows.
+// Character fields wider than 255 keep their high byte in the decimal count, as
+// Clipper, shapelib and mapserv read them.
+func dbfLayout(longest int) []dbfField {
+	fields := slices.Clone(dbfFields)
+	fields[0].size = min(max(longest, 1), dbfMaxRecord-dbfRecordLength(fields))
+	return fields
+}
+
+// dbfRecordLength is the size of a DBF record, deletion flag included
+func dbfRecordLength(fields []dbfField) int {
+	length := 1
+	for _, f := range fields {
+		length += f.size
+	}
+	return length
+}
+
+// blank numbers are null, as dBase has it
+func dbfNumber(v int64) string {
+	if v < 0 {
+		return ""
+	}
+	return strconv.FormatInt(v, 10)
+}
+
+// dbfRecord formats a frame's attributes, cutting values too long for their field
+func dbfRecord(fields []dbfField, a *FrameAttributes) []byte {
+	record := make([]byte, 0, dbfRecordLength(fields))
+	record = append(record, ' ') // not deleted
+	for _, f := range fields {
+		value := f.value(a)
+		if len(value) > f.size {
+			value = value[:f.size]
+		}
+		if f.kind == 'N' {
+			record = fmt.Appendf(record, "%*s", f.size, value)
+		} else {
+			record = fmt.Appendf(record, "%-*s", f.size, value)
+		}
+	}
+	return record
+}
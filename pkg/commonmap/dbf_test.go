@@ -0,0 +1,44 @@
+package commonmap
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewFrameAttributes(t *testing.T) {
+	tests := []struct {
+		name     string
+		fileName string
+		want     FrameAttributes
+	}{
+		{"upper case", "000A0021.JG1", FrameAttributes{SeriesCode: "JG", FrameNumber: 340, Edition: 2, Producer: 1, Zone: "1", Scale: "1:250K", Type: "CADRG"}},
+		{"lower case", "000a0021.jg1", FrameAttributes{SeriesCode: "JG", FrameNumber: 340, Edition: 2, Producer: 1, Zone: "1", Scale: "1:250K", Type: "CADRG"}},
+		{"lower case zone", "000a0021.jgj", FrameAttributes{SeriesCode: "JG", FrameNumber: 340, Edition: 2, Producer: 1, Zone: "J", Scale: "1:250K", Type: "CADRG"}},
+		{"not a frame", "readme.txt", FrameAttributes{SeriesCode: "TX", FrameNumber: -1, Edition: -1, Producer: -1}},
+	}
+	// 000A0 is frame 10*34 in base 34
+	modTime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			location := filepath.Join(t.TempDir(), tt.fileName)
+			if err := os.WriteFile(location, []byte("frame"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(location, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+			want := tt.want
+			want.Location, want.Size, want.ModTime = location, 5, modTime
+			got := NewFrameAttributes(location, nil)
+			if !got.ModTime.Equal(want.ModTime) {
+				t.Fatalf("NewFrameAttributes(%s) modified %v, want %v", tt.fileName, got.ModTime, want.ModTime)
+			}
+			got.ModTime = want.ModTime
+			if got != want {
+				t.Fatalf("NewFrameAttributes(%s) = %+v, want %+v", tt.fileName, got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package commonmap
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"cm/pkg/archive"
+)
+
+// Holdings are often copied to several drives that get mounted together, putting the
+// same frame in the index more than once. The indexer finds the copies by name and
+// size, and by content when asked, indexes the first and reports the rest.
+
+// frameCopy is a frame file found in the holdings
+type frameCopy struct {
+	path string
+	size int64
+}
+
+// duplicateGroup is a frame held more than once. The canonical copy is indexed.
+type duplicateGroup struct {
+	Name       string   `json:"name"`
+	Size       int64    `json:"size"`
+	Hash       string   `json:"sha256,omitempty"`
+	Canonical  string   `json:"canonical"`
+	Duplicates []string `json:"duplicates"`
+}
+
+// duplicateReport is what the duplicates report holds, and what its JSON looks like
+type duplicateReport struct {
+	Copies      int              `json:"copies"`      // duplicates left out of the index
+	Reclaimable int64            `json:"reclaimable"` // bytes they take
+	Groups      []duplicateGroup `json:"groups"`
+}
+
+// findDuplicates tells which copies are duplicates of an earlier one: same name, in any
+// case, and same size, and same SHA-256 when hash is set. Files of unknown size, -1,
+// or that cannot be hashed are never taken for duplicates.
+func findDuplicates(copies []frameCopy, hash bool) ([]bool, duplicateReport) {
+	type nameSize struct {
+		name string
+		size int64
+	}
+	byNameSize := make(map[nameSize][]int)
+	var order []nameSize
+	for i, c := range copies {
+		if c.size < 0 {
+			continue
+		}
+		key := nameSize{strings.ToUpper(filepath.Base(c.path)), c.size}
+		if _, ok := byNameSize[key]; !ok {
+			order = append(order, key)
+		}
+		byNameSize[key] = append(byNameSize[key], i)
+	}
+
+	duplicate := make([]bool, len(copies))
+	var report duplicateReport
+	for _, key := range order {
+		same := byNameSize[key]
+		if len(same) < 2 {
+			continue
+		}
+		groups := [][]int{same}
+		hashes := make(map[int]string)
+		if hash {
+			groups = groups[:0]
+			byHash := make(map[string]int) // hash -> group
+			for _, i := range same {
+				sum, err := fileHash(copies[i].path)
+				if err != nil {
+					fmt.Printf("Cannot hash %s : %v\n", copies[i].path, err)
+					continue
+				}
+				hashes[i] = sum
+				g, ok := byHash[sum]
+				if !ok {
+					g = len(groups)
+					byHash[sum] = g
+					groups = append(groups, nil)
+				}
+				groups[g] = append(groups[g], i)
+			}
+		}
+		for _, g := range groups {
+			if len(g) < 2 {
+				continue
+			}
+			group := duplicateGroup{
+				Name:      filepath.Base(copies[g[0]].path),
+				Size:      key.size,
+				Hash:      hashes[g[0]],
+				Canonical: copies[g[0]].path,
+			}
+			for _, i := range g[1:] {
+				duplicate[i] = true
+				group.Duplicates = append(group.Duplicates, copies[i].path)
+				report.Copies++
+				report.Reclaimable += key.size
+			}
+			report.Groups = append(report.Groups, group)
+		}
+	}
+	return duplicate, report
+}
+
+func fileHash(location string) (string, error) {
+	file, err := archive.Open(location)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = file.Close() }()
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(file, 0, file.Size())); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// print sums up the duplicates found
+func (report duplicateReport) print() {
+	if report.Copies > 0 {
+		fmt.Printf("%d duplicate copies of %d frames left out of the index, %.1f MB reclaimable.\n",
+			report.Copies, len(report.Groups), float64(report.Reclaimable)/(1<<20))
+	}
+}
+
+// write saves the report at path, as JSON when it ends in .json and as CSV otherwise,
+// a row for each duplicate copy
+func (report duplicateReport) write(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		if report.Groups == nil {
+			report.Groups = []duplicateGroup{}
+		}
+		enc := json.NewEncoder(file)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		w := csv.NewWriter(file)
+		_ = w.Write([]string{"name", "size", "sha256", "canonical", "duplicate"})
+		for _, g := range report.Groups {
+			for _, duplicate := range g.Duplicates {
+				_ = w.Write([]string{g.Name, strconv.FormatInt(g.Size, 10), g.Hash, g.Canonical, duplicate})
+			}
+		}
+		w.Flush()
+		err = w.Error()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// save prints the duplicates and writes them where the options say
+func (report duplicateReport) save(options IndexOptions) {
+	report.print()
+	if options.DuplicatesReport == "" {
+		return
+	}
+	if err := report.write(options.DuplicatesReport); err != nil {
+		fmt.Printf("Cannot write duplicates report : %v\n", err)
+	}
+}
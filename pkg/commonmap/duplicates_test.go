@@ -0,0 +1,134 @@
+package commonmap
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestFindDuplicates(t *testing.T) {
+	// files are written with their content, none when it is empty; size -1 is unknown
+	type file struct {
+		path    string
+		content string
+		size    int64
+	}
+	tests := []struct {
+		name      string
+		files     []file
+		hash      bool
+		duplicate []bool
+		groups    [][]string // canonical copy, then its duplicates
+	}{
+		{
+			name:      "other names",
+			files:     []file{{"A/000A0010.JG1", "frame", 5}, {"A/000B0010.JG1", "frame", 5}},
+			duplicate: []bool{false, false},
+		},
+		{
+			name:      "same name and size",
+			files:     []file{{"A/000A0010.JG1", "frame", 5}, {"B/000A0010.JG1", "frame", 5}},
+			duplicate: []bool{false, true},
+			groups:    [][]string{{"A/000A0010.JG1", "B/000A0010.JG1"}},
+		},
+		{
+			name:      "name in another case",
+			files:     []file{{"A/000A0010.JG1", "frame", 5}, {"B/000a0010.jg1", "frame", 5}},
+			duplicate: []bool{false, true},
+			groups:    [][]string{{"A/000A0010.JG1", "B/000a0010.jg1"}},
+		},
+		{
+			name:      "other size",
+			files:     []file{{"A/000A0010.JG1", "frame", 5}, {"B/000A0010.JG1", "frames", 6}},
+			duplicate: []bool{false, false},
+		},
+		{
+			name:      "unknown size",
+			files:     []file{{"A/000A0010.JG1", "frame", -1}, {"B/000A0010.JG1", "frame", -1}},
+			duplicate: []bool{false, false},
+		},
+		{
+			name:      "other content unhashed",
+			files:     []file{{"A/000A0010.JG1", "frame", 5}, {"B/000A0010.JG1", "FRAME", 5}},
+			duplicate: []bool{false, true},
+			groups:    [][]string{{"A/000A0010.JG1", "B/000A0010.JG1"}},
+		},
+		{
+			name:      "other content hashed",
+			files:     []file{{"A/000A0010.JG1", "frame", 5}, {"B/000A0010.JG1", "FRAME", 5}},
+			hash:      true,
+			duplicate: []bool{false, false},
+		},
+		{
+			name:      "same content hashed",
+			files:     []file{{"A/000A0010.JG1", "frame", 5}, {"B/000A0010.JG1", "frame", 5}},
+			hash:      true,
+			duplicate: []bool{false, true},
+			groups:    [][]string{{"A/000A0010.JG1", "B/000A0010.JG1"}},
+		},
+		{
+			name: "two contents hashed",
+			files: []file{{"A/000A0010.JG1", "frame", 5}, {"B/000A0010.JG1", "FRAME", 5},
+				{"C/000A0010.JG1", "frame", 5}, {"D/000A0010.JG1", "FRAME", 5}},
+			hash:      true,
+			duplicate: []bool{false, false, true, true},
+			groups:    [][]string{{"A/000A0010.JG1", "C/000A0010.JG1"}, {"B/000A0010.JG1", "D/000A0010.JG1"}},
+		},
+		{
+			name:      "copy that cannot be hashed",
+			files:     []file{{"A/000A0010.JG1", "", 5}, {"B/000A0010.JG1", "frame", 5}, {"C/000A0010.JG1", "frame", 5}},
+			hash:      true,
+			duplicate: []bool{false, false, true},
+			groups:    [][]string{{"B/000A0010.JG1", "C/000A0010.JG1"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			copies := make([]frameCopy, len(tt.files))
+			for i, f := range tt.files {
+				path := filepath.Join(root, filepath.FromSlash(f.path))
+				if f.content != "" {
+					if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+						t.Fatal(err)
+					}
+					if err := os.WriteFile(path, []byte(f.content), 0o644); err != nil {
+						t.Fatal(err)
+					}
+				}
+				copies[i] = frameCopy{path, f.size}
+			}
+
+			duplicate, report := findDuplicates(copies, tt.hash)
+			if !slices.Equal(duplicate, tt.duplicate) {
+				t.Fatalf("duplicates %v, want %v", duplicate, tt.duplicate)
+			}
+			var groups [][]string
+			copiesLeft, reclaimable := 0, int64(0)
+			for _, g := range report.Groups {
+				group := []string{g.Canonical}
+				group = append(group, g.Duplicates...)
+				for i := range group {
+					rel, err := filepath.Rel(root, group[i])
+					if err != nil {
+						t.Fatal(err)
+					}
+					group[i] = filepath.ToSlash(rel)
+				}
+				groups = append(groups, group)
+				copiesLeft += len(g.Duplicates)
+				reclaimable += int64(len(g.Duplicates)) * g.Size
+				if (g.Hash != "") != tt.hash {
+					t.Fatalf("group of %s hashed %q", g.Canonical, g.Hash)
+				}
+			}
+			if !slices.EqualFunc(groups, tt.groups, slices.Equal) {
+				t.Fatalf("groups %v, want %v", groups, tt.groups)
+			}
+			if report.Copies != copiesLeft || report.Reclaimable != reclaimable {
+				t.Fatalf("report of %d copies, %d bytes; groups hold %d, %d bytes", report.Copies, report.Reclaimable, copiesLeft, reclaimable)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package commonmap
+
+import (
+	"path/filepath"
+	"strings"
+
+	"cm/pkg/rpf"
+)
+
+// A holding may carry several editions of a frame, each a file of its own. The
+// index serves the newest and, when asked, keeps them all in a history index.
+
+// historyDirName is the directory in the index path of the history shapefiles
+const historyDirName = "history"
+
+// editionKey names a frame whatever its edition
+type editionKey struct {
+	seriesCode  string
+	zone        byte
+	frameNumber int
+}
+
+// editionOf reads the frame and the edition of a frame file from its name
+func editionOf(framePath string) (editionKey, int, bool) {
+	fileName := strings.ToUpper(filepath.Base(framePath))
+	frame := rpf.NewFrameInfo(fileName)
+	if frame == nil {
+		return editionKey{}, 0, false
+	}
+	return editionKey{seriesOf(fileName), frame.ArcZone, frame.FrameNumber}, frame.Edition, true
+}
+
+// newestEditions tells which of the boxes of a series are the newest edition of their
+// frame. Copies of the same edition are all kept, as are files whose names do not
+// parse.
+func newestEditions(boxes []RpfBox) []bool {
+	newest := make(map[editionKey]int, len(boxes))
+	for _, r := range boxes {
+		if key, edition, ok := editionOf(r.path); ok {
+			if e, seen := newest[key]; !seen || edition > e {
+				newest[key] = edition
+			}
+		}
+	}
+	keep := make([]bool, len(boxes))
+	for i, r := range boxes {
+		key, edition, ok := editionOf(r.path)
+		keep[i] = !ok || edition == newest[key]
+	}
+	return keep
+}
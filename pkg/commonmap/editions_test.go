@@ -0,0 +1,37 @@
+package commonmap
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestNewestEditions(t *testing.T) {
+	tests := []struct {
+		name  string
+		paths []string
+		keep  []bool
+	}{
+		{"single frame", []string{"RPF/JG/000A0010.JG1"}, []bool{true}},
+		{"newer edition", []string{"RPF/JG/000A0010.JG1", "RPF/JG/000A0030.JG1", "RPF/JG/000A0020.JG1"}, []bool{false, true, false}},
+		{"other directory", []string{"A/RPF/JG/000A0020.JG1", "B/RPF/JG/000A0010.JG1"}, []bool{true, false}},
+		{"copies of an edition", []string{"A/000A0020.JG1", "B/000A0020.JG1", "C/000A0010.JG1"}, []bool{true, true, false}},
+		{"other producer", []string{"000A0011.JG1", "000A0020.JG1"}, []bool{false, true}},
+		{"other zone", []string{"000A0010.JG1", "000A0020.JG2"}, []bool{true, true}},
+		{"other frame", []string{"000A0010.JG1", "000B0020.JG1"}, []bool{true, true}},
+		{"other series", []string{"000A0010.JG1", "000A0020.ON1"}, []bool{true, true}},
+		{"lower case names", []string{"rpf/jg/000a0010.jg1", "rpf/jg/000a0020.jg1"}, []bool{false, true}},
+		{"names in either case", []string{"RPF/JG/000A0030.JG1", "rpf/jg/000a0020.jg1"}, []bool{true, false}},
+		{"unparsed names", []string{"README.TXT", "000A0010.JG1", "A.TOC"}, []bool{true, true, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			boxes := make([]RpfBox, len(tt.paths))
+			for i, path := range tt.paths {
+				boxes[i] = RpfBox{path: path}
+			}
+			if keep := newestEditions(boxes); !slices.Equal(keep, tt.keep) {
+				t.Fatalf("newestEditions(%v) = %v, want %v", tt.paths, keep, tt.keep)
+			}
+		})
+	}
+}
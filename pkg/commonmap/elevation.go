@@ -0,0 +1,72 @@
+package commonmap
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"strconv"
+
+	"cm/pkg/rpf"
+)
+
+var ErrNoElevation = errors.New("no CDTED coverage at this location")
+
+// CDTED series, finest first
+var elevationSeries = []string{"D2", "D1"}
+
+// ElevationAt interpolates a height in meters from the finest indexed CDTED frame
+func (ix *Indexer) ElevationAt(lat, lon float64) (float64, error) {
+	point := Box{lon, lat, lon, lat}
+	for _, seriesCode := range elevationSeries {
+		frames, err := ix.findIndexedFrames(seriesCode, point)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue // series not indexed
+		}
+		if err != nil {
+			return 0, err
+		}
+		for _, frame := range frames {
+			value, err := ix.elevationFrames.get(frame.location, func() (any, error) {
+				return loadFrame(frame.location, func(r io.ReaderAt) (any, error) { return rpf.DecodeElevation(r) })
+			})
+			if err != nil {
+				log.Printf("cannot read CDTED frame %s: %v", frame.location, err)
+				continue
+			}
+			e := value.(*rpf.Elevation)
+			box := frameBox(e.Header, frame.box)
+			px := (lon - box[MinX]) / (box[MaxX] - box[MinX]) * float64(e.Width)
+			py := (box[MaxY] - lat) / (box[MaxY] - box[MinY]) * float64(e.Height)
+			if height, ok := e.Interpolate(px, py); ok {
+				return height, nil
+			}
+		}
+	}
+	return 0, ErrNoElevation
+}
+
+// answer /elevation?lat=..&lon=.. with a JSON spot height
+func (ix *Indexer) elevation(w http.ResponseWriter, r *http.Request) {
+	lat, err1 := strconv.ParseFloat(r.URL.Query().Get("lat"), 64)
+	lon, err2 := strconv.ParseFloat(r.URL.Query().Get("lon"), 64)
+	if err1 != nil || err2 != nil || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		http.Error(w, "lat and lon must be decimal degrees", http.StatusBadRequest)
+		return
+	}
+	height, err := ix.ElevationAt(lat, lon)
+	if errors.Is(err, ErrNoElevation) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]float64{"lat": lat, "lon": lon, "elevation": height}); err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,424 @@
+package commonmap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"math"
+	"os"
+	"sort"
+)
+
+// This file writes the frame footprints as FlatGeobuf: a flatbuffers header, a packed
+// Hilbert R-tree, then the features in Hilbert order, so web clients can fetch the
+// frames of a bbox with a few range requests.
+
+var fgbMagic = []byte{'f', 'g', 'b', 3, 'f', 'g', 'b', 0}
+
+const (
+	fgbNodeSize = 16 // children of an index node, the FlatGeobuf default
+
+	fgbPolygon = 3
+
+	fgbLong     = 7
+	fgbString   = 11
+	fgbDateTime = 13
+)
+
+// FgbWriter collects the frames of every series, the file is written once they
+// are all closed
+type FgbWriter struct {
+	path string
+	all  []footprint
+}
+
+// CreateFlatGeobuf starts a FlatGeobuf file at path, replacing any file there
+func CreateFlatGeobuf(path string) (*FgbWriter, error) {
+	// fail now rather than after indexing
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+	return &FgbWriter{path: path}, nil
+}
+
+// NewWriter returns a writer adding a series to the file
+func (f *FgbWriter) NewWriter() IndexWriter {
+	return &footprintWriter{add: func(seriesCode string, frame footprint) error {
+		f.all = append(f.all, frame)
+		return nil
+	}}
+}
+
+// Finish sorts the frames along the Hilbert curve and writes the file
+func (f *FgbWriter) Finish() error {
+	file, err := os.Create(f.path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(file, 65536)
+
+	var extent Box
+	for i := range f.all {
+		if i == 0 {
+			extent = f.all[i].box
+		} else {
+			extendBbox(&extent, &f.all[i].box)
+		}
+	}
+	hilberts := make([]uint32, len(f.all))
+	for i := range f.all {
+		hilberts[i] = hilbertOf(&f.all[i].box, &extent)
+	}
+	sort.Sort(byHilbert{f.all, hilberts})
+
+	nodeSize := fgbNodeSize
+	if len(f.all) == 0 {
+		nodeSize = 0 // no index without features
+	}
+	// every write is checked, the first error ending the file
+	write := func(b []byte) {
+		if err == nil {
+			_, err = w.Write(b)
+		}
+	}
+	write(fgbMagic)
+	header := encodeFlatbuffer(fgbHeader(extent, len(f.all), nodeSize))
+	write(binary.LittleEndian.AppendUint32(nil, uint32(len(header))))
+	write(header)
+
+	// encoded once, the index needs their sizes ahead of them
+	features := make([][]byte, len(f.all))
+	for i := range f.all {
+		features[i] = encodeFlatbuffer(fgbFeature(&f.all[i]))
+	}
+	if nodeSize > 0 {
+		// the leaves point at the features, by their offset past the index
+		offsets := make([]uint64, len(f.all))
+		offset := uint64(0)
+		for i, feature := range features {
+			offsets[i] = offset
+			offset += 4 + uint64(len(feature))
+		}
+		for _, node := range packHilbertTree(f.all, offsets, nodeSize) {
+			var item []byte
+			for _, v := range node.box {
+				item = binary.LittleEndian.AppendUint64(item, math.Float64bits(v))
+			}
+			write(binary.LittleEndian.AppendUint64(item, node.offset))
+		}
+	}
+	for i, feature := range features {
+		write(binary.LittleEndian.AppendUint32(nil, uint32(len(feature))))
+		write(feature)
+		features[i] = nil
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+type byHilbert struct {
+	frames   []footprint
+	hilberts []uint32
+}
+
+func (h byHilbert) Len() int { return len(h.frames) }
+
+// descending, as the reference writers order features
+func (h byHilbert) Less(i, j int) bool { return h.hilberts[i] > h.hilberts[j] }
+
+func (h byHilbert) Swap(i, j int) {
+	h.frames[i], h.frames[j] = h.frames[j], h.frames[i]
+	h.hilberts[i], h.hilberts[j] = h.hilberts[j], h.hilberts[i]
+}
+
+// hilbertOf places a box's center on a 16 bit Hilbert curve over the extent
+func hilbertOf(box, extent *Box) uint32 {
+	const hilbertMax = 1<<16 - 1
+	cell := func(lo, hi, min, max float64) uint32 {
+		if max <= min {
+			return 0
+		}
+		return uint32(math.Floor(hilbertMax * ((lo+hi)/2 - min) / (max - min)))
+	}
+	return hilbert(cell(box[0], box[2], extent[0], extent[2]), cell(box[1], box[3], extent[1], extent[3]))
+}
+
+// hilbert is the distance of (x, y) along the curve, after the flatbush implementation
+func hilbert(x, y uint32) uint32 {
+	a := x ^ y
+	b := 0xffff ^ a
+	c := 0xffff ^ (x | y)
+	d := x & (y ^ 0xffff)
+
+	A := a | (b >> 1)
+	B := (a >> 1) ^ a
+	C := ((c >> 1) ^ (b & (d >> 1))) ^ c
+	D := ((a & (c >> 1)) ^ (d >> 1)) ^ d
+
+	a, b, c, d = A, B, C, D
+	A = (a & (a >> 2)) ^ (b & (b >> 2))
+	B = (a & (b >> 2)) ^ (b & ((a ^ b) >> 2))
+	C ^= (a & (c >> 2)) ^ (b & (d >> 2))
+	D ^= (b & (c >> 2)) ^ ((a ^ b) & (d >> 2))
+
+	a, b, c, d = A, B, C, D
+	A = (a & (a >> 4)) ^ (b & (b >> 4))
+	B = (a & (b >> 4)) ^ (b & ((a ^ b) >> 4))
+	C ^= (a & (c >> 4)) ^ (b & (d >> 4))
+	D ^= (b & (c >> 4)) ^ ((a ^ b) & (d >> 4))
+
+	a, b, c, d = A, B, C, D
+	C ^= (a & (c >> 8)) ^ (b & (d >> 8))
+	D ^= (b & (c >> 8)) ^ ((a ^ b) & (d >> 8))
+
+	a = C ^ (C >> 1)
+	b = D ^ (D >> 1)
+
+	i0 := x ^ y
+	i1 := b | (0xffff ^ (i0 | a))
+
+	i0 = (i0 | (i0 << 8)) & 0x00ff00ff
+	i0 = (i0 | (i0 << 4)) & 0x0f0f0f0f
+	i0 = (i0 | (i0 << 2)) & 0x33333333
+	i0 = (i0 | (i0 << 1)) & 0x55555555
+
+	i1 = (i1 | (i1 << 8)) & 0x00ff00ff
+	i1 = (i1 | (i1 << 4)) & 0x0f0f0f0f
+	i1 = (i1 | (i1 << 2)) & 0x33333333
+	i1 = (i1 | (i1 << 1)) & 0x55555555
+
+	return (i1 << 1) | i0
+}
+
+// hilbertNode is an item of the packed tree: a feature's box and byte offset at the
+// leaves, above them the box of a node's children and the position of the first
+type hilbertNode struct {
+	box    Box
+	offset uint64
+}
+
+// packHilbertTree lays the tree out root first, each level after the one above and
+// the leaves last, as FlatGeobuf readers expect
+func packHilbertTree(frames []footprint, offsets []uint64, nodeSize int) []hilbertNode {
+	// nodes per level, leaves first
+	levels := []int{len(frames)}
+	total := len(frames)
+	for n := len(frames); ; {
+		n = (n + nodeSize - 1) / nodeSize
+		levels = append(levels, n)
+		total += n
+		if n == 1 {
+			break
+		}
+	}
+	starts := make([]int, len(levels))
+	end := total
+	for i, n := range levels {
+		starts[i] = end - n
+		end -= n
+	}
+
+	nodes := make([]hilbertNode, total)
+	for i := range frames {
+		nodes[starts[0]+i] = hilbertNode{frames[i].box, offsets[i]}
+	}
+	for level := 0; level < len(levels)-1; level++ {
+		parent := starts[level+1]
+		for pos := starts[level]; pos < starts[level]+levels[level]; parent++ {
+			node := hilbertNode{nodes[pos].box, uint64(pos)}
+			for end := min(pos+nodeSize, starts[level]+levels[level]); pos < end; pos++ {
+				extendBbox(&node.box, &nodes[pos].box)
+			}
+			nodes[parent] = node
+		}
+	}
+	return nodes
+}
+
+// fgbHeader describes the file: polygons in WGS 84, and the attribute columns
+func fgbHeader(extent Box, count, nodeSize int) fbTable {
+	var columns []fbTable
+	for _, c := range attributeColumns {
+		column := fbTable{c.name, uint8(fgbString)}
+		switch c.kind {
+		case integerAttribute:
+			column[1] = uint8(fgbLong)
+		case dateAttribute:
+			column[1] = uint8(fgbDateTime)
+		}
+		if c.width > 0 {
+			column = append(column, nil, nil, int32(c.width))
+		}
+		columns = append(columns, column)
+	}
+	header := fbTable{
+		0:  "frames",
+		2:  uint8(fgbPolygon),
+		7:  columns,
+		8:  uint64(count),
+		9:  uint16(nodeSize),
+		10: fbTable{"EPSG", int32(gpkgSRS)},
+		11: "RPF frame footprints",
+	}
+	if count > 0 {
+		header[1] = []float64{extent[0], extent[1], extent[2], extent[3]}
+	}
+	return header
+}
+
+// fgbFeature is a frame's polygon with its non-null attributes, each the column
+// index then the value
+func fgbFeature(frame *footprint) fbTable {
+	b := frame.box
+	xy := []float64{b[0], b[1], b[2], b[1], b[2], b[3], b[0], b[3], b[0], b[1]}
+	var properties []byte
+	for i, c := range attributeColumns {
+		switch v := c.value(&frame.attributes).(type) {
+		case int64:
+			properties = binary.LittleEndian.AppendUint16(properties, uint16(i))
+			properties = binary.LittleEndian.AppendUint64(properties, uint64(v))
+		case string:
+			properties = binary.LittleEndian.AppendUint16(properties, uint16(i))
+			properties = binary.LittleEndian.AppendUint32(properties, uint32(len(v)))
+			properties = append(properties, v...)
+		}
+	}
+	return fbTable{fbTable{1: xy}, properties}
+}
+
+// fbTable is a flatbuffers table, its fields by id and nil when absent. Fields are
+// uint8, bool, uint16, int32, uint64, string, []byte, []float64, fbTable or []fbTable.
+type fbTable []any
+
+// fbBuilder writes flatbuffers front to back: each table's vtable, then the table,
+// then what it refers to, so every offset points forward
+type fbBuilder struct {
+	buf []byte
+}
+
+func encodeFlatbuffer(root fbTable) []byte {
+	b := &fbBuilder{buf: make([]byte, 4, 256)}
+	binary.LittleEndian.PutUint32(b.buf, uint32(b.table(root)))
+	return b.buf
+}
+
+func (b *fbBuilder) pad(align int) {
+	for len(b.buf)%align != 0 {
+		b.buf = append(b.buf, 0)
+	}
+}
+
+func fbInlineSize(v any) int {
+	switch v.(type) {
+	case uint8, bool:
+		return 1
+	case uint16:
+		return 2
+	case uint64:
+		return 8
+	}
+	return 4 // int32, or an offset
+}
+
+func (b *fbBuilder) table(t fbTable) int {
+	n := len(t)
+	for n > 0 && t[n-1] == nil {
+		n--
+	}
+	at := make([]int, n)
+	size := 4 // the vtable offset
+	for i := 0; i < n; i++ {
+		if t[i] == nil {
+			continue
+		}
+		s := fbInlineSize(t[i])
+		size = (size + s - 1) / s * s
+		at[i] = size
+		size += s
+	}
+
+	b.pad(2)
+	vtable := len(b.buf)
+	b.buf = binary.LittleEndian.AppendUint16(b.buf, uint16(4+2*n))
+	b.buf = binary.LittleEndian.AppendUint16(b.buf, uint16(size))
+	for _, offset := range at {
+		b.buf = binary.LittleEndian.AppendUint16(b.buf, uint16(offset))
+	}
+	b.pad(8)
+	start := len(b.buf)
+	b.buf = append(b.buf, make([]byte, size)...)
+	binary.LittleEndian.PutUint32(b.buf[start:], uint32(start-vtable))
+
+	for i := 0; i < n; i++ {
+		field := start + at[i]
+		switch v := t[i].(type) {
+		case nil:
+		case uint8:
+			b.buf[field] = v
+		case bool:
+			if v {
+				b.buf[field] = 1
+			}
+		case uint16:
+			binary.LittleEndian.PutUint16(b.buf[field:], v)
+		case int32:
+			binary.LittleEndian.PutUint32(b.buf[field:], uint32(v))
+		case uint64:
+			binary.LittleEndian.PutUint64(b.buf[field:], v)
+		default:
+			pos := b.object(v)
+			binary.LittleEndian.PutUint32(b.buf[field:], uint32(pos-field))
+		}
+	}
+	return start
+}
+
+// object writes a string, vector or table, returning where it starts
+func (b *fbBuilder) object(v any) int {
+	switch v := v.(type) {
+	case fbTable:
+		return b.table(v)
+	case string:
+		b.pad(4)
+		pos := len(b.buf)
+		b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(v)))
+		b.buf = append(append(b.buf, v...), 0)
+		return pos
+	case []byte:
+		b.pad(4)
+		pos := len(b.buf)
+		b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(v)))
+		b.buf = append(b.buf, v...)
+		return pos
+	case []float64:
+		for (len(b.buf)+4)%8 != 0 {
+			b.buf = append(b.buf, 0)
+		}
+		pos := len(b.buf)
+		b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(v)))
+		for _, f := range v {
+			b.buf = binary.LittleEndian.AppendUint64(b.buf, math.Float64bits(f))
+		}
+		return pos
+	case []fbTable:
+		b.pad(4)
+		pos := len(b.buf)
+		b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(v)))
+		b.buf = append(b.buf, make([]byte, 4*len(v))...)
+		for i, t := range v {
+			slot := pos + 4 + 4*i
+			table := b.table(t) // before indexing b.buf, which it may move
+			binary.LittleEndian.PutUint32(b.buf[slot:], uint32(table-slot))
+		}
+		return pos
+	}
+	panic("unsupported flatbuffers field")
+}
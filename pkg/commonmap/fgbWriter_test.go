@@ -0,0 +1,366 @@
+package commonmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeFootprints writes the frames of each series through an index format
+func writeFootprints(t *testing.T, format IndexFormat, series map[string][]Box) {
+	t.Helper()
+	for seriesCode, boxes := range series {
+		w := format.NewWriter()
+		if err := w.Open(seriesCode); err != nil {
+			t.Fatal(err)
+		}
+		for i, box := range boxes {
+			if err := w.WriteBox(RpfBox{frameLocation(seriesCode, i), box}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := range boxes {
+			if err := w.WriteAttributes(NewFrameAttributes(frameLocation(seriesCode, i), nil)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := format.Finish(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fbView reads a flatbuffers table, independently of fbBuilder
+type fbView struct {
+	buf         []byte
+	pos, vtable int
+}
+
+func fbRoot(buf []byte) fbView {
+	return fbAt(buf, int(binary.LittleEndian.Uint32(buf)))
+}
+
+func fbAt(buf []byte, pos int) fbView {
+	return fbView{buf, pos, pos - int(int32(binary.LittleEndian.Uint32(buf[pos:])))}
+}
+
+// field is where a field is stored, 0 when absent
+func (v fbView) field(id int) int {
+	if 4+2*id >= int(binary.LittleEndian.Uint16(v.buf[v.vtable:])) {
+		return 0
+	}
+	if offset := int(binary.LittleEndian.Uint16(v.buf[v.vtable+4+2*id:])); offset != 0 {
+		return v.pos + offset
+	}
+	return 0
+}
+
+func (v fbView) uint8(id int) uint8 {
+	if at := v.field(id); at != 0 {
+		return v.buf[at]
+	}
+	return 0
+}
+
+func (v fbView) uint16(id int) uint16 {
+	if at := v.field(id); at != 0 {
+		return binary.LittleEndian.Uint16(v.buf[at:])
+	}
+	return 0
+}
+
+func (v fbView) int32(id int) int32 {
+	if at := v.field(id); at != 0 {
+		return int32(binary.LittleEndian.Uint32(v.buf[at:]))
+	}
+	return 0
+}
+
+func (v fbView) uint64(id int) uint64 {
+	if at := v.field(id); at != 0 {
+		return binary.LittleEndian.Uint64(v.buf[at:])
+	}
+	return 0
+}
+
+// vector returns the length of a vector field and where its elements start
+func (v fbView) vector(id int) (int, int) {
+	at := v.field(id)
+	if at == 0 {
+		return 0, 0
+	}
+	at += int(binary.LittleEndian.Uint32(v.buf[at:]))
+	return int(binary.LittleEndian.Uint32(v.buf[at:])), at + 4
+}
+
+func (v fbView) bytes(id int) []byte {
+	n, at := v.vector(id)
+	return v.buf[at : at+n]
+}
+
+func (v fbView) string(id int) string {
+	return string(v.bytes(id))
+}
+
+func (v fbView) float64s(id int) []float64 {
+	n, at := v.vector(id)
+	values := make([]float64, n)
+	for i := range values {
+		values[i] = math.Float64frombits(binary.LittleEndian.Uint64(v.buf[at+8*i:]))
+	}
+	return values
+}
+
+func (v fbView) table(id int) fbView {
+	at := v.field(id)
+	return fbAt(v.buf, at+int(binary.LittleEndian.Uint32(v.buf[at:])))
+}
+
+func (v fbView) tables(id int) []fbView {
+	n, at := v.vector(id)
+	tables := make([]fbView, n)
+	for i := range tables {
+		slot := at + 4*i
+		tables[i] = fbAt(v.buf, slot+int(binary.LittleEndian.Uint32(v.buf[slot:])))
+	}
+	return tables
+}
+
+type fgbColumn struct {
+	name  string
+	kind  uint8
+	width int32
+}
+
+// fgbProperties decodes a feature's properties by the header's column types
+func fgbProperties(t *testing.T, data []byte, columns []fgbColumn) map[string]any {
+	t.Helper()
+	properties := make(map[string]any)
+	for len(data) > 0 {
+		i := int(binary.LittleEndian.Uint16(data))
+		if i >= len(columns) {
+			t.Fatalf("property of column %d", i)
+		}
+		data = data[2:]
+		switch columns[i].kind {
+		case fgbLong:
+			properties[columns[i].name] = int64(binary.LittleEndian.Uint64(data))
+			data = data[8:]
+		case fgbString, fgbDateTime:
+			n := int(binary.LittleEndian.Uint32(data))
+			properties[columns[i].name] = string(data[4 : 4+n])
+			data = data[4+n:]
+		default:
+			t.Fatalf("column %s of type %d", columns[i].name, columns[i].kind)
+		}
+	}
+	return properties
+}
+
+// wantProperties is what the attribute columns hold for a frame, nulls left out
+func wantProperties(location string) map[string]any {
+	attributes := NewFrameAttributes(location, nil)
+	want := make(map[string]any)
+	for _, c := range attributeColumns {
+		if v := c.value(&attributes); v != nil {
+			want[c.name] = v
+		}
+	}
+	return want
+}
+
+func TestFlatGeobufReadBack(t *testing.T) {
+	tests := []struct {
+		name         string
+		jg, on       int
+		levels       int // of the index, leaves included
+		wantNodeSize uint16
+	}{
+		{"empty", 0, 0, 0, 0},
+		{"one frame", 1, 0, 2, fgbNodeSize},
+		{"one node", 10, 5, 2, fgbNodeSize},
+		{"four levels", 400, 100, 4, fgbNodeSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			series := map[string][]Box{}
+			var all []Box
+			if tt.jg > 0 {
+				series["JG"] = qixHoldings("JG", tt.jg, 4, 5)
+				all = append(all, series["JG"]...)
+			}
+			if tt.on > 0 {
+				series["ON"] = qixHoldings("ON", tt.on, 1, 6)
+				all = append(all, series["ON"]...)
+			}
+			path := filepath.Join(t.TempDir(), "index.fgb")
+			f, err := CreateFlatGeobuf(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeFootprints(t, f, series)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(data[:8], fgbMagic) {
+				t.Fatalf("file starts with %x", data[:8])
+			}
+			headerSize := int(binary.LittleEndian.Uint32(data[8:]))
+			header := fbRoot(data[12 : 12+headerSize])
+			if header.string(0) != "frames" || header.uint8(2) != fgbPolygon || header.string(11) != "RPF frame footprints" {
+				t.Fatalf("header names %q of geometry %d titled %q", header.string(0), header.uint8(2), header.string(11))
+			}
+			if crs := header.table(10); crs.string(0) != "EPSG" || crs.int32(1) != 4326 {
+				t.Fatalf("header CRS is %s:%d", crs.string(0), crs.int32(1))
+			}
+			count, nodeSize := int(header.uint64(8)), header.uint16(9)
+			if count != len(all) || nodeSize != tt.wantNodeSize {
+				t.Fatalf("header counts %d features with nodes of %d, want %d and %d", count, nodeSize, len(all), tt.wantNodeSize)
+			}
+			envelope := header.float64s(1)
+			if len(all) == 0 {
+				if len(envelope) != 0 {
+					t.Fatalf("empty file with the envelope %v", envelope)
+				}
+			} else if extent := extentOf(all); len(envelope) != 4 || Box(envelope) != extent {
+				t.Fatalf("envelope is %v, want %v", envelope, extent)
+			}
+
+			var columns []fgbColumn
+			for _, c := range header.tables(7) {
+				columns = append(columns, fgbColumn{c.string(0), c.uint8(1), c.int32(4)})
+			}
+			if len(columns) != len(attributeColumns) {
+				t.Fatalf("header has %d columns, want %d", len(columns), len(attributeColumns))
+			}
+			for i, c := range attributeColumns {
+				kind := uint8(fgbString)
+				switch c.kind {
+				case integerAttribute:
+					kind = fgbLong
+				case dateAttribute:
+					kind = fgbDateTime
+				}
+				if columns[i] != (fgbColumn{c.name, kind, int32(c.width)}) {
+					t.Fatalf("column %d is %+v, want %s of type %d and width %d", i, columns[i], c.name, kind, c.width)
+				}
+			}
+
+			// the packed tree, root first, each level sized as FlatGeobuf readers expect
+			var levels []int // nodes per level, leaves first
+			if nodeSize > 0 {
+				for n := count; ; {
+					levels = append(levels, n)
+					if n == 1 && len(levels) > 1 {
+						break
+					}
+					n = (n + int(nodeSize) - 1) / int(nodeSize)
+				}
+			}
+			if len(levels) != tt.levels {
+				t.Fatalf("index of %d levels, want %d", len(levels), tt.levels)
+			}
+			total := 0
+			for _, n := range levels {
+				total += n
+			}
+			indexStart := 12 + headerSize
+			featuresStart := indexStart + 40*total
+			node := func(i int) (Box, uint64) {
+				item := data[indexStart+40*i:]
+				var box Box
+				for j := range box {
+					box[j] = math.Float64frombits(binary.LittleEndian.Uint64(item[8*j:]))
+				}
+				return box, binary.LittleEndian.Uint64(item[32:])
+			}
+			// where each level starts, after the levels above it
+			starts := make([]int, len(levels))
+			for i := range levels {
+				for _, n := range levels[i+1:] {
+					starts[i] += n
+				}
+			}
+
+			seen := make(map[string]int)
+			var walk func(i, level int, within Box)
+			walk = func(i, level int, within Box) {
+				box, offset := node(i)
+				if box[MinX] < within[MinX] || box[MinY] < within[MinY] || box[MaxX] > within[MaxX] || box[MaxY] > within[MaxY] {
+					t.Fatalf("node %d box %v outside its parent's %v", i, box, within)
+				}
+				if level > 0 {
+					first := int(offset)
+					end := min(first+int(nodeSize), starts[level-1]+levels[level-1])
+					if first < starts[level-1] || first >= end {
+						t.Fatalf("node %d points at %d, outside level %d", i, first, level-1)
+					}
+					for child := first; child < end; child++ {
+						walk(child, level-1, box)
+					}
+					return
+				}
+
+				at := featuresStart + int(offset)
+				size := int(binary.LittleEndian.Uint32(data[at:]))
+				feature := fbRoot(data[at+4 : at+4+size])
+				xy := feature.table(0).float64s(1)
+				wantXY := []float64{box[0], box[1], box[2], box[1], box[2], box[3], box[0], box[3], box[0], box[1]}
+				if len(xy) != len(wantXY) {
+					t.Fatalf("feature at %d has the ring %v", offset, xy)
+				}
+				for j := range xy {
+					if xy[j] != wantXY[j] {
+						t.Fatalf("feature at %d has the ring %v, want %v", offset, xy, wantXY)
+					}
+				}
+				properties := fgbProperties(t, feature.bytes(1), columns)
+				location, _ := properties["location"].(string)
+				want := wantProperties(location)
+				if len(properties) != len(want) {
+					t.Fatalf("feature at %d holds %v, want %v", offset, properties, want)
+				}
+				for name, v := range want {
+					if properties[name] != v {
+						t.Fatalf("feature at %d holds %v, want %v", offset, properties, want)
+					}
+				}
+				seen[location]++
+			}
+			if len(levels) > 0 {
+				walk(0, len(levels)-1, Box{math.Inf(-1), math.Inf(-1), math.Inf(1), math.Inf(1)})
+			}
+
+			// leaves in descending Hilbert order
+			for i := 1; i < count; i++ {
+				previous, _ := node(starts[0] + i - 1)
+				box, _ := node(starts[0] + i)
+				if extent := Box(envelope); hilbertOf(&box, &extent) > hilbertOf(&previous, &extent) {
+					t.Fatalf("leaf %d %v comes after %v, earlier on the Hilbert curve", i, box, previous)
+				}
+			}
+			for seriesCode, boxes := range series {
+				for i := range boxes {
+					if n := seen[frameLocation(seriesCode, i)]; n != 1 {
+						t.Fatalf("%s is in the index %d times", frameLocation(seriesCode, i), n)
+					}
+				}
+			}
+			end := featuresStart
+			for range count {
+				end += 4 + int(binary.LittleEndian.Uint32(data[end:]))
+			}
+			if end != len(data) {
+				t.Fatalf("features end at %d of %d bytes", end, len(data))
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package commonmap
+
+import (
+	"container/list"
+	"io"
+	"sync"
+
+	"cm/pkg/archive"
+)
+
+// frameCache keeps recently decoded frames, evicting the least recently used
+type frameCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List // front is most recently used
+}
+
+type frameCacheEntry struct {
+	key   string
+	value any
+}
+
+func newFrameCache(capacity int) *frameCache {
+	return &frameCache{capacity: capacity, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// get a cached frame, loading it on a miss
+func (c *frameCache) get(key string, load func() (any, error)) (any, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		c.order.MoveToFront(e)
+		c.mu.Unlock()
+		return e.Value.(*frameCacheEntry).value, nil
+	}
+	c.mu.Unlock()
+
+	// decode outside the lock, a duplicate load of the same frame is harmless
+	value, err := load()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*frameCacheEntry).value, nil
+	}
+	c.entries[key] = c.order.PushFront(&frameCacheEntry{key, value})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*frameCacheEntry).key)
+	}
+	return value, nil
+}
+
+// clear forgets every frame, the files they came from may have changed
+func (c *frameCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+}
+
+// loadFrame opens a frame file, on disk or held in an archive, and decodes it
+func loadFrame(location string, decode func(r io.ReaderAt) (any, error)) (any, error) {
+	f, err := archive.Open(location)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	return decode(f)
+}
@@ -363,15 +363,3 @@ func processAvailableRecords(path string, ch chan *USN_RECORD, folders map[DWORD
 		}
 	}
 }
-
-type PathEvent struct {
-	Path  string
-	Flags uint32
-	Eid   uint64
-}
-
-//func WatchPaths(paths []string, eid int64) chan []PathEvent {
-//}
-
-//func Unwatch(ch chan []PathEvent) {
-//}
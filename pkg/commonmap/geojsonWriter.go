@@ -0,0 +1,103 @@
+package commonmap
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+)
+
+// This file writes the frame footprints as GeoJSON, a FeatureCollection or one
+// feature per line, for scripts that would rather not parse shapefiles.
+
+// GeoJSONWriter writes the features of every series as their attributes arrive
+type GeoJSONWriter struct {
+	file      *os.File
+	w         *bufio.Writer
+	delimited bool // newline-delimited GeoJSON, no collection around the features
+	n         int
+	err       error
+}
+
+type geojsonFeature struct {
+	Type       string         `json:"type"`
+	ID         int            `json:"id"`
+	Bbox       [4]float64     `json:"bbox"`
+	Geometry   geojsonPolygon `json:"geometry"`
+	Properties map[string]any `json:"properties"`
+}
+
+type geojsonPolygon struct {
+	Type        string         `json:"type"`
+	Coordinates [][][2]float64 `json:"coordinates"`
+}
+
+// CreateGeoJSON starts a GeoJSON file at path, newline-delimited when delimited is set
+func CreateGeoJSON(path string, delimited bool) (*GeoJSONWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	g := &GeoJSONWriter{file: file, w: bufio.NewWriterSize(file, 65536), delimited: delimited}
+	if !delimited {
+		_, g.err = g.w.WriteString(`{"type":"FeatureCollection","features":[` + "\n")
+	}
+	return g, nil
+}
+
+// NewWriter returns a writer adding the features of a series
+func (g *GeoJSONWriter) NewWriter() IndexWriter {
+	return &footprintWriter{add: g.add}
+}
+
+// add writes the feature of a frame
+func (g *GeoJSONWriter) add(seriesCode string, frame footprint) error {
+	if g.err != nil {
+		return g.err
+	}
+	b := frame.box
+	feature := geojsonFeature{
+		Type: "Feature",
+		ID:   g.n + 1,
+		Bbox: b,
+		// counterclockwise, as RFC 7946 has exterior rings
+		Geometry:   geojsonPolygon{"Polygon", [][][2]float64{{{b[0], b[1]}, {b[2], b[1]}, {b[2], b[3]}, {b[0], b[3]}, {b[0], b[1]}}}},
+		Properties: make(map[string]any, len(attributeColumns)),
+	}
+	for _, c := range attributeColumns {
+		feature.Properties[c.name] = c.value(&frame.attributes)
+	}
+	line, err := json.Marshal(feature)
+	if err != nil {
+		return err
+	}
+	switch {
+	case g.delimited:
+		line = append(line, '\n')
+	case g.n > 0:
+		if _, g.err = g.w.WriteString(",\n"); g.err != nil {
+			return g.err
+		}
+	}
+	_, g.err = g.w.Write(line)
+	g.n++
+	return g.err
+}
+
+// Finish ends the collection and the file
+func (g *GeoJSONWriter) Finish() error {
+	if !g.delimited && g.err == nil {
+		if g.n > 0 {
+			g.err = g.w.WriteByte('\n')
+		}
+		if g.err == nil {
+			_, g.err = g.w.WriteString("]}\n")
+		}
+	}
+	if g.err == nil {
+		g.err = g.w.Flush()
+	}
+	if err := g.file.Close(); g.err == nil {
+		g.err = err
+	}
+	return g.err
+}
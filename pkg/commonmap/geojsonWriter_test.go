@@ -0,0 +1,114 @@
+package commonmap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// checkFeatures checks the features read back against the frames written, matched by location
+func checkFeatures(t *testing.T, features []geojsonFeature, series map[string][]Box) {
+	t.Helper()
+	boxes := make(map[string]Box)
+	for seriesCode, frames := range series {
+		for i, box := range frames {
+			boxes[frameLocation(seriesCode, i)] = box
+		}
+	}
+	if len(features) != len(boxes) {
+		t.Fatalf("read %d features, want %d", len(features), len(boxes))
+	}
+	for i, feature := range features {
+		location, _ := feature.Properties["location"].(string)
+		box, ok := boxes[location]
+		if !ok {
+			t.Fatalf("feature %d is at %q, written once at most", i, location)
+		}
+		delete(boxes, location)
+		if feature.Type != "Feature" || feature.ID != i+1 || feature.Bbox != box {
+			t.Fatalf("feature %d is a %s of id %d in %v, want a Feature of id %d in %v", i, feature.Type, feature.ID, feature.Bbox, i+1, box)
+		}
+		ring := [][2]float64{{box[0], box[1]}, {box[2], box[1]}, {box[2], box[3]}, {box[0], box[3]}, {box[0], box[1]}}
+		g := feature.Geometry
+		if g.Type != "Polygon" || len(g.Coordinates) != 1 || len(g.Coordinates[0]) != len(ring) {
+			t.Fatalf("feature %d has the geometry %+v", i, g)
+		}
+		for j := range ring {
+			if g.Coordinates[0][j] != ring[j] {
+				t.Fatalf("feature %d has the ring %v, want %v", i, g.Coordinates[0], ring)
+			}
+		}
+
+		attributes := NewFrameAttributes(location, nil)
+		if len(feature.Properties) != len(attributeColumns) {
+			t.Fatalf("feature %d holds %v", i, feature.Properties)
+		}
+		for _, c := range attributeColumns {
+			want := c.value(&attributes)
+			if v, ok := want.(int64); ok {
+				want = float64(v) // as JSON numbers decode
+			}
+			if got, ok := feature.Properties[c.name]; !ok || got != want {
+				t.Fatalf("feature %d has %s %v, want %v", i, c.name, got, want)
+			}
+		}
+	}
+}
+
+func TestGeoJSONReadBack(t *testing.T) {
+	tests := []struct {
+		name   string
+		series map[string][]Box
+	}{
+		{"empty", map[string][]Box{}},
+		{"one frame", map[string][]Box{"JG": qixHoldings("JG", 1, 1, 5)}},
+		{"two series", map[string][]Box{"JG": qixHoldings("JG", 40, 4, 5), "ON": qixHoldings("ON", 3, 1, 6)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, delimited := range []bool{false, true} {
+				path := filepath.Join(t.TempDir(), "index.geojson")
+				g, err := CreateGeoJSON(path, delimited)
+				if err != nil {
+					t.Fatal(err)
+				}
+				writeFootprints(t, g, tt.series)
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var features []geojsonFeature
+				if delimited {
+					scanner := bufio.NewScanner(bytes.NewReader(data))
+					for scanner.Scan() {
+						var feature geojsonFeature
+						if err := json.Unmarshal(scanner.Bytes(), &feature); err != nil {
+							t.Fatalf("NDJSON line %d: %v", len(features)+1, err)
+						}
+						features = append(features, feature)
+					}
+					if err := scanner.Err(); err != nil {
+						t.Fatal(err)
+					}
+				} else {
+					var collection struct {
+						Type     string           `json:"type"`
+						Features []geojsonFeature `json:"features"`
+					}
+					if err := json.Unmarshal(data, &collection); err != nil {
+						t.Fatalf("GeoJSON: %v in %s", err, data)
+					}
+					if collection.Type != "FeatureCollection" || collection.Features == nil {
+						t.Fatalf("GeoJSON is a %s of %v", collection.Type, collection.Features)
+					}
+					features = collection.Features
+				}
+				checkFeatures(t, features, tt.series)
+			}
+		})
+	}
+}
@@ -0,0 +1,425 @@
+package commonmap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"cm/pkg/rpf"
+)
+
+// This file writes the series indexes as a GeoPackage, one SQLite file holding a
+// feature table per series with the attributes of the DBF and an R-tree index, for
+// GIS users who would rather not carry a directory of shapefiles around.
+
+const (
+	gpkgApplicationID = 0x47504b47 // "GPKG"
+	gpkgUserVersion   = 10300      // GeoPackage 1.3
+	gpkgSRS           = 4326
+	gpkgGeometry      = "geom"
+
+	// rtreeNodeSize is the size SQLite gives the nodes of new r-trees
+	rtreeNodeSize = sqlitePageSize - 64
+	rtreeFanout   = (rtreeNodeSize - 4) / 24
+)
+
+const wgs84WKT = `GEOGCS["WGS 84",DATUM["WGS_1984",SPHEROID["WGS 84",6378137,298.257223563,AUTHORITY["EPSG","7030"]],` +
+	`AUTHORITY["EPSG","6326"]],PRIMEM["Greenwich",0,AUTHORITY["EPSG","8901"]],` +
+	`UNIT["degree",0.0174532925199433,AUTHORITY["EPSG","9122"]],AUTHORITY["EPSG","4326"]]`
+
+// GpkgWriter collects the frames of every series, the GeoPackage is written once
+// they are all closed
+type GpkgWriter struct {
+	db     *sqliteWriter
+	series map[string]*gpkgSeries
+}
+
+type gpkgSeries struct {
+	frames []footprint
+	bbox   Box
+}
+
+// CreateGeoPackage starts a GeoPackage at path, replacing any file there
+func CreateGeoPackage(path string) (*GpkgWriter, error) {
+	db, err := createSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+	return &GpkgWriter{db: db, series: make(map[string]*gpkgSeries)}, nil
+}
+
+// NewWriter returns a writer adding a series to the GeoPackage
+func (g *GpkgWriter) NewWriter() IndexWriter {
+	return &footprintWriter{add: g.add}
+}
+
+func (g *GpkgWriter) add(seriesCode string, frame footprint) error {
+	s := g.series[seriesCode]
+	if s == nil {
+		s = &gpkgSeries{bbox: frame.box}
+		g.series[seriesCode] = s
+	}
+	extendBbox(&s.bbox, &frame.box)
+	s.frames = append(s.frames, frame)
+	return nil
+}
+
+// Finish writes the GeoPackage
+func (g *GpkgWriter) Finish() error {
+	db := g.db
+	seriesCodes := make([]string, 0, len(g.series))
+	for seriesCode := range g.series {
+		seriesCodes = append(seriesCodes, seriesCode)
+	}
+	sort.Strings(seriesCodes)
+	if err := g.writeMetadata(seriesCodes); err != nil {
+		_ = db.file.Close()
+		return err
+	}
+	var sequence [][]any
+	for _, seriesCode := range seriesCodes {
+		if err := g.writeSeries(seriesCode); err != nil {
+			_ = db.file.Close()
+			return fmt.Errorf("writing %s to %s: %w", seriesCode, db.file.Name(), err)
+		}
+		sequence = append(sequence, []any{seriesCode, int64(len(g.series[seriesCode].frames))})
+	}
+	if err := g.writeTable("sqlite_sequence", "CREATE TABLE sqlite_sequence(name,seq)", sequence); err != nil {
+		_ = db.file.Close()
+		return err
+	}
+	return db.close(gpkgUserVersion, gpkgApplicationID)
+}
+
+// writeTable writes a small table, rows numbered from 1
+func (g *GpkgWriter) writeTable(name, sql string, rows [][]any) error {
+	t := g.db.newTable()
+	for i, row := range rows {
+		if err := t.add(int64(i+1), row...); err != nil {
+			return err
+		}
+	}
+	root, err := t.finish(0)
+	g.db.addSchema("table", name, name, root, sql)
+	return err
+}
+
+// writeAutoindex writes the index SQLite keeps for a UNIQUE or PRIMARY KEY constraint,
+// the constraint counted from 1 in table order
+func (g *GpkgWriter) writeAutoindex(table string, constraint int, rows [][]any, columns ...int) error {
+	keys := make([][]any, len(rows))
+	for i, row := range rows {
+		for _, c := range columns {
+			keys[i] = append(keys[i], row[c])
+		}
+		keys[i] = append(keys[i], int64(i+1))
+	}
+	root, err := g.db.writeIndex(keys)
+	g.db.addSchema("index", fmt.Sprintf("sqlite_autoindex_%s_%d", table, constraint), table, root, nil)
+	return err
+}
+
+// writeMetadata writes the tables the GeoPackage specification requires
+func (g *GpkgWriter) writeMetadata(seriesCodes []string) error {
+	srs := [][]any{
+		{"Undefined cartesian SRS", nil, "NONE", int64(-1), "undefined", "undefined cartesian coordinate reference system"},
+		{"Undefined geographic SRS", nil, "NONE", int64(0), "undefined", "undefined geographic coordinate reference system"},
+		{"WGS 84 geodetic", nil, "EPSG", int64(gpkgSRS), wgs84WKT, "longitude/latitude coordinates in decimal degrees on the WGS 84 spheroid"},
+	}
+	t := g.db.newTable()
+	for _, row := range srs { // srs_id is the rowid
+		if err := t.add(row[3].(int64), row...); err != nil {
+			return err
+		}
+	}
+	root, err := t.finish(0)
+	if err != nil {
+		return err
+	}
+	g.db.addSchema("table", "gpkg_spatial_ref_sys", "gpkg_spatial_ref_sys", root,
+		"CREATE TABLE gpkg_spatial_ref_sys (srs_name TEXT NOT NULL, srs_id INTEGER NOT NULL PRIMARY KEY, "+
+			"organization TEXT NOT NULL, organization_coordsys_id INTEGER NOT NULL, definition TEXT NOT NULL, description TEXT)")
+
+	lastChange := time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+	var contents, geometryColumns, extensions [][]any
+	for _, seriesCode := range seriesCodes {
+		s := g.series[seriesCode]
+		identifier, description := seriesCode, ""
+		if series, ok := rpf.DataSeries[seriesCode]; ok {
+			identifier = seriesCode + " " + series.Name
+			description = series.ScaleText + " frames of the " + series.Name + " series"
+		}
+		contents = append(contents, []any{seriesCode, "features", identifier, description, lastChange,
+			s.bbox[0], s.bbox[1], s.bbox[2], s.bbox[3], int64(gpkgSRS)})
+		geometryColumns = append(geometryColumns, []any{seriesCode, gpkgGeometry, "POLYGON", int64(gpkgSRS), int64(0), int64(0)})
+		extensions = append(extensions, []any{seriesCode, gpkgGeometry, "gpkg_rtree_index",
+			"http://www.geopackage.org/spec120/#extension_rtree", "write-only"})
+	}
+
+	if err := g.writeTable("gpkg_contents",
+		"CREATE TABLE gpkg_contents (table_name TEXT NOT NULL PRIMARY KEY, data_type TEXT NOT NULL, "+
+			"identifier TEXT UNIQUE, description TEXT DEFAULT '', "+
+			"last_change DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ','now')), "+
+			"min_x DOUBLE, min_y DOUBLE, max_x DOUBLE, max_y DOUBLE, srs_id INTEGER, "+
+			"CONSTRAINT fk_gc_r_srs_id FOREIGN KEY (srs_id) REFERENCES gpkg_spatial_ref_sys(srs_id))", contents); err != nil {
+		return err
+	}
+	if err := g.writeAutoindex("gpkg_contents", 1, contents, 0); err != nil {
+		return err
+	}
+	if err := g.writeAutoindex("gpkg_contents", 2, contents, 2); err != nil {
+		return err
+	}
+
+	if err := g.writeTable("gpkg_geometry_columns",
+		"CREATE TABLE gpkg_geometry_columns (table_name TEXT NOT NULL, column_name TEXT NOT NULL, "+
+			"geometry_type_name TEXT NOT NULL, srs_id INTEGER NOT NULL, z TINYINT NOT NULL, m TINYINT NOT NULL, "+
+			"CONSTRAINT pk_geom_cols PRIMARY KEY (table_name, column_name), "+
+			"CONSTRAINT uk_gc_table_name UNIQUE (table_name), "+
+			"CONSTRAINT fk_gc_tn FOREIGN KEY (table_name) REFERENCES gpkg_contents(table_name), "+
+			"CONSTRAINT fk_gc_srs FOREIGN KEY (srs_id) REFERENCES gpkg_spatial_ref_sys (srs_id))", geometryColumns); err != nil {
+		return err
+	}
+	if err := g.writeAutoindex("gpkg_geometry_columns", 1, geometryColumns, 0, 1); err != nil {
+		return err
+	}
+	if err := g.writeAutoindex("gpkg_geometry_columns", 2, geometryColumns, 0); err != nil {
+		return err
+	}
+
+	if err := g.writeTable("gpkg_extensions",
+		"CREATE TABLE gpkg_extensions (table_name TEXT, column_name TEXT, extension_name TEXT NOT NULL, "+
+			"definition TEXT NOT NULL, scope TEXT NOT NULL, "+
+			"CONSTRAINT ge_tce UNIQUE (table_name, column_name, extension_name))", extensions); err != nil {
+		return err
+	}
+	return g.writeAutoindex("gpkg_extensions", 1, extensions, 0, 1, 2)
+}
+
+// writeSeries writes a series' feature table and its r-tree
+func (g *GpkgWriter) writeSeries(seriesCode string) error {
+	s := g.series[seriesCode]
+	columns := []string{`"fid" INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL`, `"` + gpkgGeometry + `" POLYGON`}
+	for _, c := range attributeColumns {
+		columns = append(columns, `"`+c.name+`" `+gpkgType(c))
+	}
+	t := g.db.newTable()
+	entries := make([]rtreeEntry, len(s.frames))
+	for i := range s.frames {
+		frame := &s.frames[i]
+		row := []any{nil, gpkgPolygon(frame.box)}
+		for _, c := range attributeColumns {
+			row = append(row, c.value(&frame.attributes))
+		}
+		fid := int64(i + 1)
+		if err := t.add(fid, row...); err != nil {
+			return err
+		}
+		entries[i] = rtreeEntry{fid, frame.box}
+	}
+	root, err := t.finish(0)
+	if err != nil {
+		return err
+	}
+	g.db.addSchema("table", seriesCode, seriesCode, root,
+		fmt.Sprintf(`CREATE TABLE "%s" (%s)`, seriesCode, strings.Join(columns, ", ")))
+	return g.writeRtree(seriesCode, entries)
+}
+
+// gpkgType declares an attribute column
+func gpkgType(c attributeColumn) string {
+	switch {
+	case c.kind == integerAttribute:
+		return "INTEGER"
+	case c.kind == dateAttribute:
+		return "DATE"
+	case c.width > 0:
+		return fmt.Sprintf("TEXT(%d)", c.width)
+	}
+	return "TEXT"
+}
+
+// gpkgPolygon encodes a box as a GeoPackage geometry: the GP header with its envelope,
+// then the WKB polygon, little endian throughout
+func gpkgPolygon(box Box) []byte {
+	minX, minY, maxX, maxY := box[0], box[1], box[2], box[3]
+	b := []byte{'G', 'P', 0, 0x03} // version 1, xy envelope, little endian
+	b = binary.LittleEndian.AppendUint32(b, gpkgSRS)
+	for _, v := range []float64{minX, maxX, minY, maxY} {
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+	}
+	b = append(b, 1)                           // little endian
+	b = binary.LittleEndian.AppendUint32(b, 3) // polygon
+	b = binary.LittleEndian.AppendUint32(b, 1) // one ring
+	b = binary.LittleEndian.AppendUint32(b, 5)
+	for _, p := range [][2]float64{{minX, minY}, {maxX, minY}, {maxX, maxY}, {minX, maxY}, {minX, minY}} {
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(p[0]))
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(p[1]))
+	}
+	return b
+}
+
+// rtreeEntry is a cell of an r-tree node: a feature, or a child node with the box of its cells
+type rtreeEntry struct {
+	id  int64
+	box Box
+}
+
+// rtreeNode is numbered once the tree is packed, the root being node 1
+type rtreeNode struct {
+	no    int64
+	cells []rtreeEntry // ids of the level below index the nodes there
+	box   Box
+}
+
+// packRtree tiles entries into full nodes, sorted into vertical slices by x then by y
+// within each slice, so sibling nodes overlap little
+func packRtree(entries []rtreeEntry) []*rtreeNode {
+	if len(entries) == 0 {
+		return []*rtreeNode{{}}
+	}
+	center := func(e rtreeEntry, axis int) float64 { return e.box[axis] + e.box[axis+2] }
+	sort.SliceStable(entries, func(i, j int) bool { return center(entries[i], 0) < center(entries[j], 0) })
+	nodes := (len(entries) + rtreeFanout - 1) / rtreeFanout
+	slices := int(math.Ceil(math.Sqrt(float64(nodes))))
+	perSlice := slices * rtreeFanout
+	var packed []*rtreeNode
+	for start := 0; start < len(entries); start += perSlice {
+		slice := entries[start:min(start+perSlice, len(entries))]
+		sort.SliceStable(slice, func(i, j int) bool { return center(slice[i], 1) < center(slice[j], 1) })
+		for n := 0; n < len(slice); n += rtreeFanout {
+			node := &rtreeNode{cells: slice[n:min(n+rtreeFanout, len(slice))]}
+			node.box = node.cells[0].box
+			for _, c := range node.cells[1:] {
+				extendBbox(&node.box, &c.box)
+			}
+			packed = append(packed, node)
+		}
+	}
+	return packed
+}
+
+// writeRtree writes the virtual table of the rtree extension, its shadow tables packed
+// as SQLite would read them, and the triggers keeping it in step with the features
+func (g *GpkgWriter) writeRtree(table string, features []rtreeEntry) error {
+	name := "rtree_" + table + "_" + gpkgGeometry
+	rowids := make([][2]int64, 0, len(features))
+
+	levels := [][]*rtreeNode{packRtree(features)}
+	for top := levels[0]; len(top) > 1; top = levels[len(levels)-1] {
+		entries := make([]rtreeEntry, len(top))
+		for i, node := range top {
+			entries[i] = rtreeEntry{int64(i), node.box}
+		}
+		levels = append(levels, packRtree(entries))
+	}
+	no := int64(1)
+	for l := len(levels) - 1; l >= 0; l-- {
+		for _, node := range levels[l] {
+			node.no = no
+			no++
+		}
+	}
+
+	nodes := g.db.newTable()
+	var parents [][2]int64
+	for l := len(levels) - 1; l >= 0; l-- {
+		for _, node := range levels[l] {
+			data := make([]byte, 4, rtreeNodeSize)
+			if node.no == 1 {
+				binary.BigEndian.PutUint16(data, uint16(len(levels)-1)) // depth of the tree
+			}
+			binary.BigEndian.PutUint16(data[2:], uint16(len(node.cells)))
+			for _, c := range node.cells {
+				id := c.id
+				if l > 0 {
+					id = levels[l-1][c.id].no
+					parents = append(parents, [2]int64{id, node.no})
+				} else {
+					rowids = append(rowids, [2]int64{id, node.no})
+				}
+				data = binary.BigEndian.AppendUint64(data, uint64(id))
+				for _, v := range []float32{float32Down(c.box[0]), float32Up(c.box[2]), float32Down(c.box[1]), float32Up(c.box[3])} {
+					data = binary.BigEndian.AppendUint32(data, math.Float32bits(v))
+				}
+			}
+			data = data[:rtreeNodeSize]
+			if err := nodes.add(node.no, nil, data); err != nil {
+				return err
+			}
+		}
+	}
+	root, err := nodes.finish(0)
+	if err != nil {
+		return err
+	}
+
+	g.db.addSchema("table", name, name, 0, fmt.Sprintf(`CREATE VIRTUAL TABLE "%s" USING rtree(id, minx, maxx, miny, maxy)`, name))
+	g.db.addSchema("table", name+"_node", name+"_node", root, fmt.Sprintf(`CREATE TABLE "%s_node"(nodeno INTEGER PRIMARY KEY,data)`, name))
+	for _, shadow := range []struct {
+		suffix, sql string
+		rows        [][2]int64
+	}{
+		{"_rowid", `CREATE TABLE "%s_rowid"(rowid INTEGER PRIMARY KEY,nodeno)`, rowids},
+		{"_parent", `CREATE TABLE "%s_parent"(nodeno INTEGER PRIMARY KEY,parentnode)`, parents},
+	} {
+		sort.Slice(shadow.rows, func(i, j int) bool { return shadow.rows[i][0] < shadow.rows[j][0] })
+		t := g.db.newTable()
+		for _, row := range shadow.rows {
+			if err := t.add(row[0], nil, row[1]); err != nil {
+				return err
+			}
+		}
+		root, err := t.finish(0)
+		if err != nil {
+			return err
+		}
+		g.db.addSchema("table", name+shadow.suffix, name+shadow.suffix, root, fmt.Sprintf(shadow.sql, name))
+	}
+
+	for _, trigger := range rtreeTriggers {
+		sql := strings.NewReplacer("<t>", `"`+table+`"`, "<c>", `"`+gpkgGeometry+`"`, "<r>", `"`+name+`"`, "<n>", name).Replace(trigger[1])
+		g.db.addSchema("trigger", name+"_"+trigger[0], table, 0, sql)
+	}
+	return nil
+}
+
+// rtreeTriggers are the triggers of the rtree extension; <t> is the table, <c> its
+// geometry column, <r> the r-tree and <n> its bare name
+var rtreeTriggers = [][2]string{
+	{"insert", `CREATE TRIGGER "<n>_insert" AFTER INSERT ON <t> WHEN (new.<c> NOT NULL AND NOT ST_IsEmpty(NEW.<c>)) ` +
+		`BEGIN INSERT OR REPLACE INTO <r> VALUES (NEW."fid", ST_MinX(NEW.<c>), ST_MaxX(NEW.<c>), ST_MinY(NEW.<c>), ST_MaxY(NEW.<c>)); END`},
+	{"update1", `CREATE TRIGGER "<n>_update1" AFTER UPDATE OF <c> ON <t> WHEN OLD."fid" = NEW."fid" AND ` +
+		`(NEW.<c> NOTNULL AND NOT ST_IsEmpty(NEW.<c>)) ` +
+		`BEGIN INSERT OR REPLACE INTO <r> VALUES (NEW."fid", ST_MinX(NEW.<c>), ST_MaxX(NEW.<c>), ST_MinY(NEW.<c>), ST_MaxY(NEW.<c>)); END`},
+	{"update2", `CREATE TRIGGER "<n>_update2" AFTER UPDATE OF <c> ON <t> WHEN OLD."fid" = NEW."fid" AND ` +
+		`(NEW.<c> ISNULL OR ST_IsEmpty(NEW.<c>)) BEGIN DELETE FROM <r> WHERE id = OLD."fid"; END`},
+	{"update3", `CREATE TRIGGER "<n>_update3" AFTER UPDATE ON <t> WHEN OLD."fid" != NEW."fid" AND ` +
+		`(NEW.<c> NOTNULL AND NOT ST_IsEmpty(NEW.<c>)) ` +
+		`BEGIN DELETE FROM <r> WHERE id = OLD."fid"; ` +
+		`INSERT OR REPLACE INTO <r> VALUES (NEW."fid", ST_MinX(NEW.<c>), ST_MaxX(NEW.<c>), ST_MinY(NEW.<c>), ST_MaxY(NEW.<c>)); END`},
+	{"update4", `CREATE TRIGGER "<n>_update4" AFTER UPDATE ON <t> WHEN OLD."fid" != NEW."fid" AND ` +
+		`(NEW.<c> ISNULL OR ST_IsEmpty(NEW.<c>)) BEGIN DELETE FROM <r> WHERE id IN (OLD."fid", NEW."fid"); END`},
+	{"delete", `CREATE TRIGGER "<n>_delete" AFTER DELETE ON <t> WHEN old.<c> NOT NULL ` +
+		`BEGIN DELETE FROM <r> WHERE id = OLD."fid"; END`},
+}
+
+// float32Down and float32Up round r-tree coordinates outward, as SQLite stores them
+func float32Down(v float64) float32 {
+	f := float32(v)
+	if float64(f) > v {
+		f = math.Nextafter32(f, float32(math.Inf(-1)))
+	}
+	return f
+}
+
+func float32Up(v float64) float32 {
+	f := float32(v)
+	if float64(f) < v {
+		f = math.Nextafter32(f, float32(math.Inf(1)))
+	}
+	return f
+}
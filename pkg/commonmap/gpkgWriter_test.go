@@ -0,0 +1,151 @@
+package commonmap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+// writeGeoPackage writes the frames of each series to a new GeoPackage
+func writeGeoPackage(t *testing.T, series map[string][]Box) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "index.gpkg")
+	g, err := CreateGeoPackage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for seriesCode, boxes := range series {
+		w := g.NewWriter()
+		if err := w.Open(seriesCode); err != nil {
+			t.Fatal(err)
+		}
+		for i, box := range boxes {
+			if err := w.WriteBox(RpfBox{frameLocation(seriesCode, i), box}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := range boxes {
+			if err := w.WriteAttributes(NewFrameAttributes(frameLocation(seriesCode, i), nil)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := g.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func frameLocation(seriesCode string, i int) string {
+	return fmt.Sprintf("RPF/%s/%05d010.%s1", seriesCode, i, seriesCode)
+}
+
+func boxContains(outer [4]float32, box Box) bool {
+	return float64(outer[0]) <= box[MinX] && float64(outer[1]) >= box[MaxX] &&
+		float64(outer[2]) <= box[MinY] && float64(outer[3]) >= box[MaxY]
+}
+
+func TestGeoPackageReadBack(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames int
+		depth  int
+	}{
+		{"one frame", 1, 0},
+		{"two levels", 500, 1},
+		{"three levels", 30000, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			boxes := qixHoldings("JG", tt.frames, 4, 5)
+			on := qixHoldings("ON", 3, 1, 6)
+			f := readSQLiteFile(t, writeGeoPackage(t, map[string][]Box{"JG": boxes, "ON": on}))
+			schema := f.schema()
+
+			_, contents := f.tableRows(f.root(schema, "gpkg_contents"))
+			if len(contents) != 2 || contents[0][0] != "JG" || contents[1][0] != "ON" {
+				t.Fatalf("gpkg_contents lists %v, want JG and ON", contents)
+			}
+			extent := extentOf(boxes)
+			for i, v := range contents[0][5:9] {
+				if v != extent[i] {
+					t.Fatalf("JG extent is %v, want %v", contents[0][5:9], extent)
+				}
+			}
+
+			rowids, rows := f.tableRows(f.root(schema, "JG"))
+			if len(rows) != len(boxes) {
+				t.Fatalf("JG holds %d rows, want %d", len(rows), len(boxes))
+			}
+			for i, row := range rows {
+				if rowids[i] != int64(i+1) || row[2] != frameLocation("JG", i) {
+					t.Fatalf("row %d is fid %d at %v, want fid %d at %s", i, rowids[i], row[2], i+1, frameLocation("JG", i))
+				}
+			}
+
+			// walk the r-tree from its root, every fid under a box holding its frame
+			nodeIDs, nodeRows := f.tableRows(f.root(schema, "rtree_JG_geom_node"))
+			nodes := make(map[int64][]byte)
+			for i, row := range nodeRows {
+				nodes[nodeIDs[i]] = row[1].([]byte)
+			}
+			seen := make([]int, len(boxes))
+			var walk func(no int64, depth int, within [4]float32)
+			walk = func(no int64, depth int, within [4]float32) {
+				data, ok := nodes[no]
+				if !ok {
+					t.Fatalf("no r-tree node %d", no)
+				}
+				count := int(binary.BigEndian.Uint16(data[2:]))
+				for c := 0; c < count; c++ {
+					cell := data[4+24*c:]
+					id := int64(binary.BigEndian.Uint64(cell))
+					var box [4]float32
+					for i := range box {
+						box[i] = math.Float32frombits(binary.BigEndian.Uint32(cell[8+4*i:]))
+					}
+					if box[0] < within[0] || box[1] > within[1] || box[2] < within[2] || box[3] > within[3] {
+						t.Fatalf("node %d cell %d box %v outside its parent's %v", no, c, box, within)
+					}
+					if depth > 0 {
+						walk(id, depth-1, box)
+						continue
+					}
+					if id < 1 || int(id) > len(boxes) || !boxContains(box, boxes[id-1]) {
+						t.Fatalf("node %d cell %d holds fid %d in %v", no, c, id, box)
+					}
+					seen[id-1]++
+				}
+			}
+			root := nodes[1]
+			if root == nil {
+				t.Fatal("no r-tree root")
+			}
+			depth := int(binary.BigEndian.Uint16(root))
+			if depth != tt.depth {
+				t.Fatalf("r-tree of depth %d, want %d", depth, tt.depth)
+			}
+			inf := float32(math.Inf(1))
+			walk(1, depth, [4]float32{-inf, inf, -inf, inf})
+			for i, n := range seen {
+				if n != 1 {
+					t.Fatalf("fid %d is in the r-tree %d times", i+1, n)
+				}
+			}
+
+			rowidRows, _ := f.tableRows(f.root(schema, "rtree_JG_geom_rowid"))
+			if len(rowidRows) != len(boxes) {
+				t.Fatalf("rtree_JG_geom_rowid holds %d rows, want %d", len(rowidRows), len(boxes))
+			}
+			parentRows, _ := f.tableRows(f.root(schema, "rtree_JG_geom_parent"))
+			if len(parentRows) != len(nodes)-1 {
+				t.Fatalf("rtree_JG_geom_parent holds %d rows, want %d", len(parentRows), len(nodes)-1)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package commonmap
+
+import (
+	"path/filepath"
+	"strings"
+
+	"cm/pkg/rpf"
+)
+
+// indexedFrame is one record of a series index
+type indexedFrame struct {
+	location string
+	box      Box
+}
+
+// find the frames of a series index intersecting a box
+func (ix *Indexer) findIndexedFrames(seriesCode string, box Box) ([]indexedFrame, error) {
+	ix.lock.RLock()
+	defer ix.lock.RUnlock()
+	index, err := ix.Open(seriesCode)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = index.Close() }()
+	records, err := index.Query(box)
+	if err != nil {
+		return nil, err
+	}
+	found := make([]indexedFrame, 0, len(records))
+	for _, rec := range records {
+		location, err := index.Attribute(rec.ID, "location")
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, indexedFrame{location, rec.Box})
+	}
+	return found, nil
+}
+
+// indexExtent reads the bounding box of a series index from its shapefile header
+func (ix *Indexer) indexExtent(seriesCode string) (Box, error) {
+	ix.lock.RLock()
+	defer ix.lock.RUnlock()
+	index, err := ix.Open(seriesCode)
+	if err != nil {
+		return Box{}, err
+	}
+	defer func() { _ = index.Close() }()
+	return index.Bounds(), nil
+}
+
+// frameBox prefers a frame's own coverage over its indexed, filename-derived box
+func frameBox(h *rpf.FrameHeader, indexed Box) Box {
+	if ok, x1, y1, x2, y2 := h.Bounds(); ok {
+		return Box{x1, y1, x2, y2}
+	}
+	return indexed
+}
+
+// polarFrame returns the grid of a frame in a polar zone, where the frame is square on the
+// grid rather than in longitude and latitude
+func polarFrame(h *rpf.FrameHeader, location string) (*rpf.PolarGrid, int, bool) {
+	info := h.Frame
+	if info == nil {
+		info = rpf.NewFrameInfo(strings.ToUpper(filepath.Base(location)))
+	}
+	if info == nil {
+		return nil, 0, false
+	}
+	grid := rpf.GetPolarGrid(info)
+	return grid, info.FrameNumber, grid != nil
+}
+
+func boxesIntersect(a, b *Box) bool {
+	return a[MinX] <= b[MaxX] && a[MaxX] >= b[MinX] && a[MinY] <= b[MaxY] && a[MaxY] >= b[MinY]
+}
@@ -0,0 +1,381 @@
+package commonmap
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// IndexWriter writes the index of a series in some format. The indexer opens a writer
+// for every series it finds, gives it the boxes of the series' frames, then their
+// attributes in the same order, and closes it.
+type IndexWriter interface {
+	Open(seriesCode string) error
+	WriteBox(r RpfBox) error
+	WriteAttributes(attributes FrameAttributes) error
+	Close() error
+}
+
+// IndexFormat is an output of an indexing run. It hands out a writer for each series
+// and is finished once they are all closed, when formats holding every series in
+// one file write it.
+type IndexFormat interface {
+	NewWriter() IndexWriter
+	Finish() error
+}
+
+// indexFormats open the registered formats by name
+var indexFormats = make(map[string]func(dir, dest string, options IndexOptions) (IndexFormat, error))
+
+// RegisterIndexFormat makes a format available to IndexOptions.Outputs by name. open
+// gets the directory of the run's shapefiles and the destination named with the
+// format, "" for its default.
+func RegisterIndexFormat(name string, open func(dir, dest string, options IndexOptions) (IndexFormat, error)) {
+	indexFormats[name] = open
+}
+
+// IndexFormats lists the registered format names
+func IndexFormats() []string {
+	names := make([]string, 0, len(indexFormats))
+	for name := range indexFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// shapefileFormat is the output the server reads, always written
+const shapefileFormat = "shp"
+
+func init() {
+	RegisterIndexFormat(shapefileFormat, func(dir, dest string, options IndexOptions) (IndexFormat, error) {
+		return &shpFormat{dir: dir, qixDepth: options.QixDepth}, nil
+	})
+	RegisterIndexFormat("gpkg", func(dir, dest string, options IndexOptions) (IndexFormat, error) {
+		return CreateGeoPackage(destOrDefault(dir, dest, "index.gpkg"))
+	})
+	RegisterIndexFormat("fgb", func(dir, dest string, options IndexOptions) (IndexFormat, error) {
+		return CreateFlatGeobuf(destOrDefault(dir, dest, "index.fgb"))
+	})
+	RegisterIndexFormat("geojson", func(dir, dest string, options IndexOptions) (IndexFormat, error) {
+		return CreateGeoJSON(destOrDefault(dir, dest, "index.geojson"), false)
+	})
+	RegisterIndexFormat("ndjson", func(dir, dest string, options IndexOptions) (IndexFormat, error) {
+		return CreateGeoJSON(destOrDefault(dir, dest, "index.ndjson"), true)
+	})
+}
+
+// single file outputs land beside the shapefiles unless told otherwise
+func destOrDefault(dir, dest, fileName string) string {
+	if dest == "" {
+		return filepath.Join(dir, fileName)
+	}
+	return dest
+}
+
+// shpFormat writes a shapefile per series, as mapserv and the lookups read them
+type shpFormat struct {
+	dir      string
+	qixDepth int
+}
+
+func (f *shpFormat) NewWriter() IndexWriter {
+	return &ShpBoxWriter{Dir: f.dir, QixDepth: f.qixDepth}
+}
+
+func (f *shpFormat) Finish() error {
+	return nil
+}
+
+// indexRun is the state of one indexing run: its formats and the writers of each series
+type indexRun struct {
+	ix      *Indexer
+	dir     string // of the shapefiles, the manifest and the history
+	formats []IndexFormat
+	writers map[string][]IndexWriter
+	// allEditions passes every frame on as it comes. Otherwise the boxes of each
+	// series are held until they are all in, to keep only the newest editions.
+	allEditions bool
+	boxes       map[string][]RpfBox
+	keep        map[string][]bool
+	next        map[string]int // attributes seen in each series
+	superseded  int
+	history     *indexRun // every edition, when kept
+}
+
+// newIndexRun opens the formats the options name, the shapefiles always among them.
+// Formats that cannot be opened are reported and left out.
+func (ix *Indexer) newIndexRun(options IndexOptions) *indexRun {
+	run := &indexRun{
+		ix:      ix,
+		dir:     ix.OutputDir(options),
+		writers: make(map[string][]IndexWriter),
+		boxes:   make(map[string][]RpfBox),
+		keep:    make(map[string][]bool),
+		next:    make(map[string]int),
+	}
+	outputs := options.Outputs
+	hasShapefiles := false
+	for _, output := range outputs {
+		name, _, _ := strings.Cut(output, "=")
+		hasShapefiles = hasShapefiles || name == shapefileFormat
+	}
+	if !hasShapefiles {
+		outputs = append([]string{shapefileFormat}, outputs...)
+	}
+	for _, output := range outputs {
+		name, dest, _ := strings.Cut(output, "=")
+		open := indexFormats[name]
+		if open == nil {
+			fmt.Printf("Unknown index format %s, not one of %s\n", name, strings.Join(IndexFormats(), ", "))
+			continue
+		}
+		format, err := open(run.dir, dest, options)
+		if err != nil {
+			fmt.Printf("Cannot write %s index : %v\n", name, err)
+			continue
+		}
+		run.formats = append(run.formats, format)
+	}
+	if options.History {
+		run.history = newHistoryRun(run, options)
+	}
+	return run
+}
+
+// newHistoryRun writes the shapefiles of every edition in the history directory of a run
+func newHistoryRun(parent *indexRun, options IndexOptions) *indexRun {
+	dir := filepath.Join(parent.dir, historyDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		fmt.Printf("Cannot write history index : %v\n", err)
+		return nil
+	}
+	return &indexRun{
+		ix:          parent.ix,
+		dir:         dir,
+		formats:     []IndexFormat{&shpFormat{dir: dir, qixDepth: options.QixDepth}},
+		writers:     make(map[string][]IndexWriter),
+		allEditions: true,
+	}
+}
+
+// wholeFiles tells whether a format holds every series in one file, so an incremental
+// run must still feed it all of them. Only shapefiles are kept per series.
+func (run *indexRun) wholeFiles() bool {
+	return len(run.formats) > 1
+}
+
+// seriesWriters opens the writers of a series on first use
+func (run *indexRun) seriesWriters(seriesCode string) []IndexWriter {
+	writers, ok := run.writers[seriesCode]
+	if ok {
+		return writers
+	}
+	for _, format := range run.formats {
+		w := format.NewWriter()
+		if err := w.Open(seriesCode); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		writers = append(writers, w)
+	}
+	run.writers[seriesCode] = writers
+	return writers
+}
+
+// written tells whether a series had frames in this run
+func (run *indexRun) written(seriesCode string) bool {
+	_, ok := run.writers[seriesCode]
+	return ok
+}
+
+func (run *indexRun) writeBox(r RpfBox) {
+	if run.history != nil {
+		run.history.writeBox(r)
+	}
+	if !run.allEditions {
+		seriesCode := seriesOf(r.path)
+		run.boxes[seriesCode] = append(run.boxes[seriesCode], r)
+		return
+	}
+	for _, w := range run.seriesWriters(seriesOf(r.path)) {
+		if err := w.WriteBox(r); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// boxesDone passes on the boxes of the newest editions once every box is in
+func (run *indexRun) boxesDone() {
+	seriesCodes := make([]string, 0, len(run.boxes))
+	for seriesCode := range run.boxes {
+		seriesCodes = append(seriesCodes, seriesCode)
+	}
+	sort.Strings(seriesCodes)
+	for _, seriesCode := range seriesCodes {
+		boxes := run.boxes[seriesCode]
+		keep := newestEditions(boxes)
+		writers := run.seriesWriters(seriesCode)
+		for i, r := range boxes {
+			if !keep[i] {
+				continue
+			}
+			for _, w := range writers {
+				if err := w.WriteBox(r); err != nil {
+					fmt.Println(err)
+				}
+			}
+		}
+		run.keep[seriesCode] = keep
+		delete(run.boxes, seriesCode)
+	}
+}
+
+func (run *indexRun) writeAttributes(attributes FrameAttributes) {
+	if run.history != nil {
+		run.history.writeAttributes(attributes)
+	}
+	seriesCode := seriesOf(attributes.Location)
+	if !run.allEditions {
+		i := run.next[seriesCode]
+		run.next[seriesCode]++
+		if keep := run.keep[seriesCode]; i < len(keep) && !keep[i] {
+			fmt.Printf("Superseded by a newer edition : %s\n", attributes.Location)
+			run.superseded++
+			return
+		}
+	}
+	for _, w := range run.seriesWriters(seriesCode) {
+		if err := w.WriteAttributes(attributes); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// close closes the writers of every series then finishes the formats
+func (run *indexRun) close() {
+	seriesCodes := make([]string, 0, len(run.writers))
+	for seriesCode := range run.writers {
+		seriesCodes = append(seriesCodes, seriesCode)
+	}
+	sort.Strings(seriesCodes)
+	for _, seriesCode := range seriesCodes {
+		for _, w := range run.writers[seriesCode] {
+			if err := w.Close(); err != nil {
+				fmt.Printf("Cannot write %s index : %v\n", seriesCode, err)
+			}
+		}
+		if !run.allEditions {
+			run.ix.invalidateTileCache(seriesCode) // images drawn from the old index are stale
+		}
+	}
+	for _, format := range run.formats {
+		if err := format.Finish(); err != nil {
+			fmt.Printf("Cannot write index : %v\n", err)
+		}
+	}
+	if run.superseded > 0 {
+		fmt.Printf("%d frames superseded by newer editions left out of the index.\n", run.superseded)
+	}
+	if run.history != nil {
+		run.history.close()
+	}
+}
+
+// attributeKind is the type of an attribute column, as the outputs declare it
+type attributeKind int
+
+const (
+	textAttribute attributeKind = iota
+	integerAttribute
+	dateAttribute // text, as 2006-01-02
+)
+
+// attributeColumn is an attribute of the frames in every output but the DBF
+type attributeColumn struct {
+	name  string
+	kind  attributeKind
+	width int                          // most characters of text, 0 when unbounded
+	value func(a *FrameAttributes) any // a string, an int64 or nil when unknown
+}
+
+// attributeColumns follow the DBF fields, unknown values left null
+var attributeColumns = []attributeColumn{
+	{"location", textAttribute, 0, func(a *FrameAttributes) any { return a.Location }},
+	{"series", textAttribute, 2, func(a *FrameAttributes) any { return nullText(a.SeriesCode) }},
+	{"frame", integerAttribute, 0, func(a *FrameAttributes) any { return nullInteger(int64(a.FrameNumber)) }},
+	{"edition", integerAttribute, 0, func(a *FrameAttributes) any { return nullInteger(int64(a.Edition)) }},
+	{"producer", integerAttribute, 0, func(a *FrameAttributes) any { return nullInteger(int64(a.Producer)) }},
+	{"zone", textAttribute, 1, func(a *FrameAttributes) any { return nullText(a.Zone) }},
+	{"scale", textAttribute, 0, func(a *FrameAttributes) any { return nullText(a.Scale) }},
+	{"size", integerAttribute, 0, func(a *FrameAttributes) any { return nullInteger(a.Size) }},
+	{"modified", dateAttribute, 0, func(a *FrameAttributes) any {
+		if a.ModTime.IsZero() {
+			return nil
+		}
+		return a.ModTime.Format("2006-01-02")
+	}},
+	{"type", textAttribute, 5, func(a *FrameAttributes) any { return nullText(a.Type) }},
+}
+
+func nullText(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func nullInteger(v int64) any {
+	if v < 0 {
+		return nil
+	}
+	return v
+}
+
+// footprint is a frame's box with its attributes
+type footprint struct {
+	box        Box
+	attributes FrameAttributes
+}
+
+// footprintWriter is the IndexWriter of formats holding every series in one file:
+// it pairs each frame's attributes with its box and hands the frame to add
+type footprintWriter struct {
+	seriesCode string
+	boxes      []RpfBox
+	next       int
+	add        func(seriesCode string, frame footprint) error
+}
+
+func (w *footprintWriter) Open(seriesCode string) error {
+	w.seriesCode = seriesCode
+	return nil
+}
+
+func (w *footprintWriter) WriteBox(r RpfBox) error {
+	w.boxes = append(w.boxes, r)
+	return nil
+}
+
+func (w *footprintWriter) WriteAttributes(attributes FrameAttributes) error {
+	if w.next >= len(w.boxes) {
+		return fmt.Errorf("no box for the attributes of %s", attributes.Location)
+	}
+	box := w.boxes[w.next].box
+	w.boxes[w.next] = RpfBox{} // let the path go
+	w.next++
+	return w.add(w.seriesCode, footprint{box, attributes})
+}
+
+// Close adds the frames whose attributes never came, described from their names
+func (w *footprintWriter) Close() error {
+	for ; w.next < len(w.boxes); w.next++ {
+		r := w.boxes[w.next]
+		if err := w.add(w.seriesCode, footprint{r.box, NewFrameAttributes(r.path, nil)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
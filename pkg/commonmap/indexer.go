@@ -2,13 +2,15 @@ package commonmap
 
 import (
 	"fmt"
-	"os"
-	"path"
+	"io"
+	"math"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
+	"cm/pkg/archive"
 	"cm/pkg/rpf"
 )
 
@@ -17,7 +19,72 @@ type RpfBox struct {
 	box  Box
 }
 
-var shapeFiles map[string]*ShpBoxWriter
+// IndexOptions controls optional indexing behavior
+type IndexOptions struct {
+	// VerifyHeaders reads each frame's NITF/RPF header and reports frames whose
+	// filename-derived bounds disagree with the header's coverage section
+	VerifyHeaders bool
+	// UseTOC builds the index from the RPF A.TOC files instead of walking every file
+	UseTOC bool
+	// Incremental rewrites only the series whose frames changed since the last walk,
+	// as recorded in the index manifest
+	Incremental bool
+	// QixDepth is the depth of the quadtrees, 0 to pick it from each series' frame count
+	QixDepth int
+	// Walkers is the number of directory readers used to scan holdings outside
+	// Windows, 0 for the default
+	Walkers int
+	// Outputs names the formats to write the index in, "name" or "name=destination"
+	// as registered with RegisterIndexFormat. The shapefiles the server reads are
+	// always written.
+	Outputs []string
+	// History keeps every edition of the frames in shapefiles of the history directory,
+	// the index itself serving only the newest
+	History bool
+	// HashDuplicates compares the content of frames with the same name and size before
+	// taking them for copies of each other
+	HashDuplicates bool
+	// DuplicatesReport is where to list the duplicate frames left out of the index, as
+	// CSV or, when it ends in .json, JSON
+	DuplicatesReport string
+}
+
+// Indexer builds and serves the index of one directory. Each keeps its own lock and
+// caches, so several indexes can be built and served in one process.
+type Indexer struct {
+	// Dir is the index directory the lookups read, and where the shapefiles are
+	// written unless an "shp=" output names another
+	Dir string
+	// CacheDir holds rendered maps and tiles, "" for no cache
+	CacheDir string
+	// Mapfile is the mapserv map file kept current while watching, "" for none
+	Mapfile string
+
+	lock            sync.RWMutex // keeps lookups off the index while it is rewritten
+	reindexing      sync.Mutex   // keeps the watchers of several roots from updating at once
+	tiles           *tileCache   // nil when caching is off
+	renderFrames    *frameCache
+	elevationFrames *frameCache
+}
+
+// NewIndexer returns an indexer of the index in dir
+func NewIndexer(dir string) *Indexer {
+	return &Indexer{
+		Dir:             dir,
+		renderFrames:    newFrameCache(32),
+		elevationFrames: newFrameCache(16),
+	}
+}
+
+// OutputDir is the directory the shapefiles, manifest and history of a run go to
+func (ix *Indexer) OutputDir(options IndexOptions) string {
+	for _, output := range options.Outputs {
+		if name, dest, _ := strings.Cut(output, "="); name == shapefileFormat && dest != "" {
+			return dest
+		}
+	}
+	return ix.Dir
+}
 
 // Assemble the path by looking up parent pointers in the folders map
 func GetFullPath2(folders map[DWORDLONG]folderEntry, cache map[DWORDLONG]string, f folderEntry) string {
@@ -39,103 +106,166 @@ func CheckPathAsNtfsDrive(path string) bool {
 	return true
 }
 
-func Index(indexPath string) {
+// Index indexes the frames below indexPath, which may list several roots separated by
+// os.PathListSeparator. A frame found more than once is indexed from the first root.
+func (ix *Indexer) Index(indexPath string, options IndexOptions) {
+	ix.indexRoots(holdingRoots(indexPath), "", options)
+}
+
+// IndexRoots indexes the frames below every root in one index
+func (ix *Indexer) IndexRoots(roots []HoldingRoot, options IndexOptions) {
+	ix.indexRoots(roots, "", options)
+}
+
+// ReindexRoot brings the index up to date with the root named, taking the frames of
+// the other roots from the manifest of the last run. Without one, every root is walked.
+func (ix *Indexer) ReindexRoot(roots []HoldingRoot, name string, options IndexOptions) {
+	options.Incremental = true
+	ix.indexRoots(roots, name, options)
+}
+
+// indexRoots walks the root named only, or every root when it is ""
+func (ix *Indexer) indexRoots(roots []HoldingRoot, only string, options IndexOptions) {
+	roots = byPriority(roots)
 
 	t0 := time.Now()
 	forShp := make(chan RpfBox) // todo: benchmark w/ pointers
-	forDbf := make(chan string)
+	forDbf := make(chan FrameAttributes)
 	done := make(chan bool)
-	go addToShp(forShp, forDbf, done)
+	run := ix.newIndexRun(options)
+	go addToShp(forShp, forDbf, done, run)
 
 	totalFiles := 0
+	mismatches := 0
+	verify := func(rpfPath string, box Box) {
+		if options.VerifyHeaders && !checkFrameHeader(rpfPath, box) {
+			mismatches++
+		}
+	}
 
-	if runtime.GOOS == "windows" { //todo:  check for NTFS drive
+	var finish func() // completes the index once the shapefiles are closed
+	if options.UseTOC && options.Incremental {
+		fmt.Println("Incremental indexing compares files on disk, ignoring the tables of contents.")
+		options.UseTOC = false
+	}
+	if options.UseTOC {
+		totalFiles = indexTOCs(roots, options, forShp, forDbf, done, verify)
+	} else if runtime.GOOS == "windows" && !options.Incremental && len(roots) == 1 { //todo:  check for NTFS drive
 		//create list of files & folders, while also generating shapefiles
-		folders, files := EnumFiles("\\\\.\\"+indexPath, func(rpfPath string) bool {
+		//a single volume, whose duplicates are left to the walk as the MFT entries lack sizes
+		var boxes []Box
+		folders, files := EnumFiles("\\\\.\\"+roots[0].Path, func(rpfPath string) bool {
 			totalFiles++
 			isRpf, x1, y1, x2, y2 := rpf.TryGetRpfBounds(rpfPath)
 			if isRpf {
 				rpfBox := RpfBox{rpfPath, [4]float64{x1, y1, x2, y2}}
 				forShp <- rpfBox //start building SHP / SHX / QIX now
+				if options.VerifyHeaders {
+					boxes = append(boxes, rpfBox.box)
+				}
+			} else if archive.IsArchive(rpfPath) {
+				if options.VerifyHeaders {
+					boxes = append(boxes, Box{}) // its frames are verified with their own boxes
+				}
+				return true
 			}
 			return isRpf
 		})
-		close(forShp)
-		fmt.Printf("Initial phase complete in %v.\n", time.Now().Sub(t0))
-		<-done
 
 		rFolders := make(map[DWORDLONG]string)
 		for k, v := range folders {
-			fPath := filepath.Join(indexPath, GetFullPath2(folders, rFolders, v))
+			fPath := filepath.Join(roots[0].Path, GetFullPath2(folders, rFolders, v))
 			rFolders[k] = fPath
 		}
 
+		// frames in archives follow those on disk
+		var archived []archivedFrame
+		for _, rpfData := range files {
+			if rpfData.name != "" && archive.IsArchive(rpfData.name) {
+				for _, f := range archivedFrames(filepath.Join(rFolders[rpfData.parent], rpfData.name), nil) {
+					forShp <- f.box
+					archived = append(archived, f)
+				}
+			}
+		}
+		close(forShp)
+		fmt.Printf("Initial phase complete in %v.\n", time.Now().Sub(t0))
+		<-done
+
 		//use files and folders to generate file paths and DBFs
 		emptyCount := 0
-		for _, rpfData := range files {
+		for i, rpfData := range files {
 			if rpfData.name == "" {
 				fmt.Printf("File name is empty string")
 				emptyCount++
 				continue
 			}
-			pathx := rFolders[rpfData.parent] + rpfData.name
-			forDbf <- pathx
+			if archive.IsArchive(rpfData.name) {
+				continue
+			}
+			pathx := filepath.Join(rFolders[rpfData.parent], rpfData.name)
+			if options.VerifyHeaders {
+				verify(pathx, boxes[i])
+			}
+			forDbf <- NewFrameAttributes(pathx, nil)
+		}
+		for _, f := range archived {
+			verify(f.location, f.box.box)
+			forDbf <- NewFrameAttributes(f.location, f.info)
 		}
 		close(forDbf)
 	} else {
-		err := filepath.Walk(indexPath, func(filepath string, f os.FileInfo, err error) error {
-			totalFiles++
-			_, fileName := path.Split(filepath)
-			isRpf, x1, y1, x2, y2 := rpf.TryGetRpfBounds(fileName)
-			if isRpf {
-				rpf := RpfBox{fileName, [4]float64{x1, y1, x2, y2}}
-				forShp <- rpf      // start building SHP / SHX / QIX now
-				forDbf <- filepath // also generate DBF
-			}
-			return nil
-		})
-		close(forShp)
-		close(forDbf)
-		if err != nil {
-			fmt.Println("file search error: ", err)
-		}
+		totalFiles, finish = indexWalk(roots, only, options, run, forShp, forDbf, done, verify)
 	}
 	<-done
+	if finish != nil {
+		finish()
+	}
 	fmt.Printf("The call took %v to scan %d files.\n", time.Now().Sub(t0), totalFiles)
+	if options.VerifyHeaders {
+		fmt.Printf("%d frames have headers that disagree with their file names.\n", mismatches)
+	}
 }
 
-// add found rpf to shapefile
-func addToShp(forShp chan RpfBox, forDbf chan string, done chan bool) {
-	//todo:  unhardcode, possibly remove existing
-	shapeFiles = make(map[string]*ShpBoxWriter)
-	var shape *ShpBoxWriter
-	var r RpfBox
-	for r = range forShp {
-		shape = getShapeFile(r.path)
-		shape.WriteBox(r)
+// compare filename-derived bounds with the frame's own coverage section
+func checkFrameHeader(framePath string, box Box) bool {
+	value, err := loadFrame(framePath, func(r io.ReaderAt) (any, error) { return rpf.ParseFrameHeader(r) })
+	header, _ := value.(*rpf.FrameHeader)
+	if err != nil {
+		fmt.Printf("Cannot read RPF header : %s : %v\n", framePath, err)
+		return false
 	}
-	done <- true
-	for shpPath := range forDbf {
-		shape = getShapeFile(shpPath)
-		shape.WriteDbf(shpPath)
+	ok, x1, y1, x2, y2 := header.Bounds()
+	if !ok {
+		fmt.Printf("RPF header has no usable coverage : %s\n", framePath)
+		return false
 	}
-	for _, shape := range shapeFiles {
-		shape.Close()
+	// allow a pixel of slack, producers round the corners differently
+	tolerance := math.Max(math.Max(header.Coverage.LonInterval, header.Coverage.LatInterval), 1e-7)
+	for i, v := range [4]float64{x1, y1, x2, y2} {
+		if math.Abs(v-box[i]) > tolerance {
+			fmt.Printf("RPF bounds mismatch : %s : name {%f, %f, %f, %f} header {%f, %f, %f, %f}\n",
+				framePath, box[0], box[1], box[2], box[3], x1, y1, x2, y2)
+			return false
+		}
 	}
-	done <- true
+	if header.Frame != nil && !strings.EqualFold(header.Frame.SeriesCode, filepath.Ext(framePath)[1:3]) {
+		fmt.Printf("RPF series mismatch : %s : header names %s\n", framePath, header.Rpf.FileName)
+		return false
+	}
+	return true
 }
 
-// get a different shapefile for each file type
-func getShapeFile(shpPath string) *ShpBoxWriter {
-	seriesCode := strings.ToUpper(filepath.Ext(shpPath)[1:3])
-	shape := shapeFiles[seriesCode]
-	if shape == nil {
-		var err error
-		shape, err = Create(seriesCode)
-		if err != nil {
-			fmt.Println(err)
-		}
-		shapeFiles[seriesCode] = shape
+// add found rpf to the index of its series, in every format of the run
+func addToShp(forShp chan RpfBox, forDbf chan FrameAttributes, done chan bool, run *indexRun) {
+	for r := range forShp {
+		run.writeBox(r)
 	}
-	return shape
+	run.boxesDone()
+	done <- true
+	for attributes := range forDbf {
+		run.writeAttributes(attributes)
+	}
+	run.close()
+	done <- true
 }
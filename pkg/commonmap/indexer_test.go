@@ -0,0 +1,109 @@
+package commonmap
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeHoldings lays out frames below a new root, their names being all the walk reads
+func writeHoldings(t *testing.T, framePaths ...string) string {
+	t.Helper()
+	root := t.TempDir()
+	for _, framePath := range framePaths {
+		path := filepath.Join(root, filepath.FromSlash(framePath))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(framePath), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestIndexersShareAProcess(t *testing.T) {
+	jg := writeHoldings(t, "RPF/JG/000A0010.JG1", "RPF/JG/000B0010.JG1")
+	on := writeHoldings(t, "RPF/ON/00010010.ON1")
+	a, b := NewIndexer(t.TempDir()), NewIndexer(t.TempDir())
+	a.Index(jg, IndexOptions{})
+	b.Index(on, IndexOptions{})
+
+	for _, tt := range []struct {
+		ix     *Indexer
+		series string
+		frames int
+	}{{a, "JG", 2}, {b, "ON", 1}} {
+		series := tt.ix.indexedSeries()
+		if len(series) != 1 || series[0].seriesCode != tt.series {
+			t.Fatalf("index in %s lists %v, want %s alone", tt.ix.Dir, series, tt.series)
+		}
+		frames, err := tt.ix.findIndexedFrames(tt.series, Box{-180, -90, 180, 90})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(frames) != tt.frames {
+			t.Fatalf("%s index holds %d frames, want %d", tt.series, len(frames), tt.frames)
+		}
+		if !fileExists(filepath.Join(tt.ix.Dir, manifestName)) {
+			t.Fatalf("no manifest in %s", tt.ix.Dir)
+		}
+	}
+}
+
+func TestIndexShapefileDestination(t *testing.T) {
+	root := writeHoldings(t, "000A0010.JG1", "000B0010.JG1")
+	ix := NewIndexer(t.TempDir())
+	dest := t.TempDir()
+	options := IndexOptions{Outputs: []string{"shp=" + dest, "geojson"}, History: true}
+	if got := ix.OutputDir(options); got != dest {
+		t.Fatalf("OutputDir = %s, want %s", got, dest)
+	}
+	ix.Index(root, options)
+
+	for _, name := range []string{"JG.shp", "JG.qix", manifestName, "index.geojson", filepath.Join(historyDirName, "JG.shp")} {
+		if !fileExists(filepath.Join(dest, name)) {
+			t.Errorf("%s missing from the shp destination", name)
+		}
+	}
+	if entries, _ := os.ReadDir(ix.Dir); len(entries) != 0 {
+		t.Errorf("index directory holds %d files, want none", len(entries))
+	}
+
+	// the frames gone, an incremental run removes the series from the destination
+	if err := os.Remove(filepath.Join(root, "000A0010.JG1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(root, "000B0010.JG1")); err != nil {
+		t.Fatal(err)
+	}
+	options.Incremental = true
+	ix.Index(root, options)
+	for _, name := range []string{"JG.shp", filepath.Join(historyDirName, "JG.shp")} {
+		if fileExists(filepath.Join(dest, name)) {
+			t.Errorf("%s left in the shp destination", name)
+		}
+	}
+}
+
+func TestIndexedSeriesWithHistory(t *testing.T) {
+	root := writeHoldings(t, "RPF/JG/000A0010.JG1", "RPF/JG/000A0020.JG1", "RPF/ON/00010010.ON1")
+	ix := NewIndexer(t.TempDir())
+	ix.Index(root, IndexOptions{History: true})
+	if !fileExists(filepath.Join(ix.Dir, historyDirName, "JG.shp")) {
+		t.Fatal("no history index written")
+	}
+
+	listed := make(map[string]int)
+	for _, series := range ix.indexedSeries() {
+		listed[series.seriesCode]++
+	}
+	if len(listed) != 2 || listed["JG"] != 1 || listed["ON"] != 1 {
+		t.Fatalf("index lists series %v, want JG and ON once each", listed)
+	}
+}
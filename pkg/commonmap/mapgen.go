@@ -33,17 +33,29 @@ func EscapeSlashes(input string) string {
 	return strings.ReplaceAll(input, "\\", "\\\\")
 }
 
-func WriteMap(w io.Writer) {
+func (ix *Indexer) WriteMap(w io.Writer) {
 
-	WriteHeader(w, proj4Path, IndexPath, "http://localhost:7070/wms")
+	WriteHeader(w, proj4Path, ix.Dir, "http://localhost:7070/wms")
 	WriteVector(w, vectorTemplatePath, contentPath)
+	for _, series := range ix.indexedSeries() {
+		WriteShapeLayer(w, series)
+	}
+	WriteFooter(w)
+}
+
+// indexedSeries lists the series found in the index directory, finest first
+func (ix *Indexer) indexedSeries() AllSeries {
 	allSeries := make(AllSeries, 0)
 
 	// scan shapepath for existing RPF shapefiles
-	err := filepath.Walk(IndexPath, func(path string, f os.FileInfo, err error) error {
+	err := filepath.Walk(ix.Dir, func(path string, f os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		// history/ holds the same series again, every edition of their frames
+		if f.IsDir() && path != ix.Dir {
+			return filepath.SkipDir
+		}
 		path = strings.ToUpper(filepath.Base(path))
 		if len(path) == 6 && filepath.Ext(path) == ".SHP" {
 			seriesCode := path[0:2]
@@ -69,10 +81,7 @@ func WriteMap(w io.Writer) {
 
 	// sort by resolution
 	sort.Sort(allSeries)
-	for _, series := range allSeries {
-		WriteShapeLayer(w, series)
-	}
-	WriteFooter(w)
+	return allSeries
 }
 
 func WriteVector(w io.Writer, vectorTemplatePath, shapePath string) {
@@ -99,7 +108,7 @@ MAP
   PROJECTION
     'init=epsg:4326'
   END
-  SHAPEPATH "` + EscapeSlashes(IndexPath) + `"
+  SHAPEPATH "` + EscapeSlashes(shapePath) + `"
   MAXSIZE 4096
   FONTSET "` + EscapeSlashes(fontsetPath) + `"
   
@@ -1,6 +1,7 @@
 package commonmap
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
@@ -11,25 +12,40 @@ import (
 var binDir string
 var mapservPath string
 var MapfilePath string
+var RootsPath string // the registered holding roots
 var proj4Path string
-var IndexPath string
+var IndexPath string // the index of the installation
 var contentPath string
 var appDir string
 var fontsetPath string
 var vectorTemplatePath string
+var TileCacheDir string
 
 func init() {
 	filename, _ := osext.Executable()
 	binDir = filepath.Dir(filename)
 
-	mapservPath = GetPathFatal("bin", "mapserv.exe")
-	proj4Path = GetPathFatal("bin", "nad")
-	IndexPath = GetPathFatal("content", "index")
-	contentPath = GetPathFatal("content")
+	// mapserv is optional, GetMap is rendered natively and only other layers need it
+	mapservPath = findMapserv()
+	proj4Path = GetPath("bin", "nad")
+	IndexPath = GetPath("content", "index")
+	contentPath = GetPath("content")
 	MapfilePath = GetPath("content", "common.map")
-	fontsetPath = GetPathFatal("content", "fonts", "fontset.txt")
-	appDir = GetPathFatal("content", "website")
-	vectorTemplatePath = GetPathFatal("content", "vector", "Natural_Earth", "template.map")
+	RootsPath = GetPath("content", "roots.json")
+	fontsetPath = GetPath("content", "fonts", "fontset.txt")
+	appDir = GetPath("content", "website")
+	vectorTemplatePath = GetPath("content", "vector", "Natural_Earth", "template.map")
+	TileCacheDir = GetPath("content", "cache")
+}
+
+// CheckInstall reports the first file of the installation that is missing
+func CheckInstall() error {
+	for _, path := range []string{IndexPath, contentPath, fontsetPath, appDir, vectorTemplatePath} {
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("missing required file at %s", path)
+		}
+	}
+	return nil
 }
 
 func GetPath(elem ...string) string {
@@ -45,7 +61,13 @@ func GetPathFatal(elem ...string) string {
 	return path
 }
 
-func GetIndexPath(fileName string) string {
-	filePath := filepath.Join(IndexPath, fileName)
-	return filePath
+// findMapserv returns the bundled mapserv binary, or "" when there is none
+func findMapserv() string {
+	for _, name := range []string{"mapserv.exe", "mapserv"} {
+		path := GetPath("bin", name)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path
+		}
+	}
+	return ""
 }
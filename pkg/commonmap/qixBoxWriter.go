@@ -1,5 +1,7 @@
 package commonmap
 
+import "math"
+
 const (
 	MinX = 0
 	MinY = 1
@@ -12,6 +14,7 @@ type Box [4]float64
 type qixTree struct {
 	root        *qixNode
 	numFeatures int32
+	depth       int32
 }
 
 type qixNode struct {
@@ -42,49 +45,152 @@ func (in *Box) Split() (x1, x2 *Box) {
 	return &out1, &out2
 }
 
-// Create a new quadtree
-func CreateQixTree() *qixTree {
-	return &qixTree{root: &qixNode{bbox: Box([4]float64{-181, -90, 181, 90})}}
+// qixMaxDepth caps the depth picked from the feature count, as shptree does
+const qixMaxDepth = 12
+
+// qixDepth picks a tree depth for n features as shptree does, aiming at a few per leaf
+func qixDepth(n int) int {
+	depth, nodes := 0, 1
+	for nodes*4 < n {
+		depth++
+		nodes *= 2
+	}
+	return min(max(depth, 1), qixMaxDepth)
 }
 
-// Insert a feature into a quadtree
-func (tree *qixTree) Insert(feature int32, bbox *Box) {
-	tree.numFeatures++
-	qixNodeAddFeature(tree, tree.root, feature, bbox, 10)
+// qixLeafSize is the most features a node of a tree of n features keeps without
+// splitting. Leaves grow with the square root of the count, so the 44 bytes of each
+// node stay a small part of the file in large series, next to the 4 of each id.
+func qixLeafSize(n int) int {
+	return max(128, int(math.Sqrt(float64(n))))
+}
+
+// buildQixTree bulk loads a quadtree over the extent of the boxes, feature ids being
+// their index, counting from 0 as shptree writes them. Each feature sinks to the
+// deepest quadrant containing it, but nodes with few features stay leaves, sibling
+// quadrants that fit in one leaf share it, empty nodes give way to their children and
+// nodes are shrunk to the boxes below them. Readers only test node boxes for overlap,
+// so all that is compatible. maxDepth 0 picks the depth from the feature count.
+func buildQixTree(boxes []Box, extent Box, maxDepth int) *qixTree {
+	if maxDepth <= 0 {
+		maxDepth = qixDepth(len(boxes))
+	}
+	ids := make([]int32, len(boxes))
+	for i := range ids {
+		ids[i] = int32(i)
+	}
+	root := buildQixNode(extent, ids, boxes, maxDepth, qixLeafSize(len(boxes)))
+	if root == nil {
+		root = &qixNode{bbox: extent}
+	}
+	return &qixTree{root: root, numFeatures: int32(len(boxes)), depth: int32(maxDepth)}
 }
 
-// Insert a feature at a node
-func qixNodeAddFeature(tree *qixTree, node *qixNode, feature int32, bbox *Box, nMaxDepth int) {
-	// If there are SubNodes, then consider whether this object will fit in them.
-	if nMaxDepth > 1 && node.numSubNodes > int32(0) {
-		for i := int32(0); i < node.numSubNodes; i++ {
-			if node.SubNodes[i].bbox.Contains(bbox) {
-				qixNodeAddFeature(tree, node.SubNodes[i], feature, bbox, nMaxDepth-1)
-				return
+// buildQixNode builds the subtree of a quadrant, nil when it has no features
+func buildQixNode(quadrant Box, ids []int32, boxes []Box, depth, leafSize int) *qixNode {
+	if len(ids) == 0 {
+		return nil
+	}
+	node := &qixNode{}
+	if depth <= 1 || len(ids) <= leafSize {
+		node.FeatureIds = ids
+	} else {
+		half1, half2 := quadrant.Split()
+		quad1, quad2 := half1.Split()
+		quad3, quad4 := half2.Split()
+		quads := [4]*Box{quad1, quad2, quad3, quad4}
+		var parts [4][]int32
+		for _, id := range ids {
+			fits := false
+			for q, quad := range quads {
+				if quad.Contains(&boxes[id]) {
+					parts[q] = append(parts[q], id)
+					fits = true
+					break
+				}
+			}
+			if !fits {
+				node.FeatureIds = append(node.FeatureIds, id)
+			}
+		}
+		groups := make([]qixGroup, 0, 4)
+		for q, part := range parts {
+			if len(part) > 0 {
+				groups = append(groups, qixGroup{*quads[q], part})
+			}
+		}
+		var subs []*qixNode
+		for _, g := range mergeQixGroups(groups, leafSize) {
+			if sub := buildQixNode(g.quadrant, g.ids, boxes, depth-1, leafSize); sub != nil {
+				subs = append(subs, sub)
 			}
 		}
-	} else if nMaxDepth > 1 && node.numSubNodes == int32(0) {
-		// Otherwise, consider creating four SubNodes if could fit into
-		// them, and adding to the appropriate SubNodes
-		var half1, half2, quad1, quad2, quad3, quad4 *Box
-		half1, half2 = (&node.bbox).Split()
-		quad1, quad2 = half1.Split()
-		quad3, quad4 = half2.Split()
+		// an empty node only adds a box to test, its children take its place when there is room
+		for i := 0; i < len(subs); {
+			sub := subs[i]
+			if len(sub.FeatureIds) > 0 || len(subs)-1+int(sub.numSubNodes) > len(node.SubNodes) {
+				i++
+				continue
+			}
+			subs = append(append(subs[:i:i], sub.SubNodes[:sub.numSubNodes]...), subs[i+1:]...)
+		}
+		for _, sub := range subs {
+			node.SubNodes[node.numSubNodes] = sub
+			node.numSubNodes++
+		}
+		if len(node.FeatureIds) == 0 && node.numSubNodes == 1 {
+			return node.SubNodes[0] // nothing to stop at here
+		}
+	}
+	node.numFeatures = int32(len(node.FeatureIds))
+
+	// shrink to what is below
+	first := true
+	for _, id := range node.FeatureIds {
+		if first {
+			node.bbox, first = boxes[id], false
+		} else {
+			extendBbox(&node.bbox, &boxes[id])
+		}
+	}
+	for _, sub := range node.SubNodes[:node.numSubNodes] {
+		if first {
+			node.bbox, first = sub.bbox, false
+		} else {
+			extendBbox(&node.bbox, &sub.bbox)
+		}
+	}
+	return node
+}
 
-		if quad1.Contains(bbox) || quad2.Contains(bbox) ||
-			quad3.Contains(bbox) || quad4.Contains(bbox) {
-			node.numSubNodes = 4
-			node.SubNodes[0] = &qixNode{bbox: *quad1}
-			node.SubNodes[1] = &qixNode{bbox: *quad2}
-			node.SubNodes[2] = &qixNode{bbox: *quad3}
-			node.SubNodes[3] = &qixNode{bbox: *quad4}
+// qixGroup is the features of one or more quadrants of a node
+type qixGroup struct {
+	quadrant Box
+	ids      []int32
+}
 
-			/* recurse back on this node now that it has SubNodes */
-			qixNodeAddFeature(tree, node, feature, bbox, nMaxDepth)
-			return
+// mergeQixGroups joins quadrants whose features fit in one leaf, closest first
+func mergeQixGroups(groups []qixGroup, leafSize int) []qixGroup {
+	for {
+		best, bi, bj := 0.0, -1, -1
+		for i := range groups {
+			for j := i + 1; j < len(groups); j++ {
+				if len(groups[i].ids)+len(groups[j].ids) > leafSize {
+					continue
+				}
+				u := groups[i].quadrant
+				extendBbox(&u, &groups[j].quadrant)
+				area := (u[MaxX] - u[MinX]) * (u[MaxY] - u[MinY])
+				if bi < 0 || area < best {
+					best, bi, bj = area, i, j
+				}
+			}
+		}
+		if bi < 0 {
+			return groups
 		}
+		extendBbox(&groups[bi].quadrant, &groups[bj].quadrant)
+		groups[bi].ids = append(append([]int32(nil), groups[bi].ids...), groups[bj].ids...)
+		groups = append(groups[:bj], groups[bj+1:]...)
 	}
-	// If none of that worked, just add it to this nodes list.
-	node.numFeatures++
-	node.FeatureIds = append(node.FeatureIds, feature)
 }
@@ -0,0 +1,215 @@
+package commonmap
+
+import (
+	"math/rand"
+	"testing"
+
+	"cm/pkg/rpf"
+)
+
+// qixHoldings lays out n frames of a series in clusters of adjacent frames on the
+// series grid, as holdings cover areas rather than scattered frames
+func qixHoldings(seriesCode string, n, clusters int, seed int64) []Box {
+	series := rpf.DataSeries[seriesCode]
+	dppLat, dppLon := rpf.CalculateDegreesPerPixel('2', series.Scale, series.Type == rpf.CADRG)
+	w, h := dppLon*1536, dppLat*1536
+	random := rand.New(rand.NewSource(seed))
+	boxes := make([]Box, 0, n)
+	for c := 0; c < clusters; c++ {
+		count := n / clusters
+		if c < n%clusters {
+			count++
+		}
+		columns := 1
+		for columns*columns < count {
+			columns++
+		}
+		column0 := int((random.Float64()*340 - 170) / w)
+		row0 := int((random.Float64()*100 - 50) / h)
+		for i := 0; i < count; i++ {
+			x, y := float64(column0+i%columns)*w, float64(row0+i/columns)*h
+			boxes = append(boxes, Box{x, y, x + w, y + h})
+		}
+	}
+	return boxes
+}
+
+// insertQixTree builds the quadtree as the writer did before bulk loading: every
+// feature inserted in turn below a fixed world extent, 1-based ids, to a depth of 10
+func insertQixTree(boxes []Box) *qixTree {
+	tree := &qixTree{root: &qixNode{bbox: Box{-181, -90, 181, 90}}, numFeatures: int32(len(boxes)), depth: 10}
+	var insert func(node *qixNode, id int32, box *Box, depth int)
+	insert = func(node *qixNode, id int32, box *Box, depth int) {
+		if depth > 1 && node.numSubNodes > 0 {
+			for _, sub := range node.SubNodes[:node.numSubNodes] {
+				if sub.bbox.Contains(box) {
+					insert(sub, id, box, depth-1)
+					return
+				}
+			}
+		} else if depth > 1 {
+			half1, half2 := node.bbox.Split()
+			quad1, quad2 := half1.Split()
+			quad3, quad4 := half2.Split()
+			if quad1.Contains(box) || quad2.Contains(box) || quad3.Contains(box) || quad4.Contains(box) {
+				node.numSubNodes = 4
+				for i, quad := range []*Box{quad1, quad2, quad3, quad4} {
+					node.SubNodes[i] = &qixNode{bbox: *quad}
+				}
+				insert(node, id, box, depth)
+				return
+			}
+		}
+		node.numFeatures++
+		node.FeatureIds = append(node.FeatureIds, id)
+	}
+	for i := range boxes {
+		insert(tree.root, int32(i+1), &boxes[i], 10)
+	}
+	return tree
+}
+
+// qixFileSize is the size of the .qix file of a tree
+func qixFileSize(tree *qixTree) int {
+	size := 16
+	var walk func(node *qixNode)
+	walk = func(node *qixNode) {
+		size += 44 + 4*len(node.FeatureIds)
+		for _, sub := range node.SubNodes[:node.numSubNodes] {
+			walk(sub)
+		}
+	}
+	walk(tree.root)
+	return size
+}
+
+// qixTreeCandidates lists the ids of the nodes a query visits, as readers walk the file
+func qixTreeCandidates(tree *qixTree, box Box) []int32 {
+	var ids []int32
+	var walk func(node *qixNode)
+	walk = func(node *qixNode) {
+		if !boxesIntersect(&node.bbox, &box) {
+			return
+		}
+		ids = append(ids, node.FeatureIds...)
+		for _, sub := range node.SubNodes[:node.numSubNodes] {
+			walk(sub)
+		}
+	}
+	walk(tree.root)
+	return ids
+}
+
+// qixQueries are boxes of about four by four frames around frames of the holdings
+func qixQueries(boxes []Box, n int, seed int64) []Box {
+	random := rand.New(rand.NewSource(seed))
+	queries := make([]Box, n)
+	for i := range queries {
+		b := boxes[random.Intn(len(boxes))]
+		w, h := b[MaxX]-b[MinX], b[MaxY]-b[MinY]
+		queries[i] = Box{b[MinX] - 1.5*w, b[MinY] - 1.5*h, b[MaxX] + 1.5*w, b[MaxY] + 1.5*h}
+	}
+	return queries
+}
+
+func extentOf(boxes []Box) Box {
+	extent := boxes[0]
+	for i := range boxes {
+		extendBbox(&extent, &boxes[i])
+	}
+	return extent
+}
+
+// qixLayouts are the trees compared, the insertion the writer used before bulk loading
+var qixLayouts = []struct {
+	name  string
+	build func(boxes []Box) *qixTree
+}{
+	{"insert", insertQixTree},
+	{"bulk", func(boxes []Box) *qixTree { return buildQixTree(boxes, extentOf(boxes), 0) }},
+}
+
+func TestQixTreeSmallerThanInsertion(t *testing.T) {
+	tests := []struct {
+		series string
+		frames int
+	}{
+		{"C1", 5000},
+		{"I4", 5000},
+		{"C1", 200000},
+		{"I4", 200000},
+		{"JG", 200000},
+		{"C1", 1024000},
+		{"I4", 1024000},
+	}
+	for _, tt := range tests {
+		if tt.frames > 200000 && testing.Short() {
+			continue
+		}
+		boxes := qixHoldings(tt.series, tt.frames, 40, 1)
+		queries := qixQueries(boxes, 1000, 2)
+		var size, candidates [2]int
+		for l, layout := range qixLayouts {
+			tree := layout.build(boxes)
+			size[l] = qixFileSize(tree)
+			for _, q := range queries {
+				candidates[l] += len(qixTreeCandidates(tree, q))
+			}
+		}
+		if size[1] >= size[0] {
+			t.Errorf("%d %s frames: bulk loaded .qix of %d bytes, inserted %d", tt.frames, tt.series, size[1], size[0])
+		}
+		// small series fit in the cells of the inserted tree, larger ones overfill them
+		if candidates[1] > candidates[0]*21/20 {
+			t.Errorf("%d %s frames: bulk loaded tree yields %d candidates, inserted %d", tt.frames, tt.series, candidates[1], candidates[0])
+		}
+	}
+}
+
+func TestQixTreeFindsEveryFrame(t *testing.T) {
+	boxes := qixHoldings("C1", 50000, 10, 3)
+	tree := buildQixTree(boxes, extentOf(boxes), 0)
+	seen := make([]int, len(boxes))
+	for _, id := range qixTreeCandidates(tree, extentOf(boxes)) {
+		seen[id]++
+	}
+	for id, n := range seen {
+		if n != 1 {
+			t.Fatalf("feature %d is in the tree %d times", id, n)
+		}
+	}
+	for _, q := range qixQueries(boxes, 200, 4) {
+		found := make(map[int32]bool)
+		for _, id := range qixTreeCandidates(tree, q) {
+			found[id] = true
+		}
+		for id := range boxes {
+			if boxesIntersect(&boxes[id], &q) && !found[int32(id)] {
+				t.Fatalf("query %v misses feature %d at %v", q, id, boxes[id])
+			}
+		}
+	}
+}
+
+// BenchmarkQixTree builds the trees of 1,024,000 frames in 40 clusters, reporting the
+// size of the .qix and the candidates read by a query of four by four frames
+func BenchmarkQixTree(b *testing.B) {
+	for _, series := range []string{"C1", "I4"} {
+		boxes := qixHoldings(series, 1024000, 40, 1)
+		queries := qixQueries(boxes, 5000, 2)
+		for _, layout := range qixLayouts {
+			b.Run(series+"/"+layout.name, func(b *testing.B) {
+				var tree *qixTree
+				for i := 0; i < b.N; i++ {
+					tree = layout.build(boxes)
+				}
+				candidates := 0
+				for _, q := range queries {
+					candidates += len(qixTreeCandidates(tree, q))
+				}
+				b.ReportMetric(float64(qixFileSize(tree)), "qix-bytes")
+				b.ReportMetric(float64(candidates)/float64(len(queries)), "candidates/query")
+			})
+		}
+	}
+}
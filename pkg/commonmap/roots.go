@@ -0,0 +1,128 @@
+package commonmap
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// This file keeps the roots of the holdings, local paths and mounted shares indexed
+// together. Each has a name, to re-index it alone, and a priority deciding whose copy
+// of a frame held below several roots is indexed.
+
+// HoldingRoot is a root of the holdings
+type HoldingRoot struct {
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	Priority int    `json:"priority"` // the highest wins a duplicate, ties going to the first root
+}
+
+// ParseHoldingRoot reads a root given as name[:priority]=path
+func ParseHoldingRoot(spec string) (HoldingRoot, error) {
+	name, path, ok := strings.Cut(spec, "=")
+	if !ok || path == "" {
+		return HoldingRoot{}, fmt.Errorf("root %q is not name[:priority]=path", spec)
+	}
+	root := HoldingRoot{Name: name, Path: path}
+	if n, priority, ok := strings.Cut(name, ":"); ok {
+		p, err := strconv.Atoi(priority)
+		if err != nil {
+			return HoldingRoot{}, fmt.Errorf("root %q has a bad priority : %v", spec, err)
+		}
+		root.Name, root.Priority = n, p
+	}
+	if root.Name == "" {
+		return HoldingRoot{}, fmt.Errorf("root %q has no name", spec)
+	}
+	return root, nil
+}
+
+// ReadRoots reads the registered roots, none when the file does not exist
+func ReadRoots() ([]HoldingRoot, error) {
+	data, err := os.ReadFile(RootsPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var roots []HoldingRoot
+	if err := json.Unmarshal(data, &roots); err != nil {
+		return nil, fmt.Errorf("%s : %v", RootsPath, err)
+	}
+	return roots, nil
+}
+
+// RegisterRoots adds roots to those registered, replacing any of the same name, and
+// returns them all
+func RegisterRoots(add []HoldingRoot) ([]HoldingRoot, error) {
+	roots, err := ReadRoots()
+	if err != nil {
+		return nil, err
+	}
+	for _, root := range add {
+		replaced := false
+		for i := range roots {
+			if roots[i].Name == root.Name {
+				roots[i], replaced = root, true
+			}
+		}
+		if !replaced {
+			roots = append(roots, root)
+		}
+	}
+	data, err := json.MarshalIndent(roots, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return roots, os.WriteFile(RootsPath, append(data, '\n'), 0644)
+}
+
+// FindRoot looks a root up by name
+func FindRoot(roots []HoldingRoot, name string) (HoldingRoot, bool) {
+	for _, root := range roots {
+		if root.Name == name {
+			return root, true
+		}
+	}
+	return HoldingRoot{}, false
+}
+
+// holdingRoots splits a list of paths to index, each its own root of equal priority
+func holdingRoots(indexPath string) []HoldingRoot {
+	var roots []HoldingRoot
+	for _, path := range filepath.SplitList(indexPath) {
+		if path != "" {
+			roots = append(roots, HoldingRoot{Name: path, Path: path})
+		}
+	}
+	return roots
+}
+
+// byPriority orders roots as their copies of a frame are preferred
+func byPriority(roots []HoldingRoot) []HoldingRoot {
+	sorted := append([]HoldingRoot(nil), roots...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Priority > sorted[j].Priority })
+	return sorted
+}
+
+// rootOf finds the root holding a path, the innermost when roots nest
+func rootOf(roots []HoldingRoot, path string) (HoldingRoot, bool) {
+	var found HoldingRoot
+	ok := false
+	for _, root := range roots {
+		dir := filepath.Clean(root.Path)
+		if path != dir && !strings.HasPrefix(path, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator)) {
+			continue
+		}
+		if !ok || len(dir) > len(filepath.Clean(found.Path)) {
+			found, ok = root, true
+		}
+	}
+	return found, ok
+}
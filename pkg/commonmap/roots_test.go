@@ -0,0 +1,215 @@
+package commonmap
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestParseHoldingRoot(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    HoldingRoot
+		wantErr bool
+	}{
+		{spec: "local=/data/rpf", want: HoldingRoot{"local", "/data/rpf", 0}},
+		{spec: "share:10=//server/rpf", want: HoldingRoot{"share", "//server/rpf", 10}},
+		{spec: "old:-1=/mnt/old", want: HoldingRoot{"old", "/mnt/old", -1}},
+		{spec: `cd:2=D:\RPF`, want: HoldingRoot{"cd", `D:\RPF`, 2}},
+		{spec: "paths=/a=b", want: HoldingRoot{"paths", "/a=b", 0}},
+		{spec: "/data/rpf", wantErr: true},
+		{spec: "local=", wantErr: true},
+		{spec: "=/data/rpf", wantErr: true},
+		{spec: ":3=/data/rpf", wantErr: true},
+		{spec: "local:high=/data/rpf", wantErr: true},
+		{spec: "local:=/data/rpf", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseHoldingRoot(tt.spec)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q parsed as %+v, want an error", tt.spec, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%q parsed as %+v, %v, want %+v", tt.spec, got, err, tt.want)
+		}
+	}
+}
+
+func TestRootOf(t *testing.T) {
+	sep := string(filepath.Separator)
+	dir := func(parts ...string) string { return sep + filepath.Join(parts...) }
+	roots := []HoldingRoot{
+		{Name: "data", Path: dir("data")},
+		{Name: "rpf", Path: dir("data", "rpf") + sep},
+		{Name: "cd", Path: dir("data", "rpf", "cd1")},
+		{Name: "other", Path: dir("database")},
+	}
+	tests := []struct {
+		path string
+		want string // "" for none
+	}{
+		{dir("data", "readme.txt"), "data"},
+		{dir("data", "rpf", "A.TOC"), "rpf"},
+		{dir("data", "rpf", "cd1", "RPF", "JG", "000A0010.JG1"), "cd"},
+		{dir("data", "rpf", "cd10", "RPF", "JG", "000A0010.JG1"), "rpf"},
+		{dir("data", "rpf"), "rpf"},
+		{dir("database", "x.JG1"), "other"},
+		{dir("dat", "x.JG1"), ""},
+		{dir("elsewhere"), ""},
+	}
+	for _, tt := range tests {
+		got, ok := rootOf(roots, tt.path)
+		if ok != (tt.want != "") || got.Name != tt.want {
+			t.Errorf("%s is below %q (%t), want %q", tt.path, got.Name, ok, tt.want)
+		}
+	}
+	// the order of the roots does not matter
+	slices.Reverse(roots)
+	if got, _ := rootOf(roots, dir("data", "rpf", "cd1", "A.TOC")); got.Name != "cd" {
+		t.Errorf("nested root found %q, want cd", got.Name)
+	}
+}
+
+func TestRegisterRoots(t *testing.T) {
+	saved := RootsPath
+	RootsPath = filepath.Join(t.TempDir(), "roots.json")
+	t.Cleanup(func() { RootsPath = saved })
+
+	if roots, err := ReadRoots(); err != nil || roots != nil {
+		t.Fatalf("no roots file read %v, %v", roots, err)
+	}
+	steps := []struct {
+		add  []HoldingRoot
+		want []HoldingRoot
+	}{
+		{
+			[]HoldingRoot{{"local", "/data/rpf", 0}, {"share", "/mnt/rpf", 5}},
+			[]HoldingRoot{{"local", "/data/rpf", 0}, {"share", "/mnt/rpf", 5}},
+		},
+		{
+			// replaced in place, new ones going last
+			[]HoldingRoot{{"cd", "/media/cd", 1}, {"local", "/srv/rpf", 2}},
+			[]HoldingRoot{{"local", "/srv/rpf", 2}, {"share", "/mnt/rpf", 5}, {"cd", "/media/cd", 1}},
+		},
+		{
+			nil,
+			[]HoldingRoot{{"local", "/srv/rpf", 2}, {"share", "/mnt/rpf", 5}, {"cd", "/media/cd", 1}},
+		},
+	}
+	for i, step := range steps {
+		roots, err := RegisterRoots(step.add)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(roots, step.want) {
+			t.Fatalf("step %d registered %v, want %v", i, roots, step.want)
+		}
+		read, err := ReadRoots()
+		if err != nil || !slices.Equal(read, step.want) {
+			t.Fatalf("step %d read back %v, %v, want %v", i, read, err, step.want)
+		}
+	}
+	if root, ok := FindRoot(steps[len(steps)-1].want, "share"); !ok || root.Path != "/mnt/rpf" {
+		t.Fatalf("found %+v, %t", root, ok)
+	}
+	if _, ok := FindRoot(steps[len(steps)-1].want, "usb"); ok {
+		t.Fatal("found a root never registered")
+	}
+
+	if err := os.WriteFile(RootsPath, []byte("not json"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RegisterRoots(nil); err == nil {
+		t.Fatal("registered over a corrupt roots file")
+	}
+}
+
+// indexedLocations lists the locations of a series in the index
+func indexedLocations(t *testing.T, ix *Indexer, seriesCode string) []string {
+	t.Helper()
+	frames, err := ix.findIndexedFrames(seriesCode, Box{-180, -90, 180, 90})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var locations []string
+	for _, frame := range frames {
+		locations = append(locations, frame.location)
+	}
+	slices.Sort(locations)
+	return locations
+}
+
+func TestRootPriority(t *testing.T) {
+	const framePath = "RPF/JG/000A0010.JG1"
+	tests := []struct {
+		name       string
+		priorities [2]int
+		want       int // the root whose copy is indexed
+	}{
+		{"first of equal priority", [2]int{0, 0}, 0},
+		{"higher priority second", [2]int{0, 5}, 1},
+		{"higher priority first", [2]int{5, 0}, 0},
+		{"negative priority", [2]int{-1, 0}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			roots := []HoldingRoot{
+				{Name: "a", Path: writeHoldings(t, framePath), Priority: tt.priorities[0]},
+				{Name: "b", Path: writeHoldings(t, framePath), Priority: tt.priorities[1]},
+			}
+			ix := NewIndexer(t.TempDir())
+			ix.IndexRoots(roots, IndexOptions{})
+			got := indexedLocations(t, ix, "JG")
+			want := []string{filepath.Join(roots[tt.want].Path, filepath.FromSlash(framePath))}
+			if !slices.Equal(got, want) {
+				t.Fatalf("indexed %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestReindexRoot(t *testing.T) {
+	roots := []HoldingRoot{
+		{Name: "a", Path: writeHoldings(t, "RPF/JG/000A0010.JG1")},
+		{Name: "b", Path: writeHoldings(t, "RPF/JG/000B0010.JG1")},
+	}
+	location := func(root int, framePath string) string {
+		return filepath.Join(roots[root].Path, filepath.FromSlash(framePath))
+	}
+	ix := NewIndexer(t.TempDir())
+	ix.IndexRoots(roots, IndexOptions{})
+
+	// both roots change, only a is walked again: b is as the manifest recorded it
+	writeFrame(t, roots[0].Path, "RPF/JG/000C0010.JG1", "new")
+	writeFrame(t, roots[1].Path, "RPF/JG/000D0010.JG1", "new")
+	ix.ReindexRoot(roots, "a", IndexOptions{})
+	want := []string{location(0, "RPF/JG/000A0010.JG1"), location(1, "RPF/JG/000B0010.JG1"), location(0, "RPF/JG/000C0010.JG1")}
+	slices.Sort(want)
+	if got := indexedLocations(t, ix, "JG"); !slices.Equal(got, want) {
+		t.Fatalf("after re-indexing a, indexed %v, want %v", got, want)
+	}
+
+	// a frame removed below a root not walked stays indexed until that root is
+	removeFrame(t, roots[1].Path, "RPF/JG/000B0010.JG1")
+	ix.ReindexRoot(roots, "a", IndexOptions{})
+	if got := indexedLocations(t, ix, "JG"); !slices.Equal(got, want) {
+		t.Fatalf("after re-indexing a again, indexed %v, want %v", got, want)
+	}
+	ix.ReindexRoot(roots, "b", IndexOptions{})
+	want = []string{location(0, "RPF/JG/000A0010.JG1"), location(0, "RPF/JG/000C0010.JG1"), location(1, "RPF/JG/000D0010.JG1")}
+	slices.Sort(want)
+	if got := indexedLocations(t, ix, "JG"); !slices.Equal(got, want) {
+		t.Fatalf("after re-indexing b, indexed %v, want %v", got, want)
+	}
+
+	// without a manifest, every root is walked
+	fresh := NewIndexer(t.TempDir())
+	fresh.ReindexRoot(roots, "a", IndexOptions{})
+	if got := indexedLocations(t, fresh, "JG"); !slices.Equal(got, want) {
+		t.Fatalf("without a manifest, indexed %v, want %v", got, want)
+	}
+}
@@ -1,6 +1,7 @@
 package commonmap
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -11,16 +12,29 @@ import (
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"strings"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 )
 
-func Serve() {
+// ServeOptions configures the web server
+type ServeOptions struct {
+	CacheSize int64 // bytes of rendered images kept on disk, 0 disables the cache
+}
+
+func (ix *Indexer) Serve(options ServeOptions) {
 	if os.Getenv("GOMAXPROCS") == "" {
 		runtime.GOMAXPROCS(runtime.NumCPU())
 	}
 
+	if options.CacheSize > 0 && ix.CacheDir != "" {
+		var err error
+		if ix.tiles, err = openTileCache(ix.CacheDir, options.CacheSize); err != nil {
+			log.Printf("tile cache disabled: %v", err)
+		}
+	}
+
 	var listenAddr = "localhost:7070"
 
 	c := make(chan os.Signal, 1)
@@ -31,18 +45,42 @@ func Serve() {
 		}
 	}()
 
-	r := mux.NewRouter()
-	r.HandleFunc("/wms", render)
-	r.Handle("/{path:.*}", http.StripPrefix("/", http.FileServer(http.Dir(appDir))))
-
 	log.Printf("listening on http://%s", listenAddr)
 
-	log.Fatal(http.ListenAndServe(listenAddr, handlers.LoggingHandler(os.Stdout, r)))
+	log.Fatal(http.ListenAndServe(listenAddr, handlers.LoggingHandler(os.Stdout, ix.routes())))
+}
+
+// routes maps the service URLs onto their handlers, anything else being a file of the app
+func (ix *Indexer) routes() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/wms", ix.render)
+	r.HandleFunc("/elevation", ix.elevation)
+	r.HandleFunc("/wmts", ix.wmts)
+	r.HandleFunc(wmtsRestPath+"WMTSCapabilities.xml", ix.wmtsCapabilities)
+	r.HandleFunc("/tiles/{layer}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{ext:[a-z]+}", ix.xyzTile)
+	r.HandleFunc("/tms/{layer}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{ext:[a-z]+}", ix.tmsTile)
+	r.HandleFunc(wmtsRestPath+"{layer}/{style}/{set}/{matrix:[0-9]+}/{row:[0-9]+}/{col:[0-9]+}.{ext:[a-z]+}", ix.wmtsTile)
+	r.Handle("/{path:.*}", http.StripPrefix("/", http.FileServer(http.Dir(appDir))))
+	return r
 }
 
-func render(w http.ResponseWriter, r *http.Request) {
-	err := MapRender(w, r)
+func (ix *Indexer) render(w http.ResponseWriter, r *http.Request) {
+	params := parseWmsParams(r.URL.Query())
+	switch strings.ToLower(params.get("REQUEST")) {
+	case "getmap", "map":
+		ix.getMap(w, r, params)
+		return
+	case "getcapabilities", "capabilities":
+		ix.getCapabilities(w, r, params)
+		return
+	}
+
+	err := ix.MapRender(w, r)
 
+	if errors.Is(err, errNoMapserv) {
+		serviceException(w, params.version(), "OperationNotSupported", "unsupported request "+params.get("REQUEST"))
+		return
+	}
 	if err != nil {
 		internalError(w, r, err)
 		return
@@ -58,8 +96,13 @@ func internalError(w http.ResponseWriter, r *http.Request, err error) {
 	}
 }
 
-func MapRender(dst io.Writer, r *http.Request /*mapReq Request2*/) error {
-	wd := filepath.Dir(MapfilePath)
+var errNoMapserv = errors.New("mapserv is not installed")
+
+func (ix *Indexer) MapRender(dst io.Writer, r *http.Request /*mapReq Request2*/) error {
+	if mapservPath == "" || ix.Mapfile == "" {
+		return errNoMapserv
+	}
+	wd := filepath.Dir(ix.Mapfile)
 	handler := cgi.Handler{
 		Path: mapservPath,
 		Dir:  wd,
@@ -69,7 +112,7 @@ func MapRender(dst io.Writer, r *http.Request /*mapReq Request2*/) error {
 		Body: dst,
 	}
 
-	query := "/?MAP=" + url.QueryEscape(MapfilePath) + "&" + r.URL.RawQuery
+	query := "/?MAP=" + url.QueryEscape(ix.Mapfile) + "&" + r.URL.RawQuery
 	//	if !strings.Contains(query, "GetCapabilities") {
 	//		query = query + "&LAYERS=map"
 	//	}
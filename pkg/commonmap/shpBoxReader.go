@@ -0,0 +1,348 @@
+package commonmap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// This file reads back the series indexes ShpBoxWriter creates: the boxes of the SHP,
+// through the SHX offsets, the attributes of the DBF and bbox queries answered by the QIX.
+
+// IndexRecord is a frame of a series index, ID counting from 0 in file order
+type IndexRecord struct {
+	ID  int
+	Box Box
+}
+
+// ShpBoxReader reads a series index
+type ShpBoxReader struct {
+	shp, shx, dbf, qix *os.File // qix nil when the index has none
+	count              int
+	bbox               Box
+	dbfHeader          dbfHeader
+}
+
+// dbfHeader locates the records and fields of a DBF
+type dbfHeader struct {
+	count        int
+	headerLength int64
+	recordLength int64
+	fields       []dbfColumn
+}
+
+type dbfColumn struct {
+	name         string
+	offset, size int
+}
+
+// Open opens the index of a series
+func (ix *Indexer) Open(seriesCode string) (*ShpBoxReader, error) {
+	return OpenShapefile(filepath.Join(ix.Dir, seriesCode+".shp"))
+}
+
+// OpenShapefile opens an index by the path of its SHP, the SHX and DBF beside it.
+// The QIX is optional.
+func OpenShapefile(shpPath string) (r *ShpBoxReader, err error) {
+	base := strings.TrimSuffix(shpPath, filepath.Ext(shpPath))
+	r = &ShpBoxReader{}
+	defer func() {
+		if err != nil {
+			_ = r.Close()
+		}
+	}()
+	if r.shp, err = os.Open(shpPath); err != nil {
+		return nil, err
+	}
+	if r.shx, err = os.Open(base + ".shx"); err != nil {
+		return nil, err
+	}
+	if r.dbf, err = os.Open(base + ".dbf"); err != nil {
+		return nil, err
+	}
+	if r.qix, err = os.Open(base + ".qix"); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		r.qix = nil
+	}
+
+	head := make([]byte, 100)
+	if _, err = r.shp.ReadAt(head, 0); err != nil {
+		return nil, fmt.Errorf("reading %s header: %w", shpPath, err)
+	}
+	if binary.BigEndian.Uint32(head[0:4]) != 9994 {
+		return nil, fmt.Errorf("%s is not a shapefile", shpPath)
+	}
+	for i := range r.bbox {
+		r.bbox[i] = math.Float64frombits(binary.LittleEndian.Uint64(head[36+i*8:]))
+	}
+	info, err := r.shx.Stat()
+	if err != nil {
+		return nil, err
+	}
+	r.count = int((info.Size() - 100) / 8)
+	if r.dbfHeader, err = readDbfHeader(r.dbf); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func readDbfHeader(file *os.File) (dbfHeader, error) {
+	head := make([]byte, 32)
+	if _, err := file.ReadAt(head, 0); err != nil {
+		return dbfHeader{}, fmt.Errorf("reading %s header: %w", file.Name(), err)
+	}
+	h := dbfHeader{
+		count:        int(binary.LittleEndian.Uint32(head[4:8])),
+		headerLength: int64(binary.LittleEndian.Uint16(head[8:10])),
+		recordLength: int64(binary.LittleEndian.Uint16(head[10:12])),
+	}
+	if h.headerLength < 33 {
+		return h, fmt.Errorf("%s has a malformed header", file.Name())
+	}
+	fields := make([]byte, h.headerLength-32)
+	if _, err := file.ReadAt(fields, 32); err != nil {
+		return h, fmt.Errorf("reading %s fields: %w", file.Name(), err)
+	}
+	offset := 1 // deletion flag
+	for i := 0; i+32 <= len(fields) && fields[i] != '\r'; i += 32 {
+		name := strings.TrimRight(string(fields[i:i+11]), "\x00 ")
+		size := int(fields[i+16])
+		if fields[i+11] == 'C' {
+			size += int(fields[i+17]) << 8 // wide character field
+		}
+		// never read past the record, whatever the field claims
+		size = max(min(size, int(h.recordLength)-offset), 0)
+		h.fields = append(h.fields, dbfColumn{strings.ToLower(name), offset, size})
+		offset += size
+	}
+	return h, nil
+}
+
+// Close closes the files of the index
+func (r *ShpBoxReader) Close() error {
+	var errs []error
+	for _, file := range []*os.File{r.shp, r.shx, r.dbf, r.qix} {
+		if file != nil {
+			errs = append(errs, file.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Len is the number of records
+func (r *ShpBoxReader) Len() int {
+	return r.count
+}
+
+// Bounds is the extent of the index
+func (r *ShpBoxReader) Bounds() Box {
+	return r.bbox
+}
+
+// Fields names the DBF columns, in lower case
+func (r *ShpBoxReader) Fields() []string {
+	names := make([]string, len(r.dbfHeader.fields))
+	for i, f := range r.dbfHeader.fields {
+		names[i] = f.name
+	}
+	return names
+}
+
+// Record reads a record's box through the SHX
+func (r *ShpBoxReader) Record(id int) (IndexRecord, error) {
+	if id < 0 || id >= r.count {
+		return IndexRecord{}, fmt.Errorf("record %d is out of range of %s", id, r.shp.Name())
+	}
+	entry := make([]byte, 8)
+	if _, err := r.shx.ReadAt(entry, 100+int64(id)*8); err != nil {
+		return IndexRecord{}, err
+	}
+	offset := int64(binary.BigEndian.Uint32(entry[0:4])) * 2
+	length := int(binary.BigEndian.Uint32(entry[4:8])) * 2
+	if length < 36 {
+		return IndexRecord{}, fmt.Errorf("record %d of %s has no box", id, r.shp.Name())
+	}
+	content := make([]byte, 36)
+	if _, err := r.shp.ReadAt(content, offset+8); err != nil {
+		return IndexRecord{}, err
+	}
+	return IndexRecord{id, shapeBox(content)}, nil
+}
+
+// shapeBox reads the box of a polygon record's content
+func shapeBox(content []byte) Box {
+	var box Box
+	for i := range box {
+		box[i] = math.Float64frombits(binary.LittleEndian.Uint64(content[4+i*8:]))
+	}
+	return box
+}
+
+// Scan calls fn for every record in file order, until it returns false
+func (r *ShpBoxReader) Scan(fn func(IndexRecord) bool) error {
+	sr := bufio.NewReaderSize(io.NewSectionReader(r.shp, 100, math.MaxInt64-100), 65536)
+	head := make([]byte, 8)
+	content := make([]byte, 0, 136)
+	for id := 0; ; id++ {
+		if _, err := io.ReadFull(sr, head); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		length := int(binary.BigEndian.Uint32(head[4:8])) * 2
+		if cap(content) < length {
+			content = make([]byte, length)
+		}
+		content = content[:length]
+		if _, err := io.ReadFull(sr, content); err != nil {
+			return err
+		}
+		if length < 36 {
+			continue // null shape
+		}
+		if !fn(IndexRecord{id, shapeBox(content)}) {
+			return nil
+		}
+	}
+}
+
+// Query finds the records intersecting a box, in file order. The QIX narrows the
+// candidates when there is one, otherwise every record is read.
+func (r *ShpBoxReader) Query(box Box) ([]IndexRecord, error) {
+	var found []IndexRecord
+	if r.qix == nil {
+		err := r.Scan(func(rec IndexRecord) bool {
+			if boxesIntersect(&rec.Box, &box) {
+				found = append(found, rec)
+			}
+			return true
+		})
+		return found, err
+	}
+
+	ids, err := r.qixCandidates(box)
+	if err != nil {
+		return nil, err
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		rec, err := r.Record(id)
+		if err != nil {
+			return nil, err
+		}
+		if boxesIntersect(&rec.Box, &box) {
+			found = append(found, rec)
+		}
+	}
+	return found, nil
+}
+
+// qixCandidates walks the quadtree for the ids of the nodes intersecting a box, shape
+// ids counting from 0
+func (r *ShpBoxReader) qixCandidates(box Box) ([]int, error) {
+	head := make([]byte, 16)
+	if _, err := r.qix.ReadAt(head, 0); err != nil {
+		return nil, fmt.Errorf("reading %s header: %w", r.qix.Name(), err)
+	}
+	if string(head[0:3]) != "SQT" {
+		return nil, fmt.Errorf("%s is not a quadtree", r.qix.Name())
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if head[3] == 2 {
+		order = binary.BigEndian
+	}
+
+	var ids []int
+	node := make([]byte, 40)
+	var visit func(pos int64) (int64, error) // returns the position past the node
+	visit = func(pos int64) (int64, error) {
+		if _, err := r.qix.ReadAt(node, pos); err != nil {
+			return 0, err
+		}
+		skip := int64(order.Uint32(node[0:4]))
+		var nodeBox Box
+		for i := range nodeBox {
+			nodeBox[i] = math.Float64frombits(order.Uint64(node[4+i*8:]))
+		}
+		shapes := int64(order.Uint32(node[36:40]))
+		childrenAt := pos + 40 + shapes*4 + 4
+		if !boxesIntersect(&nodeBox, &box) {
+			return childrenAt + skip, nil
+		}
+		tail := make([]byte, shapes*4+4)
+		if _, err := r.qix.ReadAt(tail, pos+40); err != nil {
+			return 0, err
+		}
+		for i := int64(0); i < shapes; i++ {
+			if id := int(order.Uint32(tail[i*4:])); id < r.count {
+				ids = append(ids, id)
+			}
+		}
+		children := int(order.Uint32(tail[shapes*4:]))
+		next := childrenAt
+		for i := 0; i < children; i++ {
+			var err error
+			if next, err = visit(next); err != nil {
+				return 0, err
+			}
+		}
+		return next, nil
+	}
+	if _, err := visit(16); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", r.qix.Name(), err)
+	}
+	return ids, nil
+}
+
+// Attributes reads a record's DBF values by field name, spaces trimmed
+func (r *ShpBoxReader) Attributes(id int) (map[string]string, error) {
+	record, err := r.dbfRecord(id)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(r.dbfHeader.fields))
+	for _, f := range r.dbfHeader.fields {
+		values[f.name] = strings.TrimSpace(string(record[f.offset : f.offset+f.size]))
+	}
+	return values, nil
+}
+
+// Attribute reads a single DBF value of a record
+func (r *ShpBoxReader) Attribute(id int, name string) (string, error) {
+	h := &r.dbfHeader
+	for _, f := range h.fields {
+		if f.name != strings.ToLower(name) {
+			continue
+		}
+		if id < 0 || id >= h.count {
+			return "", fmt.Errorf("record %d is past the end of %s", id, r.dbf.Name())
+		}
+		buf := make([]byte, f.size)
+		if _, err := r.dbf.ReadAt(buf, h.headerLength+int64(id)*h.recordLength+int64(f.offset)); err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(buf)), nil
+	}
+	return "", fmt.Errorf("no %s field in %s", name, r.dbf.Name())
+}
+
+func (r *ShpBoxReader) dbfRecord(id int) ([]byte, error) {
+	h := &r.dbfHeader
+	if id < 0 || id >= h.count {
+		return nil, fmt.Errorf("record %d is past the end of %s", id, r.dbf.Name())
+	}
+	record := make([]byte, h.recordLength)
+	if _, err := r.dbf.ReadAt(record, h.headerLength+int64(id)*h.recordLength); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
@@ -0,0 +1,180 @@
+package commonmap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writeShapefile writes a series index of boxes, frame i located at locations(i)
+func writeShapefile(t *testing.T, seriesCode string, boxes []Box, locations func(i int) string) string {
+	t.Helper()
+	dir := t.TempDir()
+	w, err := Create(dir, seriesCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, box := range boxes {
+		if err := w.WriteBox(RpfBox{locations(i), box}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range boxes {
+		if err := w.WriteAttributes(NewFrameAttributes(locations(i), nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, seriesCode+".shp")
+}
+
+func TestShapefileRoundTrip(t *testing.T) {
+	boxes := qixHoldings("JG", 2000, 8, 7)
+	location := func(i int) string { return frameLocation("JG", i) }
+	shpPath := writeShapefile(t, "JG", boxes, location)
+
+	for _, qix := range []bool{true, false} {
+		if !qix {
+			if err := os.Remove(strings.TrimSuffix(shpPath, ".shp") + ".qix"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		r, err := OpenShapefile(shpPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Len() != len(boxes) || r.Bounds() != extentOf(boxes) {
+			t.Fatalf("index of %d records in %v, want %d in %v", r.Len(), r.Bounds(), len(boxes), extentOf(boxes))
+		}
+		if fields := r.Fields(); len(fields) != len(dbfFields) || fields[0] != "location" {
+			t.Fatalf("DBF fields %v", fields)
+		}
+		for _, id := range []int{0, 1, len(boxes) / 2, len(boxes) - 1} {
+			rec, err := r.Record(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			attributes, err := r.Attributes(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Box != boxes[id] || attributes["location"] != location(id) || attributes["series"] != "JG" {
+				t.Fatalf("record %d is %v at %v, want %v at %s", id, rec.Box, attributes, boxes[id], location(id))
+			}
+		}
+
+		for _, q := range append(qixQueries(boxes, 100, 8), Box{-180, -90, 180, 90}, Box{0, 0, 0, 0}) {
+			var want []int
+			for id := range boxes {
+				if boxesIntersect(&boxes[id], &q) {
+					want = append(want, id)
+				}
+			}
+			found, err := r.Query(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []int
+			for _, rec := range found {
+				if rec.Box != boxes[rec.ID] {
+					t.Fatalf("record %d read as %v, written %v", rec.ID, rec.Box, boxes[rec.ID])
+				}
+				got = append(got, rec.ID)
+			}
+			if !slices.Equal(got, want) {
+				t.Fatalf("qix %v: query %v found %d records, want %d", qix, q, len(got), len(want))
+			}
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReadDbfHeaderWideCharacterFields(t *testing.T) {
+	tests := []struct {
+		name     string
+		location int
+	}{
+		{"narrow", 40},
+		{"widest narrow", 255},
+		{"wide", 256},
+		{"wider", 700},
+		{"longer than a record", dbfMaxRecord},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the first location is tt.location bytes long
+			locations := []string{strings.Repeat("d", tt.location-len("/000A0010.JG1")) + "/000A0010.JG1", "RPF/000B0010.JG1"}
+			shpPath := writeShapefile(t, "JG", qixHoldings("JG", 2, 1, 9), func(i int) string { return locations[i] })
+			r, err := OpenShapefile(shpPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = r.Close() }()
+
+			fields := dbfLayout(len(locations[0]))
+			offset := 1
+			for i, f := range r.dbfHeader.fields {
+				if f.name != fields[i].name || f.offset != offset || f.size != fields[i].size {
+					t.Fatalf("field %d is %v, want %s of %d at %d", i, f, fields[i].name, fields[i].size, offset)
+				}
+				offset += f.size
+			}
+			if int64(offset) != r.dbfHeader.recordLength {
+				t.Fatalf("fields end at %d, records are %d long", offset, r.dbfHeader.recordLength)
+			}
+			for i, location := range locations {
+				want := location[:min(len(location), fields[0].size)]
+				if got, err := r.Attribute(i, "location"); err != nil || got != want {
+					t.Fatalf("location %d read as %.40q (%v), want %.40q", i, got, err, want)
+				}
+				if got, err := r.Attribute(i, "type"); err != nil || got != "CADRG" {
+					t.Fatalf("type %d read as %q (%v), want CADRG", i, got, err)
+				}
+			}
+		})
+	}
+}
+
+func TestReadDbfHeaderClampsFields(t *testing.T) {
+	// a character field claiming 0x0120 bytes, a numeric one 0x30, in records of 0x40
+	head := make([]byte, 32, 32+2*32+1)
+	binary.LittleEndian.PutUint16(head[8:], 32+2*32+1)
+	binary.LittleEndian.PutUint16(head[10:], 0x40)
+	for _, f := range []struct {
+		name       string
+		kind, size byte
+		decimals   byte
+	}{{"location", 'C', 0x20, 0x01}, {"frame", 'N', 0x30, 0x01}} {
+		field := make([]byte, 32)
+		copy(field, f.name)
+		field[11], field[16], field[17] = f.kind, f.size, f.decimals
+		head = append(head, field...)
+	}
+	head = append(head, '\r')
+	path := filepath.Join(t.TempDir(), "JG.dbf")
+	if err := os.WriteFile(path, head, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = file.Close() }()
+
+	h, err := readDbfHeader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []dbfColumn{{"location", 1, 0x3f}, {"frame", 0x40, 0}}
+	if fmt.Sprint(h.fields) != fmt.Sprint(want) {
+		t.Fatalf("fields %v, want %v", h.fields, want)
+	}
+}
@@ -7,9 +7,11 @@ import (
 	"io"
 	"math"
 	"os"
-	"strings"
+	"path/filepath"
+	"time"
 )
 
+// ShpBoxWriter writes the index of a series as a shapefile, with its DBF, QIX and PRJ
 type ShpBoxWriter struct {
 	shp, shx, dbf, qix, prj *os.File
 	shpW, shxW, dbfW, qixW  *bufio.Writer
@@ -17,52 +19,65 @@ type ShpBoxWriter struct {
 	n                       int32
 	shxBuffer               []byte
 	shpBuffer               []byte
-	qixData                 *qixTree
+	boxes                   []Box             // for the quadtree, bulk loaded on Close
+	dbfRecords              []FrameAttributes // held until Close, which sizes the location field
+	longestLocation         int
+
+	// Dir is the directory of the files
+	Dir string
+	// QixDepth is the depth of the quadtree, 0 to pick it from the feature count
+	QixDepth int
 }
 
-func Create(seriesCode string) (*ShpBoxWriter, error) {
-	shp, err := os.Create(GetIndexPath(seriesCode + ".shp"))
-	if err != nil {
+// Create opens a writer for the index of a series in dir
+func Create(dir, seriesCode string) (*ShpBoxWriter, error) {
+	s := &ShpBoxWriter{Dir: dir}
+	if err := s.Open(seriesCode); err != nil {
 		return nil, err
 	}
-	shx, err := os.Create(GetIndexPath(seriesCode + ".shx"))
+	return s, nil
+}
+
+func (s *ShpBoxWriter) path(fileName string) string {
+	return filepath.Join(s.Dir, fileName)
+}
+
+// Open creates the files of a series
+func (s *ShpBoxWriter) Open(seriesCode string) error {
+	shp, err := os.Create(s.path(seriesCode + ".shp"))
 	if err != nil {
-		return nil, err
+		return err
 	}
-	dbf, err := os.Create(GetIndexPath(seriesCode + ".dbf"))
+	shx, err := os.Create(s.path(seriesCode + ".shx"))
 	if err != nil {
-		return nil, err
+		return err
 	}
-	qix, err := os.Create(GetIndexPath(seriesCode + ".qix"))
+	dbf, err := os.Create(s.path(seriesCode + ".dbf"))
 	if err != nil {
-		return nil, err
+		return err
 	}
-	prj, err := os.Create(GetIndexPath(seriesCode + ".prj"))
+	qix, err := os.Create(s.path(seriesCode + ".qix"))
 	if err != nil {
-		return nil, err
+		return err
+	}
+	prj, err := os.Create(s.path(seriesCode + ".prj"))
+	if err != nil {
+		return err
 	}
 
 	// Skip headers at first, we'll write them on Close().
 	mustSeek(shp, 100, os.SEEK_SET)
 	mustSeek(shx, 100, os.SEEK_SET)
-	mustSeek(dbf, 65, os.SEEK_SET)
 
 	// Create the buffered writers used for all subsequent record writes.
-	s := &ShpBoxWriter{
-		shp:       shp,
-		shx:       shx,
-		dbf:       dbf,
-		qix:       qix,
-		prj:       prj,
-		shpW:      bufio.NewWriterSize(shp, 8192),
-		shxW:      bufio.NewWriterSize(shx, 8192),
-		dbfW:      bufio.NewWriterSize(dbf, 8192),
-		qixW:      bufio.NewWriterSize(qix, 8192),
-		bbox:      Box{0.0, 0.0, 0.0, 0.0},
-		shxBuffer: make([]byte, 8, 8),
-		shpBuffer: make([]byte, 136, 136),
-		qixData:   CreateQixTree(),
-	}
+	s.shp, s.shx, s.dbf, s.qix, s.prj = shp, shx, dbf, qix, prj
+	s.shpW = bufio.NewWriterSize(shp, 8192)
+	s.shxW = bufio.NewWriterSize(shx, 8192)
+	s.dbfW = bufio.NewWriterSize(dbf, 8192)
+	s.qixW = bufio.NewWriterSize(qix, 8192)
+	s.bbox = Box{0.0, 0.0, 0.0, 0.0}
+	s.shxBuffer = make([]byte, 8, 8)
+	s.shpBuffer = make([]byte, 136, 136)
 
 	// Pre-populate fixed record values.
 	putBigInt32(s.shxBuffer, 64, 4)        // Content Length (64 16-bit words)
@@ -72,19 +87,28 @@ func Create(seriesCode string) (*ShpBoxWriter, error) {
 	putLilInt32(s.shpBuffer, int32(5), 48) // number of points
 	putLilInt32(s.shpBuffer, int32(0), 52) // index to part 0
 
-	return s, nil
+	return nil
 }
 
-func (s *ShpBoxWriter) Close() {
+// Close writes the headers, the DBF and the QIX, then closes the files
+func (s *ShpBoxWriter) Close() (err error) {
+	defer func() {
+		// the must helpers panic on I/O errors
+		if r := recover(); r != nil {
+			e, ok := r.(error)
+			if !ok {
+				panic(r)
+			}
+			err = fmt.Errorf("closing %s: %w", s.shp.Name(), e)
+		}
+	}()
 	mustFlush(s.shpW)
 	mustFlush(s.shxW)
-	mustFlush(s.dbfW)
 	mustSeek(s.shp, 0, os.SEEK_SET)
 	mustSeek(s.shx, 0, os.SEEK_SET)
-	mustSeek(s.dbf, 0, os.SEEK_SET)
 	s.writeHeader(s.shx)
 	s.writeHeader(s.shp)
-	s.writeDbfHeader(s.dbf)
+	s.writeDbf()
 
 	s.writePrjContent(s.prj)
 	s.writeQixContent(s.qix)
@@ -93,6 +117,7 @@ func (s *ShpBoxWriter) Close() {
 	mustClose(s.dbf)
 	mustClose(s.prj)
 	mustClose(s.qix)
+	return nil
 }
 
 // grow a bbox by another bbox
@@ -111,7 +136,8 @@ func extendBbox(old, new *Box) {
 	}
 }
 
-func (s *ShpBoxWriter) WriteBox(rpf RpfBox) {
+// WriteBox adds a frame's footprint
+func (s *ShpBoxWriter) WriteBox(rpf RpfBox) error {
 	var bbox = rpf.box
 	if s.n == 0 {
 		s.bbox = bbox
@@ -137,21 +163,26 @@ func (s *ShpBoxWriter) WriteBox(rpf RpfBox) {
 	putLilFloat64(shpBuffer, bbox[1], 112)
 	putLilFloat64(shpBuffer, bbox[0], 120)
 	putLilFloat64(shpBuffer, bbox[3], 128)
-	_, err := s.shpW.Write(shpBuffer)
-	if err != nil {
-		fmt.Println("error writing shp: ", err)
+	if _, err := s.shpW.Write(shpBuffer); err != nil {
+		return fmt.Errorf("error writing shp: %w", err)
 	}
 
 	// write shx
 	putBigInt32(s.shxBuffer, -18+(68*s.n), 0) // start index
-	mustBufferedWrite(s.shxW, s.shxBuffer)
+	if _, err := s.shxW.Write(s.shxBuffer); err != nil {
+		return fmt.Errorf("error writing shx: %w", err)
+	}
 
 	// Build in-memory QIX tree.
-	s.qixData.Insert(s.n, &bbox)
+	s.boxes = append(s.boxes, bbox) // shape ids count from 0
+	return nil
 }
 
-func (s *ShpBoxWriter) WriteDbf(path string) {
-	mustWriteStringBuffered(s.dbfW, pad(path))
+// WriteAttributes adds the DBF record of the next frame
+func (s *ShpBoxWriter) WriteAttributes(attributes FrameAttributes) error {
+	s.dbfRecords = append(s.dbfRecords, attributes)
+	s.longestLocation = max(s.longestLocation, len(attributes.Location))
+	return nil
 }
 
 // Writes SHP/SHX headers to specified file.
@@ -176,42 +207,65 @@ func (s *ShpBoxWriter) writeHeader(file *os.File) {
 	Write(file, binary.LittleEndian, []float64{0.0, 0.0, 0.0, 0.0})
 }
 
+// Write the DBF, its location field as wide as the longest location.
+func (s *ShpBoxWriter) writeDbf() {
+	fields := dbfLayout(s.longestLocation)
+	s.writeDbfHeader(s.dbfW, fields)
+	for i := range s.dbfRecords {
+		if len(s.dbfRecords[i].Location) > fields[0].size {
+			fmt.Printf("Location too long for the index, truncated : %s\n", s.dbfRecords[i].Location)
+		}
+		mustBufferedWrite(s.dbfW, dbfRecord(fields, &s.dbfRecords[i]))
+	}
+	mustFlush(s.dbfW)
+	s.dbfRecords = nil
+}
+
 // Write DBF header.
-func (s *ShpBoxWriter) writeDbfHeader(file *os.File) {
-	mustSeek(file, 0, os.SEEK_SET)
-	// version, year (YEAR-1990), month, day
-	Write(file, binary.LittleEndian, []byte{3, 24, 5, 3})
+func (s *ShpBoxWriter) writeDbfHeader(file io.Writer, fields []dbfField) {
+	// version, year (YEAR-1900), month, day
+	now := time.Now()
+	Write(file, binary.LittleEndian, []byte{3, byte(now.Year() - 1900), byte(now.Month()), byte(now.Day())})
 	// number of records
 	Write(file, binary.LittleEndian, s.n)
 	// header length (#fields * 32 + 33), record length (field sizes + 1)
-	Write(file, binary.LittleEndian, []int16{65, 255})
+	Write(file, binary.LittleEndian, []uint16{uint16(dbfHeaderLength), uint16(dbfRecordLength(fields))})
 	// padding
 	Write(file, binary.LittleEndian, make([]byte, 20))
-	// location field
-	Write(file, binary.LittleEndian, []byte("location   ")) // Name
-	Write(file, binary.LittleEndian, []byte("C"))           // Fieldtype
-	Write(file, binary.LittleEndian, make([]byte, 4))       // Addr
-	Write(file, binary.LittleEndian, uint8(255))            // Size
-	Write(file, binary.LittleEndian, uint8(0))              // Precision
-	Write(file, binary.LittleEndian, make([]byte, 14))      // Padding
+	for _, f := range fields {
+		name := make([]byte, 11)
+		copy(name, f.name)
+		decimals := f.decimals
+		if f.kind == 'C' {
+			decimals = f.size >> 8 // high byte of wide character fields
+		}
+		Write(file, binary.LittleEndian, name)             // Name
+		Write(file, binary.LittleEndian, f.kind)           // Fieldtype
+		Write(file, binary.LittleEndian, make([]byte, 4))  // Addr
+		Write(file, binary.LittleEndian, uint8(f.size))    // Size
+		Write(file, binary.LittleEndian, uint8(decimals))  // Precision
+		Write(file, binary.LittleEndian, make([]byte, 14)) // Padding
+	}
 	// end with return
 	Write(file, binary.LittleEndian, []byte("\r"))
 }
 
-func pad(s string) string {
-	return " " + s + strings.Repeat(" ", 254-len(s))
-}
-
 func (s *ShpBoxWriter) writePrjContent(file *os.File) {
 	mustWriteStringFile(file, `GEOGCS["GCS_WGS_1984",DATUM["D_WGS_1984",SPHEROID["WGS_1984",6378137,298.257223563]],PRIMEM["Greenwich",0],UNIT["Degree",0.017453292519943295]]`)
 }
 
+// writeQixContent writes the quadtree. Shape ids count from 0 as shptree and mapserv
+// take them; earlier writers counted from 1, so their .qix files point each id at the
+// next shape and must be rebuilt.
 func (s *ShpBoxWriter) writeQixContent(file *os.File) {
 	header := [8]byte{'S', 'Q', 'T', 1, 1, 0, 0, 0}
 	Write(file, binary.BigEndian, header)
-	Write(file, binary.LittleEndian, s.qixData.numFeatures)
-	Write(file, binary.LittleEndian, int32(12))
-	s.writeQixNode(file, s.qixData.root)
+	tree := buildQixTree(s.boxes, s.bbox, s.QixDepth)
+	Write(file, binary.LittleEndian, tree.numFeatures)
+	Write(file, binary.LittleEndian, tree.depth)
+	w := bufio.NewWriterSize(file, 65536)
+	s.writeQixNode(w, tree.root)
+	mustFlush(w)
 }
 
 // calculate # of bytes to skip this node and subnodes
@@ -226,7 +280,7 @@ func qixGetNodeSkipOffset(node *qixNode) int32 {
 	return (offset)
 }
 
-func (s *ShpBoxWriter) writeQixNode(file *os.File, node *qixNode) {
+func (s *ShpBoxWriter) writeQixNode(file io.Writer, node *qixNode) {
 	offset := qixGetNodeSkipOffset(node)
 	size := 44 + (node.numFeatures * 4)
 	qixBuffer := make([]byte, size, size)
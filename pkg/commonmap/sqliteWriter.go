@@ -0,0 +1,523 @@
+package commonmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+)
+
+// This file writes SQLite database files from scratch, for the GeoPackage output. Tables
+// are written once, rows in rowid order, straight into b-tree pages; there is no
+// journal, no free list and nothing is ever updated in place.
+
+const (
+	sqlitePageSize = 4096
+	sqliteVersion  = 3045000 // the library version the file claims to be written by
+
+	pageTableLeaf     = 0x0d
+	pageTableInterior = 0x05
+	pageIndexLeaf     = 0x0a
+	pageIndexInterior = 0x02
+)
+
+// sqliteWriter lays out a database, page 1 being written last with the schema
+type sqliteWriter struct {
+	file   *os.File
+	pages  uint32 // allocated so far
+	schema []schemaEntry
+}
+
+// schemaEntry is a row of sqlite_master
+type schemaEntry struct {
+	kind, name, table string
+	root              uint32
+	sql               any // string, or nil for automatic indexes
+}
+
+func createSQLite(path string) (*sqliteWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteWriter{file: file, pages: 1}, nil // page 1 is the schema's
+}
+
+func (w *sqliteWriter) allocate() uint32 {
+	w.pages++
+	return w.pages
+}
+
+func (w *sqliteWriter) writePage(page uint32, data []byte) error {
+	_, err := w.file.WriteAt(data, int64(page-1)*sqlitePageSize)
+	return err
+}
+
+// addSchema records a table, index, view or trigger in sqlite_master
+func (w *sqliteWriter) addSchema(kind, name, table string, root uint32, sql any) {
+	w.schema = append(w.schema, schemaEntry{kind, name, table, root, sql})
+}
+
+// close writes the schema and the database header. userVersion and applicationID
+// identify the kind of database, as GeoPackage does.
+func (w *sqliteWriter) close(userVersion, applicationID uint32) error {
+	t := w.newTable()
+	for i, e := range w.schema {
+		if err := t.add(int64(i+1), e.kind, e.name, e.table, int64(e.root), e.sql); err != nil {
+			_ = w.file.Close()
+			return err
+		}
+	}
+	if _, err := t.finish(1); err != nil {
+		_ = w.file.Close()
+		return err
+	}
+
+	header := make([]byte, 100)
+	copy(header, "SQLite format 3\x00")
+	binary.BigEndian.PutUint16(header[16:], sqlitePageSize)
+	header[18], header[19] = 1, 1                   // legacy journal
+	header[21], header[22], header[23] = 64, 32, 32 // payload fractions
+	binary.BigEndian.PutUint32(header[24:], 1)      // change counter
+	binary.BigEndian.PutUint32(header[28:], w.pages)
+	binary.BigEndian.PutUint32(header[40:], 1) // schema cookie
+	binary.BigEndian.PutUint32(header[44:], 4) // schema format
+	binary.BigEndian.PutUint32(header[56:], 1) // UTF-8
+	binary.BigEndian.PutUint32(header[60:], userVersion)
+	binary.BigEndian.PutUint32(header[68:], applicationID)
+	binary.BigEndian.PutUint32(header[92:], 1) // version valid for the change counter
+	binary.BigEndian.PutUint32(header[96:], sqliteVersion)
+	_, err := w.file.WriteAt(header, 0)
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// appendVarint encodes a SQLite varint, big endian in groups of 7 bits, the ninth byte whole
+func appendVarint(b []byte, v uint64) []byte {
+	if v > 1<<56-1 {
+		var buf [9]byte
+		buf[8] = byte(v)
+		v >>= 8
+		for i := 7; i >= 0; i-- {
+			buf[i] = byte(v&0x7f) | 0x80
+			v >>= 7
+		}
+		return append(b, buf[:]...)
+	}
+	var buf [8]byte
+	n := 0
+	for {
+		buf[n] = byte(v & 0x7f)
+		n++
+		v >>= 7
+		if v == 0 {
+			break
+		}
+	}
+	for i := n - 1; i >= 0; i-- {
+		c := buf[i]
+		if i != 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+	}
+	return b
+}
+
+// encodeRecord serializes column values: nil, int, int64, float64, string or []byte
+func encodeRecord(values ...any) []byte {
+	var types []byte
+	var body []byte
+	for _, v := range values {
+		switch v := v.(type) {
+		case nil:
+			types = appendVarint(types, 0)
+		case int:
+			types, body = appendInteger(types, body, int64(v))
+		case int64:
+			types, body = appendInteger(types, body, v)
+		case float64:
+			types = appendVarint(types, 7)
+			body = binary.BigEndian.AppendUint64(body, math.Float64bits(v))
+		case string:
+			types = appendVarint(types, uint64(len(v))*2+13)
+			body = append(body, v...)
+		case []byte:
+			types = appendVarint(types, uint64(len(v))*2+12)
+			body = append(body, v...)
+		default:
+			panic(fmt.Sprintf("cannot store %T in a record", v))
+		}
+	}
+	// the header length counts its own varint
+	length := len(types) + 1
+	for len(appendVarint(nil, uint64(length)))+len(types) != length {
+		length++
+	}
+	record := appendVarint(make([]byte, 0, length+len(body)), uint64(length))
+	record = append(record, types...)
+	return append(record, body...)
+}
+
+func appendInteger(types, body []byte, v int64) ([]byte, []byte) {
+	switch {
+	case v == 0:
+		return appendVarint(types, 8), body
+	case v == 1:
+		return appendVarint(types, 9), body
+	case v >= math.MinInt8 && v <= math.MaxInt8:
+		return appendVarint(types, 1), append(body, byte(v))
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		return appendVarint(types, 2), binary.BigEndian.AppendUint16(body, uint16(v))
+	case v >= -1<<23 && v < 1<<23:
+		return appendVarint(types, 3), append(body, byte(v>>16), byte(v>>8), byte(v))
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		return appendVarint(types, 4), binary.BigEndian.AppendUint32(body, uint32(v))
+	case v >= -1<<47 && v < 1<<47:
+		return appendVarint(types, 5), append(body, byte(v>>40), byte(v>>32), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	default:
+		return appendVarint(types, 6), binary.BigEndian.AppendUint64(body, uint64(v))
+	}
+}
+
+// btreePage collects the cells of a page
+type btreePage struct {
+	kind  byte
+	start int // 100 on page 1, after the database header
+	cells [][]byte
+	used  int
+	right uint32 // right-most child of interior pages
+}
+
+func newPage(kind byte, page uint32) *btreePage {
+	p := &btreePage{kind: kind}
+	if page == 1 {
+		p.start = 100
+	}
+	return p
+}
+
+func (p *btreePage) headerSize() int {
+	if p.kind == pageTableInterior || p.kind == pageIndexInterior {
+		return 12
+	}
+	return 8
+}
+
+func (p *btreePage) fits(cell []byte) bool {
+	return p.start+p.headerSize()+2*(len(p.cells)+1)+p.used+len(cell) <= sqlitePageSize
+}
+
+func (p *btreePage) add(cell []byte) {
+	p.cells = append(p.cells, cell)
+	p.used += len(cell)
+}
+
+// bytes lays the page out: header, cell pointers, then cells packed at the end
+func (p *btreePage) bytes() []byte {
+	data := make([]byte, sqlitePageSize)
+	h := data[p.start:]
+	h[0] = p.kind
+	content := sqlitePageSize
+	pointers := p.start + p.headerSize()
+	for i, cell := range p.cells {
+		content -= len(cell)
+		copy(data[content:], cell)
+		binary.BigEndian.PutUint16(data[pointers+2*i:], uint16(content))
+	}
+	binary.BigEndian.PutUint16(h[3:], uint16(len(p.cells)))
+	binary.BigEndian.PutUint16(h[5:], uint16(content%65536))
+	if p.headerSize() == 12 {
+		binary.BigEndian.PutUint32(h[8:], p.right)
+	}
+	return data
+}
+
+// spill keeps what a cell holds of a payload, writing the rest to overflow pages.
+// maxLocal differs between table and index pages.
+func (w *sqliteWriter) spill(cell, payload []byte, maxLocal int) ([]byte, error) {
+	if len(payload) <= maxLocal {
+		return append(cell, payload...), nil
+	}
+	const usable = sqlitePageSize
+	minLocal := (usable-12)*32/255 - 23
+	local := minLocal + (len(payload)-minLocal)%(usable-4)
+	if local > maxLocal {
+		local = minLocal
+	}
+	cell = append(cell, payload[:local]...)
+	rest := payload[local:]
+	first := w.allocate()
+	cell = binary.BigEndian.AppendUint32(cell, first)
+	for page := first; len(rest) > 0; {
+		data := make([]byte, usable)
+		n := copy(data[4:], rest)
+		rest = rest[n:]
+		next := uint32(0)
+		if len(rest) > 0 {
+			next = w.allocate()
+		}
+		binary.BigEndian.PutUint32(data, next)
+		if err := w.writePage(page, data); err != nil {
+			return nil, err
+		}
+		page = next
+	}
+	return cell, nil
+}
+
+// tableBuilder streams rows, in increasing rowid order, into a table b-tree
+type tableBuilder struct {
+	w        *sqliteWriter
+	leaf     *btreePage
+	children []btreeChild
+	last     int64
+	rows     int
+}
+
+type btreeChild struct {
+	page uint32
+	key  int64 // largest rowid below
+}
+
+func (w *sqliteWriter) newTable() *tableBuilder {
+	return &tableBuilder{w: w, leaf: newPage(pageTableLeaf, 0)}
+}
+
+func (t *tableBuilder) add(rowid int64, values ...any) error {
+	if t.rows > 0 && rowid <= t.last {
+		return fmt.Errorf("rowid %d after %d", rowid, t.last)
+	}
+	payload := encodeRecord(values...)
+	cell := appendVarint(nil, uint64(len(payload)))
+	cell = appendVarint(cell, uint64(rowid))
+	cell, err := t.w.spill(cell, payload, sqlitePageSize-35)
+	if err != nil {
+		return err
+	}
+	if !t.leaf.fits(cell) {
+		if err := t.flushLeaf(); err != nil {
+			return err
+		}
+	}
+	t.leaf.add(cell)
+	t.last = rowid
+	t.rows++
+	return nil
+}
+
+func (t *tableBuilder) flushLeaf() error {
+	page := t.w.allocate()
+	t.children = append(t.children, btreeChild{page, t.last})
+	data := t.leaf.bytes()
+	t.leaf = newPage(pageTableLeaf, 0)
+	return t.w.writePage(page, data)
+}
+
+// finish writes the rest of the tree, its root at page root or anywhere when 0
+func (t *tableBuilder) finish(root uint32) (uint32, error) {
+	if len(t.children) == 0 {
+		// a single leaf is the root, if it still fits there
+		leaf := t.leaf
+		leaf.start = newPage(pageTableLeaf, root).start
+		if fitsAll(leaf) {
+			if root == 0 {
+				root = t.w.allocate()
+			}
+			return root, t.w.writePage(root, leaf.bytes())
+		}
+		leaf.start = 0
+	}
+	if len(t.leaf.cells) > 0 {
+		if err := t.flushLeaf(); err != nil {
+			return 0, err
+		}
+	}
+
+	// interior levels, until the children fit under the root
+	children := t.children
+	for {
+		rootPage := newPage(pageTableInterior, root)
+		if len(children)-1 <= interiorCapacity(rootPage) {
+			for _, c := range children[:len(children)-1] {
+				rootPage.add(interiorCell(c))
+			}
+			rootPage.right = children[len(children)-1].page
+			if root == 0 {
+				root = t.w.allocate()
+			}
+			return root, t.w.writePage(root, rootPage.bytes())
+		}
+		perPage := interiorCapacity(newPage(pageTableInterior, 0)) + 1
+		groups := (len(children) + perPage - 1) / perPage
+		var parents []btreeChild
+		for g := 0; g < groups; g++ {
+			group := children[g*len(children)/groups : (g+1)*len(children)/groups]
+			p := newPage(pageTableInterior, 0)
+			for _, c := range group[:len(group)-1] {
+				p.add(interiorCell(c))
+			}
+			p.right = group[len(group)-1].page
+			page := t.w.allocate()
+			if err := t.w.writePage(page, p.bytes()); err != nil {
+				return 0, err
+			}
+			parents = append(parents, btreeChild{page, group[len(group)-1].key})
+		}
+		children = parents
+	}
+}
+
+// fitsAll tells whether the cells of a page still fit once its start moved
+func fitsAll(p *btreePage) bool {
+	return p.start+p.headerSize()+2*len(p.cells)+p.used <= sqlitePageSize
+}
+
+func interiorCell(c btreeChild) []byte {
+	return appendVarint(binary.BigEndian.AppendUint32(nil, c.page), uint64(c.key))
+}
+
+// interiorCapacity counts the interior cells a page holds at worst, 13 bytes and a pointer each
+func interiorCapacity(p *btreePage) int {
+	return (sqlitePageSize - p.start - p.headerSize()) / (13 + 2)
+}
+
+// writeIndex writes an index b-tree of keys, each the indexed values then the rowid
+func (w *sqliteWriter) writeIndex(keys [][]any) (uint32, error) {
+	sort.SliceStable(keys, func(i, j int) bool { return compareKeys(keys[i], keys[j]) < 0 })
+	maxLocal := (sqlitePageSize-12)*64/255 - 23
+	cells := make([][]byte, len(keys))
+	for i, key := range keys {
+		payload := encodeRecord(key...)
+		var err error
+		if cells[i], err = w.spill(appendVarint(nil, uint64(len(payload))), payload, maxLocal); err != nil {
+			return 0, err
+		}
+	}
+
+	// pack leaves, then move the last cell of each but the last leaf up as a divider.
+	// Cells are at most a quarter of a page, so leaves keep some.
+	leaves := []*btreePage{newPage(pageIndexLeaf, 0)}
+	for _, cell := range cells {
+		if leaf := leaves[len(leaves)-1]; !leaf.fits(cell) {
+			leaves = append(leaves, newPage(pageIndexLeaf, 0))
+		}
+		leaves[len(leaves)-1].add(cell)
+	}
+	dividers := make([][]byte, len(leaves)-1)
+	for i, leaf := range leaves[:len(leaves)-1] {
+		dividers[i] = leaf.cells[len(leaf.cells)-1]
+		leaf.cells = leaf.cells[:len(leaf.cells)-1]
+		leaf.used -= len(dividers[i])
+	}
+
+	pages := make([]uint32, len(leaves))
+	for i, leaf := range leaves {
+		pages[i] = w.allocate()
+		if err := w.writePage(pages[i], leaf.bytes()); err != nil {
+			return 0, err
+		}
+	}
+
+	// interior levels, each divider between two pages moving up when they fall on either
+	// side of a page full of cells, until the children fit under one root
+	for len(pages) > 1 {
+		var parents []*btreePage
+		var parentDividers [][]byte
+		p := newPage(pageIndexInterior, 0)
+		for i, child := range pages[:len(pages)-1] {
+			cell := append(binary.BigEndian.AppendUint32(nil, child), dividers[i]...)
+			if p.fits(cell) {
+				p.add(cell)
+				continue
+			}
+			p.right = child
+			parents = append(parents, p)
+			parentDividers = append(parentDividers, dividers[i])
+			p = newPage(pageIndexInterior, 0)
+		}
+		p.right = pages[len(pages)-1]
+		if len(p.cells) == 0 {
+			// keep a cell on the last page: the divider above comes down, the last
+			// cell of the page before goes up in its place
+			prev := parents[len(parents)-1]
+			last := prev.cells[len(prev.cells)-1]
+			p.add(append(binary.BigEndian.AppendUint32(nil, prev.right), parentDividers[len(parentDividers)-1]...))
+			prev.cells = prev.cells[:len(prev.cells)-1]
+			prev.used -= len(last)
+			prev.right = binary.BigEndian.Uint32(last)
+			parentDividers[len(parentDividers)-1] = last[4:]
+		}
+		parents = append(parents, p)
+
+		pages = make([]uint32, len(parents))
+		for i, parent := range parents {
+			pages[i] = w.allocate()
+			if err := w.writePage(pages[i], parent.bytes()); err != nil {
+				return 0, err
+			}
+		}
+		dividers = parentDividers
+	}
+	return pages[0], nil
+}
+
+// compareKeys orders index keys as SQLite does: NULL, numbers, text then blobs,
+// text and blobs byte by byte
+func compareKeys(a, b []any) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := compareValues(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
+
+func compareValues(a, b any) int {
+	rank := func(v any) int {
+		switch v.(type) {
+		case nil:
+			return 0
+		case int, int64, float64:
+			return 1
+		case string:
+			return 2
+		}
+		return 3
+	}
+	if ra, rb := rank(a), rank(b); ra != rb {
+		return ra - rb
+	}
+	switch a := a.(type) {
+	case nil:
+		return 0
+	case string:
+		return bytes.Compare([]byte(a), []byte(b.(string)))
+	case []byte:
+		return bytes.Compare(a, b.([]byte))
+	}
+	fa, fb := toFloat(a), toFloat(b)
+	switch {
+	case fa < fb:
+		return -1
+	case fa > fb:
+		return 1
+	}
+	return 0
+}
+
+func toFloat(v any) float64 {
+	switch v := v.(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return 0
+}
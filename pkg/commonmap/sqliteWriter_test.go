@@ -0,0 +1,264 @@
+package commonmap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// sqliteFile reads back the b-trees sqliteWriter lays out, overflow pages included
+type sqliteFile struct {
+	t    *testing.T
+	data []byte
+}
+
+func readSQLiteFile(t *testing.T, path string) *sqliteFile {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "SQLite format 3\x00") || len(data)%sqlitePageSize != 0 {
+		t.Fatalf("%s is not a SQLite database", path)
+	}
+	if pages := binary.BigEndian.Uint32(data[28:]); int(pages)*sqlitePageSize != len(data) {
+		t.Fatalf("%s claims %d pages, holds %d", path, pages, len(data)/sqlitePageSize)
+	}
+	return &sqliteFile{t, data}
+}
+
+func (f *sqliteFile) page(n uint32) []byte {
+	if n == 0 || int(n)*sqlitePageSize > len(f.data) {
+		f.t.Fatalf("page %d out of the file", n)
+	}
+	return f.data[int(n-1)*sqlitePageSize : int(n)*sqlitePageSize]
+}
+
+// cells returns the kind of a b-tree page, its cells and its right-most child
+func (f *sqliteFile) cells(n uint32) (byte, [][]byte, uint32) {
+	data := f.page(n)
+	h := data
+	if n == 1 {
+		h = data[100:]
+	}
+	kind := h[0]
+	count := int(binary.BigEndian.Uint16(h[3:]))
+	pointers, right := 8, uint32(0)
+	if kind == pageTableInterior || kind == pageIndexInterior {
+		pointers, right = 12, binary.BigEndian.Uint32(h[8:])
+	}
+	cells := make([][]byte, count)
+	for i := range cells {
+		cells[i] = data[binary.BigEndian.Uint16(h[pointers+2*i:]):]
+	}
+	return kind, cells, right
+}
+
+func readVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < 8; i++ {
+		v = v<<7 | uint64(b[i]&0x7f)
+		if b[i] < 0x80 {
+			return v, i + 1
+		}
+	}
+	return v<<8 | uint64(b[8]), 9
+}
+
+// payload gathers a payload of size bytes from a cell and its overflow pages
+func (f *sqliteFile) payload(cell []byte, size int, maxLocal int) []byte {
+	if size <= maxLocal {
+		return cell[:size]
+	}
+	minLocal := (sqlitePageSize-12)*32/255 - 23
+	local := minLocal + (size-minLocal)%(sqlitePageSize-4)
+	if local > maxLocal {
+		local = minLocal
+	}
+	payload := append([]byte(nil), cell[:local]...)
+	for next := binary.BigEndian.Uint32(cell[local:]); len(payload) < size; {
+		data := f.page(next)
+		payload = append(payload, data[4:min(sqlitePageSize, 4+size-len(payload))]...)
+		next = binary.BigEndian.Uint32(data)
+	}
+	return payload
+}
+
+func decodeRecord(record []byte) []any {
+	headerSize, n := readVarint(record)
+	types := record[n:headerSize]
+	body := record[headerSize:]
+	var values []any
+	for len(types) > 0 {
+		serial, n := readVarint(types)
+		types = types[n:]
+		switch {
+		case serial == 0:
+			values = append(values, nil)
+		case serial >= 1 && serial <= 6:
+			size := []int{0, 1, 2, 3, 4, 6, 8}[serial]
+			v := int64(0)
+			for i := 0; i < size; i++ {
+				v = v<<8 | int64(body[i])
+			}
+			shift := 64 - 8*size
+			values = append(values, v<<shift>>shift)
+			body = body[size:]
+		case serial == 7:
+			values = append(values, math.Float64frombits(binary.BigEndian.Uint64(body)))
+			body = body[8:]
+		case serial == 8 || serial == 9:
+			values = append(values, int64(serial-8))
+		case serial%2 == 0:
+			size := int(serial-12) / 2
+			values = append(values, append([]byte(nil), body[:size]...))
+			body = body[size:]
+		default:
+			size := int(serial-13) / 2
+			values = append(values, string(body[:size]))
+			body = body[size:]
+		}
+	}
+	return values
+}
+
+// tableRows walks a table b-tree in rowid order
+func (f *sqliteFile) tableRows(root uint32) ([]int64, [][]any) {
+	var rowids []int64
+	var rows [][]any
+	var walk func(n uint32)
+	walk = func(n uint32) {
+		kind, cells, right := f.cells(n)
+		switch kind {
+		case pageTableLeaf:
+			for _, cell := range cells {
+				size, a := readVarint(cell)
+				rowid, b := readVarint(cell[a:])
+				rowids = append(rowids, int64(rowid))
+				rows = append(rows, decodeRecord(f.payload(cell[a+b:], int(size), sqlitePageSize-35)))
+			}
+		case pageTableInterior:
+			for _, cell := range cells {
+				walk(binary.BigEndian.Uint32(cell))
+			}
+			walk(right)
+		default:
+			f.t.Fatalf("page %d of kind %#x in a table", n, kind)
+		}
+	}
+	walk(root)
+	return rowids, rows
+}
+
+// indexKeys walks an index b-tree in key order, with the depth of each leaf
+func (f *sqliteFile) indexKeys(root uint32) ([][]any, []int) {
+	maxLocal := (sqlitePageSize-12)*64/255 - 23
+	var keys [][]any
+	var depths []int
+	var walk func(n uint32, depth int)
+	walk = func(n uint32, depth int) {
+		kind, cells, right := f.cells(n)
+		switch kind {
+		case pageIndexLeaf:
+			for _, cell := range cells {
+				size, a := readVarint(cell)
+				keys = append(keys, decodeRecord(f.payload(cell[a:], int(size), maxLocal)))
+			}
+			depths = append(depths, depth)
+		case pageIndexInterior:
+			if len(cells) == 0 {
+				f.t.Fatalf("interior index page %d has no cells", n)
+			}
+			for _, cell := range cells {
+				walk(binary.BigEndian.Uint32(cell), depth+1)
+				size, a := readVarint(cell[4:])
+				keys = append(keys, decodeRecord(f.payload(cell[4+a:], int(size), maxLocal)))
+			}
+			walk(right, depth+1)
+		default:
+			f.t.Fatalf("page %d of kind %#x in an index", n, kind)
+		}
+	}
+	walk(root, 1)
+	return keys, depths
+}
+
+// schema maps the names in sqlite_master to their rows: type, name, tbl_name,
+// rootpage and sql
+func (f *sqliteFile) schema() map[string][]any {
+	_, rows := f.tableRows(1)
+	entries := make(map[string][]any)
+	for _, row := range rows {
+		entries[row[1].(string)] = row
+	}
+	return entries
+}
+
+func (f *sqliteFile) root(entries map[string][]any, name string) uint32 {
+	entry, ok := entries[name]
+	if !ok {
+		f.t.Fatalf("no %s in the schema", name)
+	}
+	return uint32(entry[3].(int64))
+}
+
+func TestWriteIndex(t *testing.T) {
+	tests := []struct {
+		name   string
+		keys   int
+		levels int
+	}{
+		{"single leaf", 20, 1},
+		{"one interior page", 400, 2},
+		{"last interior page of one child", 2518, 3},
+		{"four levels", 20000, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "index.db")
+			db, err := createSQLite(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var keys [][]any
+			for i := 1; i <= tt.keys; i++ {
+				// keys of up to a few hundred bytes, in no order
+				keys = append(keys, []any{fmt.Sprintf("%07d", i*7919%tt.keys) + strings.Repeat("x", i%300), int64(i)})
+			}
+			want := make([]string, len(keys))
+			for i, key := range keys {
+				want[i] = fmt.Sprint(key...)
+			}
+			sort.Strings(want)
+			root, err := db.writeIndex(keys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db.addSchema("index", "i", "t", root, "CREATE INDEX i ON t(v)")
+			if err := db.close(0, 0); err != nil {
+				t.Fatal(err)
+			}
+
+			f := readSQLiteFile(t, path)
+			got, depths := f.indexKeys(f.root(f.schema(), "i"))
+			if len(got) != len(want) {
+				t.Fatalf("index holds %d keys, want %d", len(got), len(want))
+			}
+			for i, key := range got {
+				if s := fmt.Sprint(key...); s != want[i] {
+					t.Fatalf("key %d is %.20s, want %.20s", i, s, want[i])
+				}
+			}
+			for i, depth := range depths {
+				if depth != tt.levels {
+					t.Fatalf("leaf %d of %d at depth %d, want all at %d", i, len(depths), depth, tt.levels)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,273 @@
+package commonmap
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// This file keeps rendered maps and tiles on disk, evicting the least recently used
+// once the cache outgrows its limit. Entries live in a directory per layer list, so
+// re-indexing a series can drop every entry that may have drawn it.
+
+type tileCache struct {
+	mu      sync.Mutex
+	dir     string
+	limit   int64
+	size    int64
+	entries map[string]*list.Element // by path relative to dir
+	order   *list.List               // front is most recently used
+	// generation counts invalidations, images rendered before one may be stale
+	generation uint64
+}
+
+type tileCacheEntry struct {
+	path string
+	size int64
+}
+
+// openTileCache indexes the entries left by earlier runs, oldest first
+func openTileCache(dir string, limit int64) (*tileCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	c := &tileCache{dir: dir, limit: limit, entries: make(map[string]*list.Element), order: list.New()}
+	type found struct {
+		path string
+		info fs.FileInfo
+	}
+	var files []found
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if strings.HasSuffix(path, ".tmp") {
+			return os.Remove(path) // interrupted write
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, found{rel, info})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].info.ModTime().Before(files[j].info.ModTime()) })
+	for _, f := range files {
+		c.entries[f.path] = c.order.PushFront(&tileCacheEntry{f.path, f.info.Size()})
+		c.size += f.info.Size()
+	}
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return c, nil
+}
+
+// tileCachePath names the file of a cache key: a directory for the layers, a hashed file name
+func tileCachePath(layers []string, key, format string) string {
+	ext := ".png"
+	if format == "image/jpeg" {
+		ext = ".jpg"
+	}
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(layerDir(layers), hex.EncodeToString(sum[:])+ext)
+}
+
+// layerDir turns a layer list into a safe directory name, "~" for lists too long to keep
+func layerDir(layers []string) string {
+	names := make([]string, len(layers))
+	for i, layer := range layers {
+		names[i] = strings.Map(func(r rune) rune {
+			if r == '-' || r == '_' || r == '.' || r >= '0' && r <= '9' || r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' {
+				return r
+			}
+			return '_'
+		}, layer)
+	}
+	dir := strings.Join(names, "+")
+	if dir == "" || len(dir) > 100 {
+		sum := sha256.Sum256([]byte(dir))
+		return "~" + hex.EncodeToString(sum[:8])
+	}
+	return dir
+}
+
+// layerDependsOn tells whether a layer may draw from a series index
+func layerDependsOn(layer, seriesCode string) bool {
+	layer = strings.ToUpper(layer)
+	series := "RPF-" + strings.ToUpper(seriesCode)
+	return layer == "RPF" || layer == "RPF-INDEX" || layer == series || strings.HasPrefix(layer, series+"-")
+}
+
+// get returns a cached image, false on a miss
+func (c *tileCache) get(layers []string, key, format string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	path := tileCachePath(layers, key, format)
+	c.mu.Lock()
+	e, ok := c.entries[path]
+	if ok {
+		c.order.MoveToFront(e)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	data, err := os.ReadFile(filepath.Join(c.dir, path))
+	if err != nil {
+		// evicted meanwhile, or removed by another process re-indexing
+		c.mu.Lock()
+		c.remove(path)
+		c.mu.Unlock()
+		return nil, false
+	}
+	return data, true
+}
+
+// currentGeneration is taken before rendering an image to put
+func (c *tileCache) currentGeneration() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// put stores an image rendered in a generation, evicting older entries beyond the
+// size limit. Images of an earlier generation may have drawn from a replaced index
+// and are dropped.
+func (c *tileCache) put(layers []string, key, format string, data []byte, generation uint64) {
+	if c == nil || int64(len(data)) > c.limit {
+		return
+	}
+	path := tileCachePath(layers, key, format)
+	full := filepath.Join(c.dir, path)
+	if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+		log.Print(err)
+		return
+	}
+	// write aside then rename, so readers never see half a file
+	tmp, err := os.CreateTemp(filepath.Dir(full), "*.tmp")
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil && c.generation != generation {
+		_ = os.Remove(tmp.Name())
+		return
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), full)
+	}
+	if err != nil {
+		log.Print(err)
+		_ = os.Remove(tmp.Name())
+		return
+	}
+	if e, ok := c.entries[path]; ok {
+		c.size -= e.Value.(*tileCacheEntry).size
+		c.order.Remove(e)
+	}
+	c.entries[path] = c.order.PushFront(&tileCacheEntry{path, int64(len(data))})
+	c.size += int64(len(data))
+	c.evict()
+}
+
+// evict drops the least recently used entries until the cache fits, mu held
+func (c *tileCache) evict() {
+	for c.size > c.limit && c.order.Len() > 0 {
+		path := c.order.Back().Value.(*tileCacheEntry).path
+		if err := os.Remove(filepath.Join(c.dir, path)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Print(err)
+		}
+		c.remove(path)
+	}
+}
+
+// remove forgets an entry, mu held
+func (c *tileCache) remove(path string) {
+	if e, ok := c.entries[path]; ok {
+		c.size -= e.Value.(*tileCacheEntry).size
+		c.order.Remove(e)
+		delete(c.entries, path)
+	}
+}
+
+// invalidateTileCache drops the cached images that may have drawn from a series,
+// whether or not the cache is open in this process
+func (ix *Indexer) invalidateTileCache(seriesCode string) {
+	dir, tiles := ix.CacheDir, ix.tiles
+	if tiles != nil {
+		tiles.mu.Lock()
+		defer tiles.mu.Unlock()
+		tiles.generation++
+		dir = tiles.dir
+	}
+	if dir == "" {
+		return
+	}
+	layerDirs, err := os.ReadDir(dir)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Print(err)
+		}
+		return
+	}
+	for _, d := range layerDirs {
+		stale := strings.HasPrefix(d.Name(), "~") // too many layers to tell
+		for _, layer := range strings.Split(d.Name(), "+") {
+			stale = stale || layerDependsOn(layer, seriesCode)
+		}
+		if !stale || !d.IsDir() {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, d.Name())); err != nil {
+			log.Print(err)
+		}
+		if tiles != nil {
+			prefix := d.Name() + string(filepath.Separator)
+			for path := range tiles.entries {
+				if strings.HasPrefix(path, prefix) {
+					tiles.remove(path)
+				}
+			}
+		}
+	}
+}
+
+// cachedImage answers from the cache, or renders and caches the image
+func (ix *Indexer) cachedImage(layers []string, key, format string, render func() ([]byte, error)) ([]byte, error) {
+	if data, ok := ix.tiles.get(layers, key, format); ok {
+		return data, nil
+	}
+	generation := ix.tiles.currentGeneration()
+	data, err := render()
+	if err != nil {
+		return nil, err
+	}
+	ix.tiles.put(layers, key, format, data, generation)
+	return data, nil
+}
@@ -0,0 +1,156 @@
+package commonmap
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openTestTileCache(t *testing.T, dir string, limit int64) *tileCache {
+	t.Helper()
+	c, err := openTileCache(dir, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestTileCacheGetPut(t *testing.T) {
+	dir := t.TempDir()
+	c := openTestTileCache(t, dir, 1000)
+	image := []byte("png of JG")
+	c.put([]string{"RPF-JG"}, "1/2/3", "image/png", image, 0)
+
+	if data, ok := c.get([]string{"RPF-JG"}, "1/2/3", "image/png"); !ok || !bytes.Equal(data, image) {
+		t.Fatalf("get = %q, %v, want %q", data, ok, image)
+	}
+	for _, miss := range []struct {
+		layers      []string
+		key, format string
+	}{
+		{[]string{"RPF-ON"}, "1/2/3", "image/png"},
+		{[]string{"RPF-JG"}, "1/2/4", "image/png"},
+		{[]string{"RPF-JG"}, "1/2/3", "image/jpeg"},
+		{[]string{"RPF-JG", "RPF-ON"}, "1/2/3", "image/png"},
+	} {
+		if _, ok := c.get(miss.layers, miss.key, miss.format); ok {
+			t.Fatalf("get(%v, %s, %s) hit", miss.layers, miss.key, miss.format)
+		}
+	}
+
+	// entries outlive the process, interrupted writes do not
+	stray := filepath.Join(dir, "RPF-JG", "half.tmp")
+	if err := os.WriteFile(stray, []byte("half"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	reopened := openTestTileCache(t, dir, 1000)
+	if data, ok := reopened.get([]string{"RPF-JG"}, "1/2/3", "image/png"); !ok || !bytes.Equal(data, image) {
+		t.Fatalf("reopened get = %q, %v, want %q", data, ok, image)
+	}
+	if reopened.size != int64(len(image)) || fileExists(stray) {
+		t.Fatalf("reopened cache of %d bytes, stray write left %v", reopened.size, fileExists(stray))
+	}
+}
+
+func TestTileCacheEviction(t *testing.T) {
+	c := openTestTileCache(t, t.TempDir(), 30)
+	layers := []string{"RPF-JG"}
+	tile := bytes.Repeat([]byte{1}, 10)
+	c.put(layers, "a", "image/png", tile, 0)
+	c.put(layers, "b", "image/png", tile, 0)
+	c.put(layers, "c", "image/png", tile, 0)
+	c.get(layers, "a", "image/png") // b is now the least recently used
+	c.put(layers, "d", "image/png", tile, 0)
+
+	for key, cached := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		if _, ok := c.get(layers, key, "image/png"); ok != cached {
+			t.Errorf("%s cached %v, want %v", key, ok, cached)
+		}
+	}
+	if c.size != 30 || c.order.Len() != 3 {
+		t.Fatalf("cache of %d bytes in %d entries, want 30 in 3", c.size, c.order.Len())
+	}
+	if b := filepath.Join(c.dir, tileCachePath(layers, "b", "image/png")); fileExists(b) {
+		t.Fatal("evicted entry left on disk")
+	}
+
+	// larger than the whole cache, never stored
+	c.put(layers, "e", "image/png", bytes.Repeat([]byte{1}, 31), 0)
+	if _, ok := c.get(layers, "e", "image/png"); ok || c.size != 30 {
+		t.Fatalf("stored an image larger than the cache, now %d bytes", c.size)
+	}
+}
+
+func TestInvalidateTileCache(t *testing.T) {
+	ix := NewIndexer(t.TempDir())
+	ix.CacheDir = t.TempDir()
+	ix.tiles = openTestTileCache(t, ix.CacheDir, 1000)
+	tests := []struct {
+		layers []string
+		stale  bool
+	}{
+		{[]string{"RPF-JG"}, true},
+		{[]string{"rpf-jg-index"}, true},
+		{[]string{"RPF"}, true},
+		{[]string{"RPF-INDEX"}, true},
+		{[]string{"coastline", "RPF-JG"}, true},
+		{[]string{"RPF-ON"}, false},
+		{[]string{"RPF-JGX"}, false},
+		{[]string{"coastline"}, false},
+	}
+	for _, tt := range tests {
+		ix.tiles.put(tt.layers, "0/0/0", "image/png", []byte("tile"), 0)
+	}
+	ix.invalidateTileCache("JG")
+	for _, tt := range tests {
+		_, cached := ix.tiles.get(tt.layers, "0/0/0", "image/png")
+		onDisk := fileExists(filepath.Join(ix.CacheDir, tileCachePath(tt.layers, "0/0/0", "image/png")))
+		if cached == tt.stale || onDisk == tt.stale {
+			t.Errorf("%v cached %v, on disk %v after invalidating JG", tt.layers, cached, onDisk)
+		}
+	}
+
+	// without the cache open, the files alone are removed
+	other := NewIndexer(t.TempDir())
+	other.CacheDir = ix.CacheDir
+	other.invalidateTileCache("ON")
+	if fileExists(filepath.Join(ix.CacheDir, layerDir([]string{"RPF-ON"}))) {
+		t.Fatal("ON images left after invalidating ON")
+	}
+}
+
+func TestCachedImageRenderedDuringReindex(t *testing.T) {
+	ix := NewIndexer(t.TempDir())
+	ix.CacheDir = t.TempDir()
+	ix.tiles = openTestTileCache(t, ix.CacheDir, 1000)
+	layers := []string{"RPF-JG"}
+
+	// the index is replaced while the image is drawn from the old one
+	data, err := ix.cachedImage(layers, "0/0/0", "image/png", func() ([]byte, error) {
+		ix.invalidateTileCache("JG")
+		return []byte("old index"), nil
+	})
+	if err != nil || string(data) != "old index" {
+		t.Fatalf("cachedImage = %q, %v", data, err)
+	}
+	if _, ok := ix.tiles.get(layers, "0/0/0", "image/png"); ok {
+		t.Fatal("cached an image drawn from the replaced index")
+	}
+	if entries, _ := os.ReadDir(filepath.Join(ix.CacheDir, layerDir(layers))); len(entries) != 0 {
+		t.Fatalf("%d files left in the cache", len(entries))
+	}
+
+	rendered := 0
+	for i := 0; i < 2; i++ {
+		if _, err := ix.cachedImage(layers, "0/0/0", "image/png", func() ([]byte, error) {
+			rendered++
+			return []byte("new index"), nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rendered != 1 {
+		t.Fatalf("rendered %d times, want once then cached", rendered)
+	}
+}
@@ -0,0 +1,70 @@
+package commonmap
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// This file serves slippy-map tiles on the web mercator grid, for clients without WMS:
+// /tiles/{layer}/{z}/{x}/{y}.png counts rows from the north as XYZ does, and
+// /tms/{layer}/{z}/{x}/{y}.png from the south as TMS does.
+
+// bestLayer is the virtual layer drawing the finest series available at each zoom
+const bestLayer = "best"
+
+var webMercatorTiles = findTileMatrixSet("GoogleMapsCompatible")
+
+// tileLayer maps a tile layer, a series code or "best", onto its native layer
+func (ix *Indexer) tileLayer(name string) (string, bool) {
+	layer := "RPF-" + name
+	if strings.EqualFold(name, bestLayer) {
+		layer = "RPF"
+	}
+	if _, native := ix.rasterSeries(layer, 0); !native {
+		return "", false
+	}
+	return layer, true
+}
+
+func (ix *Indexer) xyzTile(w http.ResponseWriter, r *http.Request) {
+	ix.slippyTile(w, r, false)
+}
+
+func (ix *Indexer) tmsTile(w http.ResponseWriter, r *http.Request) {
+	ix.slippyTile(w, r, true)
+}
+
+func (ix *Indexer) slippyTile(w http.ResponseWriter, r *http.Request, flipY bool) {
+	vars := mux.Vars(r)
+	layer, ok := ix.tileLayer(vars["layer"])
+	if !ok {
+		http.Error(w, "unknown layer "+vars["layer"], http.StatusNotFound)
+		return
+	}
+	format := "image/png"
+	if ext := strings.ToLower(vars["ext"]); ext == "jpg" || ext == "jpeg" {
+		format = "image/jpeg"
+	} else if ext != "png" {
+		http.Error(w, "tiles are png or jpg", http.StatusNotFound)
+		return
+	}
+	z, err1 := strconv.Atoi(vars["z"])
+	x, err2 := strconv.Atoi(vars["x"])
+	y, err3 := strconv.Atoi(vars["y"])
+	if err1 != nil || err2 != nil || err3 != nil || z < 0 || z > 30 {
+		http.Error(w, "invalid tile coordinates", http.StatusBadRequest)
+		return
+	}
+	if flipY {
+		y = 1<<z - 1 - y
+	}
+	view, ok := webMercatorTiles.tileView(z, y, x)
+	if !ok {
+		http.Error(w, "no such tile", http.StatusNotFound)
+		return
+	}
+	ix.serveTile(w, r, view, layer, format)
+}
@@ -0,0 +1,77 @@
+package commonmap
+
+import (
+	"bytes"
+	"image/color"
+	"image/png"
+	"net/http"
+	"testing"
+)
+
+func TestSlippyTile(t *testing.T) {
+	_, server := serveFrames(t, "RPF/JG/000A0010.JG1")
+	// at zoom 11 the tile in row 1022 from the north, 1025 from the south, lies within the
+	// frame across the middle of its image where red meets blue; the row south of the
+	// equator is off the frame
+	across := [4]color.NRGBA{red, red, blue, blue}
+	off := [4]color.NRGBA{transparent, transparent, transparent, transparent}
+	tests := []struct {
+		path string
+		want [4]color.NRGBA
+	}{
+		{"/tiles/JG/11/1086/1022.png", across},
+		{"/tms/JG/11/1086/1025.png", across},
+		{"/tiles/jg/11/1086/1022.png", across},
+		{"/tiles/best/11/1086/1022.png", across},
+		{"/tiles/JG/11/1086/1025.png", off},
+		{"/tms/JG/11/1086/1022.png", off},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			resp, body := httpGet(t, server.URL+tt.path)
+			if ct := resp.Header.Get("Content-type"); resp.StatusCode != http.StatusOK || ct != "image/png" {
+				t.Fatalf("%s answered %d %s: %s", tt.path, resp.StatusCode, ct, body)
+			}
+			img, err := png.Decode(bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size := img.Bounds().Size(); size.X != tileSize || size.Y != tileSize {
+				t.Fatalf("tile of %v", size)
+			}
+			checkPixels(t, img, tt.want)
+		})
+	}
+
+	t.Run("jpg", func(t *testing.T) {
+		resp, body := httpGet(t, server.URL+"/tiles/JG/11/1086/1022.jpg")
+		if ct := resp.Header.Get("Content-type"); resp.StatusCode != http.StatusOK || ct != "image/jpeg" {
+			t.Fatalf("jpg tile answered %d %s: %s", resp.StatusCode, ct, body)
+		}
+	})
+
+	invalid := []struct {
+		path   string
+		status int
+	}{
+		{"/tiles/JG/31/0/0.png", http.StatusBadRequest},
+		{"/tiles/JG/1/2/0.png", http.StatusNotFound},
+		{"/tiles/JG/1/0/2.png", http.StatusNotFound},
+		{"/tms/JG/1/0/2.png", http.StatusNotFound},
+		{"/tiles/JG/0/0/1.png", http.StatusNotFound},
+		{"/tms/JG/0/0/1.png", http.StatusNotFound},
+		{"/tiles/XX/11/1086/1022.png", http.StatusNotFound},
+		{"/tiles/roads/11/1086/1022.png", http.StatusNotFound},
+		{"/tiles/D1/5/0/0.png", http.StatusNotFound},
+		{"/tms/roads/11/1086/1025.png", http.StatusNotFound},
+		{"/tiles/JG/11/1086/1022.gif", http.StatusNotFound},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.path, func(t *testing.T) {
+			resp, body := httpGet(t, server.URL+tt.path)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("%s answered %d, want %d: %s", tt.path, resp.StatusCode, tt.status, body)
+			}
+		})
+	}
+}
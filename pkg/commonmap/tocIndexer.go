@@ -0,0 +1,144 @@
+package commonmap
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cm/pkg/rpf"
+)
+
+// build shapefiles from the A.TOC files under the roots, rather than from a file walk.
+// Only the walk looks into archives.
+func indexTOCs(roots []HoldingRoot, options IndexOptions, forShp chan RpfBox, forDbf chan FrameAttributes, done chan bool, verify func(string, Box)) int {
+	var tocPaths []string
+	for _, root := range roots {
+		tocPaths = append(tocPaths, findTOCs(root.Path)...)
+	}
+	resolver := &caseResolver{listings: make(map[string]map[string]string)}
+	var boxes []RpfBox
+	var copies []frameCopy
+	missing, skipped := 0, 0
+
+	for _, tocPath := range tocPaths {
+		toc, err := readTOC(tocPath)
+		if err != nil {
+			fmt.Printf("Cannot read table of contents : %s : %v\n", tocPath, err)
+			continue
+		}
+		tocDir := filepath.Dir(tocPath)
+		for _, frame := range toc.Frames {
+			ext := strings.ToUpper(filepath.Ext(frame.FileName))
+			if len(ext) != 4 {
+				skipped++
+				continue
+			}
+			if _, ok := rpf.DataSeries[ext[1:3]]; !ok {
+				skipped++
+				continue
+			}
+			framePath, ok := resolver.resolve(tocDir, frame.Path)
+			if !ok {
+				fmt.Printf("Frame listed in %s is missing : %s\n", tocPath, frame.Path)
+				missing++
+				continue
+			}
+			var size int64 = -1 // never a duplicate
+			if info, err := os.Stat(framePath); err == nil {
+				size = info.Size()
+			}
+			boxes = append(boxes, RpfBox{frame.FileName, Box{frame.X1, frame.Y1, frame.X2, frame.Y2}})
+			copies = append(copies, frameCopy{framePath, size})
+		}
+	}
+
+	duplicate, report := findDuplicates(copies, options.HashDuplicates)
+	dbfPaths := make([]string, 0, len(copies))
+	for i, r := range boxes {
+		if duplicate[i] {
+			continue
+		}
+		verify(copies[i].path, r.box)
+		forShp <- r
+		dbfPaths = append(dbfPaths, copies[i].path)
+	}
+	close(forShp)
+	<-done
+	for _, dbfPath := range dbfPaths {
+		forDbf <- NewFrameAttributes(dbfPath, nil)
+	}
+	close(forDbf)
+
+	fmt.Printf("Read %d tables of contents listing %d frames (%d missing, %d not RPF).\n",
+		len(tocPaths), len(copies)+missing+skipped, missing, skipped)
+	report.save(options)
+	return len(dbfPaths)
+}
+
+func readTOC(tocPath string) (*rpf.TOC, error) {
+	file, err := os.Open(tocPath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+	return rpf.ParseTOC(file)
+}
+
+// find A.TOC files, without descending into the RPF directories that hold them
+func findTOCs(dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		fmt.Println("file search error: ", err)
+		return nil
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.EqualFold(entry.Name(), "A.TOC") {
+			return []string{filepath.Join(dir, entry.Name())}
+		}
+	}
+	var tocPaths []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			tocPaths = append(tocPaths, findTOCs(filepath.Join(dir, entry.Name()))...)
+		}
+	}
+	return tocPaths
+}
+
+// caseResolver matches TOC path names against the disk, which may not share their case
+type caseResolver struct {
+	listings map[string]map[string]string // directory -> upper case name -> name on disk
+}
+
+func (c *caseResolver) resolve(dir, rel string) (string, bool) {
+	for _, part := range strings.Split(rel, "/") {
+		if part == "." || part == "" {
+			continue
+		}
+		if part == ".." {
+			dir = filepath.Dir(dir)
+			continue
+		}
+		name, ok := c.list(dir)[strings.ToUpper(part)]
+		if !ok {
+			return "", false
+		}
+		dir = filepath.Join(dir, name)
+	}
+	return dir, true
+}
+
+func (c *caseResolver) list(dir string) map[string]string {
+	if names, ok := c.listings[dir]; ok {
+		return names
+	}
+	names := make(map[string]string)
+	if entries, err := os.ReadDir(dir); err == nil {
+		for _, entry := range entries {
+			names[strings.ToUpper(entry.Name())] = entry.Name()
+		}
+	}
+	c.listings[dir] = names
+	return names
+}
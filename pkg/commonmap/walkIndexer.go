@@ -0,0 +1,355 @@
+package commonmap
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cm/pkg/archive"
+	"cm/pkg/rpf"
+)
+
+// This file builds the index from a walk of the holdings. Every walk records the frames
+// it indexed in a manifest, so an incremental run only rewrites the series whose frames
+// were added, removed or modified since.
+
+const (
+	manifestName   = "index.manifest"
+	manifestHeader = "# commonmap index manifest v1"
+)
+
+// manifestEntry is the size and modification time of an indexed frame
+type manifestEntry struct {
+	size    int64
+	modTime int64 // unix nanoseconds
+}
+
+// manifest maps frame paths to their state when indexed
+type manifest map[string]manifestEntry
+
+func readManifest(manifestPath string) (manifest, error) {
+	file, err := os.Open(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+	m := make(manifest)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if line == 1 {
+			if text != manifestHeader {
+				return nil, fmt.Errorf("%s is not an index manifest", manifestPath)
+			}
+			continue
+		}
+		// size, mtime, then the path which may hold tabs itself
+		fields := strings.SplitN(text, "\t", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: malformed entry", manifestPath, line)
+		}
+		size, err1 := strconv.ParseInt(fields[0], 10, 64)
+		modTime, err2 := strconv.ParseInt(fields[1], 10, 64)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("%s:%d: malformed entry", manifestPath, line)
+		}
+		m[fields[2]] = manifestEntry{size, modTime}
+	}
+	return m, scanner.Err()
+}
+
+// write saves the manifest atomically, in path order
+func (m manifest) write(manifestPath string) error {
+	paths := make([]string, 0, len(m))
+	for path := range m {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	tmpPath := manifestPath + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	_, err = fmt.Fprintln(w, manifestHeader)
+	for _, path := range paths {
+		if err != nil {
+			break
+		}
+		e := m[path]
+		_, err = fmt.Fprintf(w, "%d\t%d\t%s\n", e.size, e.modTime, path)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, manifestPath)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+	}
+	return err
+}
+
+// below lists in order the paths of the manifest held by a root
+func (m manifest) below(roots []HoldingRoot, root HoldingRoot) []string {
+	var paths []string
+	for path := range m {
+		if r, ok := rootOf(roots, path); ok && r.Name == root.Name {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// manifestInfo describes a frame as the manifest recorded it
+type manifestInfo struct {
+	name  string
+	entry manifestEntry
+}
+
+func (e manifestEntry) info(name string) fs.FileInfo {
+	return manifestInfo{name, e}
+}
+
+func (i manifestInfo) Name() string       { return i.name }
+func (i manifestInfo) Size() int64        { return i.entry.size }
+func (i manifestInfo) Mode() fs.FileMode  { return 0444 }
+func (i manifestInfo) ModTime() time.Time { return time.Unix(0, i.entry.modTime) }
+func (i manifestInfo) IsDir() bool        { return false }
+func (i manifestInfo) Sys() any           { return nil }
+
+// archivedFrame is a frame held in a ZIP archive or disc image
+type archivedFrame struct {
+	location string
+	box      RpfBox
+	info     fs.FileInfo
+}
+
+// archivedFrames lists the frames held in an archive, stat'ed when info is nil. They
+// take the archive's modification time, so a rewritten archive is indexed again.
+func archivedFrames(archivePath string, info fs.FileInfo) []archivedFrame {
+	if info == nil {
+		var err error
+		if info, err = os.Stat(archivePath); err != nil {
+			fmt.Printf("Cannot read archive : %v\n", err)
+			return nil
+		}
+	}
+	a, err := archive.OpenArchive(archivePath)
+	if err != nil {
+		fmt.Printf("Cannot read archive : %v\n", err)
+		return nil
+	}
+	defer func() { _ = a.Close() }()
+	var frames []archivedFrame
+	for _, m := range a.Members() {
+		fileName := path.Base(m.Name)
+		if isRpf, x1, y1, x2, y2 := rpf.TryGetRpfBounds(fileName); isRpf {
+			entry := manifestEntry{m.Size, info.ModTime().UnixNano()}
+			frames = append(frames, archivedFrame{archive.Location(archivePath, m.Name), RpfBox{fileName, [4]float64{x1, y1, x2, y2}}, entry.info(fileName)})
+		}
+	}
+	return frames
+}
+
+func seriesOf(framePath string) string {
+	return strings.ToUpper(filepath.Ext(framePath)[1:3])
+}
+
+// removeSeriesIndex deletes the index files of a series left without frames
+func (run *indexRun) removeSeriesIndex(seriesCode string) {
+	for _, ext := range []string{".shp", ".shx", ".dbf", ".qix", ".prj"} {
+		for _, path := range []string{filepath.Join(run.dir, seriesCode+ext), filepath.Join(run.dir, historyDirName, seriesCode+ext)} {
+			if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				fmt.Println(err)
+			}
+		}
+	}
+	run.ix.invalidateTileCache(seriesCode)
+}
+
+// build shapefiles from a walk of the roots, or of the root named only with the frames
+// of the others taken from the manifest. The returned function completes the index
+// once every shapefile is closed.
+func indexWalk(roots []HoldingRoot, only string, options IndexOptions, run *indexRun, forShp chan RpfBox, forDbf chan FrameAttributes, done chan bool, verify func(string, Box)) (int, func()) {
+	manifestPath := filepath.Join(run.dir, manifestName)
+	previous := make(manifest)
+	if options.Incremental {
+		m, err := readManifest(manifestPath)
+		if err == nil {
+			previous = m
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			fmt.Printf("Cannot read index manifest, rebuilding every series : %v\n", err)
+		}
+	}
+
+	type frame struct {
+		path string
+		box  RpfBox
+		info fs.FileInfo
+	}
+	var frames []frame
+	current := make(manifest)
+	if only != "" && len(previous) == 0 {
+		fmt.Printf("No index manifest to take the other roots from, walking every root.\n")
+		only = ""
+	}
+	dirs, files := 0, 0
+	for _, root := range roots {
+		if only != "" && root.Name != only {
+			// as last indexed, trusting the manifest
+			for _, path := range previous.below(roots, root) {
+				entry := previous[path]
+				fileName := filepath.Base(path)
+				if isRpf, x1, y1, x2, y2 := rpf.TryGetRpfBounds(fileName); isRpf {
+					frames = append(frames, frame{path, RpfBox{fileName, [4]float64{x1, y1, x2, y2}}, entry.info(fileName)})
+					current[path] = entry
+				}
+			}
+			continue
+		}
+		d, f := parallelWalk(root.Path, options.Walkers, true, func(filePath string, info fs.FileInfo) {
+			fileName := filepath.Base(filePath)
+			isRpf, x1, y1, x2, y2 := rpf.TryGetRpfBounds(fileName)
+			if isRpf && info != nil {
+				frames = append(frames, frame{filePath, RpfBox{fileName, [4]float64{x1, y1, x2, y2}}, info})
+				current[filePath] = manifestEntry{info.Size(), info.ModTime().UnixNano()}
+			} else if info != nil && archive.IsArchive(fileName) {
+				for _, a := range archivedFrames(filePath, info) {
+					frames = append(frames, frame{a.location, a.box, a.info})
+					current[a.location] = manifestEntry{a.info.Size(), a.info.ModTime().UnixNano()}
+				}
+			}
+		})
+		dirs, files = dirs+d, files+f
+	}
+
+	// copies of a frame found earlier are left out, from the index if not the manifest
+	copies := make([]frameCopy, len(frames))
+	for i, f := range frames {
+		copies[i] = frameCopy{f.path, f.info.Size()}
+	}
+	duplicate, report := findDuplicates(copies, options.HashDuplicates)
+	report.save(options)
+
+	// a series is rewritten when any of its frames changed, every series on a full run
+	rewrite := make(map[string]bool)
+	if len(previous) == 0 {
+		// without a manifest, whatever is in the index may be stale
+		for _, seriesCode := range existingSeriesIndexes(run.dir) {
+			rewrite[seriesCode] = true
+		}
+	}
+	added, removed, modified := 0, 0, 0
+	for path, entry := range current {
+		if old, ok := previous[path]; !ok {
+			added++
+			rewrite[seriesOf(path)] = true
+		} else if old != entry {
+			modified++
+			rewrite[seriesOf(path)] = true
+		}
+	}
+	for path := range previous {
+		if _, ok := current[path]; !ok {
+			removed++
+			rewrite[seriesOf(path)] = true
+		}
+	}
+	if run.wholeFiles() {
+		// those outputs are written whole, from every series
+		for path := range current {
+			rewrite[seriesOf(path)] = true
+		}
+	}
+
+	// shapefiles are rewritten in place, lookups wait until they are whole again
+	run.ix.lock.Lock()
+
+	// DBF records are written after all boxes, so hold the paths until then
+	var dbfRecords []FrameAttributes
+	kept := make(map[string]bool)
+	for i, f := range frames {
+		seriesCode := seriesOf(f.path)
+		if duplicate[i] {
+			continue
+		}
+		if !rewrite[seriesCode] {
+			kept[seriesCode] = true
+			continue
+		}
+		verify(f.path, f.box.box)
+		forShp <- f.box // start building SHP / SHX / QIX now
+		dbfRecords = append(dbfRecords, NewFrameAttributes(f.path, f.info))
+	}
+	close(forShp)
+	<-done
+	for _, attributes := range dbfRecords {
+		forDbf <- attributes // also generate DBF
+	}
+	close(forDbf)
+
+	return dirs + files, func() {
+		// series whose last frame went away
+		for _, seriesCode := range sortedKeys(rewrite) {
+			if !run.written(seriesCode) {
+				run.removeSeriesIndex(seriesCode)
+			}
+		}
+		run.ix.lock.Unlock()
+		if err := current.write(manifestPath); err != nil {
+			fmt.Printf("Cannot write index manifest : %v\n", err)
+		}
+		if options.Incremental {
+			var written, dropped []string
+			for _, seriesCode := range sortedKeys(rewrite) {
+				if run.written(seriesCode) {
+					written = append(written, seriesCode)
+				} else {
+					dropped = append(dropped, seriesCode)
+				}
+			}
+			fmt.Printf("Incremental index: %d frames added, %d removed, %d modified; rewrote %d series [%s], dropped %d [%s], kept %d.\n",
+				added, removed, modified, len(written), strings.Join(written, " "), len(dropped), strings.Join(dropped, " "), len(kept))
+		}
+	}
+}
+
+// existingSeriesIndexes lists the series with a shapefile in an index directory
+func existingSeriesIndexes(dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var codes []string
+	for _, entry := range entries {
+		name := strings.ToUpper(entry.Name())
+		if len(name) == 6 && strings.HasSuffix(name, ".SHP") {
+			codes = append(codes, name[:2])
+		}
+	}
+	return codes
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,177 @@
+package commonmap
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestManifestRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), manifestName)
+	m := manifest{
+		"/data/RPF/JG/000A0010.JG1":    {1234, 1700000000123456789},
+		"/data/RPF/ON/00010010.ON1":    {0, -1},
+		"/data/a\tfolder/000A0010.JG1": {5, 6},
+	}
+	if err := m.write(path); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(m) {
+		t.Fatalf("read %d entries, wrote %d", len(got), len(m))
+	}
+	for path, entry := range m {
+		if got[path] != entry {
+			t.Fatalf("%q read as %v, wrote %v", path, got[path], entry)
+		}
+	}
+
+	for _, text := range []string{"size\tmtime\tpath\n", manifestHeader + "\n12\t34\n", manifestHeader + "\n12\tx\t/a\n"} {
+		if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readManifest(path); err == nil {
+			t.Fatalf("read a manifest of %q", text)
+		}
+	}
+}
+
+func TestIncrementalIndex(t *testing.T) {
+	tests := []struct {
+		name      string
+		change    func(t *testing.T, root string)
+		rewritten []string
+		frames    map[string]int
+	}{
+		{
+			name:   "nothing changed",
+			change: func(t *testing.T, root string) {},
+			frames: map[string]int{"JG": 2, "ON": 1},
+		},
+		{
+			name: "frame added",
+			change: func(t *testing.T, root string) {
+				writeFrame(t, root, "RPF/JG/000C0010.JG1", "added")
+			},
+			rewritten: []string{"JG"},
+			frames:    map[string]int{"JG": 3, "ON": 1},
+		},
+		{
+			name: "frame changed",
+			change: func(t *testing.T, root string) {
+				writeFrame(t, root, "RPF/JG/000A0010.JG1", "a larger frame than before")
+			},
+			rewritten: []string{"JG"},
+			frames:    map[string]int{"JG": 2, "ON": 1},
+		},
+		{
+			name: "frame touched",
+			change: func(t *testing.T, root string) {
+				touched := time.Now().Add(time.Hour)
+				if err := os.Chtimes(filepath.Join(root, "RPF/ON/00010010.ON1"), touched, touched); err != nil {
+					t.Fatal(err)
+				}
+			},
+			rewritten: []string{"ON"},
+			frames:    map[string]int{"JG": 2, "ON": 1},
+		},
+		{
+			name: "frame removed",
+			change: func(t *testing.T, root string) {
+				removeFrame(t, root, "RPF/JG/000B0010.JG1")
+			},
+			rewritten: []string{"JG"},
+			frames:    map[string]int{"JG": 1, "ON": 1},
+		},
+		{
+			name: "last frame of a series removed",
+			change: func(t *testing.T, root string) {
+				removeFrame(t, root, "RPF/ON/00010010.ON1")
+			},
+			frames: map[string]int{"JG": 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := writeHoldings(t, "RPF/JG/000A0010.JG1", "RPF/JG/000B0010.JG1", "RPF/ON/00010010.ON1")
+			ix := NewIndexer(t.TempDir())
+			ix.Index(root, IndexOptions{})
+
+			// date the shapefiles back, those rewritten come out new
+			old := time.Now().Add(-24 * time.Hour)
+			for _, seriesCode := range []string{"JG", "ON"} {
+				if err := os.Chtimes(filepath.Join(ix.Dir, seriesCode+".shp"), old, old); err != nil {
+					t.Fatal(err)
+				}
+			}
+			tt.change(t, root)
+			ix.Index(root, IndexOptions{Incremental: true})
+
+			var rewritten []string
+			for _, seriesCode := range []string{"JG", "ON"} {
+				info, err := os.Stat(filepath.Join(ix.Dir, seriesCode+".shp"))
+				if _, indexed := tt.frames[seriesCode]; indexed != (err == nil) {
+					t.Fatalf("%s.shp present %v, want %v", seriesCode, err == nil, indexed)
+				}
+				if err == nil && info.ModTime().After(old) {
+					rewritten = append(rewritten, seriesCode)
+				}
+			}
+			if !slices.Equal(rewritten, tt.rewritten) {
+				t.Fatalf("rewrote %v, want %v", rewritten, tt.rewritten)
+			}
+			for seriesCode, n := range tt.frames {
+				frames, err := ix.findIndexedFrames(seriesCode, Box{-180, -90, 180, 90})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(frames) != n {
+					t.Fatalf("%s index holds %d frames, want %d", seriesCode, len(frames), n)
+				}
+			}
+
+			// the manifest records the holdings as they are now
+			m, err := readManifest(filepath.Join(ix.Dir, manifestName))
+			if err != nil {
+				t.Fatal(err)
+			}
+			onDisk := 0
+			err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() {
+					return err
+				}
+				onDisk++
+				if entry := m[path]; entry != (manifestEntry{info.Size(), info.ModTime().UnixNano()}) {
+					t.Errorf("manifest holds %v for %s", entry, path)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(m) != onDisk {
+				t.Fatalf("manifest holds %d frames, %d on disk", len(m), onDisk)
+			}
+		})
+	}
+}
+
+func writeFrame(t *testing.T, root, framePath, content string) {
+	t.Helper()
+	path := filepath.Join(root, filepath.FromSlash(framePath))
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func removeFrame(t *testing.T, root, framePath string) {
+	t.Helper()
+	if err := os.Remove(filepath.Join(root, filepath.FromSlash(framePath))); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,160 @@
+package commonmap
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// This file lists large directory trees with a pool of readers. Listings are read ahead
+// in parallel but consumed depth first in lexical order, so files are reported in the
+// same order as filepath.Walk and the index comes out identical run after run.
+
+const defaultWalkers = 16
+
+// readAheadPerWalker bounds the listings read but not yet walked, so memory follows
+// the number of readers rather than the size of the tree
+const readAheadPerWalker = 4
+
+// readDir lists a directory, a variable so tests can count the listings read
+var readDir = os.ReadDir
+
+// dirListing is a directory read, or about to be read, by a walker
+type dirListing struct {
+	path     string
+	started  atomic.Bool // claimed by a reader or the consumer
+	ahead    bool        // read ahead by a reader, holding a slot of the walk
+	done     chan struct{}
+	entries  []os.DirEntry
+	children []*dirListing // aligned with entries, nil for files
+	infos    []fs.FileInfo // aligned with entries, when the walk asks for them
+	err      error
+}
+
+// walkQueue hands directories to readers, most recently found first so reads stay
+// close to where the consumer is
+type walkQueue struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	stack    []*dirListing
+	closed   bool
+	withInfo bool          // stat files while reading, in parallel
+	slots    chan struct{} // one held by every listing read ahead and not yet walked
+}
+
+func (q *walkQueue) push(listings ...*dirListing) {
+	q.mu.Lock()
+	q.stack = append(q.stack, listings...)
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+func (q *walkQueue) pop() *dirListing {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.stack) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.stack) == 0 {
+		return nil
+	}
+	d := q.stack[len(q.stack)-1]
+	q.stack = q.stack[:len(q.stack)-1]
+	return d
+}
+
+func (q *walkQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// read lists a directory and queues its subdirectories
+func (d *dirListing) read(q *walkQueue) {
+	defer close(d.done)
+	d.entries, d.err = readDir(d.path)
+	d.children = make([]*dirListing, len(d.entries))
+	if q.withInfo {
+		d.infos = make([]fs.FileInfo, len(d.entries))
+	}
+	var subdirs []*dirListing
+	for i := len(d.entries) - 1; i >= 0; i-- { // reversed, the first pops first
+		if d.entries[i].IsDir() {
+			d.children[i] = &dirListing{path: filepath.Join(d.path, d.entries[i].Name()), done: make(chan struct{})}
+			subdirs = append(subdirs, d.children[i])
+		} else if q.withInfo {
+			d.infos[i], _ = d.entries[i].Info() // nil when the file went away
+		}
+	}
+	q.push(subdirs...)
+}
+
+// parallelWalk calls visit for every file below root, from a single goroutine,
+// in lexical depth first order. Files are also stat'ed when withInfo is set.
+func parallelWalk(root string, workers int, withInfo bool, visit func(path string, info fs.FileInfo)) (dirs, files int) {
+	if workers < 1 {
+		workers = defaultWalkers
+	}
+	t0 := time.Now()
+	q := &walkQueue{withInfo: withInfo, slots: make(chan struct{}, workers*readAheadPerWalker)}
+	q.cond = sync.NewCond(&q.mu)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := q.pop(); d != nil; d = q.pop() {
+				q.slots <- struct{}{}
+				if !d.started.CompareAndSwap(false, true) {
+					<-q.slots // the consumer got there first
+					continue
+				}
+				d.ahead = true
+				d.read(q)
+			}
+		}()
+	}
+
+	top := &dirListing{path: root, done: make(chan struct{})}
+	q.push(top)
+	var consume func(d *dirListing)
+	consume = func(d *dirListing) {
+		if d.started.CompareAndSwap(false, true) {
+			d.read(q) // not read ahead, the readers being busy or out of slots
+		}
+		<-d.done
+		if d.ahead {
+			<-q.slots
+		}
+		dirs++
+		if d.err != nil {
+			fmt.Println("file search error: ", d.err)
+		}
+		for i, entry := range d.entries {
+			if child := d.children[i]; child != nil {
+				consume(child)
+			} else {
+				var info fs.FileInfo
+				if d.infos != nil {
+					info = d.infos[i]
+				}
+				files++
+				visit(filepath.Join(d.path, entry.Name()), info)
+			}
+		}
+		d.entries, d.children, d.infos = nil, nil, nil // release the listing once walked
+	}
+	consume(top)
+	q.close()
+	wg.Wait()
+
+	elapsed := time.Since(t0)
+	fmt.Printf("Walked %d directories and %d files in %v with %d readers (%.0f files/s).\n",
+		dirs, files, elapsed, workers, float64(files)/elapsed.Seconds())
+	return dirs, files
+}
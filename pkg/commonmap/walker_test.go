@@ -0,0 +1,141 @@
+package commonmap
+
+import (
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// writeTree generates a tree of directories and files, names mixing cases, digits and
+// punctuation so lexical order matters
+func writeTree(t *testing.T, root string, dirs, filesPerDir, maxDepth int, seed int64) {
+	t.Helper()
+	rng := rand.New(rand.NewSource(seed))
+	names := []string{"a", "B", "a.b", "a0", "a_", "Z", "z", "000A0010.JG1", "-", "a b", "aa", "10", "9"}
+	parents := []string{root}
+	depth := map[string]int{root: 0}
+	for len(parents) < dirs {
+		parent := parents[rng.Intn(len(parents))]
+		if depth[parent] == maxDepth {
+			continue
+		}
+		dir := filepath.Join(parent, fmt.Sprintf("%s%d", names[rng.Intn(len(names))], rng.Intn(3)))
+		if _, ok := depth[dir]; ok {
+			continue
+		}
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		parents = append(parents, dir)
+		depth[dir] = depth[parent] + 1
+	}
+	for _, dir := range parents {
+		for range rng.Intn(2 * filesPerDir) { // some directories left empty
+			path := filepath.Join(dir, names[rng.Intn(len(names))]+fmt.Sprint(rng.Intn(5))+".f")
+			if err := os.WriteFile(path, []byte(path), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// walkDirFiles lists the files below root in the order of filepath.WalkDir, and counts
+// the directories
+func walkDirFiles(t *testing.T, root string) ([]string, int) {
+	t.Helper()
+	var files []string
+	dirs := 0
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			dirs++
+		} else {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files, dirs
+}
+
+func TestParallelWalk(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, 300, 6, 5, 7)
+	want, wantDirs := walkDirFiles(t, root)
+
+	for _, workers := range []int{1, 2, 8, 0} {
+		for _, withInfo := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%d workers, info %t", workers, withInfo), func(t *testing.T) {
+				var visiting atomic.Int32
+				var got []string // appended without a lock, the race detector minds
+				dirs, files := parallelWalk(root, workers, withInfo, func(path string, info fs.FileInfo) {
+					if visiting.Add(1) != 1 {
+						t.Error("visit called concurrently")
+					}
+					defer visiting.Add(-1)
+					got = append(got, path)
+					if withInfo != (info != nil) {
+						t.Errorf("%s visited with info %v", path, info)
+					} else if info != nil && (info.Name() != filepath.Base(path) || info.Size() != int64(len(path))) {
+						t.Errorf("%s visited with the info of %s, %d bytes", path, info.Name(), info.Size())
+					}
+				})
+				if dirs != wantDirs || files != len(want) {
+					t.Fatalf("walked %d directories and %d files, want %d and %d", dirs, files, wantDirs, len(want))
+				}
+				if !slices.Equal(got, want) {
+					for i := range min(len(got), len(want)) {
+						if got[i] != want[i] {
+							t.Fatalf("file %d is %s, want %s", i, got[i], want[i])
+						}
+					}
+					t.Fatalf("visited %d files, want %d", len(got), len(want))
+				}
+			})
+		}
+	}
+}
+
+func TestParallelWalkReadAhead(t *testing.T) {
+	const maxDepth = 3
+	root := t.TempDir()
+	writeTree(t, root, 400, 2, maxDepth, 11)
+	_, dirs := walkDirFiles(t, root)
+
+	var reads atomic.Int64
+	t.Cleanup(func() { readDir = os.ReadDir })
+	readDir = func(name string) ([]os.DirEntry, error) {
+		reads.Add(1)
+		return os.ReadDir(name)
+	}
+
+	const workers = 2
+	first := true
+	parallelWalk(root, workers, false, func(path string, info fs.FileInfo) {
+		if !first {
+			return
+		}
+		first = false
+		// held up at the first file, the readers run until out of slots
+		for n := int64(-1); n != reads.Load(); time.Sleep(50 * time.Millisecond) {
+			n = reads.Load()
+		}
+		// the directories on the way to the file are walked, the others read ahead
+		if limit := int64(maxDepth + 1 + workers*readAheadPerWalker); reads.Load() > limit {
+			t.Errorf("read %d of %d directories before walking past the first file, want %d at most", reads.Load(), dirs, limit)
+		}
+	})
+	if reads.Load() != int64(dirs) {
+		t.Fatalf("read %d directories, want %d", reads.Load(), dirs)
+	}
+}
@@ -0,0 +1,302 @@
+package commonmap
+
+import (
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"cm/pkg/archive"
+	"cm/pkg/rpf"
+)
+
+// This file watches holdings for frames coming and going, so the index follows them
+// while the server runs. Linux is told of changes by inotify, elsewhere the tree is polled.
+
+// PathEvent reports a change below a watched root
+type PathEvent struct {
+	Path  string
+	Flags uint32
+	Eid   uint64 // increases with every event of a watcher
+}
+
+// PathEvent flags
+const (
+	PathCreated uint32 = 1 << iota
+	PathRemoved
+	PathModified
+	PathIsDir
+	PathOverflow // events were lost, anything below the root may have changed
+)
+
+const (
+	defaultPollInterval = 30 * time.Second
+	watchSettle         = 2 * time.Second // quiet time before re-indexing, copies come in bursts
+)
+
+// Watcher reports batches of changes below a root until closed
+type Watcher interface {
+	Events() <-chan []PathEvent
+	Close() error
+}
+
+// NewWatcher watches a root with the platform's notifications, polling where they are
+// unavailable
+func NewWatcher(root string) (Watcher, error) {
+	if _, err := os.Stat(root); err != nil {
+		return nil, err
+	}
+	w, err := newNativeWatcher(root)
+	if err != nil {
+		log.Printf("watching %s by polling every %v: %v", root, defaultPollInterval, err)
+		return NewPollingWatcher(root, defaultPollInterval), nil
+	}
+	return w, nil
+}
+
+// pollingWatcher compares the size and modification time of every file between walks
+type pollingWatcher struct {
+	root     string
+	interval time.Duration
+	events   chan []PathEvent
+	stop     chan struct{}
+	once     sync.Once
+	eid      uint64
+}
+
+// NewPollingWatcher walks root every interval, reporting the files that changed between walks.
+// The first walk is done before it returns, so any later change is reported.
+func NewPollingWatcher(root string, interval time.Duration) Watcher {
+	w := &pollingWatcher{root: root, interval: interval, events: make(chan []PathEvent), stop: make(chan struct{})}
+	go w.run(w.snapshot())
+	return w
+}
+
+func (w *pollingWatcher) Events() <-chan []PathEvent {
+	return w.events
+}
+
+func (w *pollingWatcher) Close() error {
+	w.once.Do(func() { close(w.stop) })
+	return nil
+}
+
+func (w *pollingWatcher) run(previous manifest) {
+	defer close(w.events)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+		current := w.snapshot()
+		var batch []PathEvent
+		for path, entry := range current {
+			if old, ok := previous[path]; !ok {
+				batch = append(batch, w.event(path, PathCreated))
+			} else if old != entry {
+				batch = append(batch, w.event(path, PathModified))
+			}
+		}
+		for path := range previous {
+			if _, ok := current[path]; !ok {
+				batch = append(batch, w.event(path, PathRemoved))
+			}
+		}
+		previous = current
+		if len(batch) == 0 {
+			continue
+		}
+		select {
+		case w.events <- batch:
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+func (w *pollingWatcher) event(path string, flags uint32) PathEvent {
+	w.eid++
+	return PathEvent{path, flags, w.eid}
+}
+
+// snapshot records the files below the root, quietly skipping what cannot be read
+func (w *pollingWatcher) snapshot() manifest {
+	m := make(manifest)
+	_ = filepath.WalkDir(w.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			m[path] = manifestEntry{info.Size(), info.ModTime().UnixNano()}
+		}
+		return nil
+	})
+	return m
+}
+
+// WatchHoldings keeps the index of root current, re-indexing incrementally once changes
+// to its frames settle. root may list several roots, as Index takes them, all indexed
+// again when any changes. Close the returned watcher to stop.
+func (ix *Indexer) WatchHoldings(root string, options IndexOptions) (Watcher, error) {
+	watchers, err := watchRoots(holdingRoots(root))
+	if err != nil {
+		return nil, err
+	}
+	var w Watcher
+	if len(watchers) == 1 {
+		w = watchers[0]
+	} else {
+		w = mergeWatchers(watchers)
+	}
+	options.Incremental = true
+	go ix.followHoldings(w, root, func() { ix.Index(root, options) })
+	return w, nil
+}
+
+// WatchRoots keeps the index of the roots current, re-indexing a root alone once changes
+// below it settle. Close the returned watchers to stop.
+func (ix *Indexer) WatchRoots(roots []HoldingRoot, options IndexOptions) (io.Closer, error) {
+	watchers, err := watchRoots(roots)
+	if err != nil {
+		return nil, err
+	}
+	for i, w := range watchers {
+		name := roots[i].Name
+		go ix.followHoldings(w, roots[i].Path, func() { ix.ReindexRoot(roots, name, options) })
+	}
+	return watchers, nil
+}
+
+// watchRoots starts a watcher for each root, none unless all start
+func watchRoots(roots []HoldingRoot) (watcherGroup, error) {
+	var watchers watcherGroup
+	for _, root := range roots {
+		w, err := NewWatcher(root.Path)
+		if err != nil {
+			_ = watchers.Close()
+			return nil, err
+		}
+		watchers = append(watchers, w)
+	}
+	return watchers, nil
+}
+
+// watcherGroup closes several watchers as one
+type watcherGroup []Watcher
+
+func (g watcherGroup) Close() error {
+	var err error
+	for _, w := range g {
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// mergedWatcher reports the batches of several watchers
+type mergedWatcher struct {
+	watchers watcherGroup
+	events   chan []PathEvent
+}
+
+// mergeWatchers reports the changes below every root of the watchers until closed
+func mergeWatchers(watchers watcherGroup) Watcher {
+	m := &mergedWatcher{watchers: watchers, events: make(chan []PathEvent)}
+	var wg sync.WaitGroup
+	for _, w := range watchers {
+		wg.Add(1)
+		go func(w Watcher) {
+			defer wg.Done()
+			for batch := range w.Events() {
+				m.events <- batch
+			}
+		}(w)
+	}
+	go func() {
+		wg.Wait()
+		close(m.events)
+	}()
+	return m
+}
+
+func (m *mergedWatcher) Events() <-chan []PathEvent {
+	return m.events
+}
+
+func (m *mergedWatcher) Close() error {
+	return m.watchers.Close()
+}
+
+func (ix *Indexer) followHoldings(w Watcher, root string, update func()) {
+	settle := time.NewTimer(watchSettle)
+	settle.Stop()
+	for {
+		select {
+		case batch, ok := <-w.Events():
+			if !ok {
+				settle.Stop()
+				return
+			}
+			if affectsIndex(batch) {
+				settle.Reset(watchSettle)
+			}
+		case <-settle.C:
+			ix.reindex(root, update)
+		}
+	}
+}
+
+// affectsIndex tells whether a batch of changes may add or remove frames
+func affectsIndex(batch []PathEvent) bool {
+	for _, e := range batch {
+		if e.Flags&(PathOverflow|PathIsDir) != 0 {
+			return true
+		}
+		if isRpf, _, _, _, _ := rpf.TryGetRpfBounds(filepath.Base(e.Path)); isRpf || archive.IsArchive(e.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// reindex brings a running server up to date with the holdings
+func (ix *Indexer) reindex(root string, update func()) {
+	ix.reindexing.Lock()
+	defer ix.reindexing.Unlock()
+	log.Printf("holdings changed below %s, updating the index", root)
+	update()
+	// a frame rewritten in place keeps its path, so decoded frames can't be trusted
+	ix.renderFrames.clear()
+	ix.elevationFrames.clear()
+	if err := ix.rewriteMapfile(); err != nil {
+		log.Printf("cannot rewrite map file: %v", err)
+	}
+}
+
+// rewriteMapfile regenerates the map file aside, so mapserv never reads half of it
+func (ix *Indexer) rewriteMapfile() error {
+	if ix.Mapfile == "" {
+		return nil
+	}
+	tmpPath := ix.Mapfile + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	ix.WriteMap(file)
+	err = file.Close()
+	if err == nil {
+		err = os.Rename(tmpPath, ix.Mapfile)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+	}
+	return err
+}
@@ -0,0 +1,170 @@
+//go:build linux
+
+package commonmap
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ONLYDIR
+
+// inotifyWatcher watches every directory below a root, adding those created later
+type inotifyWatcher struct {
+	fd     int
+	file   *os.File // the non-blocking fd, so Close interrupts a pending read
+	dirs   map[int32]string
+	events chan []PathEvent
+	stop   chan struct{}
+	once   sync.Once
+	eid    uint64
+}
+
+func newNativeWatcher(root string) (Watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	w := &inotifyWatcher{fd: fd, file: os.NewFile(uintptr(fd), "inotify"), dirs: make(map[int32]string), events: make(chan []PathEvent), stop: make(chan struct{})}
+	if err := w.addTree(root, nil); err != nil {
+		_ = w.file.Close()
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *inotifyWatcher) Events() <-chan []PathEvent {
+	return w.events
+}
+
+func (w *inotifyWatcher) Close() error {
+	var err error
+	w.once.Do(func() {
+		close(w.stop)
+		err = w.file.Close()
+	})
+	return err
+}
+
+// addTree watches a directory and those below it. Files already there are reported
+// as created in batch, when given: they may have arrived before the watch did.
+func (w *inotifyWatcher) addTree(dir string, batch *[]PathEvent) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			return nil // unreadable, or gone already
+		}
+		if !d.IsDir() {
+			if batch != nil {
+				*batch = append(*batch, w.event(path, PathCreated))
+			}
+			return nil
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, path, inotifyMask)
+		if err != nil {
+			if path == dir {
+				return os.NewSyscallError("inotify_add_watch", err)
+			}
+			log.Printf("cannot watch %s: %v", path, err)
+			return fs.SkipDir
+		}
+		w.dirs[int32(wd)] = path
+		return nil
+	})
+}
+
+// removeTree drops the watches of a directory moved away, its paths no longer hold
+func (w *inotifyWatcher) removeTree(dir string) {
+	prefix := dir + string(filepath.Separator)
+	for wd, path := range w.dirs {
+		if path == dir || strings.HasPrefix(path, prefix) {
+			_, _ = syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.dirs, wd)
+		}
+	}
+}
+
+func (w *inotifyWatcher) event(path string, flags uint32) PathEvent {
+	w.eid++
+	return PathEvent{path, flags, w.eid}
+}
+
+func (w *inotifyWatcher) run() {
+	defer close(w.events)
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				log.Printf("inotify: %v", err)
+			}
+			return
+		}
+		if batch := w.parse(buf[:n]); len(batch) > 0 {
+			select {
+			case w.events <- batch:
+			case <-w.stop:
+				return
+			}
+		}
+	}
+}
+
+// parse turns the inotify_event records read from the kernel into path events
+func (w *inotifyWatcher) parse(buf []byte) []PathEvent {
+	var batch []PathEvent
+	for len(buf) >= syscall.SizeofInotifyEvent {
+		wd := int32(binary.NativeEndian.Uint32(buf[0:]))
+		mask := binary.NativeEndian.Uint32(buf[4:])
+		nameLen := int(binary.NativeEndian.Uint32(buf[12:]))
+		end := min(syscall.SizeofInotifyEvent+nameLen, len(buf))
+		name := strings.TrimRight(string(buf[syscall.SizeofInotifyEvent:end]), "\x00")
+		buf = buf[end:]
+
+		if mask&syscall.IN_Q_OVERFLOW != 0 {
+			batch = append(batch, w.event("", PathOverflow))
+			continue
+		}
+		if mask&syscall.IN_IGNORED != 0 {
+			delete(w.dirs, wd)
+			continue
+		}
+		dir, ok := w.dirs[wd]
+		if !ok || name == "" {
+			continue // a directory's own events are reported by its parent
+		}
+		path := filepath.Join(dir, name)
+		var flags uint32
+		if mask&syscall.IN_ISDIR != 0 {
+			flags = PathIsDir
+		}
+		switch {
+		case mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+			batch = append(batch, w.event(path, flags|PathCreated))
+			if flags&PathIsDir != 0 {
+				if err := w.addTree(path, &batch); err != nil {
+					log.Printf("cannot watch %s: %v", path, err)
+				}
+			}
+		case mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0:
+			batch = append(batch, w.event(path, flags|PathRemoved))
+			if flags&PathIsDir != 0 {
+				w.removeTree(path)
+			}
+		case mask&(syscall.IN_CLOSE_WRITE|syscall.IN_ATTRIB) != 0:
+			batch = append(batch, w.event(path, flags|PathModified))
+		}
+	}
+	return batch
+}
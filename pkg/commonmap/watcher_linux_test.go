@@ -0,0 +1,191 @@
+//go:build linux
+
+package commonmap
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// inotifyRecord encodes an inotify_event, its name padded with NULs as the kernel does
+func inotifyRecord(wd int32, mask uint32, name string) []byte {
+	nameLen := 0
+	if name != "" {
+		nameLen = (len(name)/16 + 1) * 16
+	}
+	buf := make([]byte, syscall.SizeofInotifyEvent+nameLen)
+	binary.NativeEndian.PutUint32(buf[0:], uint32(wd))
+	binary.NativeEndian.PutUint32(buf[4:], mask)
+	binary.NativeEndian.PutUint32(buf[12:], uint32(nameLen))
+	copy(buf[syscall.SizeofInotifyEvent:], name)
+	return buf
+}
+
+func TestInotifyParse(t *testing.T) {
+	// the watches of the root and a directory below, apart from those the kernel numbers
+	const rootWatch, jgWatch = 1000, 1001
+	root := writeHoldings(t, "RPF/JG/000A0010.JG1", "new/RPF/ON/00010010.ON1")
+	jg := filepath.Join(root, "RPF", "JG")
+	newDir := filepath.Join(root, "new")
+
+	tests := []struct {
+		name    string
+		records [][]byte
+		want    []PathEvent
+	}{
+		{"file created", [][]byte{inotifyRecord(jgWatch, syscall.IN_CREATE, "000B0010.JG1")},
+			[]PathEvent{{filepath.Join(jg, "000B0010.JG1"), PathCreated, 1}}},
+		{"file moved in", [][]byte{inotifyRecord(jgWatch, syscall.IN_MOVED_TO, "000B0010.JG1")},
+			[]PathEvent{{filepath.Join(jg, "000B0010.JG1"), PathCreated, 1}}},
+		{"file written", [][]byte{inotifyRecord(jgWatch, syscall.IN_CLOSE_WRITE, "000A0010.JG1")},
+			[]PathEvent{{filepath.Join(jg, "000A0010.JG1"), PathModified, 1}}},
+		{"file touched", [][]byte{inotifyRecord(jgWatch, syscall.IN_ATTRIB, "000A0010.JG1")},
+			[]PathEvent{{filepath.Join(jg, "000A0010.JG1"), PathModified, 1}}},
+		{"file deleted", [][]byte{inotifyRecord(jgWatch, syscall.IN_DELETE, "000A0010.JG1")},
+			[]PathEvent{{filepath.Join(jg, "000A0010.JG1"), PathRemoved, 1}}},
+		{"file moved away", [][]byte{inotifyRecord(jgWatch, syscall.IN_MOVED_FROM, "000A0010.JG1")},
+			[]PathEvent{{filepath.Join(jg, "000A0010.JG1"), PathRemoved, 1}}},
+		{"queue overflow", [][]byte{inotifyRecord(-1, syscall.IN_Q_OVERFLOW, "")},
+			[]PathEvent{{"", PathOverflow, 1}}},
+		{"unknown watch", [][]byte{inotifyRecord(jgWatch+1, syscall.IN_CREATE, "000B0010.JG1")}, nil},
+		{"directory's own event", [][]byte{inotifyRecord(jgWatch, syscall.IN_ATTRIB|syscall.IN_ISDIR, "")}, nil},
+		{"several records", [][]byte{
+			inotifyRecord(jgWatch, syscall.IN_CREATE, "000B0010.JG1"),
+			inotifyRecord(jgWatch, syscall.IN_CLOSE_WRITE, "000B0010.JG1"),
+			inotifyRecord(rootWatch, syscall.IN_DELETE, "readme.txt"),
+		}, []PathEvent{
+			{filepath.Join(jg, "000B0010.JG1"), PathCreated, 1},
+			{filepath.Join(jg, "000B0010.JG1"), PathModified, 2},
+			{filepath.Join(root, "readme.txt"), PathRemoved, 3},
+		}},
+		{"directory created with a frame in it", [][]byte{inotifyRecord(rootWatch, syscall.IN_CREATE|syscall.IN_ISDIR, "new")},
+			[]PathEvent{
+				{newDir, PathCreated | PathIsDir, 1},
+				{filepath.Join(newDir, "RPF", "ON", "00010010.ON1"), PathCreated, 2},
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+			if err != nil {
+				t.Skip(err)
+			}
+			defer func() { _ = syscall.Close(fd) }()
+			w := &inotifyWatcher{fd: fd, dirs: map[int32]string{rootWatch: root, jgWatch: jg}}
+			var buf []byte
+			for _, record := range tt.records {
+				buf = append(buf, record...)
+			}
+			got := w.parse(buf)
+			if len(got) != len(tt.want) {
+				t.Fatalf("parsed %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("parsed %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+
+	t.Run("watches follow directories", func(t *testing.T) {
+		fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+		if err != nil {
+			t.Skip(err)
+		}
+		defer func() { _ = syscall.Close(fd) }()
+		w := &inotifyWatcher{fd: fd, dirs: map[int32]string{rootWatch: root, jgWatch: jg}}
+		w.parse(inotifyRecord(rootWatch, syscall.IN_CREATE|syscall.IN_ISDIR, "new"))
+		watched := make(map[string]int32)
+		for wd, dir := range w.dirs {
+			watched[dir] = wd
+		}
+		for _, dir := range []string{newDir, filepath.Join(newDir, "RPF"), filepath.Join(newDir, "RPF", "ON")} {
+			if _, ok := watched[dir]; !ok {
+				t.Fatalf("%s is not watched: %v", dir, w.dirs)
+			}
+		}
+
+		w.parse(inotifyRecord(rootWatch, syscall.IN_MOVED_FROM|syscall.IN_ISDIR, "new"))
+		if len(w.dirs) != 2 {
+			t.Fatalf("watching %v after the directory moved away", w.dirs)
+		}
+		w.parse(inotifyRecord(jgWatch, syscall.IN_IGNORED, ""))
+		if _, ok := w.dirs[jgWatch]; ok || len(w.dirs) != 1 {
+			t.Fatalf("watching %v after the watch of %s went", w.dirs, jg)
+		}
+	})
+}
+
+func TestInotifyWatchesNewDirectories(t *testing.T) {
+	root := t.TempDir()
+	w, err := newNativeWatcher(root)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer func() { _ = w.Close() }()
+
+	dir := filepath.Join(root, "RPF", "JG")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvent(t, w, filepath.Join(root, "RPF"), PathCreated|PathIsDir)
+
+	// written once the directory is watched, or found by the walk that adds the watch
+	framePath := filepath.Join(dir, "000A0010.JG1")
+	if err := os.WriteFile(framePath, []byte("frame"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvent(t, w, framePath, 0)
+	if err := os.Remove(framePath); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvent(t, w, framePath, PathRemoved)
+}
+
+// The index follows holdings within the settle time of changes. Elsewhere than Linux the
+// holdings are polled every half minute, too slow for a test.
+func TestWatchHoldings(t *testing.T) {
+	const framePath = "RPF/JG/000A0010.JG1"
+	root := writeHoldings(t, "RPF/JG/000B0010.JG1")
+	ix := NewIndexer(t.TempDir())
+	ix.Index(root, IndexOptions{})
+	w, err := ix.WatchHoldings(root, IndexOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = w.Close() }()
+
+	indexed := func() bool {
+		frames, err := ix.findIndexedFrames("JG", frameBounds(t, framePath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, frame := range frames {
+			if filepath.Base(frame.location) == filepath.Base(framePath) {
+				return true
+			}
+		}
+		return false
+	}
+	waitForIndex := func(want bool) {
+		t.Helper()
+		for deadline := time.Now().Add(10 * watchSettle); indexed() != want; time.Sleep(50 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s indexed is %t, want %t", framePath, !want, want)
+			}
+		}
+	}
+
+	if indexed() {
+		t.Fatalf("%s indexed before it was copied in", framePath)
+	}
+	writeFrame(t, root, framePath, "frame")
+	waitForIndex(true)
+	removeFrame(t, root, framePath)
+	waitForIndex(false)
+}
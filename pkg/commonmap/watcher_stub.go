@@ -0,0 +1,13 @@
+//go:build !linux
+
+package commonmap
+
+import (
+	"errors"
+	"runtime"
+)
+
+// todo: finish the USN journal reader in fsevents_windows.go
+func newNativeWatcher(root string) (Watcher, error) {
+	return nil, errors.New("no file system notifications on " + runtime.GOOS)
+}
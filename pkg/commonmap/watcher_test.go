@@ -0,0 +1,83 @@
+package commonmap
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// waitForEvent reads batches until one reports path with flags, failing after a while
+func waitForEvent(t *testing.T, w Watcher, path string, flags uint32) {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case batch, ok := <-w.Events():
+			if !ok {
+				t.Fatalf("watcher closed before reporting %s", path)
+			}
+			for _, e := range batch {
+				if e.Path == path && e.Flags&flags == flags {
+					return
+				}
+			}
+		case <-timeout:
+			t.Fatalf("no event %#x for %s", flags, path)
+		}
+	}
+}
+
+func TestAffectsIndex(t *testing.T) {
+	tests := []struct {
+		name  string
+		batch []PathEvent
+		want  bool
+	}{
+		{"nothing", nil, false},
+		{"a frame", []PathEvent{{"/h/RPF/JG/000A0010.JG1", PathCreated, 1}}, true},
+		{"a frame in lower case", []PathEvent{{"/h/rpf/jg/000a0010.jg1", PathModified, 1}}, true},
+		{"a frame removed", []PathEvent{{"/h/RPF/JG/000A0010.JG1", PathRemoved, 1}}, true},
+		{"a table of contents", []PathEvent{{"/h/RPF/A.TOC", PathModified, 1}}, false},
+		{"other files", []PathEvent{{"/h/readme.txt", PathCreated, 1}, {"/h/RPF/JG/notes.doc", PathModified, 2}}, false},
+		{"a zip", []PathEvent{{"/h/cd1.zip", PathCreated, 1}}, true},
+		{"an iso", []PathEvent{{"/h/CD1.ISO", PathRemoved, 1}}, true},
+		{"a directory", []PathEvent{{"/h/RPF/JG", PathCreated | PathIsDir, 1}}, true},
+		{"lost events", []PathEvent{{"", PathOverflow, 1}}, true},
+		{"a frame among other files", []PathEvent{{"/h/readme.txt", PathCreated, 1}, {"/h/RPF/ON/00010010.ON1", PathCreated, 2}}, true},
+	}
+	for _, tt := range tests {
+		if got := affectsIndex(tt.batch); got != tt.want {
+			t.Errorf("%s: affectsIndex is %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPollingWatcher(t *testing.T) {
+	root := writeHoldings(t, "RPF/JG/000A0010.JG1")
+	w := NewPollingWatcher(root, 10*time.Millisecond)
+	defer func() { _ = w.Close() }()
+
+	added := filepath.Join(root, "RPF", "JG", "000B0010.JG1")
+	if err := os.WriteFile(added, []byte("new"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvent(t, w, added, PathCreated)
+
+	modified := filepath.Join(root, "RPF", "JG", "000A0010.JG1")
+	if err := os.WriteFile(modified, []byte("a newer edition"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvent(t, w, modified, PathModified)
+
+	if err := os.Remove(added); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvent(t, w, added, PathRemoved)
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for range w.Events() {
+	}
+}
@@ -0,0 +1,543 @@
+package commonmap
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"cm/pkg/rpf"
+)
+
+// This file answers WMS GetMap requests natively. RPF layers are mosaicked from the
+// frames found in the series index, any other layer is still drawn by mapserv.
+
+const (
+	maxMapSize = 4096 // MAXSIZE of the mapfile
+	// MapServer's scale conventions, so series switch at the same zoom as they used to
+	mapResolution   = 72.0
+	inchesPerDegree = 4374754.0
+	inchesPerMeter  = 39.3701
+	mercatorRadius  = 6378137.0
+)
+
+// wmsParams holds query parameters under upper case keys, WMS keys being case insensitive
+type wmsParams map[string]string
+
+func parseWmsParams(query url.Values) wmsParams {
+	params := make(wmsParams, len(query))
+	for key, values := range query {
+		if len(values) > 0 {
+			params[strings.ToUpper(key)] = values[0]
+		}
+	}
+	return params
+}
+
+func (p wmsParams) get(key string) string {
+	return p[key]
+}
+
+// version answers 1.3.0 unless the client asked for an older WMS
+func (p wmsParams) version() string {
+	v := p.get("VERSION")
+	if v == "" {
+		v = p.get("WMTVER")
+	}
+	if v != "" && v < "1.3" {
+		return "1.1.1"
+	}
+	return "1.3.0"
+}
+
+// wmsError is reported to the client as a service exception
+type wmsError struct {
+	code, message string
+}
+
+func (e *wmsError) Error() string {
+	return e.message
+}
+
+type serviceExceptionReport struct {
+	XMLName    xml.Name                `xml:"ServiceExceptionReport"`
+	Version    string                  `xml:"version,attr"`
+	Xmlns      string                  `xml:"xmlns,attr,omitempty"`
+	Exceptions []serviceExceptionEntry `xml:"ServiceException"`
+}
+
+type serviceExceptionEntry struct {
+	Code    string `xml:"code,attr,omitempty"`
+	Message string `xml:",chardata"`
+}
+
+func serviceException(w http.ResponseWriter, version, code, message string) {
+	report := serviceExceptionReport{Version: "1.1.1", Exceptions: []serviceExceptionEntry{{code, message}}}
+	contentType := "application/vnd.ogc.se_xml"
+	if version == "1.3.0" {
+		report.Version, report.Xmlns, contentType = version, "http://www.opengis.net/ogc", "text/xml"
+	}
+	body, err := xml.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	w.Header().Set("Content-type", contentType)
+	if _, err := w.Write(append([]byte(xml.Header), body...)); err != nil {
+		log.Print(err)
+	}
+}
+
+// mapView is the pixel grid of a GetMap request
+type mapView struct {
+	mercator      bool // EPSG:3857 meters, otherwise degrees
+	bbox          Box  // in request units, x before y
+	width, height int
+	lons          []float64 // longitude of each column's center
+	lats          []float64 // latitude of each row's center, north first
+}
+
+func parseMapView(params wmsParams) (*mapView, *wmsError) {
+	version := params.version()
+	crsKey, crsCode := "CRS", "InvalidCRS"
+	if version == "1.1.1" {
+		crsKey, crsCode = "SRS", "InvalidSRS"
+	}
+	crs := strings.ToUpper(params.get(crsKey))
+	if crs == "" {
+		crs = strings.ToUpper(params.get("CRS") + params.get("SRS"))
+	}
+	v := &mapView{}
+	swapAxes := false
+	switch crs {
+	case "EPSG:4326":
+		// WMS 1.3.0 follows the EPSG axis order, latitude first
+		swapAxes = version == "1.3.0"
+	case "CRS:84":
+	case "EPSG:3857", "EPSG:900913":
+		v.mercator = true
+	default:
+		return nil, &wmsError{crsCode, "unsupported " + crsKey + " " + params.get(crsKey)}
+	}
+
+	parts := strings.Split(params.get("BBOX"), ",")
+	if len(parts) != 4 {
+		return nil, &wmsError{"MissingParameterValue", "BBOX must be minx,miny,maxx,maxy"}
+	}
+	for i, part := range parts {
+		value, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, &wmsError{"InvalidParameterValue", "invalid BBOX " + params.get("BBOX")}
+		}
+		v.bbox[i] = value
+	}
+	if swapAxes {
+		v.bbox = Box{v.bbox[1], v.bbox[0], v.bbox[3], v.bbox[2]}
+	}
+	if v.bbox[MinX] >= v.bbox[MaxX] || v.bbox[MinY] >= v.bbox[MaxY] {
+		return nil, &wmsError{"InvalidParameterValue", "empty BBOX " + params.get("BBOX")}
+	}
+
+	var err1, err2 error
+	v.width, err1 = strconv.Atoi(params.get("WIDTH"))
+	v.height, err2 = strconv.Atoi(params.get("HEIGHT"))
+	if err1 != nil || err2 != nil || v.width < 1 || v.height < 1 || v.width > maxMapSize || v.height > maxMapSize {
+		return nil, &wmsError{"InvalidParameterValue", "WIDTH and HEIGHT must be between 1 and " + strconv.Itoa(maxMapSize)}
+	}
+
+	return newMapView(v.mercator, v.bbox, v.width, v.height), nil
+}
+
+func newMapView(mercator bool, bbox Box, width, height int) *mapView {
+	v := &mapView{mercator: mercator, bbox: bbox, width: width, height: height}
+	dx := (bbox[MaxX] - bbox[MinX]) / float64(width)
+	dy := (bbox[MaxY] - bbox[MinY]) / float64(height)
+	v.lons = make([]float64, width)
+	for i := range v.lons {
+		v.lons[i], _ = v.toGeographic(bbox[MinX]+(float64(i)+0.5)*dx, 0)
+	}
+	v.lats = make([]float64, height)
+	for i := range v.lats {
+		_, v.lats[i] = v.toGeographic(0, bbox[MaxY]-(float64(i)+0.5)*dy)
+	}
+	return v
+}
+
+func (v *mapView) toGeographic(x, y float64) (lon, lat float64) {
+	if !v.mercator {
+		return x, y
+	}
+	lon = x / mercatorRadius * 180 / math.Pi
+	lat = (2*math.Atan(math.Exp(y/mercatorRadius)) - math.Pi/2) * 180 / math.Pi
+	return lon, lat
+}
+
+// geoBox is the requested extent in degrees
+func (v *mapView) geoBox() Box {
+	x1, y1 := v.toGeographic(v.bbox[MinX], v.bbox[MinY])
+	x2, y2 := v.toGeographic(v.bbox[MaxX], v.bbox[MaxY])
+	return Box{x1, y1, x2, y2}
+}
+
+// cacheKey identifies the view for the tile cache
+func (v *mapView) cacheKey() string {
+	crs := "CRS:84"
+	if v.mercator {
+		crs = "EPSG:3857"
+	}
+	return fmt.Sprintf("%s %v %dx%d", crs, v.bbox, v.width, v.height)
+}
+
+// scale is the denominator MapServer would compute for this view
+func (v *mapView) scale() float64 {
+	inchesPerUnit := inchesPerDegree
+	if v.mercator {
+		inchesPerUnit = inchesPerMeter
+	}
+	return (v.bbox[MaxX] - v.bbox[MinX]) * inchesPerUnit * mapResolution / float64(max(v.width-1, 1))
+}
+
+// pixelRange returns the columns and rows whose centers fall inside a box
+func (v *mapView) pixelRange(box Box) (x0, x1, y0, y1 int) {
+	x0 = sort.SearchFloat64s(v.lons, box[MinX])
+	x1 = sort.SearchFloat64s(v.lons, box[MaxX])
+	y0 = sort.Search(len(v.lats), func(i int) bool { return v.lats[i] <= box[MaxY] })
+	y1 = sort.Search(len(v.lats), func(i int) bool { return v.lats[i] <= box[MinY] })
+	return x0, x1, y0, y1
+}
+
+// rasterSeries returns the series drawn by a native layer at a scale, finest first,
+// and false when the layer is not an RPF layer
+func (ix *Indexer) rasterSeries(layer string, scale float64) ([]SeriesRes, bool) {
+	layer = strings.ToUpper(strings.TrimSpace(layer))
+	var seriesCode string
+	switch {
+	case layer == "RPF":
+	case len(layer) == 6 && strings.HasPrefix(layer, "RPF-"):
+		seriesCode = layer[4:]
+		if series, ok := rpf.DataSeries[seriesCode]; !ok || series.Type == rpf.CDTED {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+
+	var drawn []SeriesRes
+	for _, series := range ix.indexedSeries() {
+		if rpf.DataSeries[series.seriesCode].Type == rpf.CDTED {
+			continue
+		}
+		if seriesCode == "" {
+			// the finest series for the scale, falling back to any coarser one
+			if series.scale*2 >= scale {
+				drawn = append(drawn, series)
+			}
+		} else if series.seriesCode == seriesCode && scale >= series.scale/3 && scale < series.scale*2 {
+			drawn = append(drawn, series)
+		}
+	}
+	return drawn, true
+}
+
+// mosaic collects frames into a layer image, only ever filling transparent pixels
+type mosaic struct {
+	ix        *Indexer
+	view      *mapView
+	img       *image.RGBA
+	remaining int
+}
+
+func (ix *Indexer) newMosaic(view *mapView) *mosaic {
+	return &mosaic{ix, view, image.NewRGBA(image.Rect(0, 0, view.width, view.height)), view.width * view.height}
+}
+
+// drawSeries fills the mosaic from the indexed frames of a series
+func (m *mosaic) drawSeries(seriesCode string) error {
+	frames, err := m.ix.findIndexedFrames(seriesCode, m.view.geoBox())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, indexed := range frames {
+		if m.remaining == 0 {
+			break
+		}
+		if !m.hasGaps(indexed.box) {
+			continue // skip decoding frames that cannot add anything
+		}
+		value, err := m.ix.renderFrames.get(indexed.location, func() (any, error) {
+			return loadFrame(indexed.location, func(r io.ReaderAt) (any, error) { return rpf.DecodeFrame(r) })
+		})
+		if err != nil {
+			log.Printf("cannot read frame %s: %v", indexed.location, err)
+			continue
+		}
+		frame := value.(*rpf.Frame)
+		if grid, frameNumber, ok := polarFrame(frame.Header, indexed.location); ok {
+			m.drawPolarFrame(frame, grid, frameNumber, indexed.box)
+			continue
+		}
+		m.drawFrame(frame, frameBox(frame.Header, indexed.box))
+	}
+	return nil
+}
+
+func (m *mosaic) hasGaps(box Box) bool {
+	x0, x1, y0, y1 := m.view.pixelRange(box)
+	for y := y0; y < y1; y++ {
+		for x := x0; x < x1; x++ {
+			if m.img.Pix[y*m.img.Stride+x*4+3] == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// drawFrame resamples a frame covering box into the mosaic, nearest neighbour
+func (m *mosaic) drawFrame(frame *rpf.Frame, box Box) {
+	pixel := framePixels(frame)
+	x0, x1, y0, y1 := m.view.pixelRange(box)
+	size := frame.Image.Bounds().Size()
+	sx := float64(size.X) / (box[MaxX] - box[MinX])
+	sy := float64(size.Y) / (box[MaxY] - box[MinY])
+	for y := y0; y < y1; y++ {
+		fy := min(int((box[MaxY]-m.view.lats[y])*sy), size.Y-1)
+		row := m.img.Pix[y*m.img.Stride:]
+		for x := x0; x < x1; x++ {
+			p := row[x*4 : x*4+4]
+			if p[3] != 0 {
+				continue
+			}
+			fx := min(int((m.view.lons[x]-box[MinX])*sx), size.X-1)
+			if c, ok := pixel(fx, fy); ok {
+				p[0], p[1], p[2], p[3] = c.R, c.G, c.B, 255
+				m.remaining--
+			}
+		}
+	}
+}
+
+// drawPolarFrame resamples a polar zone frame into the mosaic, looking each pixel up on the
+// zone's grid, nearest neighbour
+func (m *mosaic) drawPolarFrame(frame *rpf.Frame, grid *rpf.PolarGrid, frameNumber int, box Box) {
+	pixel := framePixels(frame)
+	x0, x1, y0, y1 := m.view.pixelRange(box)
+	size := frame.Image.Bounds().Size()
+	for y := y0; y < y1; y++ {
+		row := m.img.Pix[y*m.img.Stride:]
+		for x := x0; x < x1; x++ {
+			p := row[x*4 : x*4+4]
+			if p[3] != 0 {
+				continue
+			}
+			fx, fy := grid.FramePixel(frameNumber, m.view.lons[x], m.view.lats[y], size.X, size.Y)
+			if fx < 0 || fy < 0 || fx >= float64(size.X) || fy >= float64(size.Y) {
+				continue // inside the frame's bounds but off the frame
+			}
+			if c, ok := pixel(int(fx), int(fy)); ok {
+				p[0], p[1], p[2], p[3] = c.R, c.G, c.B, 255
+				m.remaining--
+			}
+		}
+	}
+}
+
+// framePixels returns a reader of a frame's opaque pixels
+func framePixels(frame *rpf.Frame) func(x, y int) (color.RGBA, bool) {
+	switch img := frame.Image.(type) {
+	case *image.Paletted:
+		colors := make([]color.RGBA, len(img.Palette))
+		for i, c := range img.Palette {
+			colors[i] = color.RGBAModel.Convert(c).(color.RGBA)
+		}
+		return func(x, y int) (color.RGBA, bool) {
+			i := int(img.Pix[y*img.Stride+x])
+			if i >= len(colors) || colors[i].A == 0 {
+				return color.RGBA{}, false
+			}
+			return colors[i], true
+		}
+	case *image.Gray:
+		return func(x, y int) (color.RGBA, bool) {
+			v := img.Pix[y*img.Stride+x]
+			return color.RGBA{v, v, v, 255}, frame.HasData(x, y)
+		}
+	default:
+		return func(x, y int) (color.RGBA, bool) {
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			return c, c.A != 0
+		}
+	}
+}
+
+// mapservLayers has mapserv draw the layers it still owns, such as the vector base map
+func (ix *Indexer) mapservLayers(r *http.Request, layers []string) (image.Image, error) {
+	query := r.URL.Query()
+	for key := range query {
+		switch strings.ToUpper(key) {
+		case "LAYERS", "STYLES", "FORMAT", "TRANSPARENT":
+			query.Del(key)
+		}
+	}
+	query.Set("LAYERS", strings.Join(layers, ","))
+	query.Set("STYLES", "")
+	query.Set("FORMAT", "image/png")
+	query.Set("TRANSPARENT", "TRUE")
+	sub := r.Clone(r.Context())
+	sub.URL.RawQuery = query.Encode()
+	var buf bytes.Buffer
+	if err := ix.MapRender(&buf, sub); err != nil {
+		return nil, err
+	}
+	return png.Decode(&buf)
+}
+
+// renderMap draws the layers of a view bottom to top, RPF layers natively and any
+// other run of layers through mapserv
+func (ix *Indexer) renderMap(r *http.Request, view *mapView, layers []string) (*image.RGBA, error) {
+	canvas := image.NewRGBA(image.Rect(0, 0, view.width, view.height))
+	scale := view.scale()
+	var err error
+	var pending []string // consecutive layers for a single mapserv call
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		img, err := ix.mapservLayers(r, pending)
+		if errors.Is(err, errNoMapserv) {
+			return &wmsError{"LayerNotDefined", "unknown layer " + strings.Join(pending, ",")}
+		}
+		if err != nil {
+			return err
+		}
+		draw.Draw(canvas, canvas.Bounds(), img, img.Bounds().Min, draw.Over)
+		pending = pending[:0]
+		return nil
+	}
+	for _, layer := range layers {
+		if layer == "" {
+			continue
+		}
+		series, native := ix.rasterSeries(layer, scale)
+		if !native {
+			pending = append(pending, layer)
+			continue
+		}
+		if err = flush(); err != nil {
+			break
+		}
+		m := ix.newMosaic(view)
+		for _, s := range series {
+			if err = m.drawSeries(s.seriesCode); err != nil || m.remaining == 0 {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+		draw.Draw(canvas, canvas.Bounds(), m.img, image.Point{}, draw.Over)
+	}
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return canvas, nil
+}
+
+// getMap answers a WMS GetMap request
+func (ix *Indexer) getMap(w http.ResponseWriter, r *http.Request, params wmsParams) {
+	version := params.version()
+	view, werr := parseMapView(params)
+	if werr != nil {
+		serviceException(w, version, werr.code, werr.message)
+		return
+	}
+
+	format := strings.ToLower(params.get("FORMAT"))
+	if i := strings.IndexByte(format, ';'); i != -1 {
+		format = strings.TrimSpace(format[:i]) // "image/png; mode=8bit"
+	}
+	switch format {
+	case "", "image/png":
+		format = "image/png"
+	case "image/jpeg", "image/jpg":
+		format = "image/jpeg"
+	default:
+		serviceException(w, version, "InvalidFormat", "unsupported FORMAT "+params.get("FORMAT"))
+		return
+	}
+	background := color.RGBA{255, 255, 255, 255}
+	if bg := params.get("BGCOLOR"); bg != "" {
+		rgb, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(bg), "0x"), 16, 32)
+		if err != nil {
+			serviceException(w, version, "InvalidParameterValue", "invalid BGCOLOR "+bg)
+			return
+		}
+		background = color.RGBA{uint8(rgb >> 16), uint8(rgb >> 8), uint8(rgb), 255}
+	}
+	transparent := strings.EqualFold(params.get("TRANSPARENT"), "TRUE") && format == "image/png"
+
+	layers := strings.Split(params.get("LAYERS"), ",")
+	key := fmt.Sprintf("%s %s %t %v", view.cacheKey(), format, transparent, background)
+	data, err := ix.cachedImage(layers, key, format, func() ([]byte, error) {
+		canvas, err := ix.renderMap(r, view, layers)
+		if err != nil {
+			return nil, err
+		}
+		return encodeImage(canvas, format, transparent, background)
+	})
+	if errors.As(err, &werr) {
+		serviceException(w, version, werr.code, werr.message)
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	writeImage(w, format, data)
+}
+
+// encodeImage encodes a rendered map, flattened onto the background unless transparent
+func encodeImage(canvas *image.RGBA, format string, transparent bool, background color.RGBA) ([]byte, error) {
+	var out image.Image = canvas
+	if !transparent {
+		flat := image.NewRGBA(canvas.Bounds())
+		draw.Draw(flat, flat.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+		draw.Draw(flat, flat.Bounds(), canvas, image.Point{}, draw.Over)
+		out = flat
+	}
+	var buf bytes.Buffer
+	var err error
+	if format == "image/jpeg" {
+		err = jpeg.Encode(&buf, out, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, out)
+	}
+	return buf.Bytes(), err
+}
+
+func writeImage(w http.ResponseWriter, format string, data []byte) {
+	w.Header().Set("Content-type", format)
+	if _, err := w.Write(data); err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,240 @@
+package commonmap
+
+import (
+	"bytes"
+	"encoding/xml"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strconv"
+	"testing"
+
+	"cm/pkg/rpf"
+)
+
+var (
+	red         = color.NRGBA{255, 0, 0, 255}
+	blue        = color.NRGBA{0, 0, 255, 255}
+	white       = color.NRGBA{255, 255, 255, 255}
+	transparent = color.NRGBA{}
+)
+
+// serveFrames indexes the frames named and serves them, each drawn red over blue.
+// The frame files only hold their path: their images are put in the frame cache.
+func serveFrames(t *testing.T, framePaths ...string) (*Indexer, *httptest.Server) {
+	t.Helper()
+	ix := NewIndexer(t.TempDir())
+	ix.Index(writeHoldings(t, framePaths...), IndexOptions{})
+	img := image.NewPaletted(image.Rect(0, 0, 2, 2), color.Palette{red, blue})
+	img.Pix = []uint8{0, 0, 1, 1}
+	frame := &rpf.Frame{Header: &rpf.FrameHeader{}, Image: img}
+	for _, series := range ix.indexedSeries() {
+		frames, err := ix.findIndexedFrames(series.seriesCode, Box{-180, -90, 180, 90})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, indexed := range frames {
+			if _, err := ix.renderFrames.get(indexed.location, func() (any, error) { return frame, nil }); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	server := httptest.NewServer(ix.routes())
+	t.Cleanup(server.Close)
+	return ix, server
+}
+
+// frameBounds is the box of a frame as its name gives it
+func frameBounds(t *testing.T, framePath string) Box {
+	t.Helper()
+	ok, x1, y1, x2, y2 := rpf.TryGetRpfBounds(path.Base(framePath))
+	if !ok {
+		t.Fatalf("%s is not a frame", framePath)
+	}
+	return Box{x1, y1, x2, y2}
+}
+
+func httpGet(t *testing.T, url string) (*http.Response, []byte) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+func pixelAt(img image.Image, x, y int) color.NRGBA {
+	return color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+}
+
+// checkPixels checks the colour at the middle of each quarter of an image:
+// top left, top right, bottom left, bottom right
+func checkPixels(t *testing.T, img image.Image, want [4]color.NRGBA) {
+	t.Helper()
+	size := img.Bounds().Size()
+	for i, c := range want {
+		x, y := size.X/4+i%2*size.X/2, size.Y/4+i/2*size.Y/2
+		if got := pixelAt(img, x, y); got != c {
+			t.Errorf("pixel (%d, %d) is %v, want %v", x, y, got, c)
+		}
+	}
+}
+
+func TestGetMap(t *testing.T) {
+	const framePath = "RPF/JG/000A0010.JG1"
+	_, server := serveFrames(t, framePath)
+	frame := frameBounds(t, framePath)
+	// the view straddles the frame's west edge, the frame filling its east half
+	half := (frame[MaxX] - frame[MinX]) / 2
+	west, east := formatNumber(frame[MinX]-half), formatNumber(frame[MinX]+half)
+	south, north := formatNumber(frame[MinY]), formatNumber(frame[MaxY])
+	lonLat := west + "," + south + "," + east + "," + north
+	latLon := south + "," + west + "," + north + "," + east
+
+	tests := []struct {
+		name   string
+		params url.Values
+		format string
+		want   [4]color.NRGBA
+	}{
+		{
+			"1.1.1 longitude first",
+			url.Values{"VERSION": {"1.1.1"}, "SRS": {"EPSG:4326"}, "BBOX": {lonLat}, "TRANSPARENT": {"TRUE"}},
+			"image/png", [4]color.NRGBA{transparent, red, transparent, blue},
+		},
+		{
+			"1.3.0 latitude first",
+			url.Values{"VERSION": {"1.3.0"}, "CRS": {"EPSG:4326"}, "BBOX": {latLon}, "TRANSPARENT": {"TRUE"}},
+			"image/png", [4]color.NRGBA{transparent, red, transparent, blue},
+		},
+		{
+			"1.3.0 longitude first with CRS:84",
+			url.Values{"VERSION": {"1.3.0"}, "CRS": {"CRS:84"}, "BBOX": {lonLat}, "TRANSPARENT": {"TRUE"}},
+			"image/png", [4]color.NRGBA{transparent, red, transparent, blue},
+		},
+		{
+			"1.3.0 EPSG:4326 in longitude order misses the frame",
+			url.Values{"VERSION": {"1.3.0"}, "CRS": {"EPSG:4326"}, "BBOX": {lonLat}, "TRANSPARENT": {"TRUE"}},
+			"image/png", [4]color.NRGBA{transparent, transparent, transparent, transparent},
+		},
+		{
+			"opaque on white",
+			url.Values{"VERSION": {"1.3.0"}, "CRS": {"CRS:84"}, "BBOX": {lonLat}, "TRANSPARENT": {"FALSE"}},
+			"image/png", [4]color.NRGBA{white, red, white, blue},
+		},
+		{
+			"opaque on the background colour",
+			url.Values{"VERSION": {"1.3.0"}, "CRS": {"CRS:84"}, "BBOX": {lonLat}, "BGCOLOR": {"0x00FF00"}},
+			"image/png", [4]color.NRGBA{{0, 255, 0, 255}, red, {0, 255, 0, 255}, blue},
+		},
+		{
+			"outside the scales of the series",
+			url.Values{"VERSION": {"1.3.0"}, "CRS": {"CRS:84"}, "BBOX": {lonLat}, "TRANSPARENT": {"TRUE"}, "WIDTH": {"64"}, "HEIGHT": {"64"}},
+			"image/png", [4]color.NRGBA{transparent, transparent, transparent, transparent},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.params.Set("SERVICE", "WMS")
+			tt.params.Set("REQUEST", "GetMap")
+			tt.params.Set("LAYERS", "RPF-JG")
+			tt.params.Set("FORMAT", tt.format)
+			if tt.params.Get("WIDTH") == "" {
+				tt.params.Set("WIDTH", "512")
+				tt.params.Set("HEIGHT", "512")
+			}
+			resp, body := httpGet(t, server.URL+"/wms?"+tt.params.Encode())
+			if ct := resp.Header.Get("Content-type"); ct != tt.format {
+				t.Fatalf("GetMap answered %s: %s", ct, body)
+			}
+			img, err := png.Decode(bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size := img.Bounds().Size(); strconv.Itoa(size.X) != tt.params.Get("WIDTH") || strconv.Itoa(size.Y) != tt.params.Get("HEIGHT") {
+				t.Fatalf("image of %v, want %sx%s", size, tt.params.Get("WIDTH"), tt.params.Get("HEIGHT"))
+			}
+			checkPixels(t, img, tt.want)
+		})
+	}
+
+	t.Run("jpeg", func(t *testing.T) {
+		params := url.Values{"SERVICE": {"WMS"}, "REQUEST": {"GetMap"}, "VERSION": {"1.3.0"}, "LAYERS": {"RPF-JG"},
+			"CRS": {"CRS:84"}, "BBOX": {lonLat}, "WIDTH": {"512"}, "HEIGHT": {"512"}, "FORMAT": {"image/jpeg"}, "TRANSPARENT": {"TRUE"}}
+		resp, body := httpGet(t, server.URL+"/wms?"+params.Encode())
+		if ct := resp.Header.Get("Content-type"); ct != "image/jpeg" {
+			t.Fatalf("GetMap answered %s: %s", ct, body)
+		}
+		img, err := jpeg.Decode(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// jpeg has no alpha, transparency is ignored
+		if c := pixelAt(img, 128, 256); c.R < 240 || c.G < 240 || c.B < 240 {
+			t.Fatalf("background is %v, want white", c)
+		}
+	})
+}
+
+func TestGetMapExceptions(t *testing.T) {
+	_, server := serveFrames(t, "RPF/JG/000A0010.JG1")
+	tests := []struct {
+		name     string
+		params   url.Values
+		wantType string
+		wantCode string
+	}{
+		{"unknown CRS", url.Values{"VERSION": {"1.3.0"}, "CRS": {"EPSG:32631"}}, "text/xml", "InvalidCRS"},
+		{"unknown SRS", url.Values{"VERSION": {"1.1.1"}, "SRS": {"EPSG:32631"}}, "application/vnd.ogc.se_xml", "InvalidSRS"},
+		{"BBOX of three values", url.Values{"BBOX": {"0,0,1"}}, "text/xml", "MissingParameterValue"},
+		{"no BBOX", url.Values{"BBOX": nil}, "text/xml", "MissingParameterValue"},
+		{"BBOX not a number", url.Values{"BBOX": {"0,0,1,north"}}, "text/xml", "InvalidParameterValue"},
+		{"empty BBOX", url.Values{"BBOX": {"0,1,1,1"}}, "text/xml", "InvalidParameterValue"},
+		{"inverted BBOX", url.Values{"BBOX": {"1,0,0,1"}}, "text/xml", "InvalidParameterValue"},
+		{"1.1.1 BBOX error", url.Values{"VERSION": {"1.1.1"}, "SRS": {"EPSG:4326"}, "BBOX": {"0,0"}}, "application/vnd.ogc.se_xml", "MissingParameterValue"},
+		{"no WIDTH", url.Values{"WIDTH": nil}, "text/xml", "InvalidParameterValue"},
+		{"zero HEIGHT", url.Values{"HEIGHT": {"0"}}, "text/xml", "InvalidParameterValue"},
+		{"WIDTH too large", url.Values{"WIDTH": {"4097"}}, "text/xml", "InvalidParameterValue"},
+		{"unknown FORMAT", url.Values{"FORMAT": {"image/gif"}}, "text/xml", "InvalidFormat"},
+		{"bad BGCOLOR", url.Values{"BGCOLOR": {"0xGREEN"}}, "text/xml", "InvalidParameterValue"},
+		{"unknown layer", url.Values{"LAYERS": {"roads"}}, "text/xml", "LayerNotDefined"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := url.Values{"SERVICE": {"WMS"}, "REQUEST": {"GetMap"}, "VERSION": {"1.3.0"}, "LAYERS": {"RPF-JG"},
+				"CRS": {"CRS:84"}, "BBOX": {"10,0,11,1"}, "WIDTH": {"256"}, "HEIGHT": {"256"}, "FORMAT": {"image/png"}}
+			for key, values := range tt.params {
+				if values == nil {
+					params.Del(key)
+				} else {
+					params[key] = values
+				}
+			}
+			if _, ok := tt.params["SRS"]; ok {
+				params.Del("CRS")
+			}
+			resp, body := httpGet(t, server.URL+"/wms?"+params.Encode())
+			if ct := resp.Header.Get("Content-type"); ct != tt.wantType {
+				t.Fatalf("GetMap answered %s, want %s: %s", ct, tt.wantType, body)
+			}
+			var report serviceExceptionReport
+			if err := xml.Unmarshal(body, &report); err != nil {
+				t.Fatalf("%v in %s", err, body)
+			}
+			if len(report.Exceptions) != 1 || report.Exceptions[0].Code != tt.wantCode {
+				t.Fatalf("GetMap reported %+v, want %s", report.Exceptions, tt.wantCode)
+			}
+		})
+	}
+}
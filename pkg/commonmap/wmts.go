@@ -0,0 +1,347 @@
+package commonmap
+
+import (
+	"encoding/xml"
+	"fmt"
+	"image/color"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// This file serves the RPF layers as WMTS tiles, through KVP and RESTful requests.
+// Tiles are rendered like any GetMap, so the series switch at the same zooms as in WMS.
+
+const (
+	tileSize       = 256
+	mercatorExtent = 20037508.3427892 // half the width of the web mercator world
+	wmtsRestPath   = "/wmts/1.0.0/"
+)
+
+// tileMatrixSet is a pyramid of tile grids, each level doubling the previous
+type tileMatrixSet struct {
+	identifier, crs, wellKnownScaleSet string
+	mercator                           bool
+	topLeft                            [2]float64 // x then y
+	span                               [2]float64 // width and height of the pyramid
+	scale                              float64    // scale denominator of level 0
+	columns, rows                      int        // matrix size at level 0
+	levels                             int
+}
+
+var tileMatrixSets = []*tileMatrixSet{
+	{
+		identifier:        "GoogleMapsCompatible",
+		crs:               "urn:ogc:def:crs:EPSG::3857",
+		wellKnownScaleSet: "urn:ogc:def:wkss:OGC:1.0:GoogleMapsCompatible",
+		mercator:          true,
+		topLeft:           [2]float64{-mercatorExtent, mercatorExtent},
+		span:              [2]float64{2 * mercatorExtent, 2 * mercatorExtent},
+		scale:             559082264.0287178,
+		columns:           1,
+		rows:              1,
+		levels:            21,
+	},
+	{
+		identifier: "WorldCRS84Quad",
+		crs:        "urn:ogc:def:crs:OGC:1.3:CRS84",
+		topLeft:    [2]float64{-180, 90},
+		span:       [2]float64{360, 180},
+		scale:      279541132.0143589,
+		columns:    2,
+		rows:       1,
+		levels:     20,
+	},
+}
+
+func findTileMatrixSet(identifier string) *tileMatrixSet {
+	for _, set := range tileMatrixSets {
+		if strings.EqualFold(set.identifier, identifier) {
+			return set
+		}
+	}
+	return nil
+}
+
+// tileView returns the view of one tile, false when it lies outside the pyramid
+func (s *tileMatrixSet) tileView(level, row, column int) (*mapView, bool) {
+	if level < 0 || level >= s.levels {
+		return nil, false
+	}
+	columns, rows := s.columns<<level, s.rows<<level
+	if row < 0 || column < 0 || row >= rows || column >= columns {
+		return nil, false
+	}
+	width, height := s.span[0]/float64(columns), s.span[1]/float64(rows)
+	x, y := s.topLeft[0]+float64(column)*width, s.topLeft[1]-float64(row)*height
+	return newMapView(s.mercator, Box{x, y - height, x + width, y}, tileSize, tileSize), true
+}
+
+// owsError is reported to WMTS clients as an OWS exception report
+type owsError struct {
+	status                 int
+	code, locator, message string
+}
+
+type owsExceptionReport struct {
+	XMLName   xml.Name `xml:"ows:ExceptionReport"`
+	Xmlns     string   `xml:"xmlns:ows,attr"`
+	Version   string   `xml:"version,attr"`
+	Exception struct {
+		Code    string `xml:"exceptionCode,attr"`
+		Locator string `xml:"locator,attr,omitempty"`
+		Text    string `xml:"ows:ExceptionText"`
+	} `xml:"ows:Exception"`
+}
+
+func owsException(w http.ResponseWriter, e *owsError) {
+	report := owsExceptionReport{Xmlns: "http://www.opengis.net/ows/1.1", Version: "1.1.0"}
+	report.Exception.Code, report.Exception.Locator, report.Exception.Text = e.code, e.locator, e.message
+	body, err := xml.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	w.Header().Set("Content-type", "application/xml")
+	w.WriteHeader(e.status)
+	if _, err := w.Write(append([]byte(xml.Header), body...)); err != nil {
+		log.Print(err)
+	}
+}
+
+// wmts answers KVP requests on /wmts
+func (ix *Indexer) wmts(w http.ResponseWriter, r *http.Request) {
+	params := parseWmsParams(r.URL.Query())
+	switch strings.ToLower(params.get("REQUEST")) {
+	case "getcapabilities":
+		ix.wmtsCapabilities(w, r)
+	case "gettile":
+		format := params.get("FORMAT")
+		if format == "" {
+			format = "image/png"
+		}
+		ix.getTile(w, r, params.get("LAYER"), params.get("STYLE"), params.get("TILEMATRIXSET"),
+			params.get("TILEMATRIX"), params.get("TILEROW"), params.get("TILECOL"), format)
+	case "":
+		owsException(w, &owsError{http.StatusBadRequest, "MissingParameterValue", "request", "missing REQUEST"})
+	default:
+		owsException(w, &owsError{http.StatusBadRequest, "OperationNotSupported", "request", "unsupported request " + params.get("REQUEST")})
+	}
+}
+
+// wmtsTile answers RESTful tile requests
+func (ix *Indexer) wmtsTile(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	format := "image/png"
+	if ext := strings.ToLower(vars["ext"]); ext == "jpg" || ext == "jpeg" {
+		format = "image/jpeg"
+	}
+	ix.getTile(w, r, vars["layer"], vars["style"], vars["set"], vars["matrix"], vars["row"], vars["col"], format)
+}
+
+func (ix *Indexer) getTile(w http.ResponseWriter, r *http.Request, layer, style, setName, matrix, row, column, format string) {
+	if _, native := ix.rasterSeries(layer, 0); !native {
+		owsException(w, &owsError{http.StatusBadRequest, "InvalidParameterValue", "layer", "unknown layer " + layer})
+		return
+	}
+	if style != "" && !strings.EqualFold(style, "default") {
+		owsException(w, &owsError{http.StatusBadRequest, "InvalidParameterValue", "style", "unknown style " + style})
+		return
+	}
+	switch strings.ToLower(format) {
+	case "image/png":
+		format = "image/png"
+	case "image/jpeg", "image/jpg":
+		format = "image/jpeg"
+	default:
+		owsException(w, &owsError{http.StatusBadRequest, "InvalidParameterValue", "format", "unsupported format " + format})
+		return
+	}
+	set := findTileMatrixSet(setName)
+	if set == nil {
+		owsException(w, &owsError{http.StatusBadRequest, "InvalidParameterValue", "tilematrixset", "unknown tile matrix set " + setName})
+		return
+	}
+	level, err1 := strconv.Atoi(matrix)
+	y, err2 := strconv.Atoi(row)
+	x, err3 := strconv.Atoi(column)
+	if err1 != nil || err2 != nil || err3 != nil {
+		owsException(w, &owsError{http.StatusBadRequest, "InvalidParameterValue", "tilematrix", "tile matrix, row and column must be integers"})
+		return
+	}
+	view, ok := set.tileView(level, y, x)
+	if !ok {
+		owsException(w, &owsError{http.StatusBadRequest, "TileOutOfRange", "tilerow", fmt.Sprintf("no tile %d/%d/%d in %s", level, y, x, set.identifier)})
+		return
+	}
+	ix.serveTile(w, r, view, layer, format)
+}
+
+// serveTile renders a tile of a native layer, transparent outside the data
+func (ix *Indexer) serveTile(w http.ResponseWriter, r *http.Request, view *mapView, layer, format string) {
+	layers := []string{layer}
+	data, err := ix.cachedImage(layers, view.cacheKey()+" "+format, format, func() ([]byte, error) {
+		canvas, err := ix.renderMap(r, view, layers)
+		if err != nil {
+			return nil, err
+		}
+		return encodeImage(canvas, format, format == "image/png", color.RGBA{255, 255, 255, 255})
+	})
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	writeImage(w, format, data)
+}
+
+type wmtsCapabilitiesDoc struct {
+	XMLName    xml.Name            `xml:"Capabilities"`
+	Xmlns      string              `xml:"xmlns,attr"`
+	XmlnsOws   string              `xml:"xmlns:ows,attr"`
+	XmlnsXlink string              `xml:"xmlns:xlink,attr"`
+	Version    string              `xml:"version,attr"`
+	Title      string              `xml:"ows:ServiceIdentification>ows:Title"`
+	Type       string              `xml:"ows:ServiceIdentification>ows:ServiceType"`
+	TypeVer    string              `xml:"ows:ServiceIdentification>ows:ServiceTypeVersion"`
+	Operations []wmtsOperation     `xml:"ows:OperationsMetadata>ows:Operation"`
+	Layers     []wmtsLayer         `xml:"Contents>Layer"`
+	Sets       []wmtsTileMatrixSet `xml:"Contents>TileMatrixSet"`
+	ServiceMD  *capsOnlineResource `xml:"ServiceMetadataURL"`
+}
+
+type wmtsOperation struct {
+	Name string         `xml:"name,attr"`
+	Get  []wmtsEncoding `xml:"ows:DCP>ows:HTTP>ows:Get"`
+}
+
+type wmtsEncoding struct {
+	Href       string `xml:"xlink:href,attr"`
+	Constraint struct {
+		Name     string `xml:"name,attr"`
+		Encoding string `xml:"ows:AllowedValues>ows:Value"`
+	} `xml:"ows:Constraint"`
+}
+
+func newWmtsEncoding(href, encoding string) wmtsEncoding {
+	e := wmtsEncoding{Href: href}
+	e.Constraint.Name, e.Constraint.Encoding = "GetEncoding", encoding
+	return e
+}
+
+type wmtsLayer struct {
+	Title       string            `xml:"ows:Title"`
+	Abstract    string            `xml:"ows:Abstract"`
+	LowerCorner string            `xml:"ows:WGS84BoundingBox>ows:LowerCorner"`
+	UpperCorner string            `xml:"ows:WGS84BoundingBox>ows:UpperCorner"`
+	Identifier  string            `xml:"ows:Identifier"`
+	Style       wmtsStyle         `xml:"Style"`
+	Formats     []string          `xml:"Format"`
+	Links       []string          `xml:"TileMatrixSetLink>TileMatrixSet"`
+	Resources   []wmtsResourceURL `xml:"ResourceURL"`
+}
+
+type wmtsStyle struct {
+	IsDefault  bool   `xml:"isDefault,attr"`
+	Identifier string `xml:"ows:Identifier"`
+}
+
+type wmtsResourceURL struct {
+	Format       string `xml:"format,attr"`
+	ResourceType string `xml:"resourceType,attr"`
+	Template     string `xml:"template,attr"`
+}
+
+type wmtsTileMatrixSet struct {
+	Identifier        string           `xml:"ows:Identifier"`
+	SupportedCRS      string           `xml:"ows:SupportedCRS"`
+	WellKnownScaleSet string           `xml:"WellKnownScaleSet,omitempty"`
+	Matrices          []wmtsTileMatrix `xml:"TileMatrix"`
+}
+
+type wmtsTileMatrix struct {
+	Identifier       string `xml:"ows:Identifier"`
+	ScaleDenominator string `xml:"ScaleDenominator"`
+	TopLeftCorner    string `xml:"TopLeftCorner"`
+	TileWidth        int    `xml:"TileWidth"`
+	TileHeight       int    `xml:"TileHeight"`
+	MatrixWidth      int    `xml:"MatrixWidth"`
+	MatrixHeight     int    `xml:"MatrixHeight"`
+}
+
+// wmtsCapabilities answers GetCapabilities, for KVP and RESTful clients alike
+func (ix *Indexer) wmtsCapabilities(w http.ResponseWriter, r *http.Request) {
+	base := strings.TrimSuffix(serviceURL(r), "?")
+	if i := strings.Index(base, wmtsRestPath); i != -1 {
+		base = base[:i] + "/wmts"
+	}
+	kvp := newWmtsEncoding(base+"?", "KVP")
+	rest := newWmtsEncoding(base+"/1.0.0/", "RESTful")
+	doc := wmtsCapabilitiesDoc{
+		Xmlns:      "http://www.opengis.net/wmts/1.0",
+		XmlnsOws:   "http://www.opengis.net/ows/1.1",
+		XmlnsXlink: "http://www.w3.org/1999/xlink",
+		Version:    "1.0.0",
+		Title:      "CommonMap",
+		Type:       "OGC WMTS",
+		TypeVer:    "1.0.0",
+		Operations: []wmtsOperation{
+			{"GetCapabilities", []wmtsEncoding{kvp, rest}},
+			{"GetTile", []wmtsEncoding{kvp, rest}},
+		},
+		ServiceMD: &capsOnlineResource{"simple", base + "/1.0.0/WMTSCapabilities.xml"},
+	}
+
+	var setNames []string
+	for _, set := range tileMatrixSets {
+		setNames = append(setNames, set.identifier)
+		desc := wmtsTileMatrixSet{Identifier: set.identifier, SupportedCRS: set.crs, WellKnownScaleSet: set.wellKnownScaleSet}
+		topLeft := formatNumber(set.topLeft[0]) + " " + formatNumber(set.topLeft[1])
+		for level := 0; level < set.levels; level++ {
+			desc.Matrices = append(desc.Matrices, wmtsTileMatrix{
+				Identifier:       strconv.Itoa(level),
+				ScaleDenominator: formatNumber(set.scale / math.Exp2(float64(level))),
+				TopLeftCorner:    topLeft,
+				TileWidth:        tileSize,
+				TileHeight:       tileSize,
+				MatrixWidth:      set.columns << level,
+				MatrixHeight:     set.rows << level,
+			})
+		}
+		doc.Sets = append(doc.Sets, desc)
+	}
+
+	for _, layer := range ix.rasterLayers() {
+		desc := wmtsLayer{
+			Title:       layer.title,
+			Abstract:    layer.abstract,
+			LowerCorner: formatNumber(layer.extent[MinX]) + " " + formatNumber(layer.extent[MinY]),
+			UpperCorner: formatNumber(layer.extent[MaxX]) + " " + formatNumber(layer.extent[MaxY]),
+			Identifier:  layer.name,
+			Style:       wmtsStyle{true, "default"},
+			Formats:     []string{"image/png", "image/jpeg"},
+			Links:       setNames,
+		}
+		for _, ext := range []string{"png", "jpeg"} {
+			desc.Resources = append(desc.Resources, wmtsResourceURL{
+				Format:       "image/" + ext,
+				ResourceType: "tile",
+				Template:     base + "/1.0.0/" + layer.name + "/{Style}/{TileMatrixSet}/{TileMatrix}/{TileRow}/{TileCol}." + ext,
+			})
+		}
+		doc.Layers = append(doc.Layers, desc)
+	}
+
+	body, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-type", "application/xml")
+	if _, err := w.Write(append([]byte(xml.Header), body...)); err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,153 @@
+package commonmap
+
+import (
+	"bytes"
+	"encoding/xml"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"net/http"
+	"testing"
+)
+
+func TestTileView(t *testing.T) {
+	const e = mercatorExtent
+	tests := []struct {
+		set                string
+		level, row, column int
+		want               Box
+	}{
+		{"GoogleMapsCompatible", 0, 0, 0, Box{-e, -e, e, e}},
+		{"GoogleMapsCompatible", 1, 0, 0, Box{-e, 0, 0, e}},
+		{"GoogleMapsCompatible", 1, 0, 1, Box{0, 0, e, e}},
+		{"GoogleMapsCompatible", 1, 1, 0, Box{-e, -e, 0, 0}},
+		{"GoogleMapsCompatible", 2, 3, 3, Box{e / 2, -e, e, -e / 2}},
+		{"WorldCRS84Quad", 0, 0, 0, Box{-180, -90, 0, 90}},
+		{"WorldCRS84Quad", 0, 0, 1, Box{0, -90, 180, 90}},
+		{"WorldCRS84Quad", 1, 0, 0, Box{-180, 0, -90, 90}},
+		{"WorldCRS84Quad", 1, 1, 3, Box{90, -90, 180, 0}},
+		{"WorldCRS84Quad", 2, 1, 4, Box{0, 0, 45, 45}},
+	}
+	for _, tt := range tests {
+		set := findTileMatrixSet(tt.set)
+		view, ok := set.tileView(tt.level, tt.row, tt.column)
+		if !ok {
+			t.Fatalf("%s has no tile %d/%d/%d", tt.set, tt.level, tt.row, tt.column)
+		}
+		for i := range view.bbox {
+			if math.Abs(view.bbox[i]-tt.want[i]) > 1e-6 {
+				t.Fatalf("%s tile %d/%d/%d covers %v, want %v", tt.set, tt.level, tt.row, tt.column, view.bbox, tt.want)
+			}
+		}
+		if view.mercator != (tt.set == "GoogleMapsCompatible") || view.width != tileSize || view.height != tileSize {
+			t.Fatalf("%s tile %d/%d/%d is a %dx%d view, mercator %t", tt.set, tt.level, tt.row, tt.column, view.width, view.height, view.mercator)
+		}
+	}
+
+	outside := []struct {
+		set                string
+		level, row, column int
+	}{
+		{"GoogleMapsCompatible", 0, 1, 0},
+		{"GoogleMapsCompatible", 0, 0, 1},
+		{"GoogleMapsCompatible", 3, 8, 0},
+		{"GoogleMapsCompatible", 21, 0, 0},
+		{"GoogleMapsCompatible", -1, 0, 0},
+		{"WorldCRS84Quad", 0, 1, 0},
+		{"WorldCRS84Quad", 0, 0, 2},
+		{"WorldCRS84Quad", 2, 0, 8},
+		{"WorldCRS84Quad", 20, 0, 0},
+		{"WorldCRS84Quad", 1, -1, 0},
+		{"WorldCRS84Quad", 1, 0, -1},
+	}
+	for _, tt := range outside {
+		if _, ok := findTileMatrixSet(tt.set).tileView(tt.level, tt.row, tt.column); ok {
+			t.Fatalf("%s has a tile %d/%d/%d", tt.set, tt.level, tt.row, tt.column)
+		}
+	}
+}
+
+func TestGetTile(t *testing.T) {
+	_, server := serveFrames(t, "RPF/JG/000A0010.JG1")
+	// both tiles lie within the frame, across the middle of its image where red meets blue
+	tests := []struct {
+		name, path, contentType string
+	}{
+		{"KVP GoogleMapsCompatible",
+			"/wmts?SERVICE=WMTS&REQUEST=GetTile&VERSION=1.0.0&LAYER=RPF-JG&STYLE=default&FORMAT=image/png&TILEMATRIXSET=GoogleMapsCompatible&TILEMATRIX=11&TILEROW=1022&TILECOL=1086",
+			"image/png"},
+		{"KVP WorldCRS84Quad",
+			"/wmts?service=WMTS&request=GetTile&layer=RPF-JG&tileMatrixSet=WorldCRS84Quad&tileMatrix=10&tileRow=510&tileCol=1086",
+			"image/png"},
+		{"REST GoogleMapsCompatible", wmtsRestPath + "RPF-JG/default/GoogleMapsCompatible/11/1022/1086.png", "image/png"},
+		{"REST WorldCRS84Quad", wmtsRestPath + "RPF-JG/default/WorldCRS84Quad/10/510/1086.png", "image/png"},
+		{"REST jpeg", wmtsRestPath + "RPF-JG/default/WorldCRS84Quad/10/510/1086.jpg", "image/jpeg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := httpGet(t, server.URL+tt.path)
+			if ct := resp.Header.Get("Content-type"); resp.StatusCode != http.StatusOK || ct != tt.contentType {
+				t.Fatalf("GetTile answered %d %s: %s", resp.StatusCode, ct, body)
+			}
+			var img image.Image
+			var err error
+			if tt.contentType == "image/png" {
+				img, err = png.Decode(bytes.NewReader(body))
+			} else {
+				img, err = jpeg.Decode(bytes.NewReader(body))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size := img.Bounds().Size(); size.X != tileSize || size.Y != tileSize {
+				t.Fatalf("tile of %v", size)
+			}
+			if tt.contentType == "image/png" {
+				checkPixels(t, img, [4]color.NRGBA{red, red, blue, blue})
+			}
+		})
+	}
+}
+
+func TestGetTileExceptions(t *testing.T) {
+	_, server := serveFrames(t, "RPF/JG/000A0010.JG1")
+	const kvp = "/wmts?SERVICE=WMTS&REQUEST=GetTile&VERSION=1.0.0&"
+	tests := []struct {
+		name, path, code string
+	}{
+		{"TileRow out of range", kvp + "LAYER=RPF-JG&TILEMATRIXSET=GoogleMapsCompatible&TILEMATRIX=2&TILEROW=4&TILECOL=0", "TileOutOfRange"},
+		{"TileCol out of range", kvp + "LAYER=RPF-JG&TILEMATRIXSET=WorldCRS84Quad&TILEMATRIX=0&TILEROW=0&TILECOL=2", "TileOutOfRange"},
+		{"negative TileRow", kvp + "LAYER=RPF-JG&TILEMATRIXSET=WorldCRS84Quad&TILEMATRIX=1&TILEROW=-1&TILECOL=0", "TileOutOfRange"},
+		{"TileMatrix out of range", kvp + "LAYER=RPF-JG&TILEMATRIXSET=GoogleMapsCompatible&TILEMATRIX=21&TILEROW=0&TILECOL=0", "TileOutOfRange"},
+		{"REST TileRow out of range", wmtsRestPath + "RPF-JG/default/GoogleMapsCompatible/1/2/0.png", "TileOutOfRange"},
+		{"REST TileCol out of range", wmtsRestPath + "RPF-JG/default/WorldCRS84Quad/1/0/4.png", "TileOutOfRange"},
+		{"TileRow not a number", kvp + "LAYER=RPF-JG&TILEMATRIXSET=WorldCRS84Quad&TILEMATRIX=1&TILEROW=top&TILECOL=0", "InvalidParameterValue"},
+		{"unknown layer", kvp + "LAYER=roads&TILEMATRIXSET=WorldCRS84Quad&TILEMATRIX=0&TILEROW=0&TILECOL=0", "InvalidParameterValue"},
+		{"unknown style", kvp + "LAYER=RPF-JG&STYLE=dark&TILEMATRIXSET=WorldCRS84Quad&TILEMATRIX=0&TILEROW=0&TILECOL=0", "InvalidParameterValue"},
+		{"unknown tile matrix set", kvp + "LAYER=RPF-JG&TILEMATRIXSET=UTM31&TILEMATRIX=0&TILEROW=0&TILECOL=0", "InvalidParameterValue"},
+		{"unknown format", kvp + "LAYER=RPF-JG&FORMAT=image/gif&TILEMATRIXSET=WorldCRS84Quad&TILEMATRIX=0&TILEROW=0&TILECOL=0", "InvalidParameterValue"},
+		{"no request", "/wmts?SERVICE=WMTS", "MissingParameterValue"},
+		{"unknown request", "/wmts?SERVICE=WMTS&REQUEST=GetFeatureInfo", "OperationNotSupported"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := httpGet(t, server.URL+tt.path)
+			if resp.StatusCode != http.StatusBadRequest || resp.Header.Get("Content-type") != "application/xml" {
+				t.Fatalf("GetTile answered %d %s: %s", resp.StatusCode, resp.Header.Get("Content-type"), body)
+			}
+			var report struct {
+				Exception struct {
+					Code string `xml:"exceptionCode,attr"`
+				} `xml:"Exception"`
+			}
+			if err := xml.Unmarshal(body, &report); err != nil {
+				t.Fatalf("%v in %s", err, body)
+			}
+			if report.Exception.Code != tt.code {
+				t.Fatalf("GetTile reported %s, want %s", report.Exception.Code, tt.code)
+			}
+		})
+	}
+}
@@ -38,6 +38,9 @@ var ArcZones = map[byte]ArcZone{
 const pixelsPerFrame = 1536 // 256x256 pixel subframes, stacked 6x6
 
 func GetBounds(frame *FrameInfo) (x1, y1, x2, y2 float64) {
+	if grid := GetPolarGrid(frame); grid != nil {
+		return grid.FrameBounds(frame.FrameNumber)
+	}
 	zone := ArcZones[frame.ArcZone]
 	series := DataSeries[frame.SeriesCode]
 	isCADRG := series.Type == CADRG
@@ -78,7 +81,7 @@ func CalculateGeoFrameWidthHeight(zone byte, scale float64, isCADRG bool) (geoFr
 // Computes the number of degrees per pixel - only called by CalculateGeoFrameWidthHeight
 func CalculateDegreesPerPixel(zone byte, scale float64, isCADRG bool) (float64, float64) {
 	if ArcZones[zone].IsPolar {
-		dppLatLon := 360.0 / calcPolarPixConst(scale)
+		dppLatLon := 360.0 / calcPolarPixConst(scale, isCADRG)
 		return dppLatLon, dppLatLon
 	} // else...
 	dppLat := 90.0 / CalcNsPixConst(scale, isCADRG)
@@ -89,7 +92,7 @@ func CalculateDegreesPerPixel(zone byte, scale float64, isCADRG bool) (float64,
 // Computes the number of rows and columns of frames in the given zone for the given map scale
 func CalculateNumRowsCols(zone byte, scale float64, isCADRG bool) (int, int) {
 	if ArcZones[zone].IsPolar {
-		numFrames := int(math.Ceil(calcPolarPixConst(scale) / 18.0 / pixelsPerFrame))
+		numFrames := int(math.Ceil(calcPolarPixConst(scale, isCADRG) / 18.0 / pixelsPerFrame))
 		if numFrames%2 == 0 { // round up to the next odd number of frames
 			numFrames++
 		}
@@ -100,10 +103,16 @@ func CalculateNumRowsCols(zone byte, scale float64, isCADRG bool) (int, int) {
 	return rows, cols
 }
 
-func calcPolarPixConst(scale float64) float64 {
+// the polar pixel constant is the number of pixels along 360 degrees of arc from the pole
+func calcPolarPixConst(scale float64, isCADRG bool) float64 {
 	const BParam = 400384.0
-	AdrgPixConst := roundUp(BParam*1000000.0/scale, 512)
-	return roundUp(AdrgPixConst/27.0, 512) * 18.0
+	if isCADRG { // 1:N scale
+		AdrgPixConst := roundUp(BParam*1000000.0/scale, 512)
+		return roundUp(AdrgPixConst/27.0, 512) * 18.0
+	}
+	// is CIB meters scale
+	AdrgPixConst := roundUp(BParam*100.0/scale, 512)
+	return roundUp(AdrgPixConst/18.0, 512) * 18.0
 }
 
 func CalcNsPixConst(scale float64, isCADRG bool) float64 {
@@ -0,0 +1,117 @@
+package rpf
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// This file reads CDTED (compressed DTED) elevation frames. Their posts live in the
+// same RPF sections as imagery, either uncompressed or as VQ codebooks of 16 bit values.
+
+// VoidElevation marks posts with no elevation, as in DTED
+const VoidElevation = -32767
+
+// Elevation is the grid of signed 16 bit posts (meters) held by a CDTED frame
+type Elevation struct {
+	Header        *FrameHeader
+	Width, Height int
+	Posts         []int16 // row major, northernmost row first
+}
+
+// ReadElevation opens and decodes a CDTED frame file
+func ReadElevation(framePath string) (*Elevation, error) {
+	file, err := os.Open(framePath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+	return DecodeElevation(file)
+}
+
+// DecodeElevation reads the headers and elevation posts of a CDTED frame
+func DecodeElevation(r io.ReaderAt) (*Elevation, error) {
+	h, err := ParseFrameHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if h.Frame != nil && h.Series.Type != CDTED {
+		return nil, fmt.Errorf("%w: %s is not CDTED", ErrUnexpectedFrameType, h.Rpf.FileName)
+	}
+	d := &frameDecoder{r: r, h: h, order: h.Rpf.order(), valueBytes: 2}
+	if err := d.readLookupTables(); err != nil {
+		return nil, err
+	}
+	if err := d.readLayout(); err != nil {
+		return nil, err
+	}
+
+	width, height := d.columns*d.subframeSize, d.rows*d.subframeSize
+	raw := make([]byte, width*height*2)
+	frame := d.newFrame(nil)
+	if err := d.decodeSubframes(frame, raw, width*2, 0); err != nil {
+		return nil, err
+	}
+	e := &Elevation{Header: h, Width: width, Height: height, Posts: make([]int16, width*height)}
+	for i := range e.Posts {
+		e.Posts[i] = int16(d.order.Uint16(raw[i*2:]))
+	}
+	for i, present := range frame.Present {
+		if present {
+			continue
+		}
+		sx, sy := (i%d.columns)*d.subframeSize, (i/d.columns)*d.subframeSize
+		for y := sy; y < sy+d.subframeSize; y++ {
+			for x := sx; x < sx+d.subframeSize; x++ {
+				e.Posts[y*width+x] = VoidElevation
+			}
+		}
+	}
+	return e, nil
+}
+
+// At returns the post at column x and row y, false if it is void or outside the grid
+func (e *Elevation) At(x, y int) (int16, bool) {
+	if x < 0 || y < 0 || x >= e.Width || y >= e.Height {
+		return VoidElevation, false
+	}
+	v := e.Posts[y*e.Width+x]
+	return v, v != VoidElevation
+}
+
+// Interpolate returns the bilinear height at fractional post coordinates, where
+// post centers sit at half-integer positions as pixels do in RPF imagery
+func (e *Elevation) Interpolate(px, py float64) (float64, bool) {
+	px, py = px-0.5, py-0.5
+	x0, y0 := int(math.Floor(px)), int(math.Floor(py))
+	fx, fy := px-float64(x0), py-float64(y0)
+	// clamp at the edges of the frame rather than reading into a neighbor
+	x0, x1 := clampPost(x0, e.Width), clampPost(x0+1, e.Width)
+	y0, y1 := clampPost(y0, e.Height), clampPost(y0+1, e.Height)
+
+	var sum, weight float64
+	for _, p := range [4]struct {
+		x, y int
+		w    float64
+	}{
+		{x0, y0, (1 - fx) * (1 - fy)},
+		{x1, y0, fx * (1 - fy)},
+		{x0, y1, (1 - fx) * fy},
+		{x1, y1, fx * fy},
+	} {
+		if v, ok := e.At(p.x, p.y); ok && p.w > 0 {
+			sum += float64(v) * p.w
+			weight += p.w
+		}
+	}
+	if weight == 0 {
+		return 0, false
+	}
+	// renormalize around void posts
+	return sum / weight, true
+}
+
+func clampPost(v, size int) int {
+	return min(max(v, 0), size-1)
+}
@@ -0,0 +1,79 @@
+package rpf
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// buildTestCDTED writes an uncompressed CDTED frame of 2x2 subframes, 8 posts square,
+// where the post at column x and row y is 100*y + x
+func buildTestCDTED(fileName string, masked map[int]bool) []byte {
+	file := &testRpfFile{version: "02.10", fileName: fileName}
+	file.add(CoverageSectionID, coverageSection(0, 0, 1, 1, 1.0/16, 1.0/16))
+
+	desc := new(bytes.Buffer)
+	mustWriteBE(desc, []uint16{1, 1, 1, 1, 2, 2})
+	mustWriteBE(desc, []uint32{8, 8, 0, noSubframe})
+	file.add(ImageDescriptionSubheaderID, desc.Bytes())
+
+	mask := new(bytes.Buffer)
+	mustWriteBE(mask, []uint32{14, noSubframe})
+	mustWriteBE(mask, []uint16{4, 0, 0})
+	spatial := new(bytes.Buffer)
+	for i := 0; i < 4; i++ {
+		if masked[i] {
+			mustWriteBE(mask, uint32(noSubframe))
+			continue
+		}
+		mustWriteBE(mask, uint32(spatial.Len()))
+		for y := 0; y < 8; y++ {
+			for x := 0; x < 8; x++ {
+				mustWriteBE(spatial, int16(100*((i/2)*8+y)+(i%2)*8+x))
+			}
+		}
+	}
+	file.add(MaskSubsectionID, mask.Bytes())
+	file.add(SpatialDataSubsectionID, spatial.Bytes())
+	return file.bytes()
+}
+
+func TestDecodeElevation(t *testing.T) {
+	e, err := DecodeElevation(bytes.NewReader(buildTestCDTED("00001011.D11", map[int]bool{1: true})))
+	if err != nil {
+		t.Fatalf("DecodeElevation: %v", err)
+	}
+	if e.Width != 16 || e.Height != 16 {
+		t.Fatalf("grid is %dx%d, want 16x16", e.Width, e.Height)
+	}
+	if v, ok := e.At(3, 12); !ok || v != 1203 {
+		t.Fatalf("At(3, 12) = %d, %v, want 1203", v, ok)
+	}
+	if _, ok := e.At(12, 3); ok {
+		t.Fatal("At(12, 3) in a masked subframe should be void")
+	}
+
+	// halfway between posts (3,12), (4,12), (3,13) and (4,13)
+	if v, ok := e.Interpolate(4, 13); !ok || !almostEqual(v, 1253.5) {
+		t.Fatalf("Interpolate(4, 13) = %v, %v, want 1253.5", v, ok)
+	}
+	// beside the masked subframe only the valid posts count
+	if v, ok := e.Interpolate(8, 4.5); !ok || !almostEqual(v, 407) {
+		t.Fatalf("Interpolate(8, 4.5) = %v, %v, want 407", v, ok)
+	}
+}
+
+func TestDecodeElevationRejectsImagery(t *testing.T) {
+	data := buildTestFrame("00001011.JG1", nil, false)
+	if _, err := DecodeElevation(bytes.NewReader(data)); !errors.Is(err, ErrUnexpectedFrameType) {
+		t.Fatalf("DecodeElevation error = %v, want ErrUnexpectedFrameType", err)
+	}
+}
+
+func TestCDTEDExtensions(t *testing.T) {
+	for ext, want := range map[string]bool{".D11": true, ".D2A": true, ".D1B": false, ".D2J": false} {
+		if got := isRpfExtension(ext); got != want {
+			t.Errorf("isRpfExtension(%q) = %v, want %v", ext, got, want)
+		}
+	}
+}
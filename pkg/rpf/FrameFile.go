@@ -36,11 +36,11 @@ func NewFrameInfo(filePath string) *FrameInfo {
 	if dataSeries.Type == CIB { //  MIL-PRF-89041 - ffffffvp.ccz
 		frameNumber = DecodeBase34(fileName[0:6])
 		edition = DecodeBase34(fileName[6:7])
-		producer = DecodeBase34(fileName[8:8])
+		producer = DecodeBase34(fileName[7:8])
 	} else { //  MIL-PRF 89038 - fffffvvp.ccz format
 		frameNumber = DecodeBase34(fileName[0:5])
 		edition = DecodeBase34(fileName[5:7])
-		producer = DecodeBase34(fileName[8:8])
+		producer = DecodeBase34(fileName[7:8])
 	}
 	if frameNumber == -1 || edition == -1 || producer == -1 {
 		return nil
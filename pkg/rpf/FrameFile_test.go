@@ -0,0 +1,63 @@
+package rpf
+
+import "testing"
+
+func TestNewFrameInfoDecodesNameFields(t *testing.T) {
+	tests := []struct {
+		name     string
+		fileName string
+		frame    int
+		edition  int
+		producer int
+	}{
+		// fffffvvp.ccz, producer 3 in base 34
+		{name: "cadrg", fileName: "000A0013.JG1", frame: 10 * 34, edition: 1, producer: 3},
+		// ffffffvp.ccz
+		{name: "cib", fileName: "00000Z4B.I41", frame: 33, edition: 4, producer: 11},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame := NewFrameInfo(tt.fileName)
+			if frame == nil {
+				t.Fatalf("NewFrameInfo(%q) returned nil", tt.fileName)
+			}
+			if frame.FrameNumber != tt.frame || frame.Edition != tt.edition || frame.Producer != tt.producer {
+				t.Fatalf("NewFrameInfo(%q) = frame %d, edition %d, producer %d; want %d, %d, %d", tt.fileName,
+					frame.FrameNumber, frame.Edition, frame.Producer, tt.frame, tt.edition, tt.producer)
+			}
+		})
+	}
+}
+
+func TestNewFrameInfoProducerCharacter(t *testing.T) {
+	tests := []struct {
+		fileName string
+		valid    bool
+		producer int
+	}{
+		// the eighth character names the producer, in base 34
+		{fileName: "000A0010.JG1", valid: true, producer: 0},
+		{fileName: "000A001Z.JG1", valid: true, producer: 33},
+		{fileName: "00000Z4J.I41", valid: true, producer: 18},
+		// I and O are not base 34 digits, so the name is not a frame's
+		{fileName: "000A001I.JG1", valid: false},
+		{fileName: "00000Z4O.I41", valid: false},
+		{fileName: "000A001_.JG1", valid: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fileName, func(t *testing.T) {
+			frame := NewFrameInfo(tt.fileName)
+			if (frame != nil) != tt.valid {
+				t.Fatalf("NewFrameInfo(%q) = %+v, want valid %v", tt.fileName, frame, tt.valid)
+			}
+			if frame != nil && frame.Producer != tt.producer {
+				t.Fatalf("NewFrameInfo(%q).Producer = %d, want %d", tt.fileName, frame.Producer, tt.producer)
+			}
+			if ok, _, _, _, _ := TryGetRpfBounds(tt.fileName); ok != tt.valid {
+				t.Fatalf("TryGetRpfBounds(%q) = %v, want %v", tt.fileName, ok, tt.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,422 @@
+package rpf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// This file reads the NITF file header and the RPF sections that describe a frame
+// See MIL-STD-2500A (NITF 2.0), MIL-STD-2500B/C (NITF 2.1) and MIL-STD-2411
+
+var (
+	ErrNotNitf        = errors.New("rpf: not a NITF file")
+	ErrNoRpfHeader    = errors.New("rpf: no RPFHDR extension in NITF file header")
+	ErrShortSection   = errors.New("rpf: section extends past end of file")
+	ErrBadNitfNumeric = errors.New("rpf: malformed NITF numeric field")
+)
+
+// RPF component IDs from MIL-STD-2411 table III
+const (
+	HeaderSectionID                  = 128
+	LocationSectionID                = 129
+	CoverageSectionID                = 130
+	CompressionSectionID             = 131
+	CompressionLookupSubsectionID    = 132
+	CompressionParameterSubsectionID = 133
+	ColorGrayscaleSectionID          = 134
+	ColorGrayscaleSubheaderID        = 135
+	ColormapSubsectionID             = 136
+	ImageDescriptionSubheaderID      = 137
+	ImageDisplayParametersID         = 138
+	MaskSubsectionID                 = 139
+	ColorConverterSubsectionID       = 140
+	SpatialDataSubsectionID          = 141
+	AttributeSectionSubheaderID      = 142
+	AttributeSubsectionID            = 143
+	ReplaceUpdateSectionSubheaderID  = 147
+	ReplaceUpdateTableID             = 148
+	BoundaryRectSectionSubheaderID   = 149
+	BoundaryRectTableID              = 150
+	FrameFileIndexSubheaderID        = 151
+	FrameFileIndexSubsectionID       = 152
+)
+
+// NitfSecurity holds the file level security fields common to NITF 2.0 and 2.1
+type NitfSecurity struct {
+	Classification     byte
+	Codewords          string
+	ControlAndHandling string
+	Releasing          string
+	Authority          string
+	ControlNumber      string
+}
+
+// NitfHeader holds the NITF file header fields used to locate RPF data
+type NitfHeader struct {
+	Version      string // "02.00" or "02.10"
+	StationID    string
+	DateTime     string
+	Title        string
+	Security     NitfSecurity
+	FileLength   int64
+	HeaderLength int64
+	// tagged record extensions from the user defined and extended header data
+	Extensions map[string][]byte
+}
+
+// RpfHeader is the RPF header section carried in the RPFHDR extension
+type RpfHeader struct {
+	LittleEndian    bool
+	FileName        string
+	UpdateIndicator byte // 0 = new, 1 = replacement, 2 = update
+	Standard        string
+	StandardDate    string
+	Classification  byte
+	CountryCode     string
+	ReleaseMarking  string
+	LocationOffset  uint32
+}
+
+// ComponentLocation is one record of the RPF location section
+type ComponentLocation struct {
+	ID     uint16
+	Length uint32
+	Offset uint32 // absolute file offset
+}
+
+// Coverage is the RPF coverage section, giving the real corners of a frame
+type Coverage struct {
+	NWLat, NWLon, SWLat, SWLon float64
+	NELat, NELon, SELat, SELon float64
+	VerticalResolution         float64 // meters
+	HorizontalResolution       float64 // meters
+	LatInterval, LonInterval   float64 // degrees per pixel
+}
+
+// FrameHeader is everything the headers of an RPF file say about it
+type FrameHeader struct {
+	Nitf      NitfHeader
+	Rpf       RpfHeader
+	Locations []ComponentLocation
+	Coverage  *Coverage  // nil when the file has no coverage section (e.g. A.TOC)
+	Frame     *FrameInfo // decoded from the RPF header's file name, nil if unconventional
+	Series    NitfSeries
+	Zone      byte
+	Edition   int
+}
+
+// ReadFrameHeader opens an RPF file and parses its NITF and RPF headers
+func ReadFrameHeader(filePath string) (*FrameHeader, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+	return ParseFrameHeader(file)
+}
+
+// ParseFrameHeader parses the NITF and RPF headers of an RPF file
+func ParseFrameHeader(r io.ReaderAt) (*FrameHeader, error) {
+	nitf, err := readNitfHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	tre, ok := nitf.Extensions["RPFHDR"]
+	if !ok {
+		return nil, ErrNoRpfHeader
+	}
+	h := &FrameHeader{Nitf: *nitf}
+	if err := h.Rpf.parse(tre); err != nil {
+		return nil, err
+	}
+	size := readerSize(r, nitf.FileLength)
+	if h.Locations, err = readLocationSection(r, h.Rpf.LocationOffset, h.Rpf.order(), size); err != nil {
+		return nil, err
+	}
+	if loc, ok := h.Location(CoverageSectionID); ok {
+		buf := make([]byte, 96)
+		if _, err := r.ReadAt(buf, int64(loc.Offset)); err != nil {
+			return nil, fmt.Errorf("rpf: reading coverage section: %w", err)
+		}
+		h.Coverage = parseCoverage(buf, h.Rpf.order())
+	}
+
+	// the RPF header carries the producer's file name, which survives renaming on disk
+	name := strings.ToUpper(strings.TrimSpace(h.Rpf.FileName))
+	if isRpfExtension(extOf(name)) {
+		h.Frame = NewFrameInfo(name)
+	}
+	if h.Frame != nil {
+		h.Series = DataSeries[h.Frame.SeriesCode]
+		h.Zone = h.Frame.ArcZone
+		h.Edition = h.Frame.Edition
+	}
+	return h, nil
+}
+
+// Location finds a component in the RPF location section
+func (h *FrameHeader) Location(id uint16) (ComponentLocation, bool) {
+	for _, loc := range h.Locations {
+		if loc.ID == id && loc.Offset != math.MaxUint32 {
+			return loc, true
+		}
+	}
+	return ComponentLocation{}, false
+}
+
+// Bounds returns the geographic extent of the coverage section
+func (h *FrameHeader) Bounds() (isValid bool, x1, y1, x2, y2 float64) {
+	c := h.Coverage
+	if c == nil {
+		return false, 0, 0, 0, 0
+	}
+	x1 = math.Min(math.Min(c.NWLon, c.SWLon), math.Min(c.NELon, c.SELon))
+	x2 = math.Max(math.Max(c.NWLon, c.SWLon), math.Max(c.NELon, c.SELon))
+	y1 = math.Min(math.Min(c.NWLat, c.SWLat), math.Min(c.NELat, c.SELat))
+	y2 = math.Max(math.Max(c.NWLat, c.SWLat), math.Max(c.NELat, c.SELat))
+	if x1 < -181 || x2 > 181 || y1 < -90 || y2 > 90 || x1 >= x2 || y1 >= y2 {
+		return false, 0, 0, 0, 0
+	}
+	return true, x1, y1, x2, y2
+}
+
+func extOf(fileName string) string {
+	i := strings.LastIndex(fileName, ".")
+	if i == -1 {
+		return ""
+	}
+	return fileName[i:]
+}
+
+func (h *RpfHeader) order() binary.ByteOrder {
+	if h.LittleEndian {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+// RPFHDR layout from MIL-STD-2411 5.3.1 (48 bytes)
+func (h *RpfHeader) parse(tre []byte) error {
+	if len(tre) < 48 {
+		return fmt.Errorf("rpf: RPFHDR is %d bytes, want 48", len(tre))
+	}
+	h.LittleEndian = tre[0] != 0
+	h.FileName = string(tre[3:15])
+	h.UpdateIndicator = tre[15]
+	h.Standard = strings.TrimSpace(string(tre[16:31]))
+	h.StandardDate = strings.TrimSpace(string(tre[31:39]))
+	h.Classification = tre[39]
+	h.CountryCode = strings.TrimSpace(string(tre[40:42]))
+	h.ReleaseMarking = strings.TrimSpace(string(tre[42:44]))
+	h.LocationOffset = h.order().Uint32(tre[44:48])
+	return nil
+}
+
+// readerSize is the length of what r reads, from r itself when it can tell, else the
+// file length the NITF header declares
+func readerSize(r io.ReaderAt, declared int64) int64 {
+	switch f := r.(type) {
+	case interface{ Size() int64 }:
+		return f.Size()
+	case interface{ Stat() (os.FileInfo, error) }:
+		if info, err := f.Stat(); err == nil {
+			return info.Size()
+		}
+	}
+	return declared
+}
+
+// readLocationSection reads the component location table, which must lie within the
+// size bytes of the file
+func readLocationSection(r io.ReaderAt, offset uint32, order binary.ByteOrder, size int64) ([]ComponentLocation, error) {
+	head := make([]byte, 14)
+	if _, err := r.ReadAt(head, int64(offset)); err != nil {
+		return nil, fmt.Errorf("rpf: reading location section: %w", err)
+	}
+	tableOffset := order.Uint32(head[2:6])
+	count := int(order.Uint16(head[6:8]))
+	recordLength := int(order.Uint16(head[8:10]))
+	if recordLength < 10 {
+		recordLength = 10
+	}
+	// a corrupt count or record length could otherwise ask for gigabytes
+	tableStart := int64(offset) + int64(tableOffset)
+	if tableStart > size || int64(count)*int64(recordLength) > size-tableStart {
+		return nil, fmt.Errorf("rpf: component location table of %d records of %d bytes: %w", count, recordLength, ErrShortSection)
+	}
+	table := make([]byte, count*recordLength)
+	if _, err := r.ReadAt(table, tableStart); err != nil {
+		return nil, fmt.Errorf("rpf: reading component location table: %w", err)
+	}
+	locations := make([]ComponentLocation, count)
+	for i := range locations {
+		rec := table[i*recordLength:]
+		locations[i] = ComponentLocation{
+			ID:     order.Uint16(rec[0:2]),
+			Length: order.Uint32(rec[2:6]),
+			Offset: order.Uint32(rec[6:10]),
+		}
+	}
+	return locations, nil
+}
+
+func parseCoverage(buf []byte, order binary.ByteOrder) *Coverage {
+	f := func(i int) float64 {
+		return math.Float64frombits(order.Uint64(buf[i*8:]))
+	}
+	return &Coverage{
+		NWLat: f(0), NWLon: f(1), SWLat: f(2), SWLon: f(3),
+		NELat: f(4), NELon: f(5), SELat: f(6), SELon: f(7),
+		VerticalResolution: f(8), HorizontalResolution: f(9),
+		LatInterval: f(10), LonInterval: f(11),
+	}
+}
+
+// nitfFields reads fixed width NITF header fields in order
+type nitfFields struct {
+	buf []byte
+	pos int
+	err error
+}
+
+func (f *nitfFields) bytes(n int) []byte {
+	if f.err != nil {
+		return nil
+	}
+	if n < 0 || f.pos+n > len(f.buf) {
+		f.err = ErrShortSection
+		return nil
+	}
+	b := f.buf[f.pos : f.pos+n]
+	f.pos += n
+	return b
+}
+
+func (f *nitfFields) str(n int) string {
+	return strings.TrimSpace(string(f.bytes(n)))
+}
+
+func (f *nitfFields) num(n int) int64 {
+	s := f.str(n)
+	if f.err != nil {
+		return 0
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		f.err = fmt.Errorf("%w: %q", ErrBadNitfNumeric, s)
+	}
+	return v
+}
+
+// skip a count field followed by that many fixed width length pairs
+func (f *nitfFields) skipTable(countWidth, entryWidth int) {
+	n := f.num(countWidth)
+	f.bytes(int(n) * entryWidth)
+}
+
+func readNitfHeader(r io.ReaderAt) (*NitfHeader, error) {
+	// the header length is only known part way in, so start with a guess
+	buf := make([]byte, 4096)
+	n, err := r.ReadAt(buf, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	buf = buf[:n]
+	if n < 9 || string(buf[0:4]) != "NITF" {
+		return nil, ErrNotNitf
+	}
+
+	h, err := parseNitfHeader(buf)
+	if errors.Is(err, ErrShortSection) && h.HeaderLength > int64(len(buf)) {
+		buf = make([]byte, h.HeaderLength)
+		if _, err := r.ReadAt(buf, 0); err != nil {
+			return nil, err
+		}
+		h, err = parseNitfHeader(buf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func parseNitfHeader(buf []byte) (*NitfHeader, error) {
+	f := &nitfFields{buf: buf}
+	h := &NitfHeader{Extensions: make(map[string][]byte)}
+	f.bytes(4) // FHDR
+	h.Version = f.str(5)
+	f.bytes(2 + 4) // CLEVEL, STYPE
+	h.StationID = f.str(10)
+	h.DateTime = f.str(14)
+	h.Title = f.str(80)
+	sec := &h.Security
+	if cls := f.bytes(1); cls != nil {
+		sec.Classification = cls[0]
+	}
+	if h.Version == "02.00" { // MIL-STD-2500A
+		sec.Codewords = f.str(40)
+		sec.ControlAndHandling = f.str(40)
+		sec.Releasing = f.str(40)
+		sec.Authority = f.str(20)
+		sec.ControlNumber = f.str(20)
+		if f.str(6) == "999998" { // FSDWNG, downgrade event follows
+			f.bytes(40)
+		}
+		f.bytes(5 + 5 + 1) // FSCOP, FSCPYS, ENCRYP
+		f.bytes(27 + 18)   // ONAME, OPHONE
+	} else { // MIL-STD-2500B/C
+		f.bytes(2) // FSCLSY
+		sec.Codewords = f.str(11)
+		sec.ControlAndHandling = f.str(2)
+		sec.Releasing = f.str(20)
+		f.bytes(2 + 8 + 4 + 1 + 8 + 43 + 1) // declassification and classification reason fields
+		sec.Authority = f.str(40)
+		f.bytes(1 + 8) // FSCRSN, FSSRDT
+		sec.ControlNumber = f.str(15)
+		f.bytes(5 + 5 + 1 + 3) // FSCOP, FSCPYS, ENCRYP, FBKGC
+		f.bytes(24 + 18)       // ONAME, OPHONE
+	}
+	h.FileLength = f.num(12)
+	h.HeaderLength = f.num(6)
+	if f.err != nil {
+		return h, f.err
+	}
+	if h.HeaderLength > int64(len(buf)) {
+		return h, ErrShortSection
+	}
+	f.buf = buf[:h.HeaderLength]
+
+	f.skipTable(3, 6+10)     // image segments
+	f.skipTable(3, 4+6)      // graphic/symbol segments
+	f.skipTable(3, 4+3)      // label segments (reserved in 2.1)
+	f.skipTable(3, 4+5)      // text segments
+	f.skipTable(3, 4+9)      // data extension segments
+	f.skipTable(3, 4+7)      // reserved extension segments
+	for i := 0; i < 2; i++ { // user defined, then extended header data
+		length := f.num(5)
+		if length > 0 {
+			f.bytes(3) // overflow
+			readExtensions(f.bytes(int(length)-3), h.Extensions)
+		}
+	}
+	return h, f.err
+}
+
+// split a run of tagged record extensions
+func readExtensions(data []byte, into map[string][]byte) {
+	for len(data) >= 11 {
+		tag := strings.TrimSpace(string(data[0:6]))
+		length, err := strconv.Atoi(string(data[6:11]))
+		if err != nil || 11+length > len(data) {
+			return
+		}
+		into[tag] = data[11 : 11+length]
+		data = data[11+length:]
+	}
+}
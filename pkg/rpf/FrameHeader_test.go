@@ -0,0 +1,197 @@
+package rpf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testRpfFile assembles a minimal NITF file carrying RPF components
+type testRpfFile struct {
+	version    string // NITF version, "02.00" or "02.10"
+	fileName   string // name recorded in the RPF header
+	components []testComponent
+}
+
+type testComponent struct {
+	id   uint16
+	data []byte
+}
+
+func (t *testRpfFile) add(id uint16, data []byte) {
+	t.components = append(t.components, testComponent{id, data})
+}
+
+func field(s string, n int) string {
+	return (s + strings.Repeat(" ", n))[:n]
+}
+
+func numField(v, n int) string {
+	return fmt.Sprintf("%0*d", n, v)
+}
+
+func (t *testRpfFile) bytes() []byte {
+	var pre strings.Builder
+	pre.WriteString("NITF" + t.version + "03BF01" + field("TEST", 10) + "20240101000000" + field("TITLE", 80))
+	if t.version == "02.00" {
+		pre.WriteString("U" + field("", 40) + field("", 40) + field("", 40) + field("", 20) + field("", 20) + field("", 6))
+		pre.WriteString("00000" + "00000" + "0" + field("", 27) + field("", 18))
+	} else {
+		pre.WriteString("U" + field("", 2) + field("", 11) + field("", 2) + field("", 20) + field("", 2+8+4+1+8+43+1))
+		pre.WriteString(field("", 40) + field("", 1+8) + field("", 15))
+		pre.WriteString("00000" + "00000" + "0" + "\x00\x00\x00" + field("", 24) + field("", 18))
+	}
+	const tail = 12 + 6 + 6*3 + 5 + 3 + 11 + 48 + 5
+	headerLength := pre.Len() + tail
+
+	rpfhdr := new(bytes.Buffer)
+	rpfhdr.WriteByte(0)
+	mustWriteBE(rpfhdr, uint16(48))
+	rpfhdr.WriteString(field(t.fileName, 12))
+	rpfhdr.WriteByte(0)
+	rpfhdr.WriteString(field("MIL-C-89038", 15) + "19941006" + "U" + "US" + "  ")
+	mustWriteBE(rpfhdr, uint32(headerLength))
+
+	locations := new(bytes.Buffer)
+	count := len(t.components)
+	mustWriteBE(locations, uint16(14+count*10))
+	mustWriteBE(locations, uint32(14))
+	mustWriteBE(locations, uint16(count))
+	mustWriteBE(locations, uint16(10))
+	aggregate := 0
+	for _, c := range t.components {
+		aggregate += len(c.data)
+	}
+	mustWriteBE(locations, uint32(aggregate))
+	offset := headerLength + 14 + count*10
+	for _, c := range t.components {
+		mustWriteBE(locations, c.id)
+		mustWriteBE(locations, uint32(len(c.data)))
+		mustWriteBE(locations, uint32(offset))
+		offset += len(c.data)
+	}
+
+	out := new(bytes.Buffer)
+	out.WriteString(pre.String())
+	out.WriteString(numField(offset, 12) + numField(headerLength, 6))
+	out.WriteString("000000000000000000")
+	out.WriteString(numField(3+11+48, 5) + "000" + "RPFHDR" + "00048")
+	out.Write(rpfhdr.Bytes())
+	out.WriteString("00000")
+	out.Write(locations.Bytes())
+	for _, c := range t.components {
+		out.Write(c.data)
+	}
+	return out.Bytes()
+}
+
+func mustWriteBE(buf *bytes.Buffer, v any) {
+	if err := binary.Write(buf, binary.BigEndian, v); err != nil {
+		panic(err)
+	}
+}
+
+func coverageSection(x1, y1, x2, y2, latInterval, lonInterval float64) []byte {
+	buf := new(bytes.Buffer)
+	for _, v := range []float64{y2, x1, y1, x1, y2, x2, y1, x2, 100, 100, latInterval, lonInterval} {
+		mustWriteBE(buf, v)
+	}
+	return buf.Bytes()
+}
+
+func TestParseFrameHeader(t *testing.T) {
+	for _, version := range []string{"02.00", "02.10"} {
+		t.Run(version, func(t *testing.T) {
+			ok, x1, y1, x2, y2 := TryGetRpfBounds("0REF5K4A.I41")
+			if !ok {
+				t.Fatal("test frame name is not valid")
+			}
+			file := &testRpfFile{version: version, fileName: "0ref5k4a.i41"}
+			file.add(CoverageSectionID, coverageSection(x1, y1, x2, y2, (y2-y1)/1536, (x2-x1)/1536))
+
+			h, err := ParseFrameHeader(bytes.NewReader(file.bytes()))
+			if err != nil {
+				t.Fatalf("ParseFrameHeader: %v", err)
+			}
+			if h.Nitf.Version != version || h.Nitf.Title != "TITLE" || h.Nitf.Security.Classification != 'U' {
+				t.Fatalf("NITF header = %+v", h.Nitf)
+			}
+			if h.Rpf.Standard != "MIL-C-89038" || h.Rpf.CountryCode != "US" || h.Rpf.Classification != 'U' {
+				t.Fatalf("RPF header = %+v", h.Rpf)
+			}
+			if h.Frame == nil || h.Series.SeriesCode != "I4" || h.Zone != '1' || h.Edition != 4 {
+				t.Fatalf("frame = %+v series = %q zone = %q edition = %d", h.Frame, h.Series.SeriesCode, h.Zone, h.Edition)
+			}
+			valid, hx1, hy1, hx2, hy2 := h.Bounds()
+			if !valid || !almostEqual(hx1, x1) || !almostEqual(hy1, y1) || !almostEqual(hx2, x2) || !almostEqual(hy2, y2) {
+				t.Fatalf("Bounds() = (%v, %v, %v, %v, %v), want (%v, %v, %v, %v)", valid, hx1, hy1, hx2, hy2, x1, y1, x2, y2)
+			}
+		})
+	}
+}
+
+func TestReadFrameHeaderIgnoresDiskName(t *testing.T) {
+	file := &testRpfFile{version: "02.10", fileName: "0REF5K4A.I41"}
+	file.add(CoverageSectionID, coverageSection(1, 2, 3, 4, 1.0/1536, 1.0/1536))
+	renamed := filepath.Join(t.TempDir(), "renamed.ntf")
+	if err := os.WriteFile(renamed, file.bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := ReadFrameHeader(renamed)
+	if err != nil {
+		t.Fatalf("ReadFrameHeader: %v", err)
+	}
+	if h.Frame == nil || h.Frame.SeriesCode != "I4" {
+		t.Fatalf("frame = %+v, want series from RPF header", h.Frame)
+	}
+	if _, ok := h.Location(CoverageSectionID); !ok {
+		t.Fatal("coverage section missing from location table")
+	}
+	if _, ok := h.Location(SpatialDataSubsectionID); ok {
+		t.Fatal("unexpected spatial data section in location table")
+	}
+	if math.IsNaN(h.Coverage.LatInterval) {
+		t.Fatal("coverage lat interval is NaN")
+	}
+}
+
+func TestParseFrameHeaderRejectsNonNitf(t *testing.T) {
+	_, err := ParseFrameHeader(bytes.NewReader([]byte("not a nitf file at all")))
+	if !errors.Is(err, ErrNotNitf) {
+		t.Fatalf("ParseFrameHeader error = %v, want ErrNotNitf", err)
+	}
+}
+
+func TestParseFrameHeaderRejectsOversizedLocationTable(t *testing.T) {
+	file := &testRpfFile{version: "02.10", fileName: "0REF5K4A.I41"}
+	file.add(CoverageSectionID, coverageSection(1, 2, 3, 4, 1.0/1536, 1.0/1536))
+	data := file.bytes()
+	h, err := ParseFrameHeader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ParseFrameHeader: %v", err)
+	}
+
+	// a record count and length the file cannot hold
+	offset := h.Rpf.LocationOffset
+	binary.BigEndian.PutUint16(data[offset+6:], 0xFFFF)
+	binary.BigEndian.PutUint16(data[offset+8:], 0xFFFF)
+	if _, err := ParseFrameHeader(bytes.NewReader(data)); !errors.Is(err, ErrShortSection) {
+		t.Fatalf("ParseFrameHeader error = %v, want ErrShortSection", err)
+	}
+
+	// the same from a file on disk, sized by Stat
+	corrupt := filepath.Join(t.TempDir(), "corrupt.i41")
+	if err := os.WriteFile(corrupt, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadFrameHeader(corrupt); !errors.Is(err, ErrShortSection) {
+		t.Fatalf("ReadFrameHeader error = %v, want ErrShortSection", err)
+	}
+}
@@ -0,0 +1,413 @@
+package rpf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"os"
+)
+
+// This file decodes the vector quantized image data of CADRG and CIB frames
+// See MIL-C-89038, MIL-PRF-89041 and MIL-STD-2411 5.3.3 (compression, color/grayscale and image sections)
+
+var (
+	ErrNoImageData         = errors.New("rpf: frame has no compression or spatial data section")
+	ErrUnknownCompression  = errors.New("rpf: unsupported compression algorithm")
+	ErrUnsupportedLookup   = errors.New("rpf: unsupported compression lookup table layout")
+	ErrNoColormap          = errors.New("rpf: frame has no color/grayscale table")
+	ErrUnexpectedFrameType = errors.New("rpf: frame series does not hold imagery")
+)
+
+const (
+	noCompression   = 0  // compression algorithm id for uncompressed spatial data
+	vqAlgorithm     = 1  // compression algorithm id for vector quantization
+	vqKernel        = 4  // a VQ code expands to a 4x4 block of pixels
+	vqCodeBits      = 12 // and is stored as a 12 bit value
+	noSubframe      = math.MaxUint32
+	defaultSubframe = 256
+	defaultGrid     = 6
+	maxFrameEdge    = defaultGrid * defaultSubframe // RPF frames are 1536 pixels square
+)
+
+// Frame is a decoded RPF frame
+type Frame struct {
+	Header *FrameHeader
+	// Image is a *image.Paletted for CADRG, where masked subframes use a transparent entry,
+	// or a *image.Gray for CIB
+	Image image.Image
+	// Present marks the subframes holding data, row major, false where the producer masked them
+	Present         []bool
+	SubframeColumns int // subframes east-west
+	SubframeSize    int // pixels along a subframe edge
+}
+
+// ReadFrame opens and decodes an RPF frame file
+func ReadFrame(framePath string) (*Frame, error) {
+	file, err := os.Open(framePath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+	return DecodeFrame(file)
+}
+
+// DecodeFrame reads the headers and decodes the image of a CADRG or CIB frame
+func DecodeFrame(r io.ReaderAt) (*Frame, error) {
+	h, err := ParseFrameHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if h.Frame != nil && h.Series.Type == CDTED {
+		return nil, fmt.Errorf("%w: %s", ErrUnexpectedFrameType, h.Rpf.FileName)
+	}
+	d := &frameDecoder{r: r, h: h, order: h.Rpf.order(), valueBytes: 1}
+	if err := d.readLookupTables(); err != nil {
+		return nil, err
+	}
+	if err := d.readLayout(); err != nil {
+		return nil, err
+	}
+	colors, err := d.readColormap()
+	if h.Frame != nil && h.Series.Type == CIB {
+		// CIB codebooks hold gray levels, a grayscale table is optional
+		if errors.Is(err, ErrNoColormap) {
+			colors, err = nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeGray(colors)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d.decodePaletted(colors)
+}
+
+func (d *frameDecoder) newFrame(img image.Image) *Frame {
+	return &Frame{
+		Header:          d.h,
+		Image:           img,
+		Present:         make([]bool, d.rows*d.columns),
+		SubframeColumns: d.columns,
+		SubframeSize:    d.subframeSize,
+	}
+}
+
+func (d *frameDecoder) decodePaletted(colors color.Palette) (*Frame, error) {
+	// masked subframes and pixels matching the transparent code show the transparent entry
+	transparent := d.transparentCode
+	if transparent < 0 || transparent >= 256 {
+		transparent = min(len(colors), 255)
+	}
+	// every value the lookup tables can produce needs a palette entry
+	size := max(len(colors), transparent+1)
+	if d.uncompressed {
+		size = 256
+	}
+	for _, table := range d.lookup {
+		for _, v := range table {
+			size = max(size, int(v)+1)
+		}
+	}
+	palette := make(color.Palette, size)
+	for i := range palette {
+		palette[i] = color.RGBA{}
+	}
+	copy(palette, colors)
+	palette[transparent] = color.RGBA{}
+	img := image.NewPaletted(image.Rect(0, 0, d.columns*d.subframeSize, d.rows*d.subframeSize), palette)
+
+	frame := d.newFrame(img)
+	if err := d.decodeSubframes(frame, img.Pix, img.Stride, uint8(transparent)); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// CIB frames decode to gray levels, masked subframes are black and not Present
+func (d *frameDecoder) decodeGray(colors color.Palette) (*Frame, error) {
+	img := image.NewGray(image.Rect(0, 0, d.columns*d.subframeSize, d.rows*d.subframeSize))
+	var levels [256]uint8
+	for i := range levels {
+		levels[i] = uint8(i)
+		if i < len(colors) {
+			levels[i] = color.GrayModel.Convert(colors[i]).(color.Gray).Y
+		}
+	}
+
+	frame := d.newFrame(img)
+	if err := d.decodeSubframes(frame, img.Pix, img.Stride, 0); err != nil {
+		return nil, err
+	}
+	for i, v := range img.Pix {
+		img.Pix[i] = levels[v]
+	}
+	// leave masked subframes black after the gray table is applied
+	for i, present := range frame.Present {
+		if !present {
+			sx, sy := (i%d.columns)*d.subframeSize, (i/d.columns)*d.subframeSize
+			fill(img.Pix[sy*img.Stride+sx:], img.Stride, d.subframeSize, d.subframeSize, 0)
+		}
+	}
+	return frame, nil
+}
+
+func (d *frameDecoder) decodeSubframes(frame *Frame, pix []byte, stride int, masked uint8) error {
+	block := make([]byte, d.subframeBytes())
+	for i, offset := range d.subframeOffsets {
+		sx, sy := (i%d.columns)*d.subframeSize*d.valueBytes, (i/d.columns)*d.subframeSize
+		if offset == noSubframe {
+			fill(pix[sy*stride+sx:], stride, d.subframeSize*d.valueBytes, d.subframeSize, masked)
+			continue
+		}
+		if _, err := d.r.ReadAt(block, int64(d.spatialData)+int64(offset)); err != nil {
+			return fmt.Errorf("rpf: reading subframe %d: %w", i, err)
+		}
+		d.expand(block, pix[sy*stride+sx:], stride)
+		frame.Present[i] = true
+	}
+	return nil
+}
+
+// HasData reports whether a pixel falls in a subframe the producer supplied
+func (f *Frame) HasData(x, y int) bool {
+	if f.SubframeSize == 0 || x < 0 || y < 0 {
+		return false
+	}
+	i := (y/f.SubframeSize)*f.SubframeColumns + x/f.SubframeSize
+	return i < len(f.Present) && f.Present[i]
+}
+
+func fill(pix []byte, stride, width, height int, value uint8) {
+	for row := 0; row < height; row++ {
+		line := pix[row*stride : row*stride+width]
+		for i := range line {
+			line[i] = value
+		}
+	}
+}
+
+type frameDecoder struct {
+	r     io.ReaderAt
+	h     *FrameHeader
+	order binary.ByteOrder
+
+	rows, columns   int // subframe grid
+	subframeSize    int
+	spatialData     uint32
+	subframeOffsets []uint32 // relative to spatialData, noSubframe if masked
+	transparentCode int
+
+	valueBytes   int              // bytes per output value, 1 for imagery and 2 for elevation
+	uncompressed bool             // spatial data holds values rather than VQ codes
+	lookup       [vqKernel][]byte // one table per kernel row, 4 values per code
+}
+
+func (d *frameDecoder) subframeBytes() int {
+	if d.uncompressed {
+		return d.subframeSize * d.subframeSize * d.valueBytes
+	}
+	codes := (d.subframeSize / vqKernel) * (d.subframeSize / vqKernel)
+	return codes * vqCodeBits / 8
+}
+
+func (d *frameDecoder) readAt(id uint16, size int, extra int64) ([]byte, error) {
+	loc, ok := d.h.Location(id)
+	if !ok {
+		return nil, ErrNoImageData
+	}
+	buf := make([]byte, size)
+	if _, err := d.r.ReadAt(buf, int64(loc.Offset)+extra); err != nil {
+		return nil, fmt.Errorf("rpf: reading component %d: %w", id, err)
+	}
+	return buf, nil
+}
+
+// find the subframe grid, the spatial data and which subframes are masked
+func (d *frameDecoder) readLayout() error {
+	d.rows, d.columns, d.subframeSize = defaultGrid, defaultGrid, defaultSubframe
+	d.transparentCode = -1
+	if desc, err := d.readAt(ImageDescriptionSubheaderID, 28, 0); err == nil {
+		d.columns = int(d.order.Uint16(desc[8:10]))
+		d.rows = int(d.order.Uint16(desc[10:12]))
+		d.subframeSize = int(d.order.Uint32(desc[12:16]))
+		if d.order.Uint32(desc[16:20]) != d.order.Uint32(desc[12:16]) {
+			return errors.New("rpf: non-square subframes are not supported")
+		}
+	}
+	// the image is allocated from the layout, a corrupt one could ask for gigabytes
+	if d.rows <= 0 || d.columns <= 0 || d.subframeSize <= 0 || d.subframeSize%vqKernel != 0 ||
+		d.subframeSize > maxFrameEdge || d.columns*d.subframeSize > maxFrameEdge || d.rows*d.subframeSize > maxFrameEdge {
+		return fmt.Errorf("rpf: bad subframe layout %dx%d of %d pixels", d.columns, d.rows, d.subframeSize)
+	}
+
+	loc, ok := d.h.Location(SpatialDataSubsectionID)
+	if !ok {
+		return ErrNoImageData
+	}
+	d.spatialData = loc.Offset
+	count := d.rows * d.columns
+	d.subframeOffsets = make([]uint32, count)
+	for i := range d.subframeOffsets {
+		d.subframeOffsets[i] = uint32(i * d.subframeBytes())
+	}
+
+	if _, ok := d.h.Location(MaskSubsectionID); !ok {
+		return nil // without a mask subsection every subframe is present
+	}
+	mask, err := d.readAt(MaskSubsectionID, 14, 0)
+	if err != nil {
+		return err
+	}
+	subframeTable := d.order.Uint32(mask[0:4])
+	codeBits := int(d.order.Uint16(mask[12:14]))
+	if codeBits > 0 && codeBits <= 16 {
+		code, err := d.readAt(MaskSubsectionID, (codeBits+7)/8, 14)
+		if err != nil {
+			return err
+		}
+		d.transparentCode = int(code[0])
+		if len(code) == 2 {
+			d.transparentCode = int(d.order.Uint16(code))
+		}
+	}
+	if subframeTable == noSubframe {
+		return nil
+	}
+	table, err := d.readAt(MaskSubsectionID, count*4, int64(subframeTable))
+	if err != nil {
+		return err
+	}
+	for i := range d.subframeOffsets {
+		d.subframeOffsets[i] = d.order.Uint32(table[i*4:])
+	}
+	return nil
+}
+
+func (d *frameDecoder) readLookupTables() error {
+	if _, ok := d.h.Location(CompressionSectionID); !ok {
+		d.uncompressed = true
+		return nil
+	}
+	comp, err := d.readAt(CompressionSectionID, 6, 0)
+	if err != nil {
+		return err
+	}
+	switch algorithm := d.order.Uint16(comp[0:2]); algorithm {
+	case noCompression:
+		d.uncompressed = true
+		return nil
+	case vqAlgorithm:
+	default:
+		return fmt.Errorf("%w: %d", ErrUnknownCompression, algorithm)
+	}
+	head, err := d.readAt(CompressionLookupSubsectionID, 6, 0)
+	if err != nil {
+		return err
+	}
+	tableOffset := int64(d.order.Uint32(head[0:4]))
+	recordLength := int(d.order.Uint16(head[4:6]))
+	if recordLength < 14 {
+		recordLength = 14
+	}
+	records, err := d.readAt(CompressionLookupSubsectionID, vqKernel*recordLength, tableOffset)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < vqKernel; i++ {
+		// tables are stored in kernel row order
+		rec := records[i*recordLength:]
+		count := int(d.order.Uint32(rec[2:6]))
+		values := int(d.order.Uint16(rec[6:8]))
+		bits := int(d.order.Uint16(rec[8:10]))
+		if count != 1<<vqCodeBits || values != vqKernel || bits != d.valueBytes*8 {
+			return fmt.Errorf("%w: table %d has %d records of %d %d-bit values", ErrUnsupportedLookup, i, count, values, bits)
+		}
+		offset := int64(d.order.Uint32(rec[10:14]))
+		if d.lookup[i], err = d.readAt(CompressionLookupSubsectionID, count*values*d.valueBytes, offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read the largest color table, which the image indexes
+func (d *frameDecoder) readColormap() (color.Palette, error) {
+	section, err := d.readAt(ColorGrayscaleSectionID, 2, 0)
+	if err != nil {
+		return nil, ErrNoColormap
+	}
+	count := int(section[0])
+	head, err := d.readAt(ColormapSubsectionID, 6, 0)
+	if err != nil {
+		return nil, ErrNoColormap
+	}
+	tableOffset := int64(d.order.Uint32(head[0:4]))
+	recordLength := int(d.order.Uint16(head[4:6]))
+	if recordLength < 17 {
+		recordLength = 17
+	}
+	records, err := d.readAt(ColormapSubsectionID, count*recordLength, tableOffset)
+	if err != nil {
+		return nil, err
+	}
+
+	best, bestCount, bestLength := -1, 0, 0
+	for i := 0; i < count; i++ {
+		rec := records[i*recordLength:]
+		n := int(d.order.Uint32(rec[2:6]))
+		if n > bestCount && n <= 256 {
+			best, bestCount, bestLength = i, n, int(rec[6])
+		}
+	}
+	if best == -1 || (bestLength != 4 && bestLength != 3 && bestLength != 1) {
+		return nil, ErrNoColormap
+	}
+	offset := int64(d.order.Uint32(records[best*recordLength+9:]))
+	values, err := d.readAt(ColormapSubsectionID, bestCount*bestLength, offset)
+	if err != nil {
+		return nil, err
+	}
+	palette := make(color.Palette, bestCount)
+	for i := range palette {
+		v := values[i*bestLength:]
+		if bestLength == 1 {
+			palette[i] = color.RGBA{v[0], v[0], v[0], 255}
+		} else {
+			palette[i] = color.RGBA{v[0], v[1], v[2], 255}
+		}
+	}
+	return palette, nil
+}
+
+// expand the 12 bit codes of one subframe into 4x4 blocks of pixels
+func (d *frameDecoder) expand(block []byte, pix []byte, stride int) {
+	rowBytes := d.subframeSize * d.valueBytes
+	if d.uncompressed {
+		for row := 0; row < d.subframeSize; row++ {
+			copy(pix[row*stride:row*stride+rowBytes], block[row*rowBytes:])
+		}
+		return
+	}
+	kernelBytes := vqKernel * d.valueBytes
+	blocksPerRow := d.subframeSize / vqKernel
+	for i := 0; i < blocksPerRow*blocksPerRow; i++ {
+		// two codes are packed into every three bytes
+		b := block[(i/2)*3:]
+		var code int
+		if i%2 == 0 {
+			code = int(b[0])<<4 | int(b[1])>>4
+		} else {
+			code = int(b[1]&0x0F)<<8 | int(b[2])
+		}
+		x, y := (i%blocksPerRow)*kernelBytes, (i/blocksPerRow)*vqKernel
+		for row := 0; row < vqKernel; row++ {
+			copy(pix[(y+row)*stride+x:(y+row)*stride+x+kernelBytes], d.lookup[row][code*kernelBytes:])
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package rpf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+// testCode is the VQ code written for every 4x4 block of a test subframe
+func testCode(subframe, block int) int {
+	return (subframe*64 + block) % 4096
+}
+
+// buildTestFrame writes a VQ frame whose lookup tables map code c to (c+row)%200 in each
+// kernel row; CADRG frames get a 216 color table, gray (CIB) frames an inverting gray table
+func buildTestFrame(fileName string, masked map[int]bool, gray bool) []byte {
+	file := &testRpfFile{version: "02.00", fileName: fileName}
+	file.add(CoverageSectionID, coverageSection(0, 0, 1, 1, 1.0/1536, 1.0/1536))
+
+	comp := new(bytes.Buffer)
+	mustWriteBE(comp, []uint16{vqAlgorithm, 4, 0})
+	file.add(CompressionSectionID, comp.Bytes())
+
+	lookup := new(bytes.Buffer)
+	mustWriteBE(lookup, uint32(6))
+	mustWriteBE(lookup, uint16(14))
+	for row := 0; row < 4; row++ {
+		mustWriteBE(lookup, uint16(row+1))
+		mustWriteBE(lookup, uint32(4096))
+		mustWriteBE(lookup, []uint16{4, 8})
+		mustWriteBE(lookup, uint32(6+4*14+row*4096*4))
+	}
+	for row := 0; row < 4; row++ {
+		for code := 0; code < 4096; code++ {
+			v := byte((code + row) % 200)
+			lookup.Write([]byte{v, v, v, v})
+		}
+	}
+	file.add(CompressionLookupSubsectionID, lookup.Bytes())
+
+	file.add(ColorGrayscaleSectionID, append([]byte{1, 0}, field("", 12)...))
+	colormap := new(bytes.Buffer)
+	mustWriteBE(colormap, uint32(6))
+	mustWriteBE(colormap, uint16(17))
+	mustWriteBE(colormap, uint16(2))
+	if gray {
+		mustWriteBE(colormap, uint32(256))
+		colormap.WriteByte(1)
+	} else {
+		mustWriteBE(colormap, uint32(216))
+		colormap.WriteByte(4)
+	}
+	mustWriteBE(colormap, uint16(0))
+	mustWriteBE(colormap, uint32(6+17))
+	mustWriteBE(colormap, uint32(0))
+	for i := 0; i < 216 && !gray; i++ {
+		colormap.Write([]byte{byte(i), byte(255 - i), byte(i % 3), 0})
+	}
+	for i := 0; i < 256 && gray; i++ {
+		colormap.WriteByte(byte(255 - i))
+	}
+	file.add(ColormapSubsectionID, colormap.Bytes())
+
+	desc := new(bytes.Buffer)
+	mustWriteBE(desc, []uint16{1, 1, 1, 1, 6, 6})
+	mustWriteBE(desc, []uint32{256, 256, 0, noSubframe})
+	file.add(ImageDescriptionSubheaderID, desc.Bytes())
+
+	mask := new(bytes.Buffer)
+	mustWriteBE(mask, []uint32{15, noSubframe})
+	mustWriteBE(mask, []uint16{4, 0, 8})
+	mask.WriteByte(216)
+	spatial := new(bytes.Buffer)
+	for i := 0; i < 36; i++ {
+		if masked[i] {
+			mustWriteBE(mask, uint32(noSubframe))
+			continue
+		}
+		mustWriteBE(mask, uint32(spatial.Len()))
+		for block := 0; block < 64*64; block += 2 {
+			a, b := testCode(i, block), testCode(i, block+1)
+			spatial.Write([]byte{byte(a >> 4), byte(a<<4) | byte(b>>8), byte(b)})
+		}
+	}
+	file.add(MaskSubsectionID, mask.Bytes())
+	file.add(SpatialDataSubsectionID, spatial.Bytes())
+	return file.bytes()
+}
+
+func TestDecodeFrameCADRG(t *testing.T) {
+	data := buildTestFrame("00001011.JG1", map[int]bool{7: true}, false)
+	frame, err := DecodeFrame(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("DecodeFrame: %v", err)
+	}
+	img, ok := frame.Image.(*image.Paletted)
+	if !ok {
+		t.Fatalf("image is %T, want *image.Paletted", frame.Image)
+	}
+	if img.Bounds() != image.Rect(0, 0, 1536, 1536) {
+		t.Fatalf("image bounds = %v", img.Bounds())
+	}
+
+	// subframe 8 is row 1, column 2; check block 65 (block row 1, column 1), kernel row 2
+	x, y := 2*256+4+1, 256+4+2
+	want := uint8((testCode(8, 65) + 2) % 200)
+	if got := img.ColorIndexAt(x, y); got != want {
+		t.Fatalf("ColorIndexAt(%d, %d) = %d, want %d", x, y, got, want)
+	}
+	if got := img.At(x, y); got != (color.RGBA{want, 255 - want, want % 3, 255}) {
+		t.Fatalf("At(%d, %d) = %v", x, y, got)
+	}
+	if !frame.HasData(x, y) {
+		t.Fatalf("HasData(%d, %d) = false", x, y)
+	}
+
+	// subframe 7 is masked
+	x, y = 256+10, 256+10
+	if frame.HasData(x, y) {
+		t.Fatalf("HasData(%d, %d) = true in masked subframe", x, y)
+	}
+	if _, _, _, a := img.At(x, y).RGBA(); a != 0 {
+		t.Fatalf("masked pixel alpha = %d, want 0", a)
+	}
+}
+
+func TestDecodeFrameCIB(t *testing.T) {
+	data := buildTestFrame("0REF5K4A.I41", map[int]bool{0: true}, true)
+	frame, err := DecodeFrame(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("DecodeFrame: %v", err)
+	}
+	img, ok := frame.Image.(*image.Gray)
+	if !ok {
+		t.Fatalf("image is %T, want *image.Gray", frame.Image)
+	}
+	if img.Bounds() != image.Rect(0, 0, 1536, 1536) {
+		t.Fatalf("image bounds = %v", img.Bounds())
+	}
+
+	// subframe 35 is the last, check block 4095 (the last), kernel row 3
+	x, y := 1535, 1535
+	want := uint8(255 - (testCode(35, 4095)+3)%200)
+	if got := img.GrayAt(x, y).Y; got != want {
+		t.Fatalf("GrayAt(%d, %d) = %d, want %d", x, y, got, want)
+	}
+	if frame.HasData(0, 0) || !frame.HasData(x, y) {
+		t.Fatalf("HasData = %v, %v, want masked first subframe only", frame.HasData(0, 0), frame.HasData(x, y))
+	}
+}
+
+func TestDecodeFrameRejectsCDTED(t *testing.T) {
+	data := buildTestFrame("00001011.D21", nil, true)
+	if _, err := DecodeFrame(bytes.NewReader(data)); !errors.Is(err, ErrUnexpectedFrameType) {
+		t.Fatalf("DecodeFrame error = %v, want ErrUnexpectedFrameType", err)
+	}
+}
+
+func TestDecodeFrameRejectsOversizedLayout(t *testing.T) {
+	tests := []struct {
+		name          string
+		columns, rows uint16
+		subframeSize  uint32
+	}{
+		{"too many columns", 0xffff, 6, 256},
+		{"too many rows", 6, 7, 256},
+		{"subframes too large", 6, 6, 512},
+		{"huge subframes", 1, 1, 0x40000000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := buildTestFrame("00001011.JG1", nil, false)
+			h, err := ParseFrameHeader(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			desc, _ := h.Location(ImageDescriptionSubheaderID)
+			binary.BigEndian.PutUint16(data[desc.Offset+8:], tt.columns)
+			binary.BigEndian.PutUint16(data[desc.Offset+10:], tt.rows)
+			binary.BigEndian.PutUint32(data[desc.Offset+12:], tt.subframeSize)
+			binary.BigEndian.PutUint32(data[desc.Offset+16:], tt.subframeSize)
+			if _, err := DecodeFrame(bytes.NewReader(data)); err == nil || !strings.Contains(err.Error(), "subframe layout") {
+				t.Fatalf("DecodeFrame error = %v, want a bad subframe layout", err)
+			}
+		})
+	}
+}
@@ -37,7 +37,7 @@ func isRpfExtension(extension string) bool {
 	if i := sort.SearchStrings(seriesCodes, series); i == len(seriesCodes) || seriesCodes[i] != series {
 		return false
 	}
-	if series == "D1" || series == "D2" && strings.IndexByte(zoneCodesDTED, zone) == -1 {
+	if (series == "D1" || series == "D2") && strings.IndexByte(zoneCodesDTED, zone) == -1 {
 		return false
 	}
 	return true
@@ -53,6 +53,9 @@ func TryGetRpfBounds(fileName string) (isValid bool, x1, y1, x2, y2 float64) {
 	if frame == nil {
 		return false, 0, 0, 0, 0
 	}
+	if grid := GetPolarGrid(frame); grid != nil && !grid.Contains(frame.FrameNumber) {
+		return false, 0, 0, 0, 0
+	}
 	x1, y1, x2, y2 = GetBounds(frame)
 	//todo:  establish a firmer test for X bounds
 	if x1 < -181 || x2 > 181 || y1 < -90 || y2 > 90 {
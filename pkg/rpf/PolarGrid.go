@@ -0,0 +1,123 @@
+package rpf
+
+import (
+	"math"
+)
+
+// The polar zones 9 and J are not laid out in rows of latitude, but on a square grid of an
+// azimuthal equidistant projection centred on the pole. See MIL-A-89007 and MIL-C-89038.
+
+// PolarGrid is the frame grid of a polar zone. Grid coordinates are degrees of arc from the
+// pole, x running along the 90E meridian, y along the 180 meridian in the north and along the
+// 0 meridian in the south.
+type PolarGrid struct {
+	Zone      byte
+	Frames    int     // frames along each side of the grid, odd so that one frame holds the pole
+	FrameSize float64 // degrees of arc along a frame edge
+}
+
+// NewPolarGrid returns the frame grid of a polar zone, or nil for the other zones
+func NewPolarGrid(zone byte, scale float64, isCADRG bool) *PolarGrid {
+	if !ArcZones[zone].IsPolar {
+		return nil
+	}
+	frames, _ := CalculateNumRowsCols(zone, scale, isCADRG)
+	dpp, _ := CalculateDegreesPerPixel(zone, scale, isCADRG)
+	return &PolarGrid{zone, frames, dpp * pixelsPerFrame}
+}
+
+// GetPolarGrid returns the grid a frame lies on, or nil when the frame is not in a polar zone
+func GetPolarGrid(frame *FrameInfo) *PolarGrid {
+	series := DataSeries[frame.SeriesCode]
+	return NewPolarGrid(frame.ArcZone, series.Scale, series.Type == CADRG)
+}
+
+func (g *PolarGrid) isNorth() bool {
+	return ArcZones[g.Zone].Poleward > 0
+}
+
+// Contains reports whether a frame number lies on the grid
+func (g *PolarGrid) Contains(frameNumber int) bool {
+	return frameNumber >= 0 && frameNumber < g.Frames*g.Frames
+}
+
+// FrameExtent returns the grid coordinates of a frame, rows counted up from the bottom of the grid
+func (g *PolarGrid) FrameExtent(frameNumber int) (x1, y1, x2, y2 float64) {
+	row := frameNumber / g.Frames
+	column := frameNumber - row*g.Frames
+	origin := -float64(g.Frames) * g.FrameSize / 2
+	x1 = origin + float64(column)*g.FrameSize
+	y1 = origin + float64(row)*g.FrameSize
+	return x1, y1, x1 + g.FrameSize, y1 + g.FrameSize
+}
+
+// ToGeographic converts grid coordinates to a longitude and latitude
+func (g *PolarGrid) ToGeographic(x, y float64) (lon, lat float64) {
+	rho := math.Hypot(x, y)
+	if g.isNorth() {
+		return math.Atan2(x, -y) * 180 / math.Pi, 90 - rho
+	}
+	return math.Atan2(x, y) * 180 / math.Pi, rho - 90
+}
+
+// FromGeographic converts a longitude and latitude to grid coordinates
+func (g *PolarGrid) FromGeographic(lon, lat float64) (x, y float64) {
+	sin, cos := math.Sincos(lon * math.Pi / 180)
+	if g.isNorth() {
+		rho := 90 - lat
+		return rho * sin, -rho * cos
+	}
+	rho := 90 + lat
+	return rho * sin, rho * cos
+}
+
+// FrameCorners returns the longitude and latitude of the lower left, lower right, upper right
+// and upper left corners of a frame as it lies on the grid
+func (g *PolarGrid) FrameCorners(frameNumber int) [4][2]float64 {
+	x1, y1, x2, y2 := g.FrameExtent(frameNumber)
+	var corners [4][2]float64
+	for i, c := range [4][2]float64{{x1, y1}, {x2, y1}, {x2, y2}, {x1, y2}} {
+		corners[i][0], corners[i][1] = g.ToGeographic(c[0], c[1])
+	}
+	return corners
+}
+
+// FrameBounds returns the geographic extent of a frame, spanning every longitude when the
+// frame holds the pole or straddles the antimeridian
+func (g *PolarGrid) FrameBounds(frameNumber int) (x1, y1, x2, y2 float64) {
+	gx1, gy1, gx2, gy2 := g.FrameExtent(frameNumber)
+
+	// latitude follows the distance from the pole, nearest where the frame is closest to the
+	// grid origin and farthest at one of its corners
+	near := math.Hypot(max(gx1, min(0, gx2)), max(gy1, min(0, gy2)))
+	far := math.Hypot(max(-gx1, gx2), max(-gy1, gy2))
+
+	// the antimeridian leaves the pole along +y in the north and -y in the south, and grid
+	// lines never fall on x = 0 as there is an odd number of frames
+	crossesAntimeridian := gy2 > 0
+	if !g.isNorth() {
+		crossesAntimeridian = gy1 < 0
+	}
+	if gx1 < 0 && gx2 > 0 && crossesAntimeridian {
+		x1, x2 = -180, 180
+	} else {
+		// seen from outside the frame, the widest angle is between two of its corners
+		x1, x2 = 180, -180
+		for _, c := range g.FrameCorners(frameNumber) {
+			x1, x2 = min(x1, c[0]), max(x2, c[0])
+		}
+	}
+
+	if g.isNorth() {
+		return x1, 90 - far, x2, 90 - near
+	}
+	return x1, near - 90, x2, far - 90
+}
+
+// FramePixel returns the fractional pixel of a frame image, row 0 at the top of the frame on the
+// grid, that holds a longitude and latitude
+func (g *PolarGrid) FramePixel(frameNumber int, lon, lat float64, width, height int) (fx, fy float64) {
+	x1, _, _, y2 := g.FrameExtent(frameNumber)
+	x, y := g.FromGeographic(lon, lat)
+	return (x - x1) / g.FrameSize * float64(width), (y2 - y) / g.FrameSize * float64(height)
+}
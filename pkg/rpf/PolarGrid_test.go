@@ -0,0 +1,141 @@
+package rpf
+
+import (
+	"math"
+	"testing"
+)
+
+const polarEpsilon = 1e-6
+
+func nearly(a, b float64) bool {
+	return math.Abs(a-b) <= polarEpsilon
+}
+
+func degrees(radians float64) float64 {
+	return radians * 180 / math.Pi
+}
+
+func TestPolarGridSize(t *testing.T) {
+	tests := []struct {
+		series    string
+		zone      byte
+		frames    int
+		frameSize float64
+	}{
+		{series: "ON", zone: '9', frames: 11, frameSize: 360.0 / 267264 * 1536},
+		{series: "ON", zone: 'J', frames: 11, frameSize: 360.0 / 267264 * 1536},
+	}
+	for _, tt := range tests {
+		series := DataSeries[tt.series]
+		grid := NewPolarGrid(tt.zone, series.Scale, true)
+		if grid == nil {
+			t.Fatalf("NewPolarGrid(%q, %v) = nil", tt.zone, series.Scale)
+		}
+		if grid.Frames != tt.frames || !nearly(grid.FrameSize, tt.frameSize) {
+			t.Fatalf("%s zone %c grid = %d frames of %v degrees, want %d of %v", tt.series, tt.zone, grid.Frames, grid.FrameSize, tt.frames, tt.frameSize)
+		}
+	}
+	if grid := NewPolarGrid('1', DataSeries["ON"].Scale, true); grid != nil {
+		t.Fatalf("NewPolarGrid('1') = %+v, want nil", grid)
+	}
+
+	// CIB pixels keep their nominal ground size at the pole
+	series := DataSeries["I1"]
+	grid := NewPolarGrid('9', series.Scale, false)
+	if meters := grid.FrameSize / pixelsPerFrame * 111319.49; math.Abs(meters-series.Scale) > 0.1 {
+		t.Fatalf("CIB %v m polar pixels are %v m", series.Scale, meters)
+	}
+	if grid.Frames%2 != 1 || float64(grid.Frames)*grid.FrameSize < 20 {
+		t.Fatalf("CIB polar grid of %d frames of %v degrees does not cover the zone", grid.Frames, grid.FrameSize)
+	}
+}
+
+func TestPolarGridRoundTrip(t *testing.T) {
+	for _, zone := range []byte{'9', 'J'} {
+		grid := NewPolarGrid(zone, DataSeries["ON"].Scale, true)
+		for _, p := range [][2]float64{{3, 1}, {-3, 1}, {3, -1}, {-3, -1}, {0.5, 10.5}, {-10.5, -10.5}} {
+			lon, lat := grid.ToGeographic(p[0], p[1])
+			x, y := grid.FromGeographic(lon, lat)
+			if !nearly(x, p[0]) || !nearly(y, p[1]) {
+				t.Fatalf("zone %c: (%v, %v) -> (%v, %v) -> (%v, %v)", zone, p[0], p[1], lon, lat, x, y)
+			}
+		}
+		// x runs along 90E in both hemispheres
+		if lon, lat := grid.ToGeographic(5, 0); !nearly(lon, 90) || !nearly(math.Abs(lat), 85) {
+			t.Fatalf("zone %c: (5, 0) = (%v, %v), want 90E 85", zone, lon, lat)
+		}
+	}
+}
+
+func TestPolarFrameBounds(t *testing.T) {
+	// near and far are the distances of the frame from the pole, in half frames
+	edge := degrees(math.Atan2(3, 1))
+	tests := []struct {
+		name      string
+		fileName  string
+		x1, x2    float64
+		near, far float64
+	}{
+		{name: "north pole", fileName: "0001S010.ON9", x1: -180, x2: 180, near: 0, far: math.Sqrt2},
+		{name: "south pole", fileName: "0001S010.ONJ", x1: -180, x2: 180, near: 0, far: math.Sqrt2},
+		{name: "north 90E", fileName: "0001U010.ON9", x1: edge, x2: 180 - edge, near: 3, far: math.Hypot(5, 1)},
+		{name: "south 90E", fileName: "0001U010.ONJ", x1: edge, x2: 180 - edge, near: 3, far: math.Hypot(5, 1)},
+		{name: "north antimeridian", fileName: "0002E010.ON9", x1: -180, x2: 180, near: 3, far: math.Hypot(1, 5)},
+		{name: "south antimeridian", fileName: "00014010.ONJ", x1: -180, x2: 180, near: 3, far: math.Hypot(1, 5)},
+		{name: "north 0E", fileName: "00014010.ON9", x1: edge - 90, x2: 90 - edge, near: 3, far: math.Hypot(1, 5)},
+		{name: "south 0E", fileName: "0002E010.ONJ", x1: edge - 90, x2: 90 - edge, near: 3, far: math.Hypot(1, 5)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame := NewFrameInfo(tt.fileName)
+			half := GetPolarGrid(frame).FrameSize / 2
+			y1, y2 := 90-tt.far*half, 90-tt.near*half
+			if frame.ArcZone == 'J' {
+				y1, y2 = -y2, -y1
+			}
+			ok, x1, gy1, x2, gy2 := TryGetRpfBounds(tt.fileName)
+			if !ok {
+				t.Fatalf("TryGetRpfBounds(%q) reported invalid", tt.fileName)
+			}
+			if !nearly(x1, tt.x1) || !nearly(gy1, y1) || !nearly(x2, tt.x2) || !nearly(gy2, y2) {
+				t.Fatalf("TryGetRpfBounds(%q) = (%v, %v, %v, %v), want (%v, %v, %v, %v)", tt.fileName, x1, gy1, x2, gy2, tt.x1, y1, tt.x2, y2)
+			}
+		})
+	}
+}
+
+func TestPolarFrameCorners(t *testing.T) {
+	frame := NewFrameInfo("0001U010.ON9") // three to five half frames along x, straddling y = 0
+	grid := GetPolarGrid(frame)
+	half := grid.FrameSize / 2
+	corners := grid.FrameCorners(frame.FrameNumber)
+	want := [4][2]float64{
+		{degrees(math.Atan2(3, 1)), 90 - math.Hypot(3, 1)*half},
+		{degrees(math.Atan2(5, 1)), 90 - math.Hypot(5, 1)*half},
+		{degrees(math.Atan2(5, -1)), 90 - math.Hypot(5, 1)*half},
+		{degrees(math.Atan2(3, -1)), 90 - math.Hypot(3, 1)*half},
+	}
+	for i := range corners {
+		if !nearly(corners[i][0], want[i][0]) || !nearly(corners[i][1], want[i][1]) {
+			t.Fatalf("corner %d = %v, want %v", i, corners[i], want[i])
+		}
+	}
+	if fx, fy := grid.FramePixel(frame.FrameNumber, 90, 90-4*half, 1536, 1536); !nearly(fx, 768) || !nearly(fy, 768) {
+		t.Fatalf("frame centre at pixel (%v, %v), want (768, 768)", fx, fy)
+	}
+	if fx, fy := grid.FramePixel(frame.FrameNumber, corners[3][0], corners[3][1], 1536, 1536); !nearly(fx, 0) || !nearly(fy, 0) {
+		t.Fatalf("upper left corner at pixel (%v, %v), want (0, 0)", fx, fy)
+	}
+}
+
+func TestPolarFramesOffTheGrid(t *testing.T) {
+	// 121 frames make up the 11 by 11 grid
+	for _, fileName := range []string{"0003K010.ON9", "0003K010.ONJ"} {
+		if ok, _, _, _, _ := TryGetRpfBounds(fileName); ok {
+			t.Fatalf("TryGetRpfBounds(%q) accepted a frame off the grid", fileName)
+		}
+	}
+	if ok, _, _, _, _ := TryGetRpfBounds("0003J010.ON9"); !ok {
+		t.Fatal("TryGetRpfBounds rejected the last frame of the grid")
+	}
+}
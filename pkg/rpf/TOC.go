@@ -0,0 +1,219 @@
+package rpf
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// This file reads RPF table of contents (A.TOC) files
+// See MIL-STD-2411 5.4, boundary rectangle and frame file index sections
+
+var ErrNotTOC = errors.New("rpf: missing boundary rectangle or frame file index section")
+
+// BoundaryRect is one boundary rectangle record of an A.TOC file
+type BoundaryRect struct {
+	ProductType      string // CADRG, CIB or CDTED
+	CompressionRatio string
+	Scale            string // e.g. "1:250K" or "10M"
+	Zone             byte
+	Producer         string
+	Coverage
+	Rows, Columns int // frames north-south and east-west
+}
+
+// TOCFrame is one frame file index record of an A.TOC file
+type TOCFrame struct {
+	Boundary       int    // index into TOC.Boundaries
+	Row, Column    int    // row 0 is the southernmost row of the boundary rectangle
+	Path           string // slash separated, relative to the directory holding A.TOC
+	FileName       string
+	GeoLocation    string
+	Classification byte
+	CountryCode    string
+	ReleaseMarking string
+	X1, Y1, X2, Y2 float64
+}
+
+// TOC is a parsed RPF table of contents
+type TOC struct {
+	Header     *FrameHeader
+	Boundaries []BoundaryRect
+	Frames     []TOCFrame
+}
+
+// ReadTOC parses an A.TOC file, returning frame paths joined to its directory
+func ReadTOC(tocPath string) (*TOC, error) {
+	file, err := os.Open(tocPath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+	toc, err := ParseTOC(file)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(tocPath)
+	for i := range toc.Frames {
+		toc.Frames[i].Path = filepath.Join(dir, filepath.FromSlash(toc.Frames[i].Path))
+	}
+	return toc, nil
+}
+
+// ParseTOC reads the boundary rectangles and frame file index of an A.TOC file
+func ParseTOC(r io.ReaderAt) (*TOC, error) {
+	header, err := ParseFrameHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	toc := &TOC{Header: header}
+	size := readerSize(r, header.Nitf.FileLength)
+	if err := toc.readBoundaries(r, size); err != nil {
+		return nil, err
+	}
+	if err := toc.readFrames(r, size); err != nil {
+		return nil, err
+	}
+	return toc, nil
+}
+
+// readTable reads the records of a table, which must lie within the size bytes of the
+// file. Counts come from the file, a corrupt one could otherwise ask for gigabytes.
+func readTable(r io.ReaderAt, offset int64, count, recordLength int, size int64, name string) ([]byte, error) {
+	if offset > size || int64(count)*int64(recordLength) > size-offset {
+		return nil, fmt.Errorf("rpf: %s of %d records of %d bytes: %w", name, count, recordLength, ErrShortSection)
+	}
+	buf := make([]byte, count*recordLength)
+	if _, err := r.ReadAt(buf, offset); err != nil {
+		return nil, fmt.Errorf("rpf: reading %s: %w", name, err)
+	}
+	return buf, nil
+}
+
+func (toc *TOC) readBoundaries(r io.ReaderAt, size int64) error {
+	order := toc.Header.Rpf.order()
+	sub, ok1 := toc.Header.Location(BoundaryRectSectionSubheaderID)
+	table, ok2 := toc.Header.Location(BoundaryRectTableID)
+	if !ok1 || !ok2 {
+		return ErrNotTOC
+	}
+	head := make([]byte, 8)
+	if _, err := r.ReadAt(head, int64(sub.Offset)); err != nil {
+		return fmt.Errorf("rpf: reading boundary rectangle subheader: %w", err)
+	}
+	tableOffset := order.Uint32(head[0:4])
+	count := int(order.Uint16(head[4:6]))
+	recordLength := int(order.Uint16(head[6:8]))
+	if recordLength < 132 {
+		recordLength = 132
+	}
+	buf, err := readTable(r, int64(table.Offset)+int64(tableOffset), count, recordLength, size, "boundary rectangle table")
+	if err != nil {
+		return err
+	}
+	toc.Boundaries = make([]BoundaryRect, count)
+	for i := range toc.Boundaries {
+		rec := buf[i*recordLength:]
+		toc.Boundaries[i] = BoundaryRect{
+			ProductType:      strings.TrimSpace(string(rec[0:5])),
+			CompressionRatio: strings.TrimSpace(string(rec[5:10])),
+			Scale:            strings.TrimSpace(string(rec[10:22])),
+			Zone:             rec[22],
+			Producer:         strings.TrimSpace(string(rec[23:28])),
+			Coverage:         *parseCoverage(rec[28:124], order),
+			Rows:             int(order.Uint32(rec[124:128])),
+			Columns:          int(order.Uint32(rec[128:132])),
+		}
+	}
+	return nil
+}
+
+func (toc *TOC) readFrames(r io.ReaderAt, size int64) error {
+	order := toc.Header.Rpf.order()
+	sub, ok1 := toc.Header.Location(FrameFileIndexSubheaderID)
+	index, ok2 := toc.Header.Location(FrameFileIndexSubsectionID)
+	if !ok1 || !ok2 {
+		return ErrNotTOC
+	}
+	head := make([]byte, 13)
+	if _, err := r.ReadAt(head, int64(sub.Offset)); err != nil {
+		return fmt.Errorf("rpf: reading frame file index subheader: %w", err)
+	}
+	tableOffset := order.Uint32(head[1:5])
+	count := int(order.Uint32(head[5:9]))
+	recordLength := int(order.Uint16(head[11:13]))
+	if recordLength < 33 {
+		recordLength = 33
+	}
+	buf, err := readTable(r, int64(index.Offset)+int64(tableOffset), count, recordLength, size, "frame file index table")
+	if err != nil {
+		return err
+	}
+
+	pathNames := make(map[uint32]string)
+	toc.Frames = make([]TOCFrame, 0, count)
+	for i := 0; i < count; i++ {
+		rec := buf[i*recordLength:]
+		pathOffset := order.Uint32(rec[6:10])
+		dir, ok := pathNames[pathOffset]
+		if !ok {
+			var err error
+			if dir, err = readPathName(r, int64(index.Offset)+int64(pathOffset), toc.Header.Rpf); err != nil {
+				return err
+			}
+			pathNames[pathOffset] = dir
+		}
+		frame := TOCFrame{
+			Boundary:       int(order.Uint16(rec[0:2])),
+			Row:            int(order.Uint16(rec[2:4])),
+			Column:         int(order.Uint16(rec[4:6])),
+			FileName:       strings.TrimSpace(string(rec[10:22])),
+			GeoLocation:    strings.TrimSpace(string(rec[22:28])),
+			Classification: rec[28],
+			CountryCode:    strings.TrimSpace(string(rec[29:31])),
+			ReleaseMarking: strings.TrimSpace(string(rec[31:33])),
+		}
+		frame.Path = path.Join(dir, frame.FileName)
+		if frame.Boundary >= len(toc.Boundaries) {
+			return fmt.Errorf("rpf: frame %s refers to missing boundary rectangle %d", frame.FileName, frame.Boundary)
+		}
+		frame.X1, frame.Y1, frame.X2, frame.Y2 = toc.Boundaries[frame.Boundary].frameBounds(frame.Row, frame.Column)
+		toc.Frames = append(toc.Frames, frame)
+	}
+	return nil
+}
+
+func readPathName(r io.ReaderAt, offset int64, h RpfHeader) (string, error) {
+	size := make([]byte, 2)
+	if _, err := r.ReadAt(size, offset); err != nil {
+		return "", fmt.Errorf("rpf: reading frame path name: %w", err)
+	}
+	name := make([]byte, h.order().Uint16(size))
+	if _, err := r.ReadAt(name, offset+2); err != nil {
+		return "", fmt.Errorf("rpf: reading frame path name: %w", err)
+	}
+	// path names look like "./CJNC1/", relative to the directory holding A.TOC
+	dir := strings.ReplaceAll(strings.TrimSpace(string(name)), "\\", "/")
+	return path.Clean(dir), nil
+}
+
+// bounds of the frame at a row and column, row 0 being the southernmost
+func (b *BoundaryRect) frameBounds(row, column int) (x1, y1, x2, y2 float64) {
+	west := math.Min(b.NWLon, b.SWLon)
+	east := math.Max(b.NELon, b.SELon)
+	south := math.Min(b.SWLat, b.SELat)
+	north := math.Max(b.NWLat, b.NELat)
+	if b.Rows <= 0 || b.Columns <= 0 {
+		return west, south, east, north
+	}
+	width := (east - west) / float64(b.Columns)
+	height := (north - south) / float64(b.Rows)
+	x1 = west + float64(column)*width
+	y1 = south + float64(row)*height
+	return x1, y1, x1 + width, y1 + height
+}
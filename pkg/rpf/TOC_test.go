@@ -0,0 +1,165 @@
+package rpf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testTOCFrame struct {
+	boundary, row, column int
+	dir, name             string
+}
+
+// buildTestTOC writes an A.TOC with one boundary rectangle of rows x columns frames
+func buildTestTOC(x1, y1, x2, y2 float64, rows, columns int, frames []testTOCFrame) []byte {
+	file := &testRpfFile{version: "02.00", fileName: "A.TOC"}
+
+	sub := new(bytes.Buffer)
+	mustWriteBE(sub, uint32(0))
+	mustWriteBE(sub, uint16(1))
+	mustWriteBE(sub, uint16(132))
+	file.add(BoundaryRectSectionSubheaderID, sub.Bytes())
+
+	rect := new(bytes.Buffer)
+	rect.WriteString(field("CADRG", 5) + field("55:1", 5) + field("1:250K", 12) + "1" + field("TEST", 5))
+	rect.Write(coverageSection(x1, y1, x2, y2, (y2-y1)/float64(rows*1536), (x2-x1)/float64(columns*1536)))
+	mustWriteBE(rect, uint32(rows))
+	mustWriteBE(rect, uint32(columns))
+	file.add(BoundaryRectTableID, rect.Bytes())
+
+	fsub := new(bytes.Buffer)
+	fsub.WriteByte('U')
+	mustWriteBE(fsub, uint32(0))
+	mustWriteBE(fsub, uint32(len(frames)))
+	mustWriteBE(fsub, uint16(len(frames)))
+	mustWriteBE(fsub, uint16(33))
+	file.add(FrameFileIndexSubheaderID, fsub.Bytes())
+
+	records := new(bytes.Buffer)
+	paths := new(bytes.Buffer)
+	pathBase := len(frames) * 33
+	for _, f := range frames {
+		mustWriteBE(records, uint16(f.boundary))
+		mustWriteBE(records, uint16(f.row))
+		mustWriteBE(records, uint16(f.column))
+		mustWriteBE(records, uint32(pathBase+paths.Len()))
+		records.WriteString(field(f.name, 12) + field("", 6) + "U" + "US" + "  ")
+		mustWriteBE(paths, uint16(len(f.dir)))
+		paths.WriteString(f.dir)
+	}
+	records.Write(paths.Bytes())
+	file.add(FrameFileIndexSubsectionID, records.Bytes())
+	return file.bytes()
+}
+
+func TestParseTOC(t *testing.T) {
+	data := buildTestTOC(10, 20, 14, 22, 2, 4, []testTOCFrame{
+		{0, 0, 0, "./JOG/", "00001011.JG1"},
+		{0, 1, 3, "./JOG/SUB/", "00002011.JG1"},
+	})
+	toc, err := ParseTOC(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ParseTOC: %v", err)
+	}
+	if len(toc.Boundaries) != 1 {
+		t.Fatalf("got %d boundary rectangles, want 1", len(toc.Boundaries))
+	}
+	b := toc.Boundaries[0]
+	if b.ProductType != "CADRG" || b.Scale != "1:250K" || b.Zone != '1' || b.Rows != 2 || b.Columns != 4 {
+		t.Fatalf("boundary rectangle = %+v", b)
+	}
+	if len(toc.Frames) != 2 {
+		t.Fatalf("got %d frames, want 2", len(toc.Frames))
+	}
+
+	tests := []struct {
+		path           string
+		x1, y1, x2, y2 float64
+	}{
+		{"JOG/00001011.JG1", 10, 20, 11, 21},
+		{"JOG/SUB/00002011.JG1", 13, 21, 14, 22},
+	}
+	for i, tt := range tests {
+		f := toc.Frames[i]
+		if f.Path != tt.path {
+			t.Errorf("frame %d path = %q, want %q", i, f.Path, tt.path)
+		}
+		if !almostEqual(f.X1, tt.x1) || !almostEqual(f.Y1, tt.y1) || !almostEqual(f.X2, tt.x2) || !almostEqual(f.Y2, tt.y2) {
+			t.Errorf("frame %d bounds = (%v, %v, %v, %v), want (%v, %v, %v, %v)", i, f.X1, f.Y1, f.X2, f.Y2, tt.x1, tt.y1, tt.x2, tt.y2)
+		}
+	}
+}
+
+func TestReadTOCJoinsDirectory(t *testing.T) {
+	dir := t.TempDir()
+	tocPath := filepath.Join(dir, "A.TOC")
+	data := buildTestTOC(0, 0, 1, 1, 1, 1, []testTOCFrame{{0, 0, 0, "./CJNC1/", "00000011.JN1"}})
+	if err := os.WriteFile(tocPath, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	toc, err := ReadTOC(tocPath)
+	if err != nil {
+		t.Fatalf("ReadTOC: %v", err)
+	}
+	if want := filepath.Join(dir, "CJNC1", "00000011.JN1"); toc.Frames[0].Path != want {
+		t.Fatalf("frame path = %q, want %q", toc.Frames[0].Path, want)
+	}
+}
+
+func TestParseTOCRejectsFrames(t *testing.T) {
+	file := &testRpfFile{version: "02.10", fileName: "0REF5K4A.I41"}
+	file.add(CoverageSectionID, coverageSection(0, 0, 1, 1, 1, 1))
+	if _, err := ParseTOC(bytes.NewReader(file.bytes())); !errors.Is(err, ErrNotTOC) {
+		t.Fatalf("ParseTOC error = %v, want ErrNotTOC", err)
+	}
+}
+
+func TestParseTOCRejectsCorruptTables(t *testing.T) {
+	frames := []testTOCFrame{{0, 0, 0, "./JOG/", "00001011.JG1"}, {0, 0, 1, "./JOG/", "00001021.JG1"}}
+	tests := []struct {
+		name    string
+		corrupt func(data []byte, h *FrameHeader) []byte
+	}{
+		{"boundary rectangle count", func(data []byte, h *FrameHeader) []byte {
+			sub, _ := h.Location(BoundaryRectSectionSubheaderID)
+			binary.BigEndian.PutUint16(data[sub.Offset+4:], 0xffff)
+			return data
+		}},
+		{"boundary rectangle table offset", func(data []byte, h *FrameHeader) []byte {
+			sub, _ := h.Location(BoundaryRectSectionSubheaderID)
+			binary.BigEndian.PutUint32(data[sub.Offset:], 0xfffffff0)
+			return data
+		}},
+		{"frame count", func(data []byte, h *FrameHeader) []byte {
+			sub, _ := h.Location(FrameFileIndexSubheaderID)
+			binary.BigEndian.PutUint32(data[sub.Offset+5:], 0xffffffff)
+			return data
+		}},
+		{"frame record length", func(data []byte, h *FrameHeader) []byte {
+			sub, _ := h.Location(FrameFileIndexSubheaderID)
+			binary.BigEndian.PutUint16(data[sub.Offset+11:], 0xffff)
+			return data
+		}},
+		{"truncated frame index", func(data []byte, h *FrameHeader) []byte {
+			index, _ := h.Location(FrameFileIndexSubsectionID)
+			return data[:index.Offset+40]
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := buildTestTOC(10, 20, 14, 22, 1, 2, frames)
+			h, err := ParseFrameHeader(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			data = tt.corrupt(data, h)
+			if _, err := ParseTOC(bytes.NewReader(data)); !errors.Is(err, ErrShortSection) {
+				t.Fatalf("ParseTOC error = %v, want ErrShortSection", err)
+			}
+		})
+	}
+}